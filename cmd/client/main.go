@@ -3,10 +3,25 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"text/template"
+	"time"
 
+	"github.com/marcoantonios1/chat-app/internal/chatui"
 	"github.com/marcoantonios1/chat-app/internal/client"
+	"github.com/marcoantonios1/chat-app/internal/protocol"
+	"github.com/marcoantonios1/chat-app/pkg/bot"
+	sdk "github.com/marcoantonios1/chat-app/pkg/client"
 	"github.com/urfave/cli/v2"
 )
 
@@ -36,6 +51,14 @@ func buildCLI() *cli.App {
 	if host == "" {
 		host = "localhost:8080"
 	}
+	grpcHost := os.Getenv("CHAT_GRPC_HOST")
+	if grpcHost == "" {
+		grpcHost = "localhost:9090"
+	}
+	quicHost := os.Getenv("CHAT_QUIC_HOST")
+	if quicHost == "" {
+		quicHost = "localhost:4433"
+	}
 
 	app := cli.NewApp()
 	app.Name = "chatapp"
@@ -47,11 +70,15 @@ func buildCLI() *cli.App {
 		{
 			Name:  "send",
 			Usage: "Send message to server",
-			Flags: []cli.Flag{
-				&cli.StringFlag{Name: "server", Value: "ws://" + host + "/message", Usage: "websocket server URL"},
-				&cli.StringFlag{Name: "id", Aliases: []string{"i"}, Usage: "Identification"},
+			Flags: append(connectFlags(host, grpcHost, quicHost),
 				&cli.StringFlag{Name: "recipient", Aliases: []string{"r"}, Usage: "Recipient ID"},
-			},
+				&cli.StringFlag{Name: "message", Aliases: []string{"m"}, Usage: "send this message and exit instead of chatting; - sends each line of stdin"},
+				&cli.StringFlag{Name: "wait", Value: protocol.StatusQueued, Usage: "with --message, the ack to wait for: queued (stored by the server) or delivered"},
+				&cli.DurationFlag{Name: "timeout", Value: 10 * time.Second, Usage: "with --message, how long to wait for each message's ack"},
+				&cli.BoolFlag{Name: "no-daemon", Usage: "with --message, connect directly even if a daemon is running"},
+			),
+			Description: "With --message the command exits 0 once every message is acknowledged, 1 on errors, " +
+				"2 on bad usage, 3 if the device awaits approval and 4 if acks did not arrive in time.",
 			Action: func(c *cli.Context) error {
 				id := c.String("id")
 				recipient := c.String("recipient")
@@ -59,9 +86,40 @@ func buildCLI() *cli.App {
 					printError("send", id, cli.Exit("provide an ID with --id", 2))
 					return cli.Exit("provide an ID with --id", 2)
 				}
-				if err := client.SendAndReceive(c.String("server"), id, recipient); err != nil {
-					printError("send", id, err)
-					return cli.Exit(err.Error(), 1)
+				oneShot := c.IsSet("message")
+				if oneShot && recipient == "" {
+					printError("send", id, cli.Exit("provide a recipient with --recipient", 2))
+					return cli.Exit("provide a recipient with --recipient", 2)
+				}
+				if w := c.String("wait"); oneShot && w != protocol.StatusQueued && w != protocol.StatusDelivered {
+					printError("send", id, cli.Exit("--wait must be queued or delivered", 2))
+					return cli.Exit("--wait must be queued or delivered", 2)
+				}
+				var in io.Reader = os.Stdin
+				if m := c.String("message"); oneShot && m != "-" {
+					in = strings.NewReader(m)
+				}
+				if d := daemonFor(c, id); oneShot && d != nil {
+					defer d.Close()
+					if err := d.SendMessages(in, recipient, c.String("wait"), c.Duration("timeout")); err != nil {
+						return exitError("send", id, err)
+					}
+					return nil
+				}
+				if !oneShot && daemonHolds(id) {
+					return exitError("send", id, errDaemonHolds)
+				}
+				opts, err := sessionOptions(c)
+				if err != nil {
+					return cli.Exit(err.Error(), 2)
+				}
+				if oneShot {
+					err = chatui.SendMessages(opts, in, recipient, c.String("wait"), c.Duration("timeout"))
+				} else {
+					err = chatui.Chat(opts, in, recipient)
+				}
+				if err != nil {
+					return exitError("send", id, err)
 				}
 				return nil
 			},
@@ -69,16 +127,20 @@ func buildCLI() *cli.App {
 		{
 			Name:  "register",
 			Usage: "register id with server",
-			Flags: []cli.Flag{
+			Flags: append([]cli.Flag{
 				&cli.StringFlag{Name: "server", Value: "http://" + host + "/register", Usage: "http server URL"},
 				&cli.StringFlag{Name: "id", Aliases: []string{"i"}, Usage: "Identification"},
-			},
+			}, tlsFlags()...),
 			Action: func(c *cli.Context) error {
 				id := c.String("id")
 				if id == "" {
 					printError("register", id, cli.Exit("provide an ID with --id", 2))
 					return cli.Exit("provide an ID with --id", 2)
 				}
+				if err := useTLS(c); err != nil {
+					printError("register", id, err)
+					return cli.Exit(err.Error(), 2)
+				}
 				if err := client.Register(c.String("server"), id); err != nil {
 					if err == client.ErrIDTaken {
 						printError("register", id, err)
@@ -92,19 +154,465 @@ func buildCLI() *cli.App {
 		},
 
 		{
-			Name:  "recieve",
-			Usage: "recieve message from server",
+			Name:  "devices",
+			Usage: "list, approve or revoke the devices linked to an ID",
+			Subcommands: []*cli.Command{
+				{
+					Name:  "list",
+					Usage: "list linked devices",
+					Flags: append([]cli.Flag{
+						&cli.StringFlag{Name: "server", Value: "http://" + host, Usage: "http server URL"},
+						&cli.StringFlag{Name: "id", Aliases: []string{"i"}, Usage: "Identification"},
+					}, tlsFlags()...),
+					Action: func(c *cli.Context) error {
+						id := c.String("id")
+						if id == "" {
+							printError("devices list", id, cli.Exit("provide an ID with --id", 2))
+							return cli.Exit("provide an ID with --id", 2)
+						}
+						if err := useTLS(c); err != nil {
+							printError("devices list", id, err)
+							return cli.Exit(err.Error(), 2)
+						}
+						devices, err := client.ListDevices(c.String("server"), id)
+						if err != nil {
+							printError("devices list", id, err)
+							return cli.Exit(err.Error(), 1)
+						}
+						self, _ := client.GetDeviceID()
+						for _, d := range devices {
+							marker := " "
+							if d.ID == self {
+								marker = "*"
+							}
+							fmt.Printf("%s %-16s %-9s %s\n", marker, d.ID, d.Status, d.Name)
+						}
+						return nil
+					},
+				},
+				{
+					Name:  "approve",
+					Usage: "approve a pending device (run on an already linked device)",
+					Flags: append([]cli.Flag{
+						&cli.StringFlag{Name: "server", Value: "http://" + host, Usage: "http server URL"},
+						&cli.StringFlag{Name: "id", Aliases: []string{"i"}, Usage: "Identification"},
+						&cli.StringFlag{Name: "target", Aliases: []string{"t"}, Usage: "device ID to approve"},
+					}, tlsFlags()...),
+					Action: func(c *cli.Context) error {
+						return changeDevice(c, "approve", client.ApproveDevice)
+					},
+				},
+				{
+					Name:  "revoke",
+					Usage: "revoke a linked or pending device",
+					Flags: append([]cli.Flag{
+						&cli.StringFlag{Name: "server", Value: "http://" + host, Usage: "http server URL"},
+						&cli.StringFlag{Name: "id", Aliases: []string{"i"}, Usage: "Identification"},
+						&cli.StringFlag{Name: "target", Aliases: []string{"t"}, Usage: "device ID to revoke"},
+					}, tlsFlags()...),
+					Action: func(c *cli.Context) error {
+						return changeDevice(c, "revoke", client.RevokeDevice)
+					},
+				},
+			},
+		},
+		{
+			Name:      "search",
+			Usage:     "full-text search of the local message database",
+			ArgsUsage: "<query>",
+			Flags: []cli.Flag{
+				&cli.StringFlag{Name: "id", Aliases: []string{"i"}, Usage: "only search conversations of this local ID"},
+				&cli.StringFlag{Name: "with", Aliases: []string{"w"}, Usage: "only search the conversation with this peer"},
+			},
+			Action: func(c *cli.Context) error {
+				query := strings.Join(c.Args().Slice(), " ")
+				if strings.TrimSpace(query) == "" {
+					printError("search", c.String("id"), cli.Exit("provide a search query", 2))
+					return cli.Exit("provide a search query", 2)
+				}
+				store, err := client.OpenMessageStore()
+				if err != nil {
+					printError("search", c.String("id"), err)
+					return cli.Exit(err.Error(), 1)
+				}
+				defer store.Close()
+				msgs, err := store.Search(c.String("id"), c.String("with"), query)
+				if err != nil {
+					printError("search", c.String("id"), err)
+					return cli.Exit(err.Error(), 1)
+				}
+				for _, m := range msgs {
+					fmt.Printf("%s [%s <-> %s] %s: %s\n", m.Timestamp.Format("2006-01-02 15:04"), m.Owner, m.Peer, m.From, m.Text)
+				}
+				if len(msgs) == 0 {
+					return cli.Exit("no matches", 1)
+				}
+				return nil
+			},
+		},
+		{
+			Name:  "purge",
+			Usage: "delete old messages from the local message database",
 			Flags: []cli.Flag{
-				&cli.StringFlag{Name: "server", Value: "ws://localhost:8080/message", Usage: "websocket server URL"},
+				&cli.DurationFlag{Name: "older-than", Usage: "delete messages older than this (e.g. 720h); 0 deletes everything"},
+				&cli.StringFlag{Name: "id", Aliases: []string{"i"}, Usage: "only purge conversations of this local ID"},
+				&cli.StringFlag{Name: "with", Aliases: []string{"w"}, Usage: "only purge the conversation with this peer"},
 			},
 			Action: func(c *cli.Context) error {
-				if err := client.Listen(c.String("server")); err != nil {
-					printError("recieve", "", err)
+				if !c.IsSet("older-than") {
+					printError("purge", c.String("id"), cli.Exit("provide --older-than", 2))
+					return cli.Exit("provide --older-than", 2)
+				}
+				store, err := client.OpenMessageStore()
+				if err != nil {
+					printError("purge", c.String("id"), err)
+					return cli.Exit(err.Error(), 1)
+				}
+				defer store.Close()
+				n, err := store.Purge(c.String("id"), c.String("with"), time.Now().Add(-c.Duration("older-than")))
+				if err != nil {
+					printError("purge", c.String("id"), err)
 					return cli.Exit(err.Error(), 1)
 				}
+				fmt.Printf("purged %d messages\n", n)
+				return nil
+			},
+		},
+		{
+			Name:  "retention",
+			Usage: "show or set how long the local message database keeps messages",
+			Flags: []cli.Flag{
+				&cli.DurationFlag{Name: "set", Usage: "keep messages for this long (e.g. 720h); 0 keeps forever"},
+			},
+			Action: func(c *cli.Context) error {
+				store, err := client.OpenMessageStore()
+				if err != nil {
+					printError("retention", "", err)
+					return cli.Exit(err.Error(), 1)
+				}
+				defer store.Close()
+				if c.IsSet("set") {
+					if err := store.SetRetention(c.Duration("set")); err != nil {
+						printError("retention", "", err)
+						return cli.Exit(err.Error(), 1)
+					}
+					n, err := store.ApplyRetention()
+					if err != nil {
+						printError("retention", "", err)
+						return cli.Exit(err.Error(), 1)
+					}
+					if n > 0 {
+						fmt.Printf("purged %d messages\n", n)
+					}
+				}
+				d, err := store.Retention()
+				if err != nil {
+					printError("retention", "", err)
+					return cli.Exit(err.Error(), 1)
+				}
+				if d <= 0 {
+					fmt.Println("retention: keep forever")
+				} else {
+					fmt.Printf("retention: %s\n", d)
+				}
+				return nil
+			},
+		},
+		{
+			Name:    "listen",
+			Aliases: []string{"receive", "recieve"},
+			Usage:   "print every message and event for an ID as JSON lines",
+			Flags: append(connectFlags(host, grpcHost, quicHost),
+				&cli.BoolFlag{Name: "no-daemon", Usage: "connect directly even if a daemon is running"},
+			),
+			Action: func(c *cli.Context) error {
+				id := c.String("id")
+				if id == "" {
+					printError("listen", id, cli.Exit("provide an ID with --id", 2))
+					return cli.Exit("provide an ID with --id", 2)
+				}
+				if d := daemonFor(c, id); d != nil {
+					defer d.Close()
+					enc := json.NewEncoder(os.Stdout)
+					err := d.Subscribe(func(e client.Event) error { return enc.Encode(e) })
+					return exitError("listen", id, err)
+				}
+				t, err := newTransport(c)
+				if err != nil {
+					return cli.Exit(err.Error(), 2)
+				}
+				if err := client.Listen(t, id, os.Stdout); err != nil {
+					return exitError("listen", id, err)
+				}
 				return nil
 			},
 		},
+		{
+			Name:  "daemon",
+			Usage: "keep a connection open for an ID and serve it to local tools on a Unix socket",
+			Description: "send --message and listen go through the daemon while it runs as the same ID; " +
+				"interactive send and bot run refuse to start, since they would take its device over. " +
+				"The socket is in the key directory and only its owner can use it.",
+			Flags: connectFlags(host, grpcHost, quicHost),
+			Action: func(c *cli.Context) error {
+				id := c.String("id")
+				if id == "" {
+					printError("daemon", id, cli.Exit("provide an ID with --id", 2))
+					return cli.Exit("provide an ID with --id", 2)
+				}
+				t, err := newTransport(c)
+				if err != nil {
+					return cli.Exit(err.Error(), 2)
+				}
+				stop := make(chan struct{})
+				go func() {
+					sig := make(chan os.Signal, 1)
+					signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+					<-sig
+					close(stop)
+				}()
+				if err := client.RunDaemon(t, id, stop); err != nil {
+					return exitError("daemon", id, err)
+				}
+				return nil
+			},
+		},
+		{
+			Name:  "bot",
+			Usage: "run a chat bot",
+			Subcommands: []*cli.Command{
+				{
+					Name:  "run",
+					Usage: "connect as an ID and answer its messages with a built-in bot",
+					Description: "Conversation state is kept in the key directory. " +
+						"Write your own bots with the github.com/marcoantonios1/chat-app/pkg/bot package.",
+					Flags: append(connectFlags(host, grpcHost, quicHost),
+						&cli.StringFlag{Name: "bot", Value: "echo", Usage: "the bot to run: " + strings.Join(bot.Names(), ", ")},
+					),
+					Action: runBot,
+				},
+			},
+		},
 	}
 	return app
 }
+
+// runBot runs the bot chosen with --bot until interrupted.
+func runBot(c *cli.Context) error {
+	id, name := c.String("id"), c.String("bot")
+	if id == "" {
+		printError("bot run", id, cli.Exit("provide an ID with --id", 2))
+		return cli.Exit("provide an ID with --id", 2)
+	}
+	opts, err := sessionOptions(c)
+	if err != nil {
+		printError("bot run", id, err)
+		return cli.Exit(err.Error(), 2)
+	}
+	b, err := bot.Lookup(name)
+	if err != nil {
+		printError("bot run", id, err)
+		return cli.Exit(err.Error(), 2)
+	}
+	if b.State, err = bot.OpenFileState(client.BotStateFile(id, name)); err != nil {
+		printError("bot run", id, err)
+		return cli.Exit(err.Error(), 1)
+	}
+
+	if daemonHolds(id) {
+		return exitError("bot run", id, errDaemonHolds)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	s, err := sdk.Connect(ctx, opts)
+	if err != nil {
+		return exitError("bot run", id, err)
+	}
+	defer s.Close()
+	fmt.Printf("Bot %s running as %s (device %s)\n", name, s.ID(), s.Device())
+	if err := b.Run(ctx, s); err != nil && ctx.Err() == nil {
+		return exitError("bot run", id, err)
+	}
+	return nil
+}
+
+// connectFlags are the flags of commands that connect to the server as a
+// user.
+func connectFlags(host, grpcHost, quicHost string) []cli.Flag {
+	return append([]cli.Flag{
+		&cli.StringFlag{Name: "server", Value: "ws://" + host + "/message", Usage: "websocket server URL"},
+		&cli.StringFlag{Name: "id", Aliases: []string{"i"}, Usage: "Identification"},
+		&cli.StringFlag{Name: "encoding", Value: "cbor", Usage: "frame encoding to ask the server for: cbor or json"},
+		&cli.StringFlag{Name: "transport", Value: client.TransportWebSocket, Usage: "connect over ws, http, grpc or quic; ws falls back to http on its own"},
+		&cli.StringFlag{Name: "grpc-server", Value: grpcHost, Usage: "gRPC server address, used with --transport grpc"},
+		&cli.StringFlag{Name: "quic-server", Value: quicHost, Usage: "QUIC server address, used with --transport quic"},
+	}, tlsFlags()...)
+}
+
+// tlsFlags are the flags of commands that talk to the server, choosing
+// how TLS connections check it and what they show it.
+func tlsFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{Name: "ca", Usage: "PEM certificates to trust for the server, e.g. its self-signed tls_cert.pem (default: system roots)"},
+		&cli.StringSliceFlag{Name: "pin", Usage: "hex SHA-256 of a server public key to accept; without --ca, pins replace CA checks"},
+		&cli.StringFlag{Name: "cert", Usage: "PEM client certificate for servers that require one"},
+		&cli.StringFlag{Name: "key", Usage: "PEM key of --cert"},
+	}
+}
+
+// daemonFor returns a connection to the running daemon if it is
+// connected as id, unless --no-daemon is set.
+func daemonFor(c *cli.Context, id string) *client.DaemonClient {
+	if c.Bool("no-daemon") {
+		return nil
+	}
+	d, err := client.DialDaemon()
+	if err != nil {
+		return nil
+	}
+	if st, err := d.Status(); err != nil || st.ID != id {
+		d.Close()
+		return nil
+	}
+	return d
+}
+
+// errDaemonHolds is returned by commands that would take the device over
+// from a running daemon; the two would keep replacing each other's
+// connection.
+var errDaemonHolds = errors.New("a daemon is connected as this ID with this device; stop it first, or send through it with --message")
+
+// daemonHolds reports whether this installation's daemon, which connects
+// with the same device as every other command, is running as id.
+func daemonHolds(id string) bool {
+	d, err := client.DialDaemon()
+	if err != nil {
+		return false
+	}
+	defer d.Close()
+	st, err := d.Status()
+	return err == nil && st.ID == id
+}
+
+// exitError reports the error of a command that connected as id and
+// returns its exit status.
+func exitError(cmd, id string, err error) error {
+	printError(cmd, id, err)
+	switch {
+	case errors.Is(err, client.ErrAckTimeout):
+		return cli.Exit("", 4)
+	case err == client.ErrDevicePending:
+		dev, _ := client.GetDeviceID()
+		return cli.Exit(fmt.Sprintf("approve this device from a linked one: chatapp devices approve --id %s --target %s", id, dev), 3)
+	}
+	return cli.Exit(err.Error(), 1)
+}
+
+// changeDevice runs a device approve/revoke subcommand.
+func changeDevice(c *cli.Context, op string, fn func(serverURL, id, target string) error) error {
+	cmd := "devices " + op
+	id, target := c.String("id"), c.String("target")
+	if id == "" || target == "" {
+		printError(cmd, id, cli.Exit("provide --id and --target", 2))
+		return cli.Exit("provide --id and --target", 2)
+	}
+	if err := useTLS(c); err != nil {
+		printError(cmd, id, err)
+		return cli.Exit(err.Error(), 2)
+	}
+	if err := fn(c.String("server"), id, target); err != nil {
+		printError(cmd, id, err)
+		return cli.Exit(err.Error(), 1)
+	}
+	fmt.Printf("device %s: %sd\n", target, op)
+	return nil
+}
+
+// sessionOptions are the SDK options for the connection chosen with
+// --id, --transport, --encoding and the matching server flag.
+func sessionOptions(c *cli.Context) (sdk.Options, error) {
+	opts := sdk.Options{ID: c.String("id"), Server: c.String("server"), Transport: c.String("transport"), Encoding: c.String("encoding")}
+	switch opts.Transport {
+	case client.TransportWebSocket, client.TransportHTTP:
+	case client.TransportGRPC:
+		opts.Server = c.String("grpc-server")
+	case client.TransportQUIC:
+		opts.Server = c.String("quic-server")
+	default:
+		return opts, fmt.Errorf("unknown --transport %q, want ws, http, grpc or quic", opts.Transport)
+	}
+	tlsConf, err := clientTLS(c)
+	if err != nil {
+		return opts, err
+	}
+	opts.TLS = tlsConf
+	if opts.Encoding != "cbor" && opts.Encoding != "json" {
+		return opts, fmt.Errorf("unknown --encoding %q, want cbor or json", opts.Encoding)
+	}
+	return opts, nil
+}
+
+// clientTLS is the TLS configuration asked for with --ca, --pin, --cert
+// and --key, nil for the defaults. A wss:// or https:// --server alone
+// turns on TLS for gRPC too.
+func clientTLS(c *cli.Context) (*tls.Config, error) {
+	opts := client.TLSOptions{CAFile: c.String("ca"), Pins: c.StringSlice("pin"), CertFile: c.String("cert"), KeyFile: c.String("key")}
+	if (opts.CertFile == "") != (opts.KeyFile == "") {
+		return nil, errors.New("--cert and --key go together")
+	}
+	conf, err := opts.Config()
+	if err != nil {
+		return nil, err
+	}
+	if conf == nil {
+		if u, err := url.Parse(c.String("server")); err == nil && (u.Scheme == "wss" || u.Scheme == "https") {
+			conf = &tls.Config{}
+		}
+	}
+	return conf, nil
+}
+
+// useTLS makes the configuration of clientTLS the one of the client's
+// HTTP calls and transports.
+func useTLS(c *cli.Context) error {
+	conf, err := clientTLS(c)
+	if err != nil {
+		return err
+	}
+	client.UseTLS(conf)
+	return nil
+}
+
+// newTransport builds the transport chosen with --transport, --encoding
+// and the matching server flag.
+func newTransport(c *cli.Context) (client.Transport, error) {
+	addr := c.String("server")
+	switch c.String("transport") {
+	case client.TransportWebSocket, client.TransportHTTP:
+	case client.TransportGRPC:
+		addr = c.String("grpc-server")
+	case client.TransportQUIC:
+		addr = c.String("quic-server")
+	default:
+		return nil, fmt.Errorf("unknown --transport %q, want ws, http, grpc or quic", c.String("transport"))
+	}
+	if err := useTLS(c); err != nil {
+		return nil, err
+	}
+	t, err := client.NewTransport(c.String("transport"), addr)
+	if err != nil {
+		return nil, err
+	}
+	if ws, ok := t.(*client.WebSocketTransport); ok {
+		switch c.String("encoding") {
+		case "cbor":
+			ws.Encoding = protocol.SubprotocolCBOR
+		case "json":
+			ws.Encoding = protocol.SubprotocolJSON
+		default:
+			return nil, fmt.Errorf("unknown --encoding %q, want cbor or json", c.String("encoding"))
+		}
+	}
+	return t, nil
+}
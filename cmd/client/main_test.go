@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/marcoantonios1/chat-app/internal/client"
+	"github.com/marcoantonios1/chat-app/internal/server"
+)
+
+// runMainEnv makes the test binary run the command line client instead of
+// the tests, so each command gets a process, and a home, of its own.
+const runMainEnv = "CHATAPP_TEST_MAIN"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(runMainEnv) == "1" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+var serverHub sync.Once
+
+// startServer serves the chat server in this process until the test ends
+// and returns its URL.
+func startServer(t *testing.T) string {
+	t.Helper()
+	serverHub.Do(func() { go server.RunHub() })
+	mux := http.NewServeMux()
+	mux.HandleFunc("/message", server.HandleMessage)
+	mux.HandleFunc("/stream", server.HandleStream)
+	mux.HandleFunc("/stream/", server.HandleStream)
+	mux.HandleFunc("/register", server.HandleRegister)
+	mux.HandleFunc("/history", server.HandleHistory)
+	mux.HandleFunc("/devices", server.HandleDevices)
+	mux.HandleFunc("/devices/", server.HandleDevices)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+// command returns chatapp with args, run in home against the server at
+// url.
+func command(home, url string, args ...string) *exec.Cmd {
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), runMainEnv+"=1", "HOME="+home, "CHAT_SERVER_HOST="+strings.TrimPrefix(url, "http://"))
+	return cmd
+}
+
+// chatapp runs chatapp with args and stdin in home and returns what it
+// wrote and its exit status.
+func chatapp(t *testing.T, home, url, stdin string, args ...string) (stdout, stderr string, code int) {
+	t.Helper()
+	cmd := command(home, url, args...)
+	cmd.Stdin = strings.NewReader(stdin)
+	var out, errOut bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &out, &errOut
+	err := cmd.Run()
+	var exit *exec.ExitError
+	switch {
+	case errors.As(err, &exit):
+		code = exit.ExitCode()
+	case err != nil:
+		t.Fatal(err)
+	}
+	return out.String(), errOut.String(), code
+}
+
+// register registers id from a new home and returns the home.
+func register(t *testing.T, url, id string) string {
+	t.Helper()
+	home := t.TempDir()
+	if _, stderr, code := chatapp(t, home, url, "", "register", "--id", id); code != 0 {
+		t.Fatalf("register %s: exit %d: %s", id, code, stderr)
+	}
+	return home
+}
+
+func TestSendExitCodes(t *testing.T) {
+	url := startServer(t)
+	alice := register(t, url, "alice")
+	register(t, url, "bob")
+
+	for _, c := range []struct {
+		what string
+		home string
+		args []string
+		want int
+	}{
+		{"sent", alice, []string{"-r", "bob", "-m", "hi bob"}, 0},
+		{"no id", alice, []string{"-r", "bob", "-m", "hi"}, 2},
+		{"no recipient", alice, []string{"--id", "alice", "-m", "hi"}, 2},
+		{"unknown wait", alice, []string{"--id", "alice", "-r", "bob", "-m", "hi", "--wait", "read"}, 2},
+		{"unknown transport", alice, []string{"--id", "alice", "-r", "bob", "-m", "hi", "--transport", "carrier-pigeon"}, 2},
+		{"nothing to send", alice, []string{"--id", "alice", "-r", "bob", "-m", " "}, 1},
+		{"no server", alice, []string{"--id", "alice", "-r", "bob", "-m", "hi", "--server", "ws://127.0.0.1:1/message", "--transport", "http"}, 1},
+		{"new device", t.TempDir(), []string{"--id", "alice", "-r", "bob", "-m", "hi"}, 3},
+		{"not delivered", alice, []string{"--id", "alice", "-r", "bob", "-m", "hi", "--wait", "delivered", "--timeout", "300ms"}, 4},
+	} {
+		args := c.args
+		if c.what == "sent" {
+			args = append([]string{"--id", "alice"}, args...)
+		}
+		_, stderr, code := chatapp(t, c.home, url, "", append([]string{"send", "--no-daemon"}, args...)...)
+		if code != c.want {
+			t.Errorf("%s: exit %d, want %d: %s", c.what, code, c.want, stderr)
+		}
+		if code != 0 && stderr == "" {
+			t.Errorf("%s: no error reported: %q", c.what, stderr)
+		}
+	}
+}
+
+// event is a line chatapp listen wrote, with the keys it had.
+type event struct {
+	client.Event
+	keys []string
+}
+
+// listen runs chatapp listen as id in home until the test ends and
+// returns what it writes.
+func listen(t *testing.T, home, url, id string) <-chan event {
+	t.Helper()
+	cmd := command(home, url, "listen", "--id", id)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	})
+	events := make(chan event, 64)
+	go func() {
+		defer close(events)
+		sc := bufio.NewScanner(stdout)
+		for sc.Scan() {
+			var e event
+			var fields map[string]any
+			if json.Unmarshal(sc.Bytes(), &e.Event) != nil || json.Unmarshal(sc.Bytes(), &fields) != nil {
+				e.Type, e.Error = "invalid", sc.Text()
+			}
+			for k := range fields {
+				e.keys = append(e.keys, k)
+			}
+			sort.Strings(e.keys)
+			events <- e
+		}
+	}()
+	return events
+}
+
+// next returns the next event of type typ, failing on lines that are not
+// events.
+func next(t *testing.T, events <-chan event, typ string) event {
+	t.Helper()
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				t.Fatal("listen exited")
+			}
+			if e.Type == "invalid" {
+				t.Fatalf("listen wrote %q, not a JSON event", e.Error)
+			}
+			if e.Type == typ {
+				return e
+			}
+		case <-timeout:
+			t.Fatalf("no %s event", typ)
+		}
+	}
+}
+
+func TestSendStdin(t *testing.T) {
+	url := startServer(t)
+	alice := register(t, url, "amy")
+	ben := listen(t, register(t, url, "ben"), url, "ben")
+	next(t, ben, client.EventConnection)
+
+	// lines come in slower than --timeout, which bounds each message alone
+	cmd := command(alice, url, "send", "--no-daemon", "--id", "amy", "-r", "ben", "-m", "-", "--wait", "delivered", "--timeout", "2s")
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	for i, line := range []string{"one", "", "two", "three"} {
+		if i > 0 {
+			time.Sleep(time.Second)
+		}
+		_, _ = io.WriteString(stdin, line+"\n")
+	}
+	stdin.Close()
+	if err := cmd.Wait(); err != nil {
+		t.Fatalf("send: %v: %s", err, &stderr)
+	}
+	for _, want := range []string{"one", "two", "three"} {
+		e := next(t, ben, client.EventMessage)
+		if e.From != "amy" || e.Text != want {
+			t.Fatalf("ben got %+v, want %q from amy", e, want)
+		}
+	}
+}
+
+func TestSendTimeout(t *testing.T) {
+	url := startServer(t)
+	alice := register(t, url, "ann")
+	register(t, url, "bea")
+
+	// bea is offline, so nothing is delivered
+	start := time.Now()
+	_, stderr, code := chatapp(t, alice, url, "one\ntwo\n", "send", "--no-daemon", "--id", "ann", "-r", "bea", "-m", "-", "--wait", "delivered", "--timeout", "500ms")
+	if code != 4 || !strings.Contains(stderr, "message 1 is") {
+		t.Fatalf("exit %d, want 4 for message 1: %s", code, stderr)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Fatalf("gave up after %v", d)
+	}
+	// but it is queued
+	if _, stderr, code := chatapp(t, alice, url, "one\ntwo\n", "send", "--no-daemon", "--id", "ann", "-r", "bea", "-m", "-"); code != 0 {
+		t.Fatalf("exit %d: %s", code, stderr)
+	}
+}
+
+func TestListenEvents(t *testing.T) {
+	url := startServer(t)
+	amyHome, benHome := register(t, url, "ada"), register(t, url, "bo")
+
+	// bo's message store can't be opened, which listen reports and lives
+	// with
+	if err := os.WriteFile(filepath.Join(benHome, "Desktop", ".chatkeys", "messages"), nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	bo := listen(t, benHome, url, "bo")
+	if e := next(t, bo, client.EventError); !strings.Contains(e.Error, "message store unavailable") || !slices.Equal(e.keys, []string{"error", "ts", "type"}) {
+		t.Fatalf("error event %+v with %v", e.Event, e.keys)
+	}
+	if e := next(t, bo, client.EventConnection); e.Status != "connected" || !slices.Equal(e.keys, []string{"status", "ts", "type"}) {
+		t.Fatalf("connection event %+v with %v", e.Event, e.keys)
+	}
+
+	// ada sends through her daemon, so her listen sees the acks
+	daemon := command(amyHome, url, "daemon", "--id", "ada")
+	if err := daemon.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = daemon.Process.Kill()
+		_ = daemon.Wait()
+	})
+	socket := filepath.Join(amyHome, "Desktop", ".chatkeys", "daemon.sock")
+	for start := time.Now(); ; time.Sleep(50 * time.Millisecond) {
+		if _, err := os.Stat(socket); err == nil {
+			break
+		}
+		if time.Since(start) > 10*time.Second {
+			t.Fatal("the daemon did not start")
+		}
+	}
+	ada := listen(t, amyHome, url, "ada")
+	send := func(text string) {
+		t.Helper()
+		if _, stderr, code := chatapp(t, amyHome, url, "", "send", "--id", "ada", "-r", "bo", "-m", text, "--wait", "delivered"); code != 0 {
+			t.Fatalf("send: exit %d: %s", code, stderr)
+		}
+	}
+	// until ada's listen is subscribed, what she sends goes unseen
+	var sent event
+	for i := 0; sent.MsgID == ""; i++ {
+		if i == 20 {
+			t.Fatal("ada's listen saw none of her messages")
+		}
+		send("hello")
+		select {
+		case e := <-ada:
+			if e.Type == client.EventMessage {
+				sent = e
+			}
+		case <-time.After(250 * time.Millisecond):
+		}
+	}
+	if sent.From != "ada" || sent.To != "bo" || sent.Text != "hello" ||
+		!slices.Equal(sent.keys, []string{"device", "from", "msg_id", "status", "text", "to", "ts", "type"}) {
+		t.Fatalf("sent message event %+v with %v", sent.Event, sent.keys)
+	}
+
+	e := next(t, bo, client.EventPresence)
+	if e.From != "ada" || e.Status != "online" || !slices.Equal(e.keys, []string{"device", "from", "status", "ts", "type"}) {
+		t.Fatalf("presence event %+v with %v", e.Event, e.keys)
+	}
+	device := e.Device
+	e = next(t, bo, client.EventMessage)
+	if e.From != "ada" || e.Device != device || e.Text != "hello" || e.MsgID == "" ||
+		!slices.Equal(e.keys, []string{"device", "from", "msg_id", "text", "to", "ts", "type"}) {
+		t.Fatalf("message event %+v with %v", e.Event, e.keys)
+	}
+	// the server's acks say how far it got the message, and bo's receipt
+	// comes from his device
+	for server, receipt := false, false; !server || !receipt; {
+		e = next(t, ada, client.EventAck)
+		if e.MsgID != sent.MsgID {
+			continue
+		}
+		switch {
+		case e.From == "" && e.To == "bo" && slices.Equal(e.keys, []string{"msg_id", "status", "to", "ts", "type"}):
+			server = true
+		case e.From == "bo" && e.To == "ada" && e.Device != "" && e.Status == "delivered" &&
+			slices.Equal(e.keys, []string{"device", "from", "msg_id", "status", "to", "ts", "type"}):
+			receipt = true
+		default:
+			t.Fatalf("ack event %+v with %v", e.Event, e.keys)
+		}
+	}
+}
+
+func TestListenUsage(t *testing.T) {
+	url := startServer(t)
+	home := t.TempDir()
+	if _, stderr, code := chatapp(t, home, url, "", "listen"); code != 2 || !strings.Contains(stderr, "--id") {
+		t.Fatalf("listen without an id: exit %d: %s", code, stderr)
+	}
+	if _, stderr, code := chatapp(t, home, url, "", "listen", "--id", "nobody"); code != 1 {
+		t.Fatalf("listen as an unknown id: exit %d: %s", code, stderr)
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/marcoantonios1/chat-app/internal/server"
+	"github.com/urfave/cli/v2"
+)
+
+// envPrefix starts the environment variable of every start flag:
+// --grpc-addr is CHAT_SERVER_GRPC_ADDR.
+const envPrefix = "CHAT_SERVER_"
+
+// startFlags are the flags of the start command, with defaults from def.
+// Each can also be set in the environment, and most in the config file.
+func startFlags(def server.Config) []cli.Flag {
+	return withEnv([]cli.Flag{
+		&cli.StringFlag{Name: "config", Usage: "YAML file with the server configuration; flags and environment variables override it"},
+		&cli.StringFlag{Name: "addr", Value: def.Addr, Usage: "address to listen on"},
+		&cli.StringFlag{Name: "grpc-addr", Usage: "address to serve the gRPC chat service on (default: disabled)"},
+		&cli.StringFlag{Name: "quic-addr", Usage: "UDP address to serve the chat over QUIC on (default: disabled)"},
+		&cli.StringFlag{Name: "quic-cert", Value: def.QUICCert, Usage: "TLS certificate for QUIC without --tls-cert; a self-signed one is created if it and --quic-key are missing"},
+		&cli.StringFlag{Name: "quic-key", Value: def.QUICKey, Usage: "TLS private key for QUIC without --tls-key"},
+		&cli.DurationFlag{Name: "write-timeout", Value: def.Timeouts.Write, Usage: "time allowed to write a frame to a client"},
+		&cli.DurationFlag{Name: "pong-timeout", Value: def.Timeouts.Pong, Usage: "how long a silent websocket or QUIC connection is kept; websocket pings go out at 9/10 of it"},
+		&cli.DurationFlag{Name: "shutdown-timeout", Value: def.Timeouts.Shutdown, Usage: "how long open requests get to finish on interrupt"},
+		&cli.IntFlag{Name: "max-message-size", Value: def.Limits.MaxMessageSize, Usage: "largest frame accepted from a client, in bytes"},
+		&cli.IntFlag{Name: "send-buffer", Value: def.Limits.SendBuffer, Usage: "frames buffered per connection before the hub queues them"},
+		&cli.IntFlag{Name: "rate-burst", Value: def.Limits.RateBurst, Usage: "frames a connection may send at once"},
+		&cli.Float64Flag{Name: "rate-per-sec", Value: def.Limits.RatePerSec, Usage: "frames per second a connection may send after the burst"},
+		&cli.IntFlag{Name: "max-queued-per-device", Value: def.Limits.MaxQueuedPerDevice, Usage: "frames kept for an offline device; the oldest are dropped beyond this"},
+		&cli.IntFlag{Name: "hub-shards", Value: def.Limits.HubShards, Usage: "number of hub shards routing messages in parallel"},
+		&cli.StringSliceFlag{Name: "allowed-origin", Usage: "origin browsers may connect from, like https://chat.example.com, or * (repeatable; default: any)"},
+		&cli.StringFlag{Name: "storage", Value: def.Storage.Backend, Usage: "storage backend: " + server.StorageMemory},
+		&cli.DurationFlag{Name: "history-retention", Value: def.Storage.HistoryRetention, Usage: "how long to keep message history (0 keeps forever)"},
+		&cli.StringFlag{Name: "tls-cert", Usage: "serve HTTPS, gRPC and QUIC with this certificate (PEM)"},
+		&cli.StringFlag{Name: "tls-key", Usage: "private key of --tls-cert (PEM)"},
+		&cli.BoolFlag{Name: "tls-dev", Usage: "serve TLS with a self-signed certificate, created in --tls-cert/--tls-key (default tls_cert.pem, tls_key.pem) if missing"},
+		&cli.StringFlag{Name: "tls-client-ca", Usage: "verify client certificates against this PEM bundle (mutual TLS)"},
+		&cli.BoolFlag{Name: "tls-require-client-cert", Usage: "turn away users without a client certificate"},
+		&cli.StringSliceFlag{Name: "tls-client-id", Usage: "identity=id: connect a certificate with this CN, DNS, email or URI name as id (repeatable; default: the CN is the id)"},
+		&cli.StringFlag{Name: "backplane", Usage: "address of a backplane broker shared with other instances"},
+		&cli.StringFlag{Name: "instance-id", Usage: "name of this instance on the backplane (default: random)"},
+		&cli.StringFlag{Name: "backplane-secret", Usage: "secret shared with the backplane broker and the other instances"},
+		&cli.StringFlag{Name: "domain", Usage: "federation domain of this server; enables user@domain addressing"},
+		&cli.StringFlag{Name: "identity-key", Value: def.Federation.IdentityKeyFile, Usage: "file holding the server's federation signing key"},
+		&cli.StringSliceFlag{Name: "federation-peer", Usage: "domain=url[#hexkey] of a federated server (repeatable)"},
+		&cli.StringSliceFlag{Name: "federation-allow", Usage: "only federate with these domains"},
+		&cli.StringSliceFlag{Name: "federation-deny", Usage: "never federate with these domains"},
+		&cli.StringSliceFlag{Name: "webhook", Usage: "[event,event=]url#secret to POST signed server events to (repeatable)"},
+		&cli.StringFlag{Name: "webhook-dead-letter", Value: def.Webhooks.DeadLetter, Usage: "file logging webhook events that could not be delivered"},
+	})
+}
+
+// withEnv lets each flag be set with its environment variable.
+func withEnv(flags []cli.Flag) []cli.Flag {
+	for _, f := range flags {
+		env := []string{envPrefix + strings.ToUpper(strings.ReplaceAll(f.Names()[0], "-", "_"))}
+		switch f := f.(type) {
+		case *cli.StringFlag:
+			f.EnvVars = env
+		case *cli.StringSliceFlag:
+			f.EnvVars = env
+		case *cli.IntFlag:
+			f.EnvVars = env
+		case *cli.Float64Flag:
+			f.EnvVars = env
+		case *cli.BoolFlag:
+			f.EnvVars = env
+		case *cli.DurationFlag:
+			f.EnvVars = env
+		}
+	}
+	return flags
+}
+
+// loadConfig returns the configuration asked for: the defaults, then the
+// --config file, then environment variables, then flags.
+func loadConfig(c *cli.Context) (server.Config, error) {
+	cfg := server.DefaultConfig()
+	if path := c.String("config"); path != "" {
+		var err error
+		if cfg, err = server.LoadConfig(path); err != nil {
+			return cfg, err
+		}
+	}
+	// IsSet is true for flags given on the command line or in the
+	// environment, and the command line wins
+	str := func(name string, v *string) {
+		if c.IsSet(name) {
+			*v = c.String(name)
+		}
+	}
+	str("addr", &cfg.Addr)
+	str("grpc-addr", &cfg.GRPCAddr)
+	str("quic-addr", &cfg.QUICAddr)
+	str("quic-cert", &cfg.QUICCert)
+	str("quic-key", &cfg.QUICKey)
+	str("storage", &cfg.Storage.Backend)
+	str("tls-cert", &cfg.TLS.CertFile)
+	str("tls-key", &cfg.TLS.KeyFile)
+	str("tls-client-ca", &cfg.TLS.ClientCAFile)
+	str("backplane", &cfg.Backplane.Addr)
+	str("instance-id", &cfg.Backplane.InstanceID)
+	str("backplane-secret", &cfg.Backplane.Secret)
+	str("domain", &cfg.Federation.Domain)
+	str("identity-key", &cfg.Federation.IdentityKeyFile)
+	str("webhook-dead-letter", &cfg.Webhooks.DeadLetter)
+
+	for name, v := range map[string]*int{
+		"max-message-size":      &cfg.Limits.MaxMessageSize,
+		"send-buffer":           &cfg.Limits.SendBuffer,
+		"rate-burst":            &cfg.Limits.RateBurst,
+		"max-queued-per-device": &cfg.Limits.MaxQueuedPerDevice,
+		"hub-shards":            &cfg.Limits.HubShards,
+	} {
+		if c.IsSet(name) {
+			*v = c.Int(name)
+		}
+	}
+	for name, v := range map[string]*time.Duration{
+		"write-timeout":     &cfg.Timeouts.Write,
+		"pong-timeout":      &cfg.Timeouts.Pong,
+		"shutdown-timeout":  &cfg.Timeouts.Shutdown,
+		"history-retention": &cfg.Storage.HistoryRetention,
+	} {
+		if c.IsSet(name) {
+			*v = c.Duration(name)
+		}
+	}
+	for name, v := range map[string]*[]string{
+		"allowed-origin":   &cfg.AllowedOrigins,
+		"federation-allow": &cfg.Federation.Allow,
+		"federation-deny":  &cfg.Federation.Deny,
+		"webhook":          &cfg.Webhooks.Subscriptions,
+	} {
+		if c.IsSet(name) {
+			*v = c.StringSlice(name)
+		}
+	}
+	if c.IsSet("rate-per-sec") {
+		cfg.Limits.RatePerSec = c.Float64("rate-per-sec")
+	}
+	if c.IsSet("tls-dev") {
+		cfg.TLS.Dev = c.Bool("tls-dev")
+	}
+	if c.IsSet("tls-require-client-cert") {
+		cfg.TLS.RequireClientCert = c.Bool("tls-require-client-cert")
+	}
+
+	if c.IsSet("tls-client-id") {
+		cfg.TLS.ClientIDs = make(map[string]string)
+		for _, m := range c.StringSlice("tls-client-id") {
+			identity, id, err := server.ParseClientID(m)
+			if err != nil {
+				return cfg, fmt.Errorf("--tls-client-id: %w", err)
+			}
+			cfg.TLS.ClientIDs[identity] = id
+		}
+	}
+	if c.IsSet("federation-peer") {
+		cfg.Federation.Peers = make(map[string]string)
+		for _, p := range c.StringSlice("federation-peer") {
+			name, url, ok := strings.Cut(p, "=")
+			if !ok || name == "" || url == "" {
+				return cfg, fmt.Errorf("invalid --federation-peer %q, want domain=url", p)
+			}
+			cfg.Federation.Peers[name] = url
+		}
+	}
+	if cfg.TLS.Dev && cfg.TLS.CertFile == "" {
+		cfg.TLS.CertFile, cfg.TLS.KeyFile = "tls_cert.pem", "tls_key.pem"
+	}
+	return cfg, cfg.Validate()
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/marcoantonios1/chat-app/internal/server"
+	"github.com/urfave/cli/v2"
+)
+
+// startWith runs the start command's flag parsing with args and passes
+// its context to action.
+func startWith(t *testing.T, args []string, action func(c *cli.Context) error) error {
+	t.Helper()
+	app := cli.NewApp()
+	app.Writer, app.ErrWriter = io.Discard, io.Discard
+	app.Commands = []*cli.Command{{Name: "start", Flags: startFlags(server.DefaultConfig()), Action: action}}
+	return app.Run(append([]string{"chatapp", "start"}, args...))
+}
+
+// configWith returns the configuration the start command loads with args.
+func configWith(t *testing.T, args ...string) (server.Config, error) {
+	t.Helper()
+	var cfg server.Config
+	var loadErr error
+	if err := startWith(t, args, func(c *cli.Context) error {
+		cfg, loadErr = loadConfig(c)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return cfg, loadErr
+}
+
+func writeConfig(t *testing.T, path, yaml string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(yaml), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "server.yaml")
+	writeConfig(t, path, "addr: 127.0.0.1:9000\ngrpc_addr: 127.0.0.1:9001\ntimeouts:\n  write: 3s\nlimits:\n  rate_burst: 9\n  rate_per_sec: 2\n")
+
+	// the defaults, then the file
+	cfg, err := configWith(t, "--config", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	def := server.DefaultConfig()
+	if cfg.Addr != "127.0.0.1:9000" || cfg.Limits.RateBurst != 9 || cfg.Limits.RatePerSec != 2 ||
+		cfg.Timeouts.Write != 3*time.Second || cfg.Limits.SendBuffer != def.Limits.SendBuffer || cfg.Timeouts.Pong != def.Timeouts.Pong {
+		t.Fatalf("config from the file %+v", cfg)
+	}
+
+	// then the environment
+	t.Setenv(envPrefix+"RATE_BURST", "11")
+	t.Setenv(envPrefix+"WRITE_TIMEOUT", "4s")
+	t.Setenv(envPrefix+"ALLOWED_ORIGIN", "https://a.example.com,https://b.example.com")
+	cfg, err = configWith(t, "--config", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Limits.RateBurst != 11 || cfg.Timeouts.Write != 4*time.Second || len(cfg.AllowedOrigins) != 2 ||
+		cfg.Addr != "127.0.0.1:9000" || cfg.Limits.RatePerSec != 2 {
+		t.Fatalf("config from the environment %+v", cfg)
+	}
+
+	// then the command line
+	cfg, err = configWith(t, "--config", path, "--write-timeout", "5s", "--grpc-addr", "127.0.0.1:9002", "--allowed-origin", "*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Timeouts.Write != 5*time.Second || cfg.GRPCAddr != "127.0.0.1:9002" || len(cfg.AllowedOrigins) != 1 ||
+		cfg.Limits.RateBurst != 11 || cfg.Addr != "127.0.0.1:9000" {
+		t.Fatalf("config from the command line %+v", cfg)
+	}
+
+	// the defaults of flags never hide the file
+	if cfg.Limits.SendBuffer != def.Limits.SendBuffer || cfg.QUICCert != def.QUICCert {
+		t.Fatalf("defaults lost: %+v", cfg)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	for _, c := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"--rate-burst", "0"}, "limits.rate_burst"},
+		{[]string{"--addr", "8080", "--send-buffer", "0"}, "addr"},
+		{[]string{"--tls-client-id", "alice"}, "--tls-client-id"},
+		{[]string{"--domain", "a.example", "--federation-peer", "b.example"}, "--federation-peer"},
+		{[]string{"--config", "server.toml"}, "unsupported config format"},
+	} {
+		if _, err := configWith(t, c.args...); err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%v: err = %v, want one about %s", c.args, err, c.want)
+		}
+	}
+
+	cfg, err := configWith(t, "--tls-dev", "--tls-client-id", "alice.example.com=alice", "--domain", "a.example", "--federation-peer", "b.example=https://b.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.TLS.CertFile != "tls_cert.pem" || cfg.TLS.KeyFile != "tls_key.pem" || cfg.TLS.ClientIDs["alice.example.com"] != "alice" ||
+		cfg.Federation.Peers["b.example"] != "https://b.example" {
+		t.Fatalf("config %+v", cfg)
+	}
+}
+
+func TestReloadOnHangup(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "server.yaml")
+	writeConfig(t, path, "timeouts:\n  shutdown: 2s\n")
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	defer signal.Stop(sig)
+
+	err := startWith(t, []string{"--config", path, "--addr", "127.0.0.1:8080"}, func(c *cli.Context) error {
+		cfg, err := loadConfig(c)
+		if err != nil {
+			return err
+		}
+		server.Configure(cfg)
+		type reload struct {
+			cfg server.Config
+			err error
+		}
+		reloaded := make(chan reload)
+		done := make(chan time.Duration)
+		go func() {
+			done <- reloadOnHangup(sig, cfg.Timeouts.Shutdown, func() (server.Config, error) {
+				next, err := loadConfig(c)
+				reloaded <- reload{next, err}
+				return next, err
+			})
+		}()
+		hangup := func() reload {
+			if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case r := <-reloaded:
+				return r
+			case <-time.After(5 * time.Second):
+				t.Fatal("no reload on SIGHUP")
+			}
+			return reload{}
+		}
+
+		// the file is read again, and the flags still win over it
+		writeConfig(t, path, "addr: 127.0.0.1:9000\ntimeouts:\n  shutdown: 7s\n")
+		if r := hangup(); r.err != nil || r.cfg.Addr != "127.0.0.1:8080" || r.cfg.Timeouts.Shutdown != 7*time.Second {
+			t.Fatalf("reloaded %+v, %v", r.cfg, r.err)
+		}
+		// a broken file leaves the running configuration
+		writeConfig(t, path, "limits:\n  rate_burst: 0\n")
+		if r := hangup(); r.err == nil {
+			t.Fatal("reloaded an invalid config")
+		}
+
+		sig <- os.Interrupt
+		select {
+		case shutdown := <-done:
+			if shutdown != 7*time.Second {
+				t.Fatalf("shutdown timeout %v after the reloads, want 7s", shutdown)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("still reloading after an interrupt")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
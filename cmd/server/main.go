@@ -2,10 +2,12 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"net/http"
 	"os"
 	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/marcoantonios1/chat-app/internal/server"
@@ -29,41 +31,179 @@ func buildCLI() *cli.App {
 		{
 			Name:  "start",
 			Usage: "Start the chat server",
+			Flags: startFlags(server.DefaultConfig()),
 			Action: func(c *cli.Context) error {
-				return startServer()
+				cfg, err := loadConfig(c)
+				if err != nil {
+					return cli.Exit(fmt.Sprintf("❌ Config: %v", err), 1)
+				}
+				server.Configure(cfg)
+				if cfg.Backplane.Addr != "" {
+					instance := cfg.Backplane.InstanceID
+					if instance == "" {
+						instance = server.NewInstanceID()
+					}
+					bp, err := server.DialBackplane(cfg.Backplane.Addr, instance, cfg.Backplane.Secret)
+					if err != nil {
+						return cli.Exit(fmt.Sprintf("❌ Backplane: %v", err), 1)
+					}
+					server.ConfigureBackplane(bp)
+				}
+				if cfg.Federation.Domain != "" {
+					if err := server.ConfigureFederation(cfg.Federation); err != nil {
+						return cli.Exit(fmt.Sprintf("❌ Federation: %v", err), 1)
+					}
+				}
+				var hooks []server.WebhookConfig
+				for _, w := range cfg.Webhooks.Subscriptions {
+					hook, err := server.ParseWebhook(w)
+					if err != nil {
+						return cli.Exit(fmt.Sprintf("❌ Invalid webhook: %v", err), 1)
+					}
+					hooks = append(hooks, hook)
+				}
+				if err := server.ConfigureWebhooks(hooks, cfg.Webhooks.DeadLetter); err != nil {
+					return cli.Exit(fmt.Sprintf("❌ Webhooks: %v", err), 1)
+				}
+				var tlsConf *tls.Config
+				if cfg.TLS.CertFile != "" {
+					if tlsConf, err = server.ConfigureTLS(cfg.TLS); err != nil {
+						return cli.Exit(fmt.Sprintf("❌ TLS: %v", err), 1)
+					}
+				}
+				var quicSrv *server.QUICServer
+				if cfg.QUICAddr != "" {
+					quicTLS := tlsConf
+					if quicTLS == nil {
+						cert, err := server.LoadCertificate(cfg.QUICCert, cfg.QUICKey)
+						if err != nil {
+							return cli.Exit(fmt.Sprintf("❌ QUIC certificate: %v", err), 1)
+						}
+						quicTLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+					}
+					if quicSrv, err = server.ListenQUIC(cfg.QUICAddr, quicTLS); err != nil {
+						return cli.Exit(fmt.Sprintf("❌ QUIC: %v", err), 1)
+					}
+				}
+				return startServer(cfg, quicSrv, tlsConf, func() (server.Config, error) { return loadConfig(c) })
+			},
+		},
+		{
+			Name:  "backplane",
+			Usage: "Run a backplane broker that relays routing between server instances",
+			Flags: []cli.Flag{
+				&cli.StringFlag{Name: "listen", Value: "127.0.0.1:7400", Usage: "address to listen on"},
+				&cli.StringFlag{Name: "secret", EnvVars: []string{envPrefix + "BACKPLANE_SECRET"}, Required: true, Usage: "secret every instance must prove it knows"},
+			},
+			Action: func(c *cli.Context) error {
+				stop := make(chan struct{})
+				go func() {
+					sig := make(chan os.Signal, 1)
+					signal.Notify(sig, os.Interrupt)
+					<-sig
+					close(stop)
+				}()
+				fmt.Println("🔀 Backplane broker on", c.String("listen"))
+				return server.RunBackplaneBroker(c.String("listen"), c.String("secret"), stop)
 			},
 		},
 	}
 	return app
 }
 
-func startServer() error {
-    fmt.Println("🚀 Starting chat server on :8080...")
+// startServer serves cfg until interrupted, reloading the configuration
+// with reload on SIGHUP.
+func startServer(cfg server.Config, quicSrv *server.QUICServer, tlsConf *tls.Config, reload func() (server.Config, error)) error {
+	addr, grpcAddr := cfg.Addr, cfg.GRPCAddr
+	scheme := "http"
+	if tlsConf != nil {
+		scheme = "https"
+	}
+	fmt.Printf("🚀 Starting chat server on %s (%s)...\n", addr, scheme)
 
 	go server.RunHub()
+	go server.RunHistoryPruner(time.Minute)
 
-    mux := http.NewServeMux()
-    mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("OK")) })
-    mux.HandleFunc("/message", server.HandleMessage)
-    mux.HandleFunc("/register", server.HandleRegister)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("OK")) })
+	mux.HandleFunc("/message", server.HandleMessage)
+	mux.HandleFunc("/stream", server.HandleStream)
+	mux.HandleFunc("/stream/", server.HandleStream)
+	mux.HandleFunc("/register", server.HandleRegister)
+	mux.HandleFunc("/history", server.HandleHistory)
+	mux.HandleFunc("/devices", server.HandleDevices)
+	mux.HandleFunc("/devices/", server.HandleDevices)
+	mux.HandleFunc("/api/", server.HandleAPI)
+	mux.HandleFunc("/webhooks/deliveries", server.HandleWebhookDeliveries)
+	mux.HandleFunc("/federation/identity", server.HandleFederationIdentity)
+	mux.HandleFunc("/federation/inbox", server.HandleFederationInbox)
 
-    srv := &http.Server{Addr: ":8080", Handler: mux}
+	srv := &http.Server{Addr: addr, Handler: mux, TLSConfig: tlsConf}
 
-    // graceful shutdown
-    idleConnsClosed := make(chan struct{})
-    go func() {
-        sig := make(chan os.Signal, 1)
-        signal.Notify(sig, os.Interrupt)
-        <-sig
-        ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-        defer cancel()
-        _ = srv.Shutdown(ctx)
-        close(idleConnsClosed)
-    }()
+	grpcSrv := server.NewGRPCServer(tlsConf)
+	if grpcAddr != "" {
+		fmt.Printf("📡 Serving gRPC on %s\n", grpcAddr)
+		go func() {
+			if err := server.ServeGRPC(grpcSrv, grpcAddr); err != nil {
+				fmt.Fprintf(os.Stderr, "❌ gRPC: %v\n", err)
+			}
+		}()
+	}
 
-    if err := srv.ListenAndServe(); err != http.ErrServerClosed {
-        return err
-    }
-    <-idleConnsClosed
-    return nil
+	if quicSrv != nil {
+		fmt.Printf("⚡ Serving QUIC on %s\n", quicSrv.Addr())
+		go func() {
+			if err := quicSrv.Serve(); err != nil {
+				fmt.Fprintf(os.Stderr, "❌ QUIC: %v\n", err)
+			}
+		}()
+	}
+
+	// reload on SIGHUP, graceful shutdown on interrupt
+	idleConnsClosed := make(chan struct{})
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGHUP)
+		shutdown := reloadOnHangup(sig, cfg.Timeouts.Shutdown, reload)
+		ctx, cancel := context.WithTimeout(context.Background(), shutdown)
+		defer cancel()
+		_ = srv.Shutdown(ctx)
+		grpcSrv.Stop()
+		if quicSrv != nil {
+			_ = quicSrv.Close()
+		}
+		server.ShutdownHub()
+		close(idleConnsClosed)
+	}()
+
+	serve := srv.ListenAndServe
+	if tlsConf != nil {
+		// the certificate is in TLSConfig
+		serve = func() error { return srv.ListenAndServeTLS("", "") }
+	}
+	if err := serve(); err != http.ErrServerClosed {
+		return err
+	}
+	<-idleConnsClosed
+	return nil
+}
+
+// reloadOnHangup switches the server to the configuration reload returns
+// on each SIGHUP from sig, until any other signal. It returns the shutdown
+// timeout then in effect. A configuration that fails to load is reported
+// and the running one kept.
+func reloadOnHangup(sig <-chan os.Signal, shutdown time.Duration, reload func() (server.Config, error)) time.Duration {
+	for s := range sig {
+		if s != syscall.SIGHUP {
+			break
+		}
+		next, err := reload()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "❌ Config reload: %v\n", err)
+			continue
+		}
+		server.Reload(next)
+		shutdown = next.Timeouts.Shutdown
+	}
+	return shutdown
 }
@@ -2,13 +2,27 @@ module github.com/marcoantonios1/chat-app
 
 go 1.25.2
 
-require github.com/urfave/cli/v2 v2.27.7
+require (
+	github.com/fxamacker/cbor/v2 v2.9.0
+	github.com/quic-go/quic-go v0.59.1
+	github.com/urfave/cli/v2 v2.27.7
+	google.golang.org/grpc v1.82.1
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
+	github.com/x448/float16 v0.8.4 // indirect
+	golang.org/x/net v0.53.0 // indirect
+	golang.org/x/text v0.36.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20260414002931-afd174a4e478 // indirect
+	google.golang.org/protobuf v1.36.11 // indirect
+)
 
 require (
 	github.com/cloudflare/circl v1.6.1 // direct
 	github.com/mattn/go-colorable v0.1.13 // indirect
 	github.com/mattn/go-isatty v0.0.20 // indirect
-	golang.org/x/sys v0.37.0 // indirect
+	golang.org/x/sys v0.43.0 // indirect
 )
 
 require (
@@ -17,5 +31,5 @@ require (
 	github.com/gorilla/websocket v1.5.3
 	github.com/russross/blackfriday/v2 v2.1.0 // indirect
 	github.com/xrash/smetrics v0.0.0-20240521201337-686a1a2994c1 // indirect
-	golang.org/x/crypto v0.43.0
+	golang.org/x/crypto v0.50.0
 )
@@ -0,0 +1,119 @@
+// Package chatquic defines how the chat protocol runs over QUIC, next to
+// the websocket and gRPC endpoints.
+//
+// The client opens a bidirectional control stream first and writes a
+// Preface naming itself, then its hello; the server answers with the
+// welcome. Frames that belong to a conversation then travel on a
+// unidirectional stream per conversation and direction, so a lost packet
+// only holds up its own conversation; everything else stays on the
+// control stream. Every frame is CBOR, prefixed with its length as a
+// uvarint.
+//
+// A refused connection is closed with CodeRefused and the reason as its
+// message, or for a failed handshake with the protocol close code.
+package chatquic
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/marcoantonios1/chat-app/internal/protocol"
+	"github.com/quic-go/quic-go"
+)
+
+// ALPN is the TLS application protocol of the chat over QUIC.
+const ALPN = "chatapp-quic/1"
+
+// Application error codes the server closes connections with.
+const (
+	CodeClosed  quic.ApplicationErrorCode = 0
+	CodeRefused quic.ApplicationErrorCode = 0x100 // the device may not connect
+)
+
+// Preface names the client, like the websocket query parameters.
+type Preface struct {
+	ID         string `cbor:"id"`
+	Device     string `cbor:"device,omitempty"`
+	DeviceName string `cbor:"device_name,omitempty"`
+	// DeviceSecret proves the client is Device.
+	DeviceSecret string `cbor:"device_secret,omitempty"`
+}
+
+// DefaultIdleTimeout is the idle timeout clients ask for. The connection
+// uses the smaller of the two sides' timeouts.
+const DefaultIdleTimeout = 60 * time.Second
+
+// Config returns the QUIC settings both sides use, with idle as the idle
+// timeout; the server passes its websocket pong wait. Keepalives hold NAT
+// bindings open.
+func Config(idle time.Duration) *quic.Config {
+	return &quic.Config{
+		MaxIdleTimeout:  idle,
+		KeepAlivePeriod: idle / 3,
+		Allow0RTT:       true,
+	}
+}
+
+// Conversation returns the conversation f belongs to for me: the other
+// side's id, or "" for frames kept on the control stream.
+func Conversation(f protocol.Frame, me string) string {
+	if _, ok := f.(*protocol.Hello); ok {
+		return ""
+	}
+	if h := f.Head(); h.ID != "" && h.ID != me {
+		return h.ID
+	}
+	if t, ok := f.(protocol.Targeted); ok {
+		to, _ := t.Target()
+		if to != me {
+			return to
+		}
+	}
+	return ""
+}
+
+// WriteRecord writes b with its length prefix.
+func WriteRecord(w io.Writer, b []byte) error {
+	buf := binary.AppendUvarint(make([]byte, 0, len(b)+binary.MaxVarintLen32), uint64(len(b)))
+	_, err := w.Write(append(buf, b...))
+	return err
+}
+
+// ReadRecord reads one record of at most limit bytes.
+func ReadRecord(r *bufio.Reader, limit int) ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if n > uint64(limit) {
+		return nil, fmt.Errorf("record of %d bytes is too large", n)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// WritePreface writes p as the first record of the control stream.
+func WritePreface(w io.Writer, p Preface) error {
+	b, err := cbor.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return WriteRecord(w, b)
+}
+
+// ReadPreface reads the first record of the control stream.
+func ReadPreface(r *bufio.Reader) (Preface, error) {
+	var p Preface
+	b, err := ReadRecord(r, 1024)
+	if err != nil {
+		return p, err
+	}
+	return p, cbor.Unmarshal(b, &p)
+}
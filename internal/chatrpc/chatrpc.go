@@ -0,0 +1,176 @@
+// Package chatrpc defines the gRPC chat service served next to the
+// websocket endpoint. Messages are CBOR rather than protobuf: the Connect
+// stream carries the same protocol frames as a websocket connection, and
+// the unary calls use the plain structs below. The service is written out
+// by hand in the shape protoc-gen-go-grpc would generate:
+//
+//	service Chat {
+//	  rpc Connect(stream Frame) returns (stream Frame);
+//	  rpc Register(RegisterRequest) returns (RegisterResponse);
+//	  rpc FetchHistory(FetchHistoryRequest) returns (FetchHistoryResponse);
+//	  rpc GetPrekeys(GetPrekeysRequest) returns (GetPrekeysResponse);
+//	}
+//
+// Calls other than Register identify the caller with the metadata keys
+// MetadataID, MetadataDevice and MetadataDeviceName, and prove it is that
+// device with MetadataDeviceSecret, the secret the device chose when it
+// was first seen.
+package chatrpc
+
+import (
+	"context"
+
+	"github.com/marcoantonios1/chat-app/internal/protocol"
+	"google.golang.org/grpc"
+)
+
+// ServiceName is the fully qualified gRPC service name.
+const ServiceName = "chatapp.v1.Chat"
+
+// Metadata keys naming the caller, like the websocket query parameters.
+const (
+	MetadataID         = "chat-id"
+	MetadataDevice     = "chat-device"
+	MetadataDeviceName = "chat-device-name"
+	// MetadataDeviceSecret is also the HTTP header of the secret.
+	MetadataDeviceSecret = "chat-device-secret"
+)
+
+// Frame is one protocol frame on the Connect stream.
+type Frame struct {
+	protocol.Frame
+	raw []byte // already CBOR encoded
+}
+
+// Encoded wraps a frame that is already CBOR encoded, so it is sent as is.
+func Encoded(b []byte) *Frame {
+	return &Frame{raw: b}
+}
+
+// RegisterRequest claims an id, like POST /register.
+type RegisterRequest struct {
+	ID         string `json:"id"`
+	Device     string `json:"device,omitempty"`
+	DeviceName string `json:"device_name,omitempty"`
+	// DeviceSecret is Device's secret, required with Device.
+	DeviceSecret string `json:"device_secret,omitempty"`
+}
+
+type RegisterResponse struct{}
+
+// FetchHistoryRequest asks for a page of the caller's conversation with
+// With, newest first. Before is the cursor from the previous page.
+type FetchHistoryRequest struct {
+	With   string `json:"with"`
+	Before int64  `json:"before,omitempty"`
+	Limit  int    `json:"limit,omitempty"`
+}
+
+type FetchHistoryResponse struct {
+	Messages   []protocol.HistoryEntry `json:"messages"`
+	NextBefore int64                   `json:"next_before,omitempty"`
+}
+
+// GetPrekeysRequest asks for the public keys User's devices last
+// announced, so a session can be set up while they are offline.
+type GetPrekeysRequest struct {
+	User string `json:"user"`
+}
+
+type GetPrekeysResponse struct {
+	Keys []Prekey `json:"keys"`
+}
+
+// Prekey is the key announcement of one device, as in a pubkey frame.
+type Prekey struct {
+	Device         string `json:"device"`
+	PublicKey      string `json:"public_key"`
+	IdentityPublic string `json:"identity_public,omitempty"`
+	PublicKeySig   string `json:"public_key_sig,omitempty"`
+}
+
+// ChatServer is implemented by the chat server.
+type ChatServer interface {
+	Connect(grpc.BidiStreamingServer[Frame, Frame]) error
+	Register(context.Context, *RegisterRequest) (*RegisterResponse, error)
+	FetchHistory(context.Context, *FetchHistoryRequest) (*FetchHistoryResponse, error)
+	GetPrekeys(context.Context, *GetPrekeysRequest) (*GetPrekeysResponse, error)
+}
+
+// RegisterChatServer registers srv with s.
+func RegisterChatServer(s grpc.ServiceRegistrar, srv ChatServer) {
+	s.RegisterService(&serviceDesc, srv)
+}
+
+var serviceDesc = grpc.ServiceDesc{
+	ServiceName: ServiceName,
+	HandlerType: (*ChatServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{MethodName: "Register", Handler: unaryHandler("Register", ChatServer.Register)},
+		{MethodName: "FetchHistory", Handler: unaryHandler("FetchHistory", ChatServer.FetchHistory)},
+		{MethodName: "GetPrekeys", Handler: unaryHandler("GetPrekeys", ChatServer.GetPrekeys)},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Connect",
+			Handler:       connectHandler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+}
+
+func connectHandler(srv any, stream grpc.ServerStream) error {
+	return srv.(ChatServer).Connect(&grpc.GenericServerStream[Frame, Frame]{ServerStream: stream})
+}
+
+func unaryHandler[Req, Resp any](method string, call func(ChatServer, context.Context, *Req) (*Resp, error)) grpc.MethodHandler {
+	return func(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
+		req := new(Req)
+		if err := dec(req); err != nil {
+			return nil, err
+		}
+		if interceptor == nil {
+			return call(srv.(ChatServer), ctx, req)
+		}
+		info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/" + ServiceName + "/" + method}
+		return interceptor(ctx, req, info, func(ctx context.Context, req any) (any, error) {
+			return call(srv.(ChatServer), ctx, req.(*Req))
+		})
+	}
+}
+
+// ChatClient calls the chat service.
+type ChatClient struct {
+	cc grpc.ClientConnInterface
+}
+
+// NewChatClient returns a client for the service on cc. Calls must use the
+// CBOR codec, see CallOption.
+func NewChatClient(cc grpc.ClientConnInterface) *ChatClient {
+	return &ChatClient{cc: cc}
+}
+
+// Connect opens the frame stream. The first frame sent must be a hello.
+func (c *ChatClient) Connect(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[Frame, Frame], error) {
+	stream, err := c.cc.NewStream(ctx, &serviceDesc.Streams[0], "/"+ServiceName+"/Connect", opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &grpc.GenericClientStream[Frame, Frame]{ClientStream: stream}, nil
+}
+
+func (c *ChatClient) Register(ctx context.Context, in *RegisterRequest, opts ...grpc.CallOption) (*RegisterResponse, error) {
+	out := new(RegisterResponse)
+	return out, c.cc.Invoke(ctx, "/"+ServiceName+"/Register", in, out, opts...)
+}
+
+func (c *ChatClient) FetchHistory(ctx context.Context, in *FetchHistoryRequest, opts ...grpc.CallOption) (*FetchHistoryResponse, error) {
+	out := new(FetchHistoryResponse)
+	return out, c.cc.Invoke(ctx, "/"+ServiceName+"/FetchHistory", in, out, opts...)
+}
+
+func (c *ChatClient) GetPrekeys(ctx context.Context, in *GetPrekeysRequest, opts ...grpc.CallOption) (*GetPrekeysResponse, error) {
+	out := new(GetPrekeysResponse)
+	return out, c.cc.Invoke(ctx, "/"+ServiceName+"/GetPrekeys", in, out, opts...)
+}
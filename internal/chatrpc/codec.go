@@ -0,0 +1,53 @@
+package chatrpc
+
+import (
+	"fmt"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/marcoantonios1/chat-app/internal/protocol"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/encoding"
+)
+
+// CodecName is the gRPC content subtype of the service's messages.
+const CodecName = "cbor"
+
+func init() {
+	encoding.RegisterCodec(codec{})
+}
+
+// CallOption selects the service's codec on a client connection.
+func CallOption() grpc.CallOption {
+	return grpc.CallContentSubtype(CodecName)
+}
+
+// codec encodes Frames with protocol.CBOR and everything else as plain
+// CBOR.
+type codec struct{}
+
+func (codec) Name() string { return CodecName }
+
+func (codec) Marshal(v any) ([]byte, error) {
+	if f, ok := v.(*Frame); ok {
+		if f.raw != nil {
+			return f.raw, nil
+		}
+		if f.Frame == nil {
+			return nil, fmt.Errorf("empty frame")
+		}
+		return protocol.CBOR.Marshal(f.Frame)
+	}
+	return cbor.Marshal(v)
+}
+
+func (codec) Unmarshal(b []byte, v any) error {
+	if f, ok := v.(*Frame); ok {
+		frame, err := protocol.CBOR.Unmarshal(b)
+		if err != nil {
+			return err
+		}
+		f.Frame, f.raw = frame, nil
+		return nil
+	}
+	return cbor.Unmarshal(b, v)
+}
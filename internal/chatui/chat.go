@@ -0,0 +1,397 @@
+// Package chatui is the terminal chat of the command line client. It is
+// built on the client SDK like any other program would be.
+package chatui
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/marcoantonios1/chat-app/internal/client"
+	sdk "github.com/marcoantonios1/chat-app/pkg/client"
+)
+
+const (
+	// default number of messages fetched by /history
+	defaultHistoryCount = 20
+	// how often a chat retries what is left in its outbox
+	outboxRetryInterval = 10 * time.Second
+	// how long after a message arrives it is marked read
+	readDelay = time.Second
+)
+
+// chat is an interactive conversation with one recipient.
+type chat struct {
+	s         *sdk.Session
+	recipient string
+
+	mu   sync.Mutex
+	sent map[string]*sentMsg
+	// cursor for the next /history page; historyDone is set once the
+	// server reports there are no older messages
+	historyBefore int64
+	historyDone   bool
+
+	// messages are written to the outbox before they are sent, so they
+	// survive a dropped connection; without one they go out directly
+	outbox *client.Outbox
+	// flushMu keeps flushes and outbox edits from interleaving
+	flushMu sync.Mutex
+}
+
+// Chat runs an interactive chat session with recipient, reading what to
+// send from in.
+func Chat(opts sdk.Options, in io.Reader, recipient string) error {
+	opts.KeepMessages = true
+	applyRetention()
+	s, err := sdk.Connect(context.Background(), opts)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	printSystem(fmt.Sprintf("Connected as %s (device %s). Type /quit to exit, /outbox for unsent messages.", meColor(s.ID()), s.Device()))
+
+	c := &chat{s: s, recipient: recipient, sent: make(map[string]*sentMsg)}
+	if c.outbox, err = client.OpenOutbox(s.ID(), recipient); err != nil {
+		printError(fmt.Sprintf("outbox unavailable, messages can't be kept while offline: %v", err))
+	}
+	go c.events()
+	go func() {
+		s.Introduce(context.Background(), recipient)
+		printSystem("Public key sent to " + meColor(recipient))
+	}()
+
+	if c.outbox != nil {
+		if pending, err := c.outbox.List(); err == nil && len(pending) > 0 {
+			printSystem(fmt.Sprintf("Sending %d messages left from an earlier session", len(pending)))
+			c.flush()
+		}
+		// retry what is left every so often, not only when the user types
+		go func() {
+			tick := time.NewTicker(outboxRetryInterval)
+			defer tick.Stop()
+			for {
+				select {
+				case <-s.Done():
+					return
+				case <-tick.C:
+					c.flush()
+				}
+			}
+		}()
+	}
+	return c.input(in)
+}
+
+// applyRetention purges expired messages from the local database before
+// a chat starts.
+func applyRetention() {
+	store, err := client.OpenMessageStore()
+	if err != nil {
+		printError(fmt.Sprintf("message store unavailable: %v", err))
+		return
+	}
+	defer store.Close()
+	if n, err := store.ApplyRetention(); err != nil {
+		printError(fmt.Sprintf("message store retention error: %v", err))
+	} else if n > 0 {
+		printSystem(fmt.Sprintf("Purged %d expired messages", n))
+	}
+}
+
+// input reads commands and messages until /quit or the end of in.
+func (c *chat) input(in io.Reader) error {
+	scanner := bufio.NewScanner(in)
+	for {
+		printPrompt()
+		if !scanner.Scan() {
+			break
+		}
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		if text == "/quit" {
+			printSystem("Goodbye 👋")
+			break
+		}
+		if text == "/history" || strings.HasPrefix(text, "/history ") {
+			c.history(strings.TrimSpace(strings.TrimPrefix(text, "/history")))
+			continue
+		}
+
+		if cmd, arg, _ := strings.Cut(text, " "); c.outbox != nil && outboxCommands[cmd] {
+			c.flushMu.Lock()
+			err := outboxCommand(c.outbox, cmd, strings.TrimSpace(arg))
+			c.flushMu.Unlock()
+			if err != nil {
+				printError(err.Error())
+			} else if cmd == "/retry" {
+				c.flush()
+			}
+			continue
+		}
+
+		msgID := client.NewMessageID()
+		if c.outbox == nil {
+			if err := c.deliver(msgID, text, time.Now()); err != nil {
+				printError(fmt.Sprintf("write error: %v", err))
+			}
+			continue
+		}
+		p, err := c.outbox.Add(msgID, text)
+		if err != nil {
+			printError(fmt.Sprintf("outbox error: %v", err))
+			continue
+		}
+		c.flush()
+		if pending, err := c.outbox.List(); err == nil && isPending(pending, msgID) {
+			sentMsg{Text: p.Text, Timestamp: p.Created, Status: "pending"}.printSent()
+		}
+	}
+	return scanner.Err()
+}
+
+// history fetches and prints the next page of older messages.
+func (c *chat) history(arg string) {
+	n := defaultHistoryCount
+	if arg != "" {
+		v, err := strconv.Atoi(arg)
+		if err != nil || v <= 0 {
+			printError("usage: /history [n]")
+			return
+		}
+		n = v
+	}
+	c.mu.Lock()
+	before, done := c.historyBefore, c.historyDone
+	c.mu.Unlock()
+	if done {
+		printSystem("No older messages")
+		return
+	}
+	msgs, next, err := c.s.History(context.Background(), c.recipient, before, n)
+	if err != nil {
+		printError(fmt.Sprintf("history error: %v", err))
+		return
+	}
+	c.mu.Lock()
+	c.historyBefore, c.historyDone = next, next == 0
+	c.mu.Unlock()
+	if len(msgs) == 0 {
+		printSystem("No older messages")
+		return
+	}
+	printHistory(c.s.ID(), msgs)
+}
+
+// deliver hands a message to the server and records it as sent.
+func (c *chat) deliver(msgID, text string, created time.Time) error {
+	c.mu.Lock()
+	c.sent[msgID] = &sentMsg{Text: text, Timestamp: created, Status: "sent"}
+	c.mu.Unlock()
+	if _, _, err := c.s.SendMessage(context.Background(), sdk.Outgoing{ID: msgID, To: c.recipient, Text: text}); err != nil {
+		c.mu.Lock()
+		delete(c.sent, msgID)
+		c.mu.Unlock()
+		return err
+	}
+	c.mu.Lock()
+	m := *c.sent[msgID]
+	c.mu.Unlock()
+	m.printSent()
+	return nil
+}
+
+// flush sends the outbox in order. It stops at the first message that
+// doesn't go out, so later ones never overtake it, and skips messages
+// that ran out of attempts.
+func (c *chat) flush() {
+	if c.outbox == nil {
+		return
+	}
+	c.flushMu.Lock()
+	defer c.flushMu.Unlock()
+	pending, err := c.outbox.List()
+	if err != nil {
+		printError(fmt.Sprintf("outbox error: %v", err))
+		return
+	}
+	for _, p := range pending {
+		if p.Failed {
+			continue
+		}
+		err := c.deliver(p.MsgID, p.Text, p.Created)
+		if err == nil {
+			if err := c.outbox.Remove(p.MsgID); err != nil {
+				printError(fmt.Sprintf("outbox error: %v", err))
+			}
+			continue
+		}
+		if errors.Is(err, sdk.ErrOffline) {
+			return
+		}
+		if p, err = c.outbox.Attempted(p.MsgID, err); err != nil {
+			printError(fmt.Sprintf("outbox error: %v", err))
+			return
+		}
+		if p.Failed {
+			printError(fmt.Sprintf("giving up on %q after %d attempts: %s. Use /outbox to retry or cancel it.", p.Text, p.Attempts, p.LastError))
+			continue
+		}
+		printError(fmt.Sprintf("write error: %s (attempt %d of %d)", p.LastError, p.Attempts, client.MaxSendAttempts))
+		return
+	}
+}
+
+// events prints what happens in the session until it ends.
+func (c *chat) events() {
+	self := c.s.ID()
+	reconnecting := false
+	for e := range c.s.Events() {
+		switch e := e.(type) {
+		case sdk.Message:
+			if e.From == self {
+				// sent from another of our devices; deliver prints ours
+				if e.Device != c.s.Device() && e.To == c.recipient {
+					sentMsg{Text: e.Text, Timestamp: e.Time, Status: "sent"}.printSent()
+				}
+				break
+			}
+			printIncoming(e.From, e.Text, e.Time)
+			if e.ID != "" {
+				// the message is on screen
+				go func(from, msgID string) {
+					time.Sleep(readDelay)
+					_ = c.s.MarkRead(from, msgID)
+				}(e.From, e.ID)
+			}
+
+		case sdk.Receipt:
+			if e.From == self {
+				break
+			}
+			c.mu.Lock()
+			if msg, ok := c.sent[e.MsgID]; ok && client.StatusRank(string(e.Status)) > client.StatusRank(msg.Status) {
+				msg.Status = string(e.Status)
+				msg.printSent()
+			}
+			c.mu.Unlock()
+
+		case sdk.Presence:
+			printSystem(fmt.Sprintf("Cached public key for %s", meColor(deviceName(e.User, e.Device))))
+
+		case sdk.KeyChange:
+			printSystem(fmt.Sprintf("%s has a new key", meColor(deviceName(e.User, e.Device))))
+
+		case sdk.Connection:
+			switch e.State {
+			case sdk.StateReconnecting:
+				setConnStatus("reconnecting")
+				if reconnecting {
+					printError(fmt.Sprintf("reconnect failed: %v", e.Err))
+				} else {
+					printError(fmt.Sprintf("connection lost: %v", e.Err))
+				}
+				reconnecting = true
+			case sdk.StateConnected, sdk.StateResumed:
+				setConnStatus("")
+				if !reconnecting {
+					break
+				}
+				reconnecting = false
+				if e.State == sdk.StateResumed {
+					printSystem("Reconnected, session resumed")
+				} else {
+					printSystem("Reconnected. Some messages may have been missed, use /history to check")
+				}
+				go c.flush()
+			case sdk.StateOffline:
+				setConnStatus("offline")
+				printError(fmt.Sprintf("reconnect failed: %v. Type /quit to exit.", e.Err))
+			}
+
+		case sdk.DeviceLink:
+			name := e.Name
+			if name == "" {
+				name = "unnamed"
+			}
+			printSystem(fmt.Sprintf("New device %s (%s) wants to link to %s. Approve it with: chatapp devices approve --id %s --target %s",
+				e.Device, name, self, self, e.Device))
+
+		case sdk.Error:
+			printError(e.Err.Error())
+		}
+	}
+}
+
+// deviceName names device of user as the server does.
+func deviceName(user, device string) string {
+	if device == "" {
+		return user
+	}
+	return user + "/" + device
+}
+
+// SendMessages sends every non-empty line of in to recipient without an
+// interactive session. It returns once each message is acknowledged with
+// at least the status wait (queued, which the server sends once it has
+// stored the message, or delivered), or with sdk.ErrAckTimeout when a
+// message is not acknowledged within timeout of being sent; reading in may
+// take as long as it needs. Any other error means a message may not have
+// been sent.
+func SendMessages(opts sdk.Options, in io.Reader, recipient, wait string, timeout time.Duration) error {
+	if r := client.StatusRank(wait); r <= 0 {
+		return fmt.Errorf("cannot wait for status %q", wait)
+	}
+	showPrompt = false
+	opts.KeepMessages = true
+	ctx := context.Background()
+	s, err := sdk.Connect(ctx, opts)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	printSystem(fmt.Sprintf("Connected as %s (device %s)", meColor(s.ID()), s.Device()))
+	go func() {
+		for e := range s.Events() {
+			if e, ok := e.(sdk.Error); ok {
+				printError(e.Err.Error())
+			}
+		}
+	}()
+
+	scanner := bufio.NewScanner(in)
+	n := 0
+	for scanner.Scan() {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		created := time.Now()
+		ackCtx, cancel := context.WithTimeout(ctx, timeout)
+		_, status, err := s.SendMessage(ackCtx, sdk.Outgoing{To: recipient, Text: text, Wait: sdk.Status(wait)})
+		cancel()
+		if errors.Is(err, sdk.ErrAckTimeout) {
+			return fmt.Errorf("%w: message %d is %s", sdk.ErrAckTimeout, n+1, status)
+		}
+		if err != nil {
+			return fmt.Errorf("send error: %w", err)
+		}
+		sentMsg{Text: text, Timestamp: created, Status: string(status)}.printSent()
+		n++
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if n == 0 {
+		return errors.New("nothing to send")
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package chatui
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/marcoantonios1/chat-app/internal/client"
+	sdk "github.com/marcoantonios1/chat-app/pkg/client"
+)
+
+// connect connects id to srv until the test ends.
+func connect(t *testing.T, srv *client.MemoryServer, id string) *sdk.Session {
+	t.Helper()
+	s, err := sdk.Connect(context.Background(), sdk.Options{
+		ID:        id,
+		Transport: sdk.TransportMemory,
+		Server:    srv.Addr(),
+		Keys:      sdk.NewMemoryKeyStore(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestOutboxFlushesAfterReconnect(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	printMu.Lock()
+	console = io.Discard
+	printMu.Unlock()
+	t.Cleanup(func() {
+		printMu.Lock()
+		console = os.Stdout
+		printMu.Unlock()
+	})
+	srv := client.NewMemoryServer()
+	defer srv.Close()
+	alice, bob := connect(t, srv, "alice"), connect(t, srv, "bob")
+	alice.Introduce(context.Background(), "bob")
+
+	outbox, err := client.OpenOutbox("alice", "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &chat{s: alice, recipient: "bob", sent: make(map[string]*sentMsg), outbox: outbox}
+	go c.events()
+
+	srv.Disconnect("alice")
+	waitFor(t, "alice to go offline", func() bool { return !alice.Online() })
+	if err := c.input(strings.NewReader("one\ntwo\nthree\n")); err != nil {
+		t.Fatal(err)
+	}
+	pending, err := outbox.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var texts []string
+	for _, p := range pending {
+		if p.Attempts != 0 || p.Failed {
+			t.Fatalf("being offline counted as an attempt: %+v", p)
+		}
+		texts = append(texts, p.Text)
+	}
+	if got := strings.Join(texts, " "); got != "one two three" {
+		t.Fatalf("outbox holds %q", got)
+	}
+
+	// back online, the chat flushes the outbox by itself; a flush of its
+	// own at the same time must not send anything twice
+	srv.Reconnect("alice")
+	waitFor(t, "alice to reconnect", alice.Online)
+	go c.flush()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var got []string
+	for len(got) < 3 {
+		select {
+		case e := <-bob.Events():
+			if m, ok := e.(sdk.Message); ok && m.From == "alice" {
+				got = append(got, m.Text)
+			}
+		case <-ctx.Done():
+			t.Fatalf("bob got %q", got)
+		}
+	}
+	if fmt.Sprint(got) != "[one two three]" {
+		t.Fatalf("bob got %q, want them in order", got)
+	}
+	quiet := time.After(100 * time.Millisecond)
+	for done := false; !done; {
+		select {
+		case e := <-bob.Events():
+			if m, ok := e.(sdk.Message); ok {
+				t.Fatalf("bob got %q again", m.Text)
+			}
+		case <-quiet:
+			done = true
+		}
+	}
+	waitFor(t, "the outbox to empty", func() bool {
+		pending, err := outbox.List()
+		return err == nil && len(pending) == 0
+	})
+}
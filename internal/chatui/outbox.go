@@ -0,0 +1,75 @@
+package chatui
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/marcoantonios1/chat-app/internal/client"
+)
+
+// interactive commands handled by outboxCommand
+var outboxCommands = map[string]bool{"/outbox": true, "/edit": true, "/cancel": true, "/retry": true}
+
+// outboxCommand runs an interactive outbox command. Pending messages are
+// numbered from 1 in the order /outbox lists them.
+func outboxCommand(o *client.Outbox, cmd, arg string) error {
+	pending, err := o.List()
+	if err != nil {
+		return fmt.Errorf("outbox error: %w", err)
+	}
+	if cmd == "/outbox" {
+		if len(pending) == 0 {
+			printSystem("No pending messages")
+			return nil
+		}
+		printPending(pending)
+		return nil
+	}
+
+	usage := "usage: " + cmd + " <n>"
+	if cmd == "/edit" {
+		usage = "usage: /edit <n> <text>"
+	}
+	num, text, _ := strings.Cut(arg, " ")
+	n, err := strconv.Atoi(num)
+	if err != nil || n < 1 {
+		return errors.New(usage)
+	}
+	if n > len(pending) {
+		return fmt.Errorf("no pending message %d, see /outbox", n)
+	}
+	p := pending[n-1]
+	switch cmd {
+	case "/edit":
+		text = strings.TrimSpace(text)
+		if text == "" {
+			return errors.New(usage)
+		}
+		if err := o.Edit(p.MsgID, text); err != nil {
+			return fmt.Errorf("outbox error: %w", err)
+		}
+		printSystem(fmt.Sprintf("Pending message %d changed", n))
+	case "/cancel":
+		if err := o.Remove(p.MsgID); err != nil {
+			return fmt.Errorf("outbox error: %w", err)
+		}
+		printSystem(fmt.Sprintf("Pending message %d cancelled", n))
+	case "/retry":
+		if err := o.Retry(p.MsgID); err != nil {
+			return fmt.Errorf("outbox error: %w", err)
+		}
+	}
+	return nil
+}
+
+// isPending reports whether msgID is still in the outbox.
+func isPending(pending []client.PendingMessage, msgID string) bool {
+	for _, p := range pending {
+		if p.MsgID == msgID {
+			return true
+		}
+	}
+	return false
+}
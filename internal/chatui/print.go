@@ -0,0 +1,146 @@
+package chatui
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/marcoantonios1/chat-app/internal/client"
+	sdk "github.com/marcoantonios1/chat-app/pkg/client"
+)
+
+type sentMsg struct {
+	Text      string
+	Timestamp time.Time
+	Status    string // "pending", "failed", "sent", "queued", "delivered", "read"
+}
+
+var (
+	printMu    sync.Mutex
+	showPrompt = true // false for sessions nobody types into
+	// where session output goes
+	console       io.Writer = os.Stdout
+	timeFormat              = "15:04"
+	historyFormat           = "Jan 2 15:04"
+	meColor                 = color.New(color.FgGreen).SprintFunc()
+	incomingColor           = color.New(color.FgCyan).SprintFunc()
+	sysColor                = color.New(color.FgYellow).SprintFunc()
+	errColor                = color.New(color.FgRed).SprintFunc()
+	statusIcon              = map[string]string{
+		"sent":      "✅",
+		"queued":    "🕓",
+		"delivered": "📬",
+		"read":      "🟢",
+		"pending":   "⏳",
+		"failed":    "⚠️",
+	}
+
+	// connStatus describes the connection in the prompt; empty while
+	// connected
+	connStatus atomic.Value
+)
+
+func setConnStatus(s string) {
+	connStatus.Store(s)
+}
+
+func currentConnStatus() string {
+	s, _ := connStatus.Load().(string)
+	return s
+}
+
+func printPrompt() {
+	if !showPrompt {
+		return
+	}
+	printMu.Lock()
+	if status := currentConnStatus(); status != "" {
+		fmt.Fprintf(console, "[You · %s]: ", status)
+	} else {
+		fmt.Fprint(console, "[You]: ")
+	}
+	printMu.Unlock()
+}
+
+// printIncoming prints a message from user from.
+func printIncoming(from, text string, at time.Time) {
+	printMu.Lock()
+	fmt.Fprint(console, "\r")
+	fmt.Fprintf(console, "%s %s %s\n", color.HiBlackString(at.Format(timeFormat)), incomingColor(from+":"), text)
+	printMu.Unlock()
+	printPrompt()
+}
+
+func printSystem(msg string) {
+	printMu.Lock()
+	fmt.Fprint(console, "\r")
+	fmt.Fprintln(console, sysColor("ℹ️ "+msg))
+	printMu.Unlock()
+	printPrompt()
+}
+
+func printError(msg string) {
+	printMu.Lock()
+	fmt.Fprint(console, "\r")
+	fmt.Fprintln(console, errColor("❌ "+msg))
+	printMu.Unlock()
+	printPrompt()
+}
+
+func (msg sentMsg) printSent() {
+	printMu.Lock()
+	icon := statusIcon[msg.Status]
+	if icon == "" {
+		icon = "…"
+	}
+	fmt.Fprint(console, "\r")
+	fmt.Fprintf(console, "%s %s %s %s\n",
+		color.HiBlackString(msg.Timestamp.Format(timeFormat)),
+		meColor("You:"),
+		msg.Text,
+		icon,
+	)
+	printMu.Unlock()
+	printPrompt()
+}
+
+// printHistory renders a page of stored messages, oldest first.
+func printHistory(id string, msgs []sdk.Message) {
+	printMu.Lock()
+	fmt.Fprint(console, "\r")
+	for _, m := range msgs {
+		text := m.Text
+		if m.Err != nil {
+			text = errColor("<unable to decrypt>")
+		}
+		who := incomingColor(m.From + ":")
+		if m.From == id {
+			who = meColor("You:")
+		}
+		fmt.Fprintf(console, "%s %s %s\n", color.HiBlackString(m.Time.Format(historyFormat)), who, text)
+	}
+	printMu.Unlock()
+	printPrompt()
+}
+
+// printPending lists pending messages with their numbers.
+func printPending(pending []client.PendingMessage) {
+	printMu.Lock()
+	fmt.Fprint(console, "\r")
+	for i, p := range pending {
+		state := statusIcon["pending"]
+		switch {
+		case p.Failed:
+			state = fmt.Sprintf("%s failed after %d attempts: %s", statusIcon["failed"], p.Attempts, p.LastError)
+		case p.Attempts > 0:
+			state = fmt.Sprintf("%s %d failed attempts, last: %s", state, p.Attempts, p.LastError)
+		}
+		fmt.Fprintf(console, "%2d. %s %s %s\n", i+1, color.HiBlackString(p.Created.Format(timeFormat)), p.Text, state)
+	}
+	printMu.Unlock()
+	printPrompt()
+}
@@ -1,439 +1,89 @@
 package client
 
 import (
-	"bufio"
 	"bytes"
-	"crypto/rand"
-	"crypto/sha256"
-	"encoding/base64"
-	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"net/http"
-	"net/url"
-	"os"
-	"strings"
-	"sync"
 	"time"
 
-	"github.com/fatih/color"
-	"github.com/gorilla/websocket"
-	"golang.org/x/crypto/hkdf"
+	"github.com/marcoantonios1/chat-app/internal/protocol"
 )
 
-type messagePayload struct {
-	Type           string `json:"type,omitempty"`
-	ID             string `json:"id"`
-	Recipient      string `json:"recipient"`
-	Body           string `json:"body,omitempty"`
-	MsgID          string `json:"msg_id,omitempty"`
-	PublicKey      string `json:"public_key,omitempty"`
-	EncryptedKey   string `json:"encrypted_key,omitempty"`
-	IdentityPublic string `json:"identity_public,omitempty"`
-	PublicKeySig   string `json:"public_key_sig,omitempty"`
-}
-
-type sentMsg struct {
-	Text      string
-	Timestamp time.Time
-	Status    string // "sent", "delivered", "read"
-}
-
-var (
-	printMu       sync.Mutex
-	timeFormat    = "15:04"
-	meColor       = color.New(color.FgGreen).SprintFunc()
-	incomingColor = color.New(color.FgCyan).SprintFunc()
-	sysColor      = color.New(color.FgYellow).SprintFunc()
-	errColor      = color.New(color.FgRed).SprintFunc()
-	statusIcon    = map[string]string{
-		"sent":      "✅",
-		"delivered": "📬",
-		"read":      "🟢",
-	}
-	peerKeysMu sync.RWMutex
-	peerKeys   = make(map[string][]byte)
-
-	peerPubMu sync.RWMutex
-	peerPub   = make(map[string][]byte)
-)
+// default number of messages fetched by a history request.
+const defaultHistoryCount = 20
 
-func printPrompt() {
-	printMu.Lock()
-	fmt.Print("[You]: ")
-	printMu.Unlock()
+// statuses only ever move forward; with several recipient devices the
+// same message is acknowledged more than once
+var statusRank = map[string]int{
+	"sent":      0,
+	"queued":    1,
+	"delivered": 2,
+	"read":      3,
 }
 
-func printIncoming(sender, msg, key, id string) {
-	printMu.Lock()
-	defer func() {
-		printMu.Unlock()
-		printPrompt()
-	}()
-
-	if key != "" {
-		// try hex-decoded symmetric key first
-		if kb, err := hex.DecodeString(key); err == nil {
-			decrypted, err := Decrypt(kb, msg)
-			if err == nil {
-				msg = decrypted
-			} else {
-				printError(fmt.Sprintf("decrypt error: %v", err))
-			}
-		} else {
-			// try base64 -> treat as KEM encapsulated ciphertext
-			if ct, err2 := base64.StdEncoding.DecodeString(key); err2 == nil {
-				// need our private key to decapsulate
-				_, priv, err := LoadKeyPair()
-				if err != nil || len(priv) == 0 {
-					printError(fmt.Sprintf("no private key for decapsulation: %v", err))
-				} else {
-					shared, err := DecapsulateWithPriv(priv, ct)
-					if err != nil {
-						printError(fmt.Sprintf("decapsulate error: %v", err))
-					} else {
-						// derive AEAD key from shared secret via HKDF-SHA256
-						salt := makeSalt(sender, id)
-						info := []byte("chat-client-shared-key")
-						h := hkdf.New(sha256.New, shared, salt, info)
-						derived := make([]byte, 32)
-						if _, err := io.ReadFull(h, derived); err != nil {
-							printError(fmt.Sprintf("hkdf error: %v", err))
-						} else {
-							// cache derived key for this sender
-							peerKeysMu.Lock()
-							peerKeys[sender] = append([]byte(nil), derived...)
-							peerKeysMu.Unlock()
-
-							// try decrypting with derived key
-							if dec, err := Decrypt(derived, msg); err == nil {
-								msg = dec
-							} else {
-								printError(fmt.Sprintf("decrypt-with-derived-key error: %v", err))
-							}
-						}
-					}
-				}
-			} else {
-				printError(fmt.Sprintf("key decode error: %v / %v", err, err2))
-			}
-		}
+// StatusRank orders message statuses from sent (0) to read (3); it returns
+// -1 for an unknown status.
+func StatusRank(status string) int {
+	if r, ok := statusRank[status]; ok {
+		return r
 	}
-
-	fmt.Print("\r")
-	fmt.Printf("%s %s %s\n", color.HiBlackString(time.Now().Format(timeFormat)), incomingColor(sender+":"), msg)
-}
-
-func printSystem(msg string) {
-	printMu.Lock()
-	fmt.Print("\r")
-	fmt.Println(sysColor("ℹ️ " + msg))
-	printMu.Unlock()
-	printPrompt()
+	return -1
 }
 
-func printError(msg string) {
-	printMu.Lock()
-	fmt.Print("\r")
-	fmt.Println(errColor("❌ " + msg))
-	printMu.Unlock()
-	printPrompt()
+// ErrAckTimeout is returned when messages were sent but not acknowledged
+// in time.
+var ErrAckTimeout = errors.New("timed out waiting for acknowledgement")
+
+// how long a send waits for the recipient's keys before sending; it sends
+// without them, with a one-off key, if none come
+const keyWait = 2 * time.Second
+
+// addressedTo reports whether a frame that reached device of user id is
+// meant for it. The server also passes on copies encrypted for our other
+// devices, and echoes of our own frames.
+func addressedTo(frame protocol.Frame, id, device string) bool {
+	h := frame.Head()
+	t, ok := frame.(protocol.Targeted)
+	if !ok || h.ID == "" {
+		return true
+	}
+	to, toDevice := t.Target()
+	if toDevice != "" && toDevice != device {
+		return false
+	}
+	fromSelf := h.ID == id
+	if fromSelf && h.Device == device {
+		return false
+	}
+	// frames from other users must be addressed to us; frames from our
+	// other devices are mirrored copies of what they sent
+	return fromSelf || to == "" || to == id
 }
 
-func (msg sentMsg) printSent() {
-	printMu.Lock()
-	icon := statusIcon[msg.Status]
-	if icon == "" {
-		icon = "…"
-	}
-	fmt.Print("\r")
-	fmt.Printf("%s %s %s %s\n",
-		color.HiBlackString(msg.Timestamp.Format(timeFormat)),
-		meColor("You:"),
-		msg.Text,
-		icon,
-	)
-	printMu.Unlock()
-	printPrompt()
-}
-
-func SendAndReceive(rawURL string, id string, recipient string) error {
-	var mu sync.Mutex
-	sentMessages := make(map[string]*sentMsg)
+var ErrIDTaken = fmt.Errorf("id already taken")
 
-	u, err := url.Parse(rawURL)
+// Register claims id on the server and links this installation as its first device.
+func Register(registerURL, id string) error {
+	device, err := GetDeviceID()
 	if err != nil {
-		return fmt.Errorf("dial error: %w", err)
+		return err
 	}
-	q := u.Query()
-	q.Set("id", id)
-	u.RawQuery = q.Encode()
-
-	conn, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	body := map[string]string{"id": id, "device": device, "device_name": DeviceName()}
+	b, err := json.Marshal(body)
 	if err != nil {
-		return fmt.Errorf("dial error: %w", err)
-	}
-	defer conn.Close()
-
-	printSystem(fmt.Sprintf("Connected as %s. Type /quit to exit.", meColor(id)))
-
-	sendPayload := func(body, typ, msgID, to, encryptedKey, publicKey string) error {
-		payload := messagePayload{Type: typ, ID: id, Body: body, Recipient: to, MsgID: msgID, EncryptedKey: encryptedKey, PublicKey: publicKey}
-		b, err := json.Marshal(payload)
-		if err != nil {
-			return fmt.Errorf("marshal error: %w", err)
-		}
-		return conn.WriteMessage(websocket.TextMessage, b)
-	}
-
-	// send a message
-	sendBody := func(body, typ, msgID, key string) error {
-		// 1) if we already have a derived symmetric key for this peer, use it
-		peerKeysMu.RLock()
-		derived, hasDerived := peerKeys[recipient]
-		peerKeysMu.RUnlock()
-		if hasDerived && len(derived) > 0 {
-			ciphertext, err := Encrypt(derived, []byte(body))
-			if err != nil {
-				return err
-			}
-			return sendPayload(ciphertext, typ, msgID, recipient, "", "")
-		}
-
-		// 2) if we have the peer's public key, encapsulate on-demand, cache derived key,
-		//    send KEM ciphertext (base64) in EncryptedKey and send encrypted message
-
-		peerPubMu.RLock()
-		pubb, hasPub := peerPub[recipient]
-		peerPubMu.RUnlock()
-		if hasPub && len(pubb) > 0 {
-			ctKEM, shared, err := EncapsulateWithPub(pubb)
-			if err != nil {
-				return fmt.Errorf("encapsulate error: %w", err)
-			}
-			// derive symmetric key (32 bytes) from KEM shared secret via HKDF-SHA256
-			salt := makeSalt(id, recipient)
-			info := []byte("chat-client-shared-key")
-			h := hkdf.New(sha256.New, shared, salt, info)
-			newDerived := make([]byte, 32)
-			if _, err := io.ReadFull(h, newDerived); err != nil {
-				return fmt.Errorf("hkdf derive error: %w", err)
-			}
-			// cache derived key
-			peerKeysMu.Lock()
-			peerKeys[recipient] = append([]byte(nil), newDerived...)
-			peerKeysMu.Unlock()
-
-			// send encap key to peer (base64) so they can decapsulate
-			enc := base64.StdEncoding.EncodeToString(ctKEM)
-			if err := sendPayload("", "encap_key", "", recipient, enc, ""); err != nil {
-				return fmt.Errorf("send encap_key error: %w", err)
-			}
-
-			// encrypt and send actual message with derived key
-			ciphertext, err := Encrypt(newDerived, []byte(body))
-			if err != nil {
-				return err
-			}
-			return sendPayload(ciphertext, typ, msgID, recipient, "", "")
-		}
-
-		// 3) fallback: use provided symmetric key hex (existing behavior)
-		if key == "" {
-			return fmt.Errorf("no key available and no peer public key to encapsulate")
-		}
-		kb, err := hex.DecodeString(key)
-		if err != nil {
-			return fmt.Errorf("key decode error: %w", err)
-		}
-		ciphertext, err := Encrypt(kb, []byte(body))
-		if err != nil {
-			return err
-		}
-		return sendPayload(ciphertext, typ, msgID, recipient, key, "")
-	}
-
-	pub, _, err := GetKeyPair()
-	if err != nil || len(pub) == 0 {
-		pub, priv, genErr := GenerateKyberKeyPair()
-		if genErr != nil {
-			printError(fmt.Sprintf("key gen error: %v", genErr))
-			return genErr
-		}
-		if saveErr := SaveKeyPair(pub, priv); saveErr != nil {
-			printError(fmt.Sprintf("key save error: %v", saveErr))
-		}
-	}
-
-	b64Pub := base64.StdEncoding.EncodeToString(pub)
-	pubMsg := messagePayload{Type: "pubkey", ID: id, Recipient: recipient, PublicKey: b64Pub}
-	if b, err := json.Marshal(pubMsg); err == nil {
-		if err := conn.WriteMessage(websocket.TextMessage, b); err != nil {
-			printError(fmt.Sprintf("pubkey send error: %v", err))
-		} else {
-			printSystem("Public key sent to " + meColor(recipient))
-		}
-	} else {
-		printError(fmt.Sprintf("pubkey marshal error: %v", err))
-	}
-
-	// read loop
-	go func() {
-		for {
-			_, m, err := conn.ReadMessage()
-			if err != nil {
-				printError(fmt.Sprintf("read error: %v", err))
-				return
-			}
-			var payload messagePayload
-			if err := json.Unmarshal(m, &payload); err != nil {
-				printIncoming("Server", string(m), "", id)
-				continue
-			}
-			if payload.ID == id && payload.Type != "ack" {
-				continue
-			}
-			if payload.Recipient != "" && payload.Recipient != id {
-				continue
-			}
-
-			switch payload.Type {
-			case "ack":
-				if payload.MsgID != "" {
-					mu.Lock()
-					if msg, ok := sentMessages[payload.MsgID]; ok {
-						msg.Status = payload.Body
-						msg.printSent()
-					}
-					mu.Unlock()
-				}
-
-			case "pubkey":
-				printSystem(fmt.Sprintf("Received public key from %s", meColor(payload.ID)))
-
-				ctBytes, err := base64.StdEncoding.DecodeString(payload.EncryptedKey)
-				if err != nil {
-					printError(fmt.Sprintf("public key decode error: %v", err))
-					break
-				}
-
-				peerPubMu.Lock()
-				peerPub[payload.ID] = append([]byte(nil), ctBytes...)
-				peerPubMu.Unlock()
-				printSystem(fmt.Sprintf("Cached public key for %s", meColor(payload.ID)))
-
-			case "encap_key":
-				printSystem(fmt.Sprintf("Received encapsulated key from %s", meColor(payload.ID)))
-				ctBytes, err := base64.StdEncoding.DecodeString(payload.PublicKey)
-				if err != nil {
-					printError(fmt.Sprintf("encap_key decode error from %s: %v", payload.ID, err))
-					break
-				}
-				_, priv, err := LoadKeyPair()
-				if err != nil || len(priv) == 0 {
-					printError(fmt.Sprintf("no private key for decapsulation: %v", err))
-					break
-				}
-
-				shared, err := DecapsulateWithPriv(priv, ctBytes)
-				if err != nil {
-					printError(fmt.Sprintf("decapsulate error from %s: %v", payload.ID, err))
-					break
-				}
-
-				salt := makeSalt(id, recipient)
-				info := []byte("chat-client-shared-key")
-				h := hkdf.New(sha256.New, shared, salt, info)
-				derived := make([]byte, 32)
-				if _, err := io.ReadFull(h, derived); err != nil {
-					printError(fmt.Sprintf("hkdf derive error from %s: %v", payload.ID, err))
-					break
-				}
-				peerKeysMu.Lock()
-				peerKeys[payload.ID] = append([]byte(nil), derived...)
-				peerKeysMu.Unlock()
-				printSystem(fmt.Sprintf("Established shared key with %s", meColor(payload.ID)))
-			default:
-				printIncoming(payload.ID, payload.Body, payload.EncryptedKey, payload.ID)
-				_ = sendPayload("delivered", "ack", payload.MsgID, payload.ID, "", "")
-				// simulate read after receiving
-				go func(mid string, sender string) {
-					time.Sleep(1 * time.Second)
-					_ = sendPayload("read", "ack", mid, sender, "", "")
-				}(payload.MsgID, payload.ID)
-			}
-		}
-	}()
-
-	// write loop
-	scanner := bufio.NewScanner(os.Stdin)
-	for {
-		printPrompt()
-		if !scanner.Scan() {
-			break
-		}
-		text := strings.TrimSpace(scanner.Text())
-		if text == "" {
-			continue
-		}
-		if text == "/quit" {
-			printSystem("Goodbye 👋")
-			break
-		}
-
-		msgID := fmt.Sprintf("%d", time.Now().UnixNano())
-		t := time.Now()
-		kb := make([]byte, 32)
-		if _, err := rand.Read(kb); err != nil {
-			printError(fmt.Sprintf("key gen error: %v", err))
-			continue
-		}
-		keyHex := hex.EncodeToString(kb)
-		if err := sendBody(text, "msg", msgID, keyHex); err != nil {
-			printError(fmt.Sprintf("write error: %v", err))
-			break
-		}
-
-		mu.Lock()
-		sentMessages[msgID] = &sentMsg{Text: text, Timestamp: t, Status: "sent"}
-		m := *sentMessages[msgID]
-		mu.Unlock()
-
-		m.printSent()
+		return fmt.Errorf("marshal error: %w", err)
 	}
-
-	return scanner.Err()
-}
-
-func Listen(url string) error {
-	dialer := websocket.DefaultDialer
-	conn, _, err := dialer.Dial(url, nil)
+	req, err := http.NewRequest(http.MethodPost, registerURL, bytes.NewReader(b))
 	if err != nil {
-		return fmt.Errorf("dial error: %w", err)
+		return fmt.Errorf("url error: %w", err)
 	}
-	defer conn.Close()
-
-	fmt.Println("📡 Connected. Waiting for messages...")
-
-	for {
-		_, msg, err := conn.ReadMessage()
-		if err != nil {
-			return fmt.Errorf("read error: %w", err)
-		}
-		fmt.Println("📨 New message:", string(msg))
-	}
-}
-
-var ErrIDTaken = fmt.Errorf("id already taken")
-
-func Register(registerURL, id string) error {
-	body := map[string]string{"id": id}
-	b, err := json.Marshal(body)
-	if err != nil {
-		return fmt.Errorf("marshal error: %w", err)
+	req.Header.Set("Content-Type", "application/json")
+	if err := withDeviceSecret(req); err != nil {
+		return err
 	}
-	resp, err := http.Post(registerURL, "application/json", bytes.NewReader(b))
+	resp, err := httpClient.Do(req)
 	if err != nil {
 		return fmt.Errorf("post error: %w", err)
 	}
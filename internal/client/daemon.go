@@ -0,0 +1,442 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/marcoantonios1/chat-app/internal/protocol"
+)
+
+// The daemon keeps one session open and serves it to local tools over a
+// Unix socket in the key directory. The socket is only accessible to its
+// owner; whoever can open it acts as the daemon's user.
+//
+// The API is JSON-RPC 2.0, one object per line. Methods:
+//
+//	status                            -> {id, device, connected}
+//	send      {to, text, wait, timeout_ms} -> {msg_id, status}
+//	history   {with, before, limit}   -> {messages: [Event], next_before}
+//	contacts                          -> [Contact]
+//	subscribe                         -> {}, then "event" notifications
+//	                                     with an Event as params
+const daemonSocket = "daemon.sock"
+
+// JSON-RPC error codes; the server-defined ones are in -32000..-32099.
+const (
+	rpcParseError     = -32700
+	rpcMethodNotFound = -32601
+	rpcInvalidParams  = -32602
+	rpcServerError    = -32000
+	rpcAckTimeout     = -32001
+)
+
+// ErrNoDaemon is returned by DialDaemon when no daemon is running.
+var ErrNoDaemon = errors.New("daemon not running")
+
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method,omitempty"` // notifications
+	Params  any             `json:"params,omitempty"`
+	Result  any             `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *rpcError) Error() string { return e.Message }
+
+// DaemonStatus describes a running daemon.
+type DaemonStatus struct {
+	ID        string `json:"id"`
+	Device    string `json:"device"`
+	Connected bool   `json:"connected"`
+}
+
+type sendParams struct {
+	To        string `json:"to"`
+	Text      string `json:"text"`
+	Wait      string `json:"wait,omitempty"`
+	TimeoutMS int64  `json:"timeout_ms,omitempty"`
+}
+
+type sendResult struct {
+	MsgID  string `json:"msg_id"`
+	Status string `json:"status"`
+}
+
+type historyParams struct {
+	With   string `json:"with"`
+	Before int64  `json:"before,omitempty"`
+	Limit  int    `json:"limit,omitempty"`
+}
+
+type historyResult struct {
+	Messages   []Event `json:"messages"`
+	NextBefore int64   `json:"next_before,omitempty"`
+}
+
+// DaemonSocket returns the path of this installation's daemon socket.
+func DaemonSocket() string {
+	return filepath.Join(getKeyDir(), daemonSocket)
+}
+
+// RunDaemon connects t as id and serves the session on the daemon socket
+// until stop is closed or the connection fails for good.
+func RunDaemon(t Transport, id string, stop <-chan struct{}) error {
+	path := DaemonSocket()
+	if c, err := net.Dial("unix", path); err == nil {
+		c.Close()
+		return fmt.Errorf("a daemon is already running on %s", path)
+	}
+	// left behind by a daemon that didn't shut down cleanly
+	_ = os.Remove(path)
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return fmt.Errorf("mkdir key dir: %w", err)
+	}
+
+	store, err := OpenMessageStore()
+	if err != nil {
+		// the daemon works without the message store
+		fmt.Fprintf(os.Stderr, "message store unavailable: %v\n", err)
+	} else {
+		defer store.Close()
+	}
+	s, err := NewSession(t, id, FileKeyStore{}, store)
+	if err != nil {
+		return err
+	}
+	if err := s.Connect(context.Background()); err != nil {
+		return err
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		s.Close()
+		return fmt.Errorf("listen: %w", err)
+	}
+	if err := os.Chmod(path, 0o600); err != nil {
+		l.Close()
+		s.Close()
+		return fmt.Errorf("chmod socket: %w", err)
+	}
+	defer l.Close()
+	fmt.Printf("Daemon for %s (device %s) listening on %s\n", id, s.device, path)
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serveRPC(conn)
+		}
+	}()
+	go func() {
+		select {
+		case <-stop:
+			s.Close()
+		case <-s.closed:
+		}
+	}()
+	err = s.Run()
+	s.Close()
+	return err
+}
+
+// serveRPC answers the requests of one API connection. Requests are
+// handled concurrently, so a slow send doesn't hold up the others.
+func (s *Session) serveRPC(conn net.Conn) {
+	defer conn.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var writeMu sync.Mutex
+	enc := json.NewEncoder(conn)
+	write := func(r rpcResponse) error {
+		r.JSONRPC = "2.0"
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		return enc.Encode(r)
+	}
+
+	dec := json.NewDecoder(bufio.NewReader(conn))
+	for {
+		var req rpcRequest
+		if err := dec.Decode(&req); err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				_ = write(rpcResponse{Error: &rpcError{rpcParseError, err.Error()}})
+			}
+			return
+		}
+		if req.Method == "subscribe" {
+			go s.serveEvents(ctx, req, write, conn)
+			continue
+		}
+		go func() {
+			result, err := s.call(ctx, req)
+			if req.ID == nil {
+				return
+			}
+			resp := rpcResponse{ID: req.ID, Result: result}
+			if err != nil {
+				var re *rpcError
+				switch {
+				case errors.As(err, &re):
+				case errors.Is(err, ErrAckTimeout):
+					re = &rpcError{rpcAckTimeout, err.Error()}
+				default:
+					re = &rpcError{rpcServerError, err.Error()}
+				}
+				resp.Result, resp.Error = nil, re
+			}
+			_ = write(resp)
+		}()
+	}
+}
+
+// serveEvents streams the session's events as notifications until the
+// connection goes away. The connection is closed if the subscription
+// ends, so the subscriber knows it has missed events.
+func (s *Session) serveEvents(ctx context.Context, req rpcRequest, write func(rpcResponse) error, conn net.Conn) {
+	events, cancel := s.Subscribe(listenBuffer)
+	defer cancel()
+	if err := write(rpcResponse{ID: req.ID, Result: struct{}{}}); err != nil {
+		return
+	}
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				conn.Close()
+				return
+			}
+			if err := write(rpcResponse{Method: "event", Params: e}); err != nil {
+				conn.Close()
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// call runs one API method.
+func (s *Session) call(ctx context.Context, req rpcRequest) (any, error) {
+	params := func(v any) error {
+		if len(req.Params) == 0 {
+			return nil
+		}
+		if err := json.Unmarshal(req.Params, v); err != nil {
+			return &rpcError{rpcInvalidParams, err.Error()}
+		}
+		return nil
+	}
+
+	switch req.Method {
+	case "status":
+		return DaemonStatus{ID: s.id, Device: s.device, Connected: s.Online()}, nil
+
+	case "send":
+		var p sendParams
+		if err := params(&p); err != nil {
+			return nil, err
+		}
+		if p.To == "" || strings.TrimSpace(p.Text) == "" {
+			return nil, &rpcError{rpcInvalidParams, "to and text are required"}
+		}
+		if p.Wait == "" {
+			p.Wait = protocol.StatusQueued
+		}
+		if _, ok := statusRank[p.Wait]; !ok {
+			return nil, &rpcError{rpcInvalidParams, fmt.Sprintf("cannot wait for status %q", p.Wait)}
+		}
+		timeout := 10 * time.Second
+		if p.TimeoutMS > 0 {
+			timeout = time.Duration(p.TimeoutMS) * time.Millisecond
+		}
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		msgID, status, err := s.SendMessage(ctx, "", p.To, p.Text, p.Wait)
+		if err != nil {
+			return nil, err
+		}
+		return sendResult{MsgID: msgID, Status: status}, nil
+
+	case "history":
+		var p historyParams
+		if err := params(&p); err != nil {
+			return nil, err
+		}
+		if p.With == "" {
+			return nil, &rpcError{rpcInvalidParams, "with is required"}
+		}
+		if p.Limit <= 0 {
+			p.Limit = defaultHistoryCount
+		}
+		msgs, next, err := s.History(ctx, p.With, p.Before, p.Limit)
+		if err != nil {
+			return nil, err
+		}
+		return historyResult{Messages: msgs, NextBefore: next}, nil
+
+	case "contacts":
+		return s.Contacts()
+	}
+	return nil, &rpcError{rpcMethodNotFound, fmt.Sprintf("unknown method %q", req.Method)}
+}
+
+// DaemonClient calls a running daemon's API. It makes one call at a
+// time.
+type DaemonClient struct {
+	conn   net.Conn
+	enc    *json.Encoder
+	dec    *json.Decoder
+	nextID int
+}
+
+// DialDaemon connects to this installation's daemon.
+func DialDaemon() (*DaemonClient, error) {
+	conn, err := net.DialTimeout("unix", DaemonSocket(), time.Second)
+	if err != nil {
+		return nil, ErrNoDaemon
+	}
+	return &DaemonClient{conn: conn, enc: json.NewEncoder(conn), dec: json.NewDecoder(bufio.NewReader(conn))}, nil
+}
+
+func (d *DaemonClient) Close() error {
+	return d.conn.Close()
+}
+
+// call sends a request and decodes its result into result.
+func (d *DaemonClient) call(method string, params, result any) error {
+	d.nextID++
+	id := json.RawMessage(fmt.Sprint(d.nextID))
+	b, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	if err := d.enc.Encode(rpcRequest{JSONRPC: "2.0", ID: id, Method: method, Params: b}); err != nil {
+		return fmt.Errorf("daemon: %w", err)
+	}
+	for {
+		var resp struct {
+			ID     json.RawMessage `json:"id"`
+			Result json.RawMessage `json:"result"`
+			Error  *rpcError       `json:"error"`
+		}
+		if err := d.dec.Decode(&resp); err != nil {
+			return fmt.Errorf("daemon: %w", err)
+		}
+		if string(resp.ID) != string(id) {
+			continue
+		}
+		if resp.Error != nil {
+			if resp.Error.Code == rpcAckTimeout {
+				return fmt.Errorf("%w (%s)", ErrAckTimeout, resp.Error.Message)
+			}
+			return fmt.Errorf("daemon: %w", resp.Error)
+		}
+		if result == nil {
+			return nil
+		}
+		return json.Unmarshal(resp.Result, result)
+	}
+}
+
+// Status reports who the daemon is connected as.
+func (d *DaemonClient) Status() (DaemonStatus, error) {
+	var st DaemonStatus
+	err := d.call("status", nil, &st)
+	return st, err
+}
+
+// Send sends text to user to and waits up to timeout for an ack with at
+// least the status wait. It returns the message ID.
+func (d *DaemonClient) Send(to, text, wait string, timeout time.Duration) (string, error) {
+	var r sendResult
+	err := d.call("send", sendParams{To: to, Text: text, Wait: wait, TimeoutMS: timeout.Milliseconds()}, &r)
+	return r.MsgID, err
+}
+
+// SendMessages is SendMessages through the daemon: every non-empty line
+// of in goes to recipient, and each must be acknowledged within timeout of
+// being sent.
+func (d *DaemonClient) SendMessages(in io.Reader, recipient, wait string, timeout time.Duration) error {
+	scanner := bufio.NewScanner(in)
+	n := 0
+	for scanner.Scan() {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		if _, err := d.Send(recipient, text, wait, timeout); err != nil {
+			return err
+		}
+		n++
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if n == 0 {
+		return errors.New("nothing to send")
+	}
+	return nil
+}
+
+// History fetches a page of the conversation with user with, oldest
+// first, and the cursor for the page before it (0 when there is none).
+func (d *DaemonClient) History(with string, before int64, limit int) ([]Event, int64, error) {
+	var r historyResult
+	err := d.call("history", historyParams{With: with, Before: before, Limit: limit}, &r)
+	return r.Messages, r.NextBefore, err
+}
+
+// Contacts lists the users the daemon knows.
+func (d *DaemonClient) Contacts() ([]Contact, error) {
+	var r []Contact
+	err := d.call("contacts", nil, &r)
+	return r, err
+}
+
+// Subscribe calls fn with every event until fn fails or the daemon goes
+// away. A nil error from fn keeps the subscription going.
+func (d *DaemonClient) Subscribe(fn func(Event) error) error {
+	if err := d.call("subscribe", nil, nil); err != nil {
+		return err
+	}
+	for {
+		var n struct {
+			Method string `json:"method"`
+			Params Event  `json:"params"`
+		}
+		if err := d.dec.Decode(&n); err != nil {
+			return fmt.Errorf("daemon: %w", err)
+		}
+		if n.Method != "event" {
+			continue
+		}
+		if err := fn(n.Params); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/marcoantonios1/chat-app/internal/protocol"
+)
+
+// dialTestDaemon serves s's API on one end of a pipe and returns a client
+// for the other.
+func dialTestDaemon(t *testing.T, s *Session) *DaemonClient {
+	t.Helper()
+	srv, conn := net.Pipe()
+	go s.serveRPC(srv)
+	t.Cleanup(func() { conn.Close() })
+	return &DaemonClient{conn: conn, enc: json.NewEncoder(conn), dec: json.NewDecoder(bufio.NewReader(conn))}
+}
+
+func TestDaemonSendSubscribeContacts(t *testing.T) {
+	srv := NewMemoryServer()
+	defer srv.Close()
+	alice := startSession(t, srv.Transport(), "alice", nil)
+	bob := startSession(t, srv.Transport(), "bob", nil)
+	d := dialTestDaemon(t, alice.Session)
+
+	st, err := d.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.ID != "alice" || st.Device != alice.device || !st.Connected {
+		t.Fatalf("status %+v", st)
+	}
+
+	// a subscriber on its own connection sees what the session does
+	events := make(chan Event, 64)
+	sub := dialTestDaemon(t, alice.Session)
+	go func() {
+		_ = sub.Subscribe(func(e Event) error {
+			events <- e
+			return nil
+		})
+	}()
+	waitFor(t, "the subscription", func() bool {
+		alice.mu.Lock()
+		defer alice.mu.Unlock()
+		return len(alice.subs) == 2
+	})
+
+	id, err := d.Send("bob", "hi bob", protocol.StatusDelivered, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := bob.next(t, EventMessage, nil); e.MsgID != id || e.Text != "hi bob" {
+		t.Fatalf("bob got %+v, want %s", e, id)
+	}
+	if _, _, err := bob.SendMessage(context.Background(), "", "alice", "hi alice", "sent"); err != nil {
+		t.Fatal(err)
+	}
+	timeout := time.After(5 * time.Second)
+	for seen := 0; seen != 3; {
+		select {
+		case e := <-events:
+			switch {
+			case e.Type == EventMessage && e.MsgID == id && e.From == "alice":
+				seen |= 1
+			case e.Type == EventMessage && e.From == "bob" && e.Text == "hi alice":
+				seen |= 2
+			}
+		case <-timeout:
+			t.Fatal("the subscriber missed the conversation")
+		}
+	}
+
+	contacts, err := d.Contacts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(contacts) != 1 || contacts[0].ID != "bob" || len(contacts[0].Devices) != 1 || contacts[0].Devices[0] != bob.device {
+		t.Fatalf("contacts %+v, want bob and his device", contacts)
+	}
+
+	// requests the daemon can't serve fail on their own
+	if _, err := d.Send("bob", " ", "", time.Second); err == nil {
+		t.Fatal("sent an empty message")
+	}
+	if _, err := d.Send("bob", "hi", "seen", time.Second); err == nil {
+		t.Fatal("waited for an unknown status")
+	}
+	var re *rpcError
+	if err := d.call("shout", nil, nil); !errors.As(err, &re) || re.Code != rpcMethodNotFound {
+		t.Fatalf("unknown method: err = %v", err)
+	}
+	if _, err := d.Status(); err != nil {
+		t.Fatalf("status after failed calls: %v", err)
+	}
+}
+
+func TestDaemonSendTimeout(t *testing.T) {
+	srv := NewMemoryServer()
+	defer srv.Close()
+	alice := startSession(t, srv.Transport(), "alice", nil)
+	d := dialTestDaemon(t, alice.Session)
+
+	// carol is offline, so the message never gets further than queued
+	if _, err := d.Send("carol", "are you there?", protocol.StatusDelivered, 100*time.Millisecond); !errors.Is(err, ErrAckTimeout) {
+		t.Fatalf("Send error = %v, want %v", err, ErrAckTimeout)
+	}
+}
+
+func TestDaemonHistory(t *testing.T) {
+	tr := NewMemoryTransport()
+	bob := startSession(t, tr, "bob", nil)
+	d := dialTestDaemon(t, bob.Session)
+
+	if _, _, err := d.History("", 0, 0); err == nil {
+		t.Fatal("history without a peer")
+	}
+	lost := protocol.NewMessage("bob", "", "lost", "00112233445566778899aabbccddeeff00112233445566778899")
+	lost.ID = "alice"
+	env, _ := protocol.Encode(lost)
+	go func() {
+		for f := range tr.Sent {
+			if req, ok := f.(*protocol.HistoryRequest); ok && req.Recipient == "alice" && req.Before == 9 && req.Limit == defaultHistoryCount {
+				tr.Deliver(protocol.NewHistoryPage("bob", []protocol.HistoryEntry{{Seq: 8, From: "alice", To: "bob", MsgID: "lost", Envelope: env}}, 7))
+				return
+			}
+		}
+	}()
+	events, next, err := d.History("alice", 9, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next != 7 || len(events) != 1 || events[0].MsgID != "lost" || events[0].Error != "unable to decrypt" {
+		t.Fatalf("History = %+v, %d", events, next)
+	}
+}
@@ -0,0 +1,221 @@
+package client
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/marcoantonios1/chat-app/internal/chatrpc"
+)
+
+const (
+	deviceIDFile     = "device_id"
+	deviceSecretFile = "device_secret"
+)
+
+var (
+	deviceMu     sync.Mutex
+	deviceID     string
+	deviceSecret string
+
+	// ErrDevicePending is returned when this device still has to be approved
+	// from one of the user's existing devices.
+	ErrDevicePending = errors.New("device pending approval")
+	// ErrDeviceRevoked is returned when this device has been revoked.
+	ErrDeviceRevoked = errors.New("device revoked")
+)
+
+// Device is one linked device of a user as reported by the server.
+type Device struct {
+	ID       string    `json:"id"`
+	Name     string    `json:"name,omitempty"`
+	Status   string    `json:"status"`
+	Created  time.Time `json:"created"`
+	LastSeen time.Time `json:"last_seen,omitempty"`
+}
+
+// GetDeviceID returns this installation's device ID, creating one on first use.
+// Every device keeps its own keys in its own key directory.
+func GetDeviceID() (string, error) {
+	deviceMu.Lock()
+	defer deviceMu.Unlock()
+	return loadOrCreate(deviceIDFile, "device id", 8, &deviceID)
+}
+
+// GetDeviceSecret returns the secret this installation proves its device
+// ID with, creating one on first use. The server learns it when the device
+// is first seen.
+func GetDeviceSecret() (string, error) {
+	deviceMu.Lock()
+	defer deviceMu.Unlock()
+	return loadOrCreate(deviceSecretFile, "device secret", 32, &deviceSecret)
+}
+
+// loadOrCreate returns the value in file of the key directory, caching it
+// in *cached, and writes n random bytes in hex there if there is none yet.
+// The caller holds deviceMu.
+func loadOrCreate(file, what string, n int, cached *string) (string, error) {
+	if *cached != "" {
+		return *cached, nil
+	}
+
+	dir := getKeyDir()
+	path := filepath.Join(dir, file)
+	b, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		*cached = strings.TrimSpace(string(b))
+		if *cached != "" {
+			return *cached, nil
+		}
+		fallthrough
+	case os.IsNotExist(err):
+		raw := make([]byte, n)
+		if _, err := rand.Read(raw); err != nil {
+			return "", fmt.Errorf("generate %s: %w", what, err)
+		}
+		v := hex.EncodeToString(raw)
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return "", fmt.Errorf("mkdir key dir: %w", err)
+		}
+		if err := os.WriteFile(path, []byte(v), 0o600); err != nil {
+			return "", fmt.Errorf("write %s: %w", what, err)
+		}
+		*cached = v
+		return v, nil
+	default:
+		return "", fmt.Errorf("read %s: %w", what, err)
+	}
+}
+
+// withDeviceSecret adds this device's secret to req, which names the device.
+func withDeviceSecret(req *http.Request) error {
+	secret, err := GetDeviceSecret()
+	if err != nil {
+		return err
+	}
+	req.Header.Set(chatrpc.MetadataDeviceSecret, secret)
+	return nil
+}
+
+// DeviceName returns a human-readable name for this device.
+func DeviceName() string {
+	name, err := os.Hostname()
+	if err != nil || name == "" {
+		return "unknown"
+	}
+	return name
+}
+
+// deviceAddr is the key used for per-device state such as public keys and
+// session keys. Clients that do not announce a device are addressed by id.
+func deviceAddr(id, device string) string {
+	if device == "" {
+		return id
+	}
+	return id + "/" + device
+}
+
+// ListDevices returns the devices linked to id. The request is made as this
+// device, which must already be approved.
+func ListDevices(serverURL, id string) ([]Device, error) {
+	dev, err := GetDeviceID()
+	if err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(strings.TrimRight(serverURL, "/") + "/devices")
+	if err != nil {
+		return nil, fmt.Errorf("url error: %w", err)
+	}
+	q := u.Query()
+	q.Set("id", id)
+	q.Set("device", dev)
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("url error: %w", err)
+	}
+	if err := withDeviceSecret(req); err != nil {
+		return nil, err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("get error: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, responseError("list devices", resp)
+	}
+	var devices []Device
+	if err := json.NewDecoder(resp.Body).Decode(&devices); err != nil {
+		return nil, fmt.Errorf("decode error: %w", err)
+	}
+	return devices, nil
+}
+
+// ApproveDevice links a pending device to id, acting as this device.
+func ApproveDevice(serverURL, id, target string) error {
+	return changeDevice(serverURL, "/devices/approve", id, target)
+}
+
+// RevokeDevice unlinks a device from id and disconnects it, acting as this device.
+func RevokeDevice(serverURL, id, target string) error {
+	return changeDevice(serverURL, "/devices/revoke", id, target)
+}
+
+func changeDevice(serverURL, path, id, target string) error {
+	dev, err := GetDeviceID()
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(map[string]string{"id": id, "device": dev, "target": target})
+	if err != nil {
+		return fmt.Errorf("marshal error: %w", err)
+	}
+	req, err := http.NewRequest(http.MethodPost, strings.TrimRight(serverURL, "/")+path, bytes.NewReader(b))
+	if err != nil {
+		return fmt.Errorf("url error: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if err := withDeviceSecret(req); err != nil {
+		return err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("post error: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return responseError(strings.TrimPrefix(path, "/devices/")+" device", resp)
+	}
+	return nil
+}
+
+// responseError turns a non-success HTTP response into an error carrying the
+// server's explanation.
+func responseError(op string, resp *http.Response) error {
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	text := strings.TrimSpace(string(msg))
+	switch text {
+	case ErrDevicePending.Error():
+		return ErrDevicePending
+	case ErrDeviceRevoked.Error():
+		return ErrDeviceRevoked
+	}
+	if text == "" {
+		text = resp.Status
+	}
+	return fmt.Errorf("%s failed: %s", op, text)
+}
@@ -0,0 +1,69 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/marcoantonios1/chat-app/internal/protocol"
+)
+
+// SoftwareVersion is announced to the server in the hello frame.
+var SoftwareVersion = "chatapp-client/0.1.0"
+
+// maxClockSkew is how far the server clock may drift before we warn:
+// message timestamps and history cursors come from both sides.
+const maxClockSkew = time.Minute
+
+// open dials t as id/device with the device's secret and runs the
+// handshake, resuming the session in rs if it has one. rs may be nil.
+func open(ctx context.Context, t Transport, id, device, secret string, rs *resumeState) (*protocol.Welcome, error) {
+	ctx, cancel := context.WithTimeout(ctx, protocol.HandshakeTimeout)
+	defer cancel()
+	if err := t.Dial(ctx, id, device, secret); err != nil {
+		return nil, err
+	}
+	// a server that never answers hello
+	stop := context.AfterFunc(ctx, func() { _ = t.Close() })
+	welcome, err := handshake(t, id, device, rs)
+	if !stop() && err != nil {
+		err = fmt.Errorf("handshake error: %w", ctx.Err())
+	}
+	if err != nil {
+		_ = t.Close()
+		return nil, err
+	}
+	t.SetFrameLimit(welcome.MaxFrameSize)
+	return welcome, nil
+}
+
+// handshake sends hello on a freshly dialed connection and waits for the
+// server's welcome.
+func handshake(t Transport, id, device string, rs *resumeState) (*protocol.Welcome, error) {
+	hello := protocol.NewHello(SoftwareVersion, protocol.FeatureHistory, protocol.FeatureReceipts, protocol.FeatureDevices, protocol.FeatureResume)
+	hello.ID, hello.Device = id, device
+	if rs != nil {
+		rs.hello(hello)
+	}
+	if err := t.Send(hello); err != nil {
+		return nil, fmt.Errorf("handshake error: %w", err)
+	}
+
+	frame, err := t.Receive()
+	if err != nil {
+		if errors.Is(err, ErrBadFrame) {
+			return nil, fmt.Errorf("handshake error: %w", err)
+		}
+		return nil, err
+	}
+	welcome, ok := frame.(*protocol.Welcome)
+	if !ok {
+		return nil, fmt.Errorf("handshake error: expected welcome, got %s", frame.Kind())
+	}
+
+	if rs != nil {
+		rs.welcome(welcome)
+	}
+	return welcome, nil
+}
@@ -0,0 +1,229 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/marcoantonios1/chat-app/internal/chatrpc"
+	"github.com/marcoantonios1/chat-app/internal/protocol"
+)
+
+// TransportHTTP connects over plain HTTP requests, for networks where
+// websocket upgrades don't get through.
+const TransportHTTP = "http"
+
+// how long POSTing one frame may take
+const streamSendTimeout = 10 * time.Second
+
+var errStreamClosed = errors.New("stream closed by server")
+
+// HTTPTransport connects to the server's /stream endpoint: frames come
+// down a server-sent event stream and go up as one POST each.
+// WebSocketTransport falls back to it when a websocket can't be dialed.
+type HTTPTransport struct {
+	// URL is the stream endpoint, like http://localhost:8080/stream.
+	URL string
+	// TLS configures https:// connections. Nil uses the system roots.
+	TLS *tls.Config
+
+	connState
+	stream *eventStream
+}
+
+func (t *HTTPTransport) Dial(ctx context.Context, id, device, secret string) error {
+	s, err := dialStream(ctx, httpClientFor(t.TLS), t.URL, id, device, secret)
+	if err != nil {
+		return err
+	}
+	t.stream = s
+	t.connected()
+	return nil
+}
+
+func (t *HTTPTransport) Send(f protocol.Frame) error {
+	if err := t.checkSize(f); err != nil {
+		return err
+	}
+	return t.stream.send(f)
+}
+
+func (t *HTTPTransport) Receive() (protocol.Frame, error) {
+	f, err := t.stream.receive()
+	if err != nil && !errors.Is(err, ErrBadFrame) {
+		t.disconnected(err)
+	}
+	return f, err
+}
+
+func (t *HTTPTransport) Close() error {
+	if t.stream == nil {
+		return nil
+	}
+	t.stream.close()
+	t.disconnected(nil)
+	return nil
+}
+
+// streamURL is the stream endpoint of the server with the websocket URL
+// addr. Other URLs are returned as they are.
+func streamURL(addr string) string {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return addr
+	}
+	switch u.Scheme {
+	case "ws":
+		u.Scheme = "http"
+	case "wss":
+		u.Scheme = "https"
+	default:
+		return addr
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/message") + "/stream"
+	u.RawQuery = ""
+	return u.String()
+}
+
+// eventStream is one connection to a stream endpoint.
+type eventStream struct {
+	client   *http.Client
+	endpoint string
+	token    string // names the stream when POSTing
+	body     io.ReadCloser
+	events   *bufio.Reader
+	cancel   context.CancelFunc
+}
+
+// dialStream opens the event stream of id/device and reads the stream's
+// name from it.
+func dialStream(ctx context.Context, client *http.Client, endpoint, id, device, secret string) (*eventStream, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("dial error: %w", err)
+	}
+	q := u.Query()
+	q.Set("id", id)
+	q.Set("device", device)
+	q.Set("device_name", DeviceName())
+	u.RawQuery = q.Encode()
+
+	// the stream outlives ctx, which only bounds dialing
+	streamCtx, cancel := context.WithCancel(context.Background())
+	stop := context.AfterFunc(ctx, cancel)
+	defer stop()
+	req, err := http.NewRequestWithContext(streamCtx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("dial error: %w", err)
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set(chatrpc.MetadataDeviceSecret, secret)
+	resp, err := client.Do(req)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("dial error: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		cancel()
+		return nil, responseError("connect", resp)
+	}
+	s := &eventStream{client: client, endpoint: endpoint, body: resp.Body, events: bufio.NewReader(resp.Body), cancel: cancel}
+	name, data, err := s.next()
+	if err == nil && name != "stream" {
+		err = fmt.Errorf("unexpected %q event", name)
+	}
+	if err != nil {
+		s.close()
+		return nil, fmt.Errorf("dial error: %w", err)
+	}
+	s.token = string(data)
+	return s, nil
+}
+
+// next reads the next event, skipping keepalive comments.
+func (s *eventStream) next() (name string, data []byte, err error) {
+	for {
+		line, err := s.events.ReadBytes('\n')
+		if err != nil {
+			if err == io.EOF {
+				err = errStreamClosed
+			}
+			return "", nil, err
+		}
+		line = bytes.TrimRight(line, "\r\n")
+		if len(line) == 0 {
+			if name != "" || data != nil {
+				return name, data, nil
+			}
+			continue
+		}
+		field, value, _ := bytes.Cut(line, []byte(":"))
+		value = bytes.TrimPrefix(value, []byte(" "))
+		switch string(field) {
+		case "event":
+			name = string(value)
+		case "data":
+			if data != nil {
+				data = append(data, '\n')
+			}
+			data = append(data, value...)
+		}
+	}
+}
+
+// receive returns the next frame on the stream.
+func (s *eventStream) receive() (protocol.Frame, error) {
+	name, data, err := s.next()
+	if err != nil {
+		return nil, err
+	}
+	if name == "refused" {
+		return nil, fmt.Errorf("server rejected connection: %s", data)
+	}
+	f, err := protocol.Decode(data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadFrame, err)
+	}
+	return f, nil
+}
+
+// send POSTs f to the stream. Frames are sent one at a time, so the
+// server sees them in order.
+func (s *eventStream) send(f protocol.Frame) error {
+	b, err := protocol.Encode(f)
+	if err != nil {
+		return fmt.Errorf("encode error: %w", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), streamSendTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.endpoint+"/send?stream="+url.QueryEscape(s.token), bytes.NewReader(b))
+	if err != nil {
+		return fmt.Errorf("send error: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		// the reason is reported by Receive
+		return fmt.Errorf("send error: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return responseError("send", resp)
+	}
+	return nil
+}
+
+func (s *eventStream) close() {
+	s.cancel()
+	_ = s.body.Close()
+}
@@ -0,0 +1,171 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/marcoantonios1/chat-app/internal/chatrpc"
+	"github.com/marcoantonios1/chat-app/internal/protocol"
+)
+
+// streamServer is a server behind a proxy that breaks websocket upgrades:
+// /message answers with wsStatus and wsBody, and /stream works. What
+// clients POST shows up on up; frames sent on down go to the connected
+// client.
+type streamServer struct {
+	*httptest.Server
+	wsStatus int
+	wsBody   string
+	up       chan protocol.Frame
+	down     chan protocol.Frame
+	streams  atomic.Int32
+}
+
+func startStreamServer(t *testing.T, wsStatus int, wsBody string) *streamServer {
+	t.Helper()
+	s := &streamServer{wsStatus: wsStatus, wsBody: wsBody, up: make(chan protocol.Frame, 16), down: make(chan protocol.Frame, 16)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/message", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, s.wsBody, s.wsStatus)
+	})
+	mux.HandleFunc("/stream", s.events)
+	mux.HandleFunc("/stream/send", func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		f, err := protocol.Decode(b)
+		if err != nil || r.URL.Query().Get("stream") != "tok" {
+			http.Error(w, "bad frame", http.StatusBadRequest)
+			return
+		}
+		s.up <- f
+		w.WriteHeader(http.StatusAccepted)
+	})
+	s.Server = httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *streamServer) events(w http.ResponseWriter, r *http.Request) {
+	s.streams.Add(1)
+	q := r.URL.Query()
+	if q.Get("id") != "alice" || q.Get("device") != "a1" || r.Header.Get(chatrpc.MetadataDeviceSecret) != "secret" {
+		http.Error(w, "wrong caller", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	fmt.Fprint(w, "event: stream\ndata: tok\n\n: ping\n\n")
+	w.(http.Flusher).Flush()
+	for seq := 1; ; seq++ {
+		select {
+		case f := <-s.down:
+			b, _ := protocol.Encode(f)
+			fmt.Fprintf(w, "id: %d\ndata: %s\n\n", seq, b)
+			w.(http.Flusher).Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// wsURL is the websocket endpoint of s.
+func (s *streamServer) wsURL() string {
+	return "ws" + strings.TrimPrefix(s.URL, "http") + "/message"
+}
+
+func (s *streamServer) next(t *testing.T) protocol.Frame {
+	t.Helper()
+	select {
+	case f := <-s.up:
+		return f
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing POSTed")
+	}
+	return nil
+}
+
+func TestWebSocketFallsBackToStream(t *testing.T) {
+	srv := startStreamServer(t, http.StatusBadGateway, "upgrade not supported")
+	tr := &WebSocketTransport{URL: srv.wsURL(), Encoding: protocol.SubprotocolCBOR}
+	if err := tr.Dial(context.Background(), "alice", "a1", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+	if tr.stream == nil {
+		t.Fatal("not connected over the stream endpoint")
+	}
+
+	// frames go up in order, one POST each
+	for i := 0; i < 3; i++ {
+		m := protocol.NewMessage("bob", "", fmt.Sprint("m", i), "00")
+		if err := tr.Send(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		if m, ok := srv.next(t).(*protocol.Message); !ok || m.MsgID != fmt.Sprint("m", i) {
+			t.Fatalf("frame %d POSTed as %#v", i, m)
+		}
+	}
+
+	// and come down in order
+	for i := 0; i < 3; i++ {
+		m := protocol.NewMessage("alice", "", fmt.Sprint("r", i), "00")
+		m.ID = "bob"
+		srv.down <- m
+	}
+	for i := 0; i < 3; i++ {
+		f, err := tr.Receive()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m, ok := f.(*protocol.Message); !ok || m.MsgID != fmt.Sprint("r", i) {
+			t.Fatalf("received %#v as frame %d", f, i)
+		}
+	}
+
+	// the stream ending is a disconnect
+	srv.CloseClientConnections()
+	if _, err := tr.Receive(); err == nil {
+		t.Fatal("Receive after the stream closed")
+	}
+}
+
+func TestWebSocketFallbackRefusals(t *testing.T) {
+	for _, c := range []struct {
+		status int
+		body   string
+		want   error
+	}{
+		{http.StatusForbidden, ErrDevicePending.Error(), ErrDevicePending},
+		{http.StatusForbidden, ErrDeviceRevoked.Error(), ErrDeviceRevoked},
+		{http.StatusForbidden, "wrong device secret", nil},
+		{http.StatusUnauthorized, "client certificate required", nil},
+	} {
+		srv := startStreamServer(t, c.status, c.body)
+		tr := &WebSocketTransport{URL: srv.wsURL()}
+		err := tr.Dial(context.Background(), "alice", "a1", "secret")
+		if err == nil || (c.want != nil && !errors.Is(err, c.want)) {
+			t.Fatalf("%d %s: Dial error = %v, want %v", c.status, c.body, err, c.want)
+		}
+		// the stream endpoint would refuse the device just the same
+		if n := srv.streams.Load(); n != 0 {
+			t.Fatalf("%d %s: fell back to the stream endpoint", c.status, c.body)
+		}
+	}
+
+	// nothing to fall back to when nobody answers
+	srv := startStreamServer(t, http.StatusBadGateway, "")
+	url := srv.wsURL()
+	srv.Close()
+	tr := &WebSocketTransport{URL: url}
+	if err := tr.Dial(context.Background(), "alice", "a1", "secret"); err == nil || tr.stream != nil {
+		t.Fatalf("Dial to a closed port: %v", err)
+	}
+}
@@ -3,6 +3,7 @@ package client
 import (
 	"crypto/ed25519"
 	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -12,6 +13,7 @@ import (
 const (
 	identityPubFile  = "identity_ed25519.pub"
 	identityPrivFile = "identity_ed25519.key"
+	storageKeyFile   = "storage.key"
 )
 
 var (
@@ -22,6 +24,9 @@ var (
 	identityMu   sync.RWMutex
 	identityPub  []byte
 	identityPriv []byte
+
+	storageKeyMu sync.Mutex
+	storageKey   []byte
 )
 
 // SaveKeyPair saves the public and private key bytes to files and caches them in memory.
@@ -107,6 +112,12 @@ func getKeyDir() string {
 	return filepath.Join(home, "Desktop", ".chatkeys")
 }
 
+// BotStateFile returns where chatapp bot run keeps the state of bot name
+// running as id.
+func BotStateFile(id, name string) string {
+	return filepath.Join(getKeyDir(), "bots", hex.EncodeToString([]byte(id))+"-"+name+".json")
+}
+
 // GetIdentityKeyPair returns (pub, priv, error). It loads from cache/disk.
 func GetIdentityKeyPair() ([]byte, []byte, error) {
 	identityMu.RLock()
@@ -172,3 +183,39 @@ func LoadIdentityKeyPair() ([]byte, []byte, error) {
 	identityMu.Unlock()
 	return append([]byte(nil), pub...), append([]byte(nil), priv...), nil
 }
+
+// GetStorageKey returns the 32-byte key used to encrypt the local message
+// database, creating and saving one on first use.
+func GetStorageKey() ([]byte, error) {
+	storageKeyMu.Lock()
+	defer storageKeyMu.Unlock()
+	if len(storageKey) > 0 {
+		return append([]byte(nil), storageKey...), nil
+	}
+
+	dir := getKeyDir()
+	path := filepath.Join(dir, storageKeyFile)
+	key, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		if len(key) != 32 {
+			return nil, fmt.Errorf("storage key has invalid length %d", len(key))
+		}
+	case os.IsNotExist(err):
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, fmt.Errorf("generate storage key: %w", err)
+		}
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return nil, fmt.Errorf("mkdir key dir: %w", err)
+		}
+		if err := os.WriteFile(path, key, 0o600); err != nil {
+			return nil, fmt.Errorf("write storage key: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("read storage key: %w", err)
+	}
+
+	storageKey = append([]byte(nil), key...)
+	return key, nil
+}
@@ -0,0 +1,292 @@
+package client
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/marcoantonios1/chat-app/internal/protocol"
+)
+
+// keyring holds the keys of one session: the public keys devices
+// announced and the session keys set up with them, kept per device (see
+// deviceAddr). What has to outlive the session goes to its KeyStore.
+type keyring struct {
+	store KeyStore
+
+	mu       sync.RWMutex
+	peerPub  map[string][]byte
+	peerKeys map[string][]byte
+}
+
+func newKeyring(store KeyStore) *keyring {
+	return &keyring{store: store, peerPub: make(map[string][]byte), peerKeys: make(map[string][]byte)}
+}
+
+// ownPublicKey returns our KEM public key, base64 encoded, generating the
+// key pair on first use.
+func (k *keyring) ownPublicKey() (string, error) {
+	pub, _, err := k.store.KeyPair()
+	if err != nil {
+		return "", fmt.Errorf("key load error: %w", err)
+	}
+	if len(pub) == 0 {
+		var priv []byte
+		pub, priv, err = GenerateKyberKeyPair()
+		if err != nil {
+			return "", fmt.Errorf("key gen error: %w", err)
+		}
+		if err := k.store.SaveKeyPair(pub, priv); err != nil {
+			return "", fmt.Errorf("key save error: %w", err)
+		}
+	}
+	return base64.StdEncoding.EncodeToString(pub), nil
+}
+
+// cachePeerKey records the public key a device announced. It reports
+// whether that key was already known, and whether it replaces a
+// different one; a new key invalidates any session we had with that
+// device.
+func (k *keyring) cachePeerKey(peerAddr, b64Pub string) (known, changed bool, err error) {
+	pubBytes, err := base64.StdEncoding.DecodeString(b64Pub)
+	if err != nil || len(pubBytes) == 0 {
+		return false, false, fmt.Errorf("public key decode error from %s: %v", peerAddr, err)
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	old, had := k.peerPub[peerAddr]
+	if bytes.Equal(old, pubBytes) {
+		return true, false, nil
+	}
+	k.peerPub[peerAddr] = append([]byte(nil), pubBytes...)
+	delete(k.peerKeys, peerAddr)
+	return false, had, nil
+}
+
+// knownDevices lists the devices of id whose public keys we hold. A client
+// that does not announce a device is reported as the empty device.
+func (k *keyring) knownDevices(id string) []string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	var out []string
+	for addr := range k.peerPub {
+		switch {
+		case addr == id:
+			out = append(out, "")
+		case strings.HasPrefix(addr, id+"/"):
+			out = append(out, addr[len(id)+1:])
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// knownUsers lists the users we hold a public key of.
+func (k *keyring) knownUsers() []string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	seen := make(map[string]bool)
+	var out []string
+	for addr := range k.peerPub {
+		user, _, _ := strings.Cut(addr, "/")
+		if !seen[user] {
+			seen[user] = true
+			out = append(out, user)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+func (k *keyring) sessionKey(addr string) ([]byte, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	key, ok := k.peerKeys[addr]
+	return key, ok
+}
+
+func (k *keyring) setSessionKey(addr string, key []byte) {
+	k.mu.Lock()
+	if key == nil {
+		delete(k.peerKeys, addr)
+	} else {
+		k.peerKeys[addr] = append([]byte(nil), key...)
+	}
+	k.mu.Unlock()
+}
+
+// decryptIncoming recovers the plaintext of an incoming message body sent by
+// the device peerAddr of user peerID. key is either a hex symmetric key, a
+// base64 KEM ciphertext, or empty when the body is sealed with the session
+// key already shared with that device.
+func (k *keyring) decryptIncoming(peerID, peerAddr, msg, key, self string) (string, error) {
+	if key == "" {
+		derived, ok := k.sessionKey(peerAddr)
+		if !ok {
+			return "", fmt.Errorf("no session key for %s", peerAddr)
+		}
+		dec, err := Decrypt(derived, msg)
+		if err != nil {
+			return "", fmt.Errorf("decrypt error: %w", err)
+		}
+		return dec, nil
+	}
+
+	// try hex-decoded symmetric key first
+	if kb, err := hex.DecodeString(key); err == nil {
+		dec, err := Decrypt(kb, msg)
+		if err != nil {
+			return "", fmt.Errorf("decrypt error: %w", err)
+		}
+		return dec, nil
+	}
+
+	// try base64 -> treat as KEM encapsulated ciphertext
+	ct, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return "", fmt.Errorf("key decode error: %w", err)
+	}
+	derived, err := k.decapsulateSessionKey(peerID, peerAddr, ct, self)
+	if err != nil {
+		return "", err
+	}
+	dec, err := Decrypt(derived, msg)
+	if err != nil {
+		return "", fmt.Errorf("decrypt-with-derived-key error: %w", err)
+	}
+	return dec, nil
+}
+
+// decapsulateSessionKey recovers the session key peerAddr encapsulated for
+// us and caches it.
+func (k *keyring) decapsulateSessionKey(peerID, peerAddr string, ct []byte, self string) ([]byte, error) {
+	// need our private key to decapsulate
+	_, priv, err := k.store.KeyPair()
+	if err != nil || len(priv) == 0 {
+		return nil, fmt.Errorf("no private key for decapsulation: %v", err)
+	}
+	shared, err := DecapsulateWithPriv(priv, ct)
+	if err != nil {
+		return nil, fmt.Errorf("decapsulate error: %w", err)
+	}
+	derived, err := deriveSessionKey(shared, self, peerAddr)
+	if err != nil {
+		return nil, err
+	}
+	k.setSessionKey(peerAddr, derived)
+	_ = k.store.SaveSessionKey(peerID, derived)
+	return derived, nil
+}
+
+// sessionKeyFor returns the key shared with device peerDevice of peerID,
+// encapsulating a fresh one against its public key if we have none yet.
+// The encapsulated key goes out with send in a frame addressed to user to.
+func (k *keyring) sessionKeyFor(send func(protocol.Frame) error, self, to, peerID, peerDevice string) ([]byte, error) {
+	addr := deviceAddr(peerID, peerDevice)
+	if derived, ok := k.sessionKey(addr); ok {
+		return derived, nil
+	}
+
+	k.mu.RLock()
+	pubb := k.peerPub[addr]
+	k.mu.RUnlock()
+	if len(pubb) == 0 {
+		return nil, fmt.Errorf("no public key for %s", addr)
+	}
+	ctKEM, shared, err := EncapsulateWithPub(pubb)
+	if err != nil {
+		return nil, fmt.Errorf("encapsulate error: %w", err)
+	}
+	derived, err := deriveSessionKey(shared, self, addr)
+	if err != nil {
+		return nil, err
+	}
+	k.setSessionKey(addr, derived)
+	_ = k.store.SaveSessionKey(peerID, derived)
+
+	// send encap key to that device (base64) so it can decapsulate
+	enc := base64.StdEncoding.EncodeToString(ctKEM)
+	if err := send(protocol.NewEncapKey(to, peerDevice, enc)); err != nil {
+		// the device never got the key, so don't use it
+		k.setSessionKey(addr, nil)
+		return nil, fmt.Errorf("send encap_key error: %w", err)
+	}
+	return derived, nil
+}
+
+// sendBody encrypts body separately for every known device of recipient
+// and for our own other devices, so each one can read it, and sends the
+// copies with send.
+func (k *keyring) sendBody(send func(protocol.Frame) error, id, device, recipient, body, msgID string) error {
+	self := deviceAddr(id, device)
+	type target struct{ id, device string }
+	var targets []target
+	for _, d := range k.knownDevices(recipient) {
+		targets = append(targets, target{recipient, d})
+	}
+	for _, d := range k.knownDevices(id) {
+		if d != device {
+			targets = append(targets, target{id, d})
+		}
+	}
+
+	if len(targets) > 0 {
+		for _, t := range targets {
+			key, err := k.sessionKeyFor(send, self, recipient, t.id, t.device)
+			if err != nil {
+				return err
+			}
+			ciphertext, err := Encrypt(key, []byte(body))
+			if err != nil {
+				return err
+			}
+			if err := send(protocol.NewMessage(recipient, t.device, msgID, ciphertext)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// fallback: no peer public key yet, send with a one-off symmetric key
+	kb := make([]byte, 32)
+	if _, err := rand.Read(kb); err != nil {
+		return fmt.Errorf("key gen error: %w", err)
+	}
+	ciphertext, err := Encrypt(kb, []byte(body))
+	if err != nil {
+		return err
+	}
+	m := protocol.NewMessage(recipient, "", msgID, ciphertext)
+	m.EncryptedKey = hex.EncodeToString(kb)
+	return send(m)
+}
+
+// decryptEnvelope recovers the plaintext of a stored message, trying the key
+// carried in the envelope first and then every session key we have derived
+// with each of owners (the conversation peer and, for copies synced between
+// our own devices, ourselves). The server keeps no one-off keys, so
+// messages sent before a key exchange can't be read back from its history.
+func (k *keyring) decryptEnvelope(env *protocol.Message, owners ...string) (string, error) {
+	if env.EncryptedKey != "" {
+		if kb, err := hex.DecodeString(env.EncryptedKey); err == nil {
+			return Decrypt(kb, env.Body)
+		}
+	}
+	for _, owner := range owners {
+		keys, err := k.store.SessionKeys(owner)
+		if err != nil {
+			return "", err
+		}
+		for _, key := range keys {
+			if msg, err := Decrypt(key, env.Body); err == nil {
+				return msg, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("no session key decrypts this message")
+}
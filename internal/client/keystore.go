@@ -0,0 +1,131 @@
+package client
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"sync"
+)
+
+// KeyStore keeps the key material that identifies one client across
+// runs: its device ID and the secret proving it, its KEM key pair, and
+// every session key derived with a peer, so stored messages stay readable.
+type KeyStore interface {
+	// DeviceID returns the device ID, creating one on first use.
+	DeviceID() (string, error)
+	// DeviceSecret returns the device's secret, creating one on first use.
+	DeviceSecret() (string, error)
+	// KeyPair returns the KEM key pair, or nil keys if there is none yet.
+	KeyPair() (pub, priv []byte, err error)
+	SaveKeyPair(pub, priv []byte) error
+	// SessionKeys returns the keys derived with peer, newest first.
+	SessionKeys(peer string) ([][]byte, error)
+	SaveSessionKey(peer string, key []byte) error
+}
+
+// FileKeyStore is the KeyStore of the command line client: files in the
+// key directory, shared by every session of this installation.
+type FileKeyStore struct{}
+
+func (FileKeyStore) DeviceID() (string, error) { return GetDeviceID() }
+
+func (FileKeyStore) DeviceSecret() (string, error) { return GetDeviceSecret() }
+
+func (FileKeyStore) KeyPair() ([]byte, []byte, error) {
+	pub, priv, err := LoadKeyPair()
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil, nil
+	}
+	return pub, priv, err
+}
+
+func (FileKeyStore) SaveKeyPair(pub, priv []byte) error { return SaveKeyPair(pub, priv) }
+
+func (FileKeyStore) SessionKeys(peer string) ([][]byte, error) {
+	return knownSessionKeys(peer), nil
+}
+
+func (FileKeyStore) SaveSessionKey(peer string, key []byte) error {
+	return rememberSessionKey(peer, key)
+}
+
+// MemoryKeyStore is a KeyStore that lives as long as the process, for
+// bots and tests that shouldn't touch the key directory.
+type MemoryKeyStore struct {
+	mu       sync.Mutex
+	device   string
+	secret   string
+	pub      []byte
+	priv     []byte
+	sessions map[string][][]byte // oldest first
+}
+
+// NewMemoryKeyStore returns an empty MemoryKeyStore.
+func NewMemoryKeyStore() *MemoryKeyStore {
+	return &MemoryKeyStore{sessions: make(map[string][][]byte)}
+}
+
+func (m *MemoryKeyStore) DeviceID() (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.device == "" {
+		raw := make([]byte, 8)
+		if _, err := rand.Read(raw); err != nil {
+			return "", fmt.Errorf("generate device id: %w", err)
+		}
+		m.device = hex.EncodeToString(raw)
+	}
+	return m.device, nil
+}
+
+func (m *MemoryKeyStore) DeviceSecret() (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.secret == "" {
+		raw := make([]byte, 32)
+		if _, err := rand.Read(raw); err != nil {
+			return "", fmt.Errorf("generate device secret: %w", err)
+		}
+		m.secret = hex.EncodeToString(raw)
+	}
+	return m.secret, nil
+}
+
+func (m *MemoryKeyStore) KeyPair() ([]byte, []byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.pub, m.priv, nil
+}
+
+func (m *MemoryKeyStore) SaveKeyPair(pub, priv []byte) error {
+	m.mu.Lock()
+	m.pub, m.priv = append([]byte(nil), pub...), append([]byte(nil), priv...)
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *MemoryKeyStore) SessionKeys(peer string) ([][]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	keys := m.sessions[peer]
+	out := make([][]byte, 0, len(keys))
+	for i := len(keys) - 1; i >= 0; i-- {
+		out = append(out, keys[i])
+	}
+	return out, nil
+}
+
+func (m *MemoryKeyStore) SaveSessionKey(peer string, key []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, k := range m.sessions[peer] {
+		if bytes.Equal(k, key) {
+			return nil
+		}
+	}
+	m.sessions[peer] = append(m.sessions[peer], append([]byte(nil), key...))
+	return nil
+}
@@ -1,9 +1,13 @@
 package client
 
 import (
+	"crypto/sha256"
 	"fmt"
+	"io"
+	"strings"
 
 	"github.com/cloudflare/circl/kem/kyber/kyber1024"
+	"golang.org/x/crypto/hkdf"
 )
 
 // GenerateKeyPair returns (publicKeyBytes, privateKeyBytes, error)
@@ -56,8 +60,38 @@ func DecapsulateWithPriv(privBytes, ciphertext []byte) ([]byte, error) {
 
 // helper to create deterministic salt for HKDF
 func makeSalt(a, b string) []byte {
+	a, b = saltName(a), saltName(b)
 	if a < b {
 		return []byte("chat-client-salt:" + a + ":" + b)
 	}
 	return []byte("chat-client-salt:" + b + ":" + a)
-}
\ No newline at end of file
+}
+
+// saltName drops the domain from a federated "user@domain/device" address.
+// The two ends of a federated conversation only agree on each other's
+// domain-less names: a client knows itself as "alice" while its peer knows
+// it as "alice@example.org".
+func saltName(addr string) string {
+	user, device, _ := strings.Cut(addr, "/")
+	if i := strings.LastIndex(user, "@"); i > 0 {
+		user = user[:i]
+	}
+	if device == "" {
+		return user
+	}
+	return user + "/" + device
+}
+
+// deriveSessionKey turns a KEM shared secret between endpoints a and b into a
+// 32-byte AEAD key via HKDF-SHA256. The result does not depend on the order
+// of a and b.
+func deriveSessionKey(shared []byte, a, b string) ([]byte, error) {
+	salt := makeSalt(a, b)
+	info := []byte("chat-client-shared-key")
+	h := hkdf.New(sha256.New, shared, salt, info)
+	derived := make([]byte, 32)
+	if _, err := io.ReadFull(h, derived); err != nil {
+		return nil, fmt.Errorf("hkdf derive error: %w", err)
+	}
+	return derived, nil
+}
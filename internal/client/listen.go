@@ -0,0 +1,79 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// events Listen buffers while its output is blocked
+const listenBuffer = 1024
+
+// Event types published by a Session and written by Listen.
+const (
+	EventMessage    = "message"     // a message to us, or one we sent from another device
+	EventAck        = "ack"         // a status update for a message we sent
+	EventPresence   = "presence"    // a device came online and announced its key
+	EventConnection = "connection"  // our own connection came up or went down
+	EventDeviceLink = "device_link" // a new device asks to be approved
+	EventKeyChange  = "key_change"  // a known device announced a different key
+	EventError      = "error"
+)
+
+// Event is one line of Listen's output.
+type Event struct {
+	Type   string    `json:"type"`
+	Time   time.Time `json:"ts"`
+	From   string    `json:"from,omitempty"`
+	Device string    `json:"device,omitempty"`
+	To     string    `json:"to,omitempty"`
+	MsgID  string    `json:"msg_id,omitempty"`
+	Text   string    `json:"text,omitempty"`
+	Status string    `json:"status,omitempty"`
+	Error  string    `json:"error,omitempty"`
+}
+
+// Listen connects as id and writes every event for it to out, one JSON
+// object per line, until the connection fails for good. Like an
+// interactive session it answers key announcements, decrypts and stores
+// messages, acknowledges their delivery and reconnects after a drop.
+func Listen(t Transport, id string, out io.Writer) error {
+	store, storeErr := OpenMessageStore()
+	if storeErr == nil {
+		defer store.Close()
+	}
+	s, err := NewSession(t, id, FileKeyStore{}, store)
+	if err != nil {
+		return err
+	}
+	events, _ := s.Subscribe(listenBuffer)
+	written := make(chan bool)
+	go func() {
+		enc := json.NewEncoder(out)
+		for e := range events {
+			if err := enc.Encode(e); err != nil {
+				break
+			}
+		}
+		// dropped for falling behind or failing to write, unless the
+		// session ended first
+		lagged := !s.isClosed()
+		s.Close()
+		written <- lagged
+	}()
+	if storeErr != nil {
+		// the session works without the message store
+		s.publish(Event{Type: EventError, Error: fmt.Sprintf("message store unavailable: %v", storeErr)})
+	}
+	if err = s.Connect(context.Background()); err == nil {
+		err = s.Run()
+	}
+	s.Close()
+	if lagged := <-written; lagged && err == nil {
+		err = errors.New("output fell behind, events were lost")
+	}
+	return err
+}
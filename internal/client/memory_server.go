@@ -0,0 +1,194 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/marcoantonios1/chat-app/internal/protocol"
+)
+
+// TransportMemory is the transport kind of MemoryServers; the address is
+// the server's Addr.
+const TransportMemory = "memory"
+
+var (
+	memoryServersMu sync.Mutex
+	memoryServers   = make(map[string]*MemoryServer)
+)
+
+// MemoryServer routes frames between MemoryTransports the way the chat
+// server routes them between connections, so several sessions can talk
+// to each other in one process without a network. Every ID is accepted
+// and approved; frames for a user with no device connected wait until one
+// connects. It keeps no history.
+type MemoryServer struct {
+	addr string
+
+	mu      sync.Mutex
+	conns   []*MemoryTransport
+	pending map[string][]protocol.Frame // per user
+}
+
+// NewMemoryServer returns a MemoryServer that NewTransport can reach
+// under its Addr.
+func NewMemoryServer() *MemoryServer {
+	memoryServersMu.Lock()
+	defer memoryServersMu.Unlock()
+	s := &MemoryServer{
+		addr:    fmt.Sprintf("memory-%d", len(memoryServers)+1),
+		pending: make(map[string][]protocol.Frame),
+	}
+	memoryServers[s.addr] = s
+	return s
+}
+
+// Addr names the server for NewTransport(TransportMemory, addr).
+func (s *MemoryServer) Addr() string {
+	return s.addr
+}
+
+// Transport returns a new transport connected to the server.
+func (s *MemoryServer) Transport() *MemoryTransport {
+	t := NewMemoryTransport()
+	t.server = s
+	s.mu.Lock()
+	s.conns = append(s.conns, t)
+	s.mu.Unlock()
+	return t
+}
+
+// Close disconnects every transport; the server can't be reached any
+// more.
+func (s *MemoryServer) Close() {
+	memoryServersMu.Lock()
+	delete(memoryServers, s.addr)
+	memoryServersMu.Unlock()
+	s.mu.Lock()
+	conns := s.conns
+	s.conns = nil
+	s.mu.Unlock()
+	for _, t := range conns {
+		t.Drop(errMemoryClosed)
+	}
+}
+
+// errMemoryOffline fails the dials of a user cut off with Disconnect.
+var errMemoryOffline = errors.New("memory server unreachable")
+
+// Disconnect breaks the connections of user id as a network failure
+// would, and fails their dials until Reconnect.
+func (s *MemoryServer) Disconnect(id string) {
+	for _, t := range s.transportsOf(id) {
+		t.FailDials(errMemoryOffline)
+		t.Drop(errMemoryOffline)
+	}
+}
+
+// Reconnect lets the transports of user id dial again.
+func (s *MemoryServer) Reconnect(id string) {
+	for _, t := range s.transportsOf(id) {
+		t.FailDials(nil)
+	}
+}
+
+// transportsOf returns the transports that have dialed as user id.
+func (s *MemoryServer) transportsOf(id string) []*MemoryTransport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []*MemoryTransport
+	for _, t := range s.conns {
+		if user, _, _ := t.who(); user == id {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+func memoryServer(addr string) (*MemoryServer, error) {
+	memoryServersMu.Lock()
+	defer memoryServersMu.Unlock()
+	s, ok := memoryServers[addr]
+	if !ok {
+		return nil, fmt.Errorf("no memory server %q", addr)
+	}
+	return s, nil
+}
+
+// who returns the user and device a transport is connected as, and
+// whether it is connected.
+func (t *MemoryTransport) who() (string, string, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.id, t.device, t.in != nil
+}
+
+// online returns the connected transports of user id, except skip.
+func (s *MemoryServer) online(id string, skip *MemoryTransport) []*MemoryTransport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []*MemoryTransport
+	for _, t := range s.conns {
+		if user, _, ok := t.who(); ok && user == id && t != skip {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+// attached hands a transport that finished its handshake what was
+// waiting for its user.
+func (s *MemoryServer) attached(t *MemoryTransport) {
+	id, _, _ := t.who()
+	s.mu.Lock()
+	frames := s.pending[id]
+	delete(s.pending, id)
+	s.mu.Unlock()
+	for _, f := range frames {
+		t.Deliver(f)
+	}
+}
+
+// route passes on a frame from t. Targeted frames go to the devices of
+// their recipient and, when meant for all of them, to the sender's other
+// devices; messages are acknowledged to the sender as the server would.
+func (s *MemoryServer) route(from *MemoryTransport, f protocol.Frame) {
+	id, device, _ := from.who()
+	h := f.Head()
+	h.ID, h.Device = id, device
+
+	if _, ok := f.(*protocol.HistoryRequest); ok {
+		from.Deliver(protocol.NewHistoryPage(id, nil, 0))
+		return
+	}
+	t, ok := f.(protocol.Targeted)
+	if !ok {
+		return
+	}
+	to, toDevice := t.Target()
+	delivered := false
+	for _, c := range s.online(to, from) {
+		if _, d, _ := c.who(); toDevice == "" || d == toDevice {
+			c.Deliver(f)
+			delivered = true
+		}
+	}
+	if toDevice == "" && to != id {
+		for _, c := range s.online(id, from) {
+			c.Deliver(f)
+		}
+	}
+	if !delivered && toDevice == "" {
+		s.mu.Lock()
+		s.pending[to] = append(s.pending[to], f)
+		s.mu.Unlock()
+	}
+
+	if m, ok := f.(*protocol.Message); ok && m.MsgID != "" {
+		status := protocol.StatusQueued
+		if delivered {
+			status = protocol.StatusDelivered
+		}
+		from.Deliver(protocol.NewAck(to, m.MsgID, status))
+	}
+}
@@ -0,0 +1,169 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/marcoantonios1/chat-app/internal/protocol"
+)
+
+// errMemoryClosed is returned by a MemoryTransport that is not connected.
+var errMemoryClosed = errors.New("memory transport closed")
+
+// MemoryTransport is an in-memory Transport for exercising session logic
+// without a server. It answers hello with a welcome on its own; every
+// other frame the client sends shows up on Sent, and Deliver hands frames
+// to the client. Frames go through the JSON encoding both ways, so invalid
+// frames fail as they would on a real connection.
+type MemoryTransport struct {
+	// Sent receives the frames the client sends, hello excepted, unless
+	// the transport belongs to a MemoryServer.
+	Sent chan protocol.Frame
+	// Welcome answers hello; nil uses a default welcome.
+	Welcome *protocol.Welcome
+
+	connState
+	mu      sync.Mutex
+	in      chan protocol.Frame
+	dropped chan error
+	dialErr error
+	dials   int
+	// who dialed, and the server the transport belongs to, if any
+	id, device string
+	server     *MemoryServer
+}
+
+// NewMemoryTransport returns a disconnected MemoryTransport.
+func NewMemoryTransport() *MemoryTransport {
+	return &MemoryTransport{Sent: make(chan protocol.Frame, 256)}
+}
+
+// FailDials makes the next dials fail with err, until it is called with nil.
+func (t *MemoryTransport) FailDials(err error) {
+	t.mu.Lock()
+	t.dialErr = err
+	t.mu.Unlock()
+}
+
+// Dials returns how many times the transport connected.
+func (t *MemoryTransport) Dials() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.dials
+}
+
+func (t *MemoryTransport) Dial(ctx context.Context, id, device, secret string) error {
+	t.mu.Lock()
+	if t.dialErr != nil {
+		err := t.dialErr
+		t.mu.Unlock()
+		return err
+	}
+	t.in = make(chan protocol.Frame, 256)
+	t.dropped = make(chan error, 1)
+	t.dials++
+	t.id, t.device = id, device
+	t.mu.Unlock()
+	t.connected()
+	return nil
+}
+
+// channels returns the current connection's channels, nil if not dialed.
+func (t *MemoryTransport) channels() (chan protocol.Frame, chan error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.in, t.dropped
+}
+
+func (t *MemoryTransport) Send(f protocol.Frame) error {
+	in, _ := t.channels()
+	if in == nil {
+		return errMemoryClosed
+	}
+	if err := t.checkSize(f); err != nil {
+		return err
+	}
+	f, err := roundTrip(f)
+	if err != nil {
+		return err
+	}
+	if _, ok := f.(*protocol.Hello); ok {
+		w := t.Welcome
+		if w == nil {
+			w = &protocol.Welcome{
+				Version:      protocol.Version,
+				Suite:        protocol.SuiteKyberAESGCM,
+				MaxFrameSize: protocol.MaxFrameSize,
+				Features:     []string{protocol.FeatureHistory, protocol.FeatureReceipts, protocol.FeatureDevices},
+			}
+		}
+		welcome := *w
+		welcome.ServerTime = time.Now().UnixMilli()
+		t.Deliver(&welcome)
+		if t.server != nil {
+			t.server.attached(t)
+		}
+		return nil
+	}
+	if t.server != nil {
+		t.server.route(t, f)
+		return nil
+	}
+	t.Sent <- f
+	return nil
+}
+
+// Deliver queues f for the client's Receive. It is dropped when the
+// transport is not connected.
+func (t *MemoryTransport) Deliver(f protocol.Frame) {
+	in, _ := t.channels()
+	if in == nil {
+		return
+	}
+	if f, err := roundTrip(f); err == nil {
+		in <- f
+	}
+}
+
+// Drop breaks the connection as a network failure would: Receive returns
+// err and the client has to dial again.
+func (t *MemoryTransport) Drop(err error) {
+	t.mu.Lock()
+	dropped := t.dropped
+	t.in, t.dropped = nil, nil
+	t.mu.Unlock()
+	if dropped != nil {
+		dropped <- err
+	}
+}
+
+func (t *MemoryTransport) Receive() (protocol.Frame, error) {
+	in, dropped := t.channels()
+	if in == nil {
+		return nil, errMemoryClosed
+	}
+	select {
+	case f := <-in:
+		return f, nil
+	case err := <-dropped:
+		t.disconnected(err)
+		return nil, err
+	}
+}
+
+func (t *MemoryTransport) Close() error {
+	t.Drop(errMemoryClosed)
+	t.disconnected(nil)
+	return nil
+}
+
+// roundTrip encodes and decodes f as the wire would.
+func roundTrip(f protocol.Frame) (protocol.Frame, error) {
+	b, err := protocol.Encode(f)
+	if err != nil {
+		return nil, err
+	}
+	return protocol.Decode(b)
+}
@@ -0,0 +1,188 @@
+package client
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	outboxDir = "outbox"
+	// MaxSendAttempts is how often a message is tried before it is marked
+	// failed; being offline doesn't count as an attempt
+	MaxSendAttempts = 5
+)
+
+// PendingMessage is a message composed but not yet handed to the server.
+type PendingMessage struct {
+	MsgID     string    `json:"msg_id"`
+	Text      string    `json:"text"`
+	Created   time.Time `json:"created"`
+	Attempts  int       `json:"attempts,omitempty"`
+	LastError string    `json:"last_error,omitempty"`
+	Failed    bool      `json:"failed,omitempty"` // out of attempts, skipped by flushes
+}
+
+// Outbox keeps the pending messages of one conversation on disk, in the
+// order they were written, so nothing typed is lost to a dropped
+// connection or a restart. The file is encrypted with the storage key and
+// rewritten whole on every change; an outbox only holds a few messages.
+type Outbox struct {
+	mu   sync.Mutex
+	path string
+	key  []byte
+}
+
+// OpenOutbox opens (creating if needed) the outbox of owner's conversation
+// with peer.
+func OpenOutbox(owner, peer string) (*Outbox, error) {
+	key, err := GetStorageKey()
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Join(getKeyDir(), outboxDir, hex.EncodeToString([]byte(owner)))
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("mkdir outbox: %w", err)
+	}
+	return &Outbox{path: filepath.Join(dir, hex.EncodeToString([]byte(peer))+".enc"), key: key}, nil
+}
+
+// Add queues text under msgID.
+func (o *Outbox) Add(msgID, text string) (PendingMessage, error) {
+	m := PendingMessage{MsgID: msgID, Text: text, Created: time.Now()}
+	return m, o.update(func(msgs []PendingMessage) ([]PendingMessage, error) {
+		return append(msgs, m), nil
+	})
+}
+
+// List returns the pending messages, oldest first.
+func (o *Outbox) List() ([]PendingMessage, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.readLocked()
+}
+
+// Edit replaces the text of a pending message. A failed message gets its
+// attempts back.
+func (o *Outbox) Edit(msgID, text string) error {
+	return o.update(func(msgs []PendingMessage) ([]PendingMessage, error) {
+		i := indexPending(msgs, msgID)
+		if i < 0 {
+			return nil, fmt.Errorf("no pending message %s", msgID)
+		}
+		msgs[i].Text = text
+		msgs[i].Attempts, msgs[i].Failed, msgs[i].LastError = 0, false, ""
+		return msgs, nil
+	})
+}
+
+// Retry gives a failed message its attempts back.
+func (o *Outbox) Retry(msgID string) error {
+	return o.update(func(msgs []PendingMessage) ([]PendingMessage, error) {
+		i := indexPending(msgs, msgID)
+		if i < 0 {
+			return nil, fmt.Errorf("no pending message %s", msgID)
+		}
+		msgs[i].Attempts, msgs[i].Failed, msgs[i].LastError = 0, false, ""
+		return msgs, nil
+	})
+}
+
+// Remove drops a message from the outbox, once it is sent or cancelled.
+func (o *Outbox) Remove(msgID string) error {
+	return o.update(func(msgs []PendingMessage) ([]PendingMessage, error) {
+		i := indexPending(msgs, msgID)
+		if i < 0 {
+			return nil, fmt.Errorf("no pending message %s", msgID)
+		}
+		return append(msgs[:i], msgs[i+1:]...), nil
+	})
+}
+
+// Attempted records a failed attempt at sending a message and returns it
+// as updated, marked failed once it runs out of attempts.
+func (o *Outbox) Attempted(msgID string, sendErr error) (PendingMessage, error) {
+	var m PendingMessage
+	err := o.update(func(msgs []PendingMessage) ([]PendingMessage, error) {
+		i := indexPending(msgs, msgID)
+		if i < 0 {
+			return nil, fmt.Errorf("no pending message %s", msgID)
+		}
+		msgs[i].Attempts++
+		msgs[i].LastError = sendErr.Error()
+		msgs[i].Failed = msgs[i].Attempts >= MaxSendAttempts
+		m = msgs[i]
+		return msgs, nil
+	})
+	return m, err
+}
+
+func indexPending(msgs []PendingMessage, msgID string) int {
+	for i, m := range msgs {
+		if m.MsgID == msgID {
+			return i
+		}
+	}
+	return -1
+}
+
+// update rewrites the outbox with what fn makes of its messages.
+func (o *Outbox) update(fn func([]PendingMessage) ([]PendingMessage, error)) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	msgs, err := o.readLocked()
+	if err != nil {
+		return err
+	}
+	if msgs, err = fn(msgs); err != nil {
+		return err
+	}
+	return o.writeLocked(msgs)
+}
+
+func (o *Outbox) readLocked() ([]PendingMessage, error) {
+	b, err := os.ReadFile(o.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("read outbox: %w", err)
+	}
+	plain, err := Decrypt(o.key, strings.TrimSpace(string(b)))
+	if err != nil {
+		return nil, fmt.Errorf("decrypt outbox: %w", err)
+	}
+	var msgs []PendingMessage
+	if err := json.Unmarshal([]byte(plain), &msgs); err != nil {
+		return nil, fmt.Errorf("decode outbox: %w", err)
+	}
+	return msgs, nil
+}
+
+// writeLocked atomically replaces the outbox file, removing it when empty.
+func (o *Outbox) writeLocked(msgs []PendingMessage) error {
+	if len(msgs) == 0 {
+		if err := os.Remove(o.path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("remove outbox: %w", err)
+		}
+		return nil
+	}
+	b, err := json.Marshal(msgs)
+	if err != nil {
+		return fmt.Errorf("marshal outbox: %w", err)
+	}
+	enc, err := Encrypt(o.key, b)
+	if err != nil {
+		return fmt.Errorf("encrypt outbox: %w", err)
+	}
+	tmp := o.path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(enc+"\n"), 0o600); err != nil {
+		return fmt.Errorf("write outbox: %w", err)
+	}
+	return os.Rename(tmp, o.path)
+}
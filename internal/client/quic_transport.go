@@ -0,0 +1,268 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/marcoantonios1/chat-app/internal/chatquic"
+	"github.com/marcoantonios1/chat-app/internal/protocol"
+	"github.com/quic-go/quic-go"
+)
+
+// TransportQUIC connects over QUIC, which copes better with lossy
+// networks: conversations don't hold each other up, redials skip a round
+// trip with 0-RTT, and the connection survives address changes.
+const TransportQUIC = "quic"
+
+// most conversation streams the client opens on one connection; frames of
+// further conversations go on the control stream
+const maxQUICStreams = 64
+
+var errQUICClosed = errors.New("connection closed")
+
+// QUICTransport connects to the server's QUIC endpoint (see package
+// chatquic).
+type QUICTransport struct {
+	Addr string
+	// TLS configures the connection, e.g. RootCAs trusting a self-signed
+	// server certificate. Nil uses the system roots.
+	TLS *tls.Config
+
+	connState
+	tlsConf *tls.Config // TLS with the ALPN and a session cache for 0-RTT
+
+	mu      sync.Mutex
+	id      string
+	conn    *quic.Conn
+	ctrl    *quic.Stream
+	streams map[string]*quic.SendStream // nil: on the control stream
+	paths   []*quic.Transport           // sockets of the connection, the first dialed
+	in      chan quicFrame
+	done    chan struct{}
+}
+
+// quicFrame is a frame, or the error that ended the connection.
+type quicFrame struct {
+	f   protocol.Frame
+	err error
+}
+
+func (t *QUICTransport) Dial(ctx context.Context, id, device, secret string) error {
+	if t.tlsConf == nil {
+		c := &tls.Config{}
+		if t.TLS != nil {
+			c = t.TLS.Clone()
+		}
+		c.NextProtos = []string{chatquic.ALPN}
+		if c.ServerName == "" {
+			c.ServerName, _, _ = net.SplitHostPort(t.Addr)
+		}
+		if c.ClientSessionCache == nil {
+			// kept across dials, so reconnects resume with 0-RTT
+			c.ClientSessionCache = tls.NewLRUClientSessionCache(4)
+		}
+		t.tlsConf = c
+	}
+	// the socket is ours rather than quic-go's single-use one, so
+	// Migrate can add paths next to it
+	addr, err := net.ResolveUDPAddr("udp", t.Addr)
+	if err != nil {
+		return fmt.Errorf("dial error: %w", err)
+	}
+	udp, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return fmt.Errorf("dial error: %w", err)
+	}
+	tr := &quic.Transport{Conn: udp}
+	conn, err := tr.DialEarly(ctx, addr, t.tlsConf, chatquic.Config(chatquic.DefaultIdleTimeout))
+	if err != nil {
+		_ = tr.Close()
+		return fmt.Errorf("dial error: %w", err)
+	}
+	ctrl, err := conn.OpenStream()
+	if err == nil {
+		err = chatquic.WritePreface(ctrl, chatquic.Preface{ID: id, Device: device, DeviceName: DeviceName(), DeviceSecret: secret})
+	}
+	if err != nil {
+		_ = conn.CloseWithError(chatquic.CodeClosed, "")
+		_ = tr.Close()
+		return fmt.Errorf("dial error: %w", err)
+	}
+
+	in, done := make(chan quicFrame, 256), make(chan struct{})
+	t.mu.Lock()
+	t.id, t.conn, t.ctrl = id, conn, ctrl
+	t.paths = []*quic.Transport{tr}
+	t.streams = make(map[string]*quic.SendStream)
+	t.in, t.done = in, done
+	t.mu.Unlock()
+
+	// a reader per stream; the control stream's error ends the connection
+	go t.read(bufio.NewReader(ctrl), in, done, true)
+	go func() {
+		for {
+			s, err := conn.AcceptUniStream(conn.Context())
+			if err != nil {
+				return
+			}
+			go t.read(bufio.NewReader(s), in, done, false)
+		}
+	}()
+	t.connected()
+	return nil
+}
+
+// read passes the frames on one stream to Receive.
+func (t *QUICTransport) read(r *bufio.Reader, in chan<- quicFrame, done <-chan struct{}, control bool) {
+	for {
+		var next quicFrame
+		b, err := chatquic.ReadRecord(r, protocol.MaxFrameSize)
+		if err == nil {
+			next.f, err = protocol.CBOR.Unmarshal(b)
+			if err != nil {
+				err = fmt.Errorf("%w: %v", ErrBadFrame, err)
+			}
+		} else if !control {
+			return
+		} else {
+			err = quicError(err)
+		}
+		next.err = err
+		select {
+		case in <- next:
+		case <-done:
+			return
+		}
+		if next.f == nil && !errors.Is(err, ErrBadFrame) {
+			return
+		}
+	}
+}
+
+func (t *QUICTransport) Send(f protocol.Frame) error {
+	if err := t.checkSize(f); err != nil {
+		return err
+	}
+	b, err := protocol.CBOR.Marshal(f)
+	if err != nil {
+		return fmt.Errorf("encode error: %w", err)
+	}
+	t.mu.Lock()
+	conn, w := t.conn, io.Writer(t.ctrl)
+	if conn == nil {
+		t.mu.Unlock()
+		return errQUICClosed
+	}
+	if key := chatquic.Conversation(f, t.id); key != "" {
+		s, ok := t.streams[key]
+		if !ok && len(t.streams) < maxQUICStreams {
+			s, _ = conn.OpenUniStream()
+		}
+		t.streams[key] = s
+		if s != nil {
+			w = s
+		}
+	}
+	t.mu.Unlock()
+	if err := chatquic.WriteRecord(w, b); err != nil {
+		// the reason is reported by Receive
+		return fmt.Errorf("send error: %w", err)
+	}
+	return nil
+}
+
+func (t *QUICTransport) Receive() (protocol.Frame, error) {
+	t.mu.Lock()
+	in, done := t.in, t.done
+	t.mu.Unlock()
+	if in == nil {
+		return nil, errQUICClosed
+	}
+	select {
+	case next := <-in:
+		if next.err != nil && !errors.Is(next.err, ErrBadFrame) {
+			t.disconnected(next.err)
+		}
+		return next.f, next.err
+	case <-done:
+		return nil, errQUICClosed
+	}
+}
+
+// Migrate moves the connection to a new local UDP socket, as when the
+// device changed networks, without reconnecting.
+func (t *QUICTransport) Migrate(ctx context.Context) error {
+	t.mu.Lock()
+	conn := t.conn
+	t.mu.Unlock()
+	if conn == nil {
+		return errQUICClosed
+	}
+	udp, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return fmt.Errorf("migrate error: %w", err)
+	}
+	tr := &quic.Transport{Conn: udp}
+	path, err := conn.AddPath(tr)
+	if err == nil {
+		if err = path.Probe(ctx); err == nil {
+			err = path.Switch()
+		}
+	}
+	if err != nil {
+		_ = tr.Close()
+		return fmt.Errorf("migrate error: %w", err)
+	}
+	t.mu.Lock()
+	t.paths = append(t.paths, tr)
+	t.mu.Unlock()
+	return nil
+}
+
+func (t *QUICTransport) Close() error {
+	t.mu.Lock()
+	conn, done, paths := t.conn, t.done, t.paths
+	t.conn, t.ctrl, t.streams, t.paths = nil, nil, nil, nil
+	t.mu.Unlock()
+	if conn == nil {
+		return nil
+	}
+	close(done)
+	err := conn.CloseWithError(chatquic.CodeClosed, "")
+	for _, tr := range paths {
+		_ = tr.Close()
+	}
+	t.disconnected(nil)
+	return err
+}
+
+// quicError turns the close codes the server uses to refuse a connection
+// into the errors the websocket transport returns.
+func quicError(err error) error {
+	var ae *quic.ApplicationError
+	if !errors.As(err, &ae) || !ae.Remote {
+		return err
+	}
+	code := int(ae.ErrorCode)
+	switch {
+	case ae.ErrorCode == chatquic.CodeRefused:
+		switch ae.ErrorMessage {
+		case ErrDevicePending.Error():
+			return ErrDevicePending
+		case ErrDeviceRevoked.Error():
+			return ErrDeviceRevoked
+		}
+		return fmt.Errorf("connect failed: %s", ae.ErrorMessage)
+	case code >= protocol.CloseHandshakeRequired && code <= protocol.CloseNoCommonSuite:
+		return fmt.Errorf("server rejected connection: %s", ae.ErrorMessage)
+	case ae.ErrorMessage != "":
+		return fmt.Errorf("connection closed by server: %s", ae.ErrorMessage)
+	}
+	return err
+}
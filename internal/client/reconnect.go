@@ -0,0 +1,105 @@
+package client
+
+import (
+	"errors"
+	"math/rand/v2"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/marcoantonios1/chat-app/internal/protocol"
+)
+
+const (
+	// first and longest wait between reconnect attempts
+	reconnectMin = 500 * time.Millisecond
+	reconnectMax = 30 * time.Second
+)
+
+// ErrOffline is returned for frames sent while the connection is down.
+var ErrOffline = errors.New("not connected")
+
+// backoff returns how long to wait before reconnect attempt n (counting
+// from 0): doubling from reconnectMin up to reconnectMax, with the upper
+// half jittered so clients dropped together don't return together.
+func backoff(n int) time.Duration {
+	d := reconnectMax
+	if n < 16 {
+		d = min(reconnectMin<<n, reconnectMax)
+	}
+	return d/2 + rand.N(d/2+1)
+}
+
+// permanent reports whether a connect error won't go away by retrying.
+func permanent(err error) bool {
+	return errors.Is(err, ErrDevicePending) || errors.Is(err, ErrDeviceRevoked) ||
+		strings.HasPrefix(err.Error(), "server rejected connection") ||
+		strings.HasSuffix(err.Error(), "id not registered")
+}
+
+// most frames remembered past a gap in the numbering; beyond that the
+// gap is taken as lost, as the server no longer keeps it either
+const maxSeqAhead = 256
+
+// resumeState carries a session's resume token and the number of the last
+// frame received across reconnects. Transports with several streams can
+// deliver frames out of order, so lastSeq is the end of the unbroken run
+// received, and frames past a gap are remembered in ahead.
+type resumeState struct {
+	mu      sync.Mutex
+	token   string
+	lastSeq int64
+	ahead   map[int64]bool
+}
+
+// hello asks to resume the previous connection, if there was one.
+func (r *resumeState) hello(h *protocol.Hello) {
+	r.mu.Lock()
+	h.Resume, h.LastSeq = r.token, r.lastSeq
+	r.mu.Unlock()
+}
+
+// welcome records the new connection's token. A connection that was not
+// resumed numbers its frames from scratch.
+func (r *resumeState) welcome(w *protocol.Welcome) {
+	r.mu.Lock()
+	r.token = w.ResumeToken
+	if !w.Resumed {
+		r.lastSeq, r.ahead = 0, nil
+	}
+	r.mu.Unlock()
+}
+
+// fresh reports whether the frame numbered seq is new, recording it.
+// Replayed frames we already have are not; unnumbered frames always are.
+func (r *resumeState) fresh(seq int64) bool {
+	if seq == 0 {
+		return true
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if seq <= r.lastSeq || r.ahead[seq] {
+		return false
+	}
+	if seq == r.lastSeq+1 {
+		r.lastSeq = seq
+	} else {
+		if r.ahead == nil {
+			r.ahead = make(map[int64]bool)
+		}
+		r.ahead[seq] = true
+		if len(r.ahead) > maxSeqAhead {
+			// give up on the gap: skip to just before the oldest frame past it
+			first := seq
+			for s := range r.ahead {
+				first = min(first, s)
+			}
+			r.lastSeq = first - 1
+		}
+	}
+	for r.ahead[r.lastSeq+1] {
+		delete(r.ahead, r.lastSeq+1)
+		r.lastSeq++
+	}
+	return true
+}
@@ -0,0 +1,542 @@
+package client
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/marcoantonios1/chat-app/internal/protocol"
+)
+
+// how long a history request waits for the server's page
+const historyTimeout = 10 * time.Second
+
+// Contact is a user we have a conversation with or a key from.
+type Contact struct {
+	ID      string   `json:"id"`
+	Devices []string `json:"devices,omitempty"` // devices whose key we have
+}
+
+// Session keeps one authenticated connection for a user alive and does
+// what a client has to do for every conversation: it answers key
+// announcements, decrypts, stores and acknowledges messages, and
+// reconnects after a drop. Whatever happens is published as Events.
+// Unlike an interactive chat it isn't tied to one recipient.
+type Session struct {
+	t      Transport
+	id     string
+	device string
+	secret string // proves device to the server
+	pub    string // our public key, base64
+	keys   *keyring
+	rs     *resumeState
+	store  *MessageStore
+
+	// writeMu serializes writes and reconnects; online is false while
+	// the connection is being restored
+	writeMu sync.Mutex
+	online  bool
+
+	mu        sync.Mutex
+	subs      map[chan Event]struct{}
+	waiters   map[string]chan string   // ack statuses of messages being sent
+	sent      map[string]StoredMessage // our messages not read yet
+	announced map[string]bool          // users we sent our key to
+	newKeys   chan struct{}            // closed and replaced when a peer key arrives
+
+	historyMu    sync.Mutex // one history request at a time
+	historyPages chan *protocol.HistoryPage
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// NewSession prepares a session for id over t with the keys in keys.
+// Messages are saved to store unless it is nil; the caller closes it once
+// Run has returned. Subscribe before Connect to see every event.
+func NewSession(t Transport, id string, keys KeyStore, store *MessageStore) (*Session, error) {
+	device, err := keys.DeviceID()
+	if err != nil {
+		return nil, err
+	}
+	secret, err := keys.DeviceSecret()
+	if err != nil {
+		return nil, err
+	}
+	ring := newKeyring(keys)
+	pub, err := ring.ownPublicKey()
+	if err != nil {
+		return nil, err
+	}
+	return &Session{
+		t:            t,
+		id:           id,
+		device:       device,
+		secret:       secret,
+		pub:          pub,
+		keys:         ring,
+		rs:           &resumeState{},
+		store:        store,
+		subs:         make(map[chan Event]struct{}),
+		waiters:      make(map[string]chan string),
+		sent:         make(map[string]StoredMessage),
+		announced:    make(map[string]bool),
+		newKeys:      make(chan struct{}),
+		historyPages: make(chan *protocol.HistoryPage, 1),
+		closed:       make(chan struct{}),
+	}, nil
+}
+
+// ID returns the user the session is for.
+func (s *Session) ID() string { return s.id }
+
+// Device returns our device ID.
+func (s *Session) Device() string { return s.device }
+
+// Connect dials and authenticates. ctx bounds the attempt.
+func (s *Session) Connect(ctx context.Context) error {
+	s.writeMu.Lock()
+	welcome, err := open(ctx, s.t, s.id, s.device, s.secret, s.rs)
+	s.online = err == nil
+	s.writeMu.Unlock()
+	if err != nil {
+		return err
+	}
+	s.connected(welcome, "connected")
+	return nil
+}
+
+// connected publishes that the connection is up.
+func (s *Session) connected(welcome *protocol.Welcome, status string) {
+	s.publish(Event{Type: EventConnection, Status: status})
+	if skew := time.Since(time.UnixMilli(welcome.ServerTime)); skew > maxClockSkew || skew < -maxClockSkew {
+		s.publish(Event{Type: EventError, Error: fmt.Sprintf("clock differs from the server by %s, message times may be off", skew.Round(time.Second))})
+	}
+}
+
+// Online reports whether the connection is currently up.
+func (s *Session) Online() bool {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	return s.online
+}
+
+// Close ends the session and its subscriptions; Run returns.
+func (s *Session) Close() {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		s.writeMu.Lock()
+		_ = s.t.Close()
+		s.writeMu.Unlock()
+		s.unsubscribeAll()
+	})
+}
+
+// Done is closed once Close is called.
+func (s *Session) Done() <-chan struct{} {
+	return s.closed
+}
+
+func (s *Session) isClosed() bool {
+	select {
+	case <-s.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// Run handles frames until the session is closed, or until the
+// connection fails for a reason retrying won't fix. Subscriptions end
+// when it returns.
+func (s *Session) Run() error {
+	defer s.unsubscribeAll()
+	for {
+		frame, err := s.t.Receive()
+		if errors.Is(err, ErrBadFrame) {
+			s.publish(Event{Type: EventError, Error: err.Error()})
+			continue
+		}
+		if err != nil {
+			if s.isClosed() {
+				return nil
+			}
+			s.writeMu.Lock()
+			s.online = false
+			s.writeMu.Unlock()
+			s.publish(Event{Type: EventConnection, Status: "reconnecting", Error: err.Error()})
+			if err := s.reconnect(); err != nil || s.isClosed() {
+				if err != nil {
+					s.publish(Event{Type: EventConnection, Status: "offline", Error: err.Error()})
+				}
+				return err
+			}
+			continue
+		}
+		s.handle(frame)
+	}
+}
+
+// reconnect dials again with backoff until it gets through, the session
+// is closed, or the server turns us away for good.
+func (s *Session) reconnect() error {
+	for n := 0; ; n++ {
+		select {
+		case <-s.closed:
+			return nil
+		case <-time.After(backoff(n)):
+		}
+		s.writeMu.Lock()
+		_ = s.t.Close()
+		welcome, err := open(context.Background(), s.t, s.id, s.device, s.secret, s.rs)
+		s.online = err == nil
+		s.writeMu.Unlock()
+		if err != nil {
+			if permanent(err) {
+				return err
+			}
+			s.publish(Event{Type: EventConnection, Status: "reconnecting", Error: err.Error()})
+			continue
+		}
+
+		status := "connected"
+		if welcome.Resumed {
+			status = "resumed"
+		}
+		s.connected(welcome, status)
+		// peers that came online meanwhile may not know our key
+		s.mu.Lock()
+		peers := make([]string, 0, len(s.announced))
+		for p := range s.announced {
+			peers = append(peers, p)
+		}
+		s.mu.Unlock()
+		for _, p := range peers {
+			_ = s.send(protocol.NewPublicKey(p, "", s.pub))
+		}
+		return nil
+	}
+}
+
+// send puts a frame from us on the connection.
+func (s *Session) send(f protocol.Frame) error {
+	f.Head().ID = s.id
+	f.Head().Device = s.device
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if !s.online {
+		return ErrOffline
+	}
+	return s.t.Send(f)
+}
+
+// Subscribe returns a channel of the session's events. A subscriber that
+// falls behind is dropped: its channel is closed, as it is when the
+// session ends.
+func (s *Session) Subscribe(buffer int) (<-chan Event, func()) {
+	ch := make(chan Event, buffer)
+	s.mu.Lock()
+	s.subs[ch] = struct{}{}
+	s.mu.Unlock()
+	return ch, func() {
+		s.mu.Lock()
+		if _, ok := s.subs[ch]; ok {
+			delete(s.subs, ch)
+			close(ch)
+		}
+		s.mu.Unlock()
+	}
+}
+
+func (s *Session) unsubscribeAll() {
+	s.mu.Lock()
+	for ch := range s.subs {
+		delete(s.subs, ch)
+		close(ch)
+	}
+	s.mu.Unlock()
+}
+
+func (s *Session) publish(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for ch := range s.subs {
+		select {
+		case ch <- e:
+		default:
+			delete(s.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+func (s *Session) persist(m StoredMessage) {
+	if s.store == nil {
+		return
+	}
+	if err := s.store.Save(m); err != nil {
+		s.publish(Event{Type: EventError, Error: fmt.Sprintf("message store error: %v", err)})
+	}
+}
+
+// SendMessage encrypts text for the devices of user to and sends it under
+// msgID, or a new ID if msgID is empty. It returns the ID and the status
+// reached once the message is acknowledged with at least the status wait,
+// or ErrAckTimeout when ctx ends first; "sent" doesn't wait.
+func (s *Session) SendMessage(ctx context.Context, msgID, to, text, wait string) (string, string, error) {
+	s.Introduce(ctx, to)
+
+	if msgID == "" {
+		msgID = NewMessageID()
+	}
+	acks := make(chan string, 8)
+	s.mu.Lock()
+	s.waiters[msgID] = acks
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.waiters, msgID)
+		s.mu.Unlock()
+	}()
+
+	if err := s.keys.sendBody(s.send, s.id, s.device, to, text, msgID); err != nil {
+		return "", "", err
+	}
+	m := StoredMessage{MsgID: msgID, Owner: s.id, Peer: to, From: s.id, Text: text, Timestamp: time.Now(), Status: "sent"}
+	s.mu.Lock()
+	s.sent[msgID] = m
+	s.mu.Unlock()
+	s.persist(m)
+	s.publish(Event{Type: EventMessage, From: s.id, Device: s.device, To: to, MsgID: msgID, Text: text, Status: m.Status})
+
+	for statusRank[m.Status] < statusRank[wait] {
+		select {
+		case st := <-acks:
+			if statusRank[st] > statusRank[m.Status] {
+				m.Status = st
+			}
+		case <-ctx.Done():
+			return msgID, m.Status, fmt.Errorf("%w: message %s is %s", ErrAckTimeout, msgID, m.Status)
+		case <-s.closed:
+			if ctx.Err() != nil {
+				// the session was bound to ctx too
+				return msgID, m.Status, fmt.Errorf("%w: message %s is %s", ErrAckTimeout, msgID, m.Status)
+			}
+			return msgID, m.Status, errors.New("session closed")
+		}
+	}
+	return msgID, m.Status, nil
+}
+
+// SendReceipt acknowledges message msgID from user to with status,
+// protocol.StatusRead once the user has seen it. Delivery is acknowledged
+// by the session itself.
+func (s *Session) SendReceipt(to, msgID, status string) error {
+	return s.send(protocol.NewAck(to, msgID, status))
+}
+
+// NewMessageID returns an ID for a message about to be sent.
+func NewMessageID() string {
+	return fmt.Sprintf("%d", time.Now().UnixNano())
+}
+
+// Introduce sends our key to every device of user to, once per session,
+// and gives their online devices up to keyWait to answer with theirs.
+func (s *Session) Introduce(ctx context.Context, to string) {
+	s.mu.Lock()
+	done := s.announced[to]
+	s.announced[to] = true
+	s.mu.Unlock()
+	if done {
+		return
+	}
+	if err := s.send(protocol.NewPublicKey(to, "", s.pub)); err != nil {
+		s.mu.Lock()
+		delete(s.announced, to)
+		s.mu.Unlock()
+		return
+	}
+	timer := time.NewTimer(keyWait)
+	defer timer.Stop()
+	for {
+		s.mu.Lock()
+		keys := s.newKeys
+		s.mu.Unlock()
+		if len(s.keys.knownDevices(to)) > 0 {
+			return
+		}
+		select {
+		case <-keys:
+		case <-timer.C:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// History returns a page of the stored conversation with user with,
+// decrypted, oldest first, and the cursor for the page before it.
+func (s *Session) History(ctx context.Context, with string, before int64, limit int) ([]Event, int64, error) {
+	s.historyMu.Lock()
+	defer s.historyMu.Unlock()
+	// a page that came after its request gave up
+	select {
+	case <-s.historyPages:
+	default:
+	}
+	if err := s.send(protocol.NewHistoryRequest(with, before, limit)); err != nil {
+		return nil, 0, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, historyTimeout)
+	defer cancel()
+	var page *protocol.HistoryPage
+	select {
+	case page = <-s.historyPages:
+	case <-ctx.Done():
+		return nil, 0, fmt.Errorf("history: %w", ctx.Err())
+	}
+
+	out := make([]Event, 0, len(page.Messages))
+	for i := len(page.Messages) - 1; i >= 0; i-- {
+		e := page.Messages[i]
+		ev := Event{Type: EventMessage, Time: time.UnixMilli(e.Timestamp), From: e.From, Device: e.FromDevice, To: e.To, MsgID: e.MsgID}
+		frame, err := protocol.Decode(e.Envelope)
+		if env, ok := frame.(*protocol.Message); err != nil || !ok {
+			ev.Error = fmt.Sprintf("bad envelope: %v", err)
+		} else if ev.Text, err = s.keys.decryptEnvelope(env, with, s.id); err != nil {
+			ev.Error = "unable to decrypt"
+		}
+		out = append(out, ev)
+	}
+	return out, page.NextBefore, nil
+}
+
+// Contacts lists the users we have stored conversations with or keys
+// from, sorted by ID.
+func (s *Session) Contacts() ([]Contact, error) {
+	ids := make(map[string]bool)
+	if s.store != nil {
+		convs, err := s.store.Conversations(s.id)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range convs {
+			ids[c[1]] = true
+		}
+	}
+	for _, user := range s.keys.knownUsers() {
+		ids[user] = true
+	}
+	delete(ids, s.id)
+
+	out := make([]Contact, 0, len(ids))
+	for id := range ids {
+		out = append(out, Contact{ID: id, Devices: s.keys.knownDevices(id)})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out, nil
+}
+
+// handle acts on one frame from the server.
+func (s *Session) handle(frame protocol.Frame) {
+	h := frame.Head()
+	if !s.rs.fresh(h.Seq) || !addressedTo(frame, s.id, s.device) {
+		return
+	}
+	self := deviceAddr(s.id, s.device)
+	peerAddr := deviceAddr(h.ID, h.Device)
+
+	switch f := frame.(type) {
+	case *protocol.Message:
+		text, err := s.keys.decryptIncoming(h.ID, peerAddr, f.Body, f.EncryptedKey, self)
+		if err != nil {
+			s.publish(Event{Type: EventError, From: h.ID, Device: h.Device, MsgID: f.MsgID, Error: err.Error()})
+			return
+		}
+		if h.ID == s.id {
+			// sent from another of our devices
+			s.persist(StoredMessage{MsgID: f.MsgID, Owner: s.id, Peer: f.Recipient, From: s.id, Text: text, Timestamp: time.Now(), Status: "sent"})
+			s.publish(Event{Type: EventMessage, From: s.id, Device: h.Device, To: f.Recipient, MsgID: f.MsgID, Text: text})
+			return
+		}
+		s.persist(StoredMessage{MsgID: f.MsgID, Owner: s.id, Peer: h.ID, From: h.ID, Text: text, Timestamp: time.Now(), Status: "delivered", Incoming: true})
+		s.publish(Event{Type: EventMessage, From: h.ID, Device: h.Device, To: s.id, MsgID: f.MsgID, Text: text})
+		if f.MsgID != "" && f.Recipient != "" {
+			_ = s.send(protocol.NewAck(h.ID, f.MsgID, protocol.StatusDelivered))
+		}
+
+	case *protocol.Ack:
+		s.mu.Lock()
+		if acks, ok := s.waiters[f.MsgID]; ok {
+			select {
+			case acks <- f.Status:
+			default:
+			}
+		}
+		m, ok := s.sent[f.MsgID]
+		ok = ok && statusRank[f.Status] > statusRank[m.Status]
+		if ok {
+			m.Status = f.Status
+			s.sent[f.MsgID] = m
+			if m.Status == protocol.StatusRead {
+				delete(s.sent, f.MsgID)
+			}
+		}
+		s.mu.Unlock()
+		if ok {
+			s.persist(m)
+		}
+		s.publish(Event{Type: EventAck, From: h.ID, Device: h.Device, To: f.Recipient, MsgID: f.MsgID, Status: f.Status})
+
+	case *protocol.PublicKey:
+		known, changed, err := s.keys.cachePeerKey(peerAddr, f.PublicKey)
+		if err != nil {
+			s.publish(Event{Type: EventError, From: h.ID, Device: h.Device, Error: err.Error()})
+			return
+		}
+		if known {
+			return
+		}
+		s.mu.Lock()
+		close(s.newKeys)
+		s.newKeys = make(chan struct{})
+		s.mu.Unlock()
+		if changed {
+			s.publish(Event{Type: EventKeyChange, From: h.ID, Device: h.Device})
+		}
+		s.publish(Event{Type: EventPresence, From: h.ID, Device: h.Device, Status: "online"})
+		// introduce ourselves so the device can set up a session key
+		if err := s.send(protocol.NewPublicKey(h.ID, h.Device, s.pub)); err != nil {
+			s.publish(Event{Type: EventError, Error: fmt.Sprintf("pubkey send error: %v", err)})
+		}
+
+	case *protocol.EncapKey:
+		ct, err := base64.StdEncoding.DecodeString(f.EncryptedKey)
+		if err == nil {
+			_, err = s.keys.decapsulateSessionKey(h.ID, peerAddr, ct, self)
+		}
+		if err != nil {
+			s.publish(Event{Type: EventError, From: h.ID, Device: h.Device, Error: err.Error()})
+		}
+
+	case *protocol.HistoryPage:
+		select {
+		case s.historyPages <- f:
+		default:
+		}
+
+	case *protocol.DeviceLink:
+		s.publish(Event{Type: EventDeviceLink, From: s.id, Device: f.Device, Text: f.DeviceName})
+
+	case *protocol.Error:
+		s.publish(Event{Type: EventError, Error: "server: " + f.Text})
+	}
+}
@@ -0,0 +1,284 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/marcoantonios1/chat-app/internal/protocol"
+)
+
+// testSession is a connected session with a subscription to its events.
+type testSession struct {
+	*Session
+	ks     *MemoryKeyStore
+	events <-chan Event
+}
+
+// startSession connects id over t with keys, a new key store if nil, and
+// runs the session until the test ends.
+func startSession(t *testing.T, tr Transport, id string, keys *MemoryKeyStore) *testSession {
+	t.Helper()
+	if keys == nil {
+		keys = NewMemoryKeyStore()
+	}
+	s, err := NewSession(tr, id, keys, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, _ := s.Subscribe(256)
+	if err := s.Connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		_ = s.Run()
+		close(done)
+	}()
+	t.Cleanup(func() {
+		s.Close()
+		<-done
+	})
+	return &testSession{Session: s, ks: keys, events: events}
+}
+
+// next returns the first event of type typ that match accepts (nil
+// accepts any).
+func (s *testSession) next(t *testing.T, typ string, match func(Event) bool) Event {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case e, ok := <-s.events:
+			if !ok {
+				t.Fatalf("%s: events closed waiting for %s", s.id, typ)
+			}
+			if e.Type == typ && (match == nil || match(e)) {
+				return e
+			}
+		case <-timeout:
+			t.Fatalf("%s: no %s event", s.id, typ)
+		}
+	}
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestSessionKeyExchange(t *testing.T) {
+	srv := NewMemoryServer()
+	defer srv.Close()
+	alice := startSession(t, srv.Transport(), "alice", nil)
+	bob := startSession(t, srv.Transport(), "bob", nil)
+
+	alice.Introduce(context.Background(), "bob")
+	if got := alice.keys.knownDevices("bob"); len(got) != 1 || got[0] != bob.Device() {
+		t.Fatalf("alice knows bob's devices %v, want [%s]", got, bob.Device())
+	}
+	e := bob.next(t, EventPresence, nil)
+	if e.From != "alice" || e.Device != alice.Device() {
+		t.Fatalf("bob saw presence of %s/%s", e.From, e.Device)
+	}
+	waitFor(t, "bob to learn alice's key", func() bool { return len(bob.keys.knownDevices("alice")) == 1 })
+
+	// the first message sets up a session key both sides keep
+	if _, _, err := alice.SendMessage(context.Background(), "", "bob", "hi", "sent"); err != nil {
+		t.Fatal(err)
+	}
+	if e := bob.next(t, EventMessage, nil); e.Text != "hi" {
+		t.Fatalf("bob got %q", e.Text)
+	}
+	aliceKeys, _ := alice.ks.SessionKeys("bob")
+	bobKeys, _ := bob.ks.SessionKeys("alice")
+	if len(aliceKeys) != 1 || len(bobKeys) != 1 || string(aliceKeys[0]) != string(bobKeys[0]) {
+		t.Fatalf("session keys differ: alice %x, bob %x", aliceKeys, bobKeys)
+	}
+
+	// introducing again sends nothing new
+	alice.Introduce(context.Background(), "bob")
+	if _, _, err := bob.SendMessage(context.Background(), "", "alice", "hello", "sent"); err != nil {
+		t.Fatal(err)
+	}
+	if e := alice.next(t, EventMessage, func(e Event) bool { return e.From == "bob" }); e.Text != "hello" {
+		t.Fatalf("alice got %q", e.Text)
+	}
+	if keys, _ := alice.ks.SessionKeys("bob"); len(keys) != 1 {
+		t.Fatalf("alice has %d session keys with bob, want 1", len(keys))
+	}
+}
+
+func TestSessionSendAck(t *testing.T) {
+	srv := NewMemoryServer()
+	defer srv.Close()
+	alice := startSession(t, srv.Transport(), "alice", nil)
+	bob := startSession(t, srv.Transport(), "bob", nil)
+
+	id, status, err := alice.SendMessage(context.Background(), "m1", "bob", "hi", protocol.StatusDelivered)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "m1" || status != protocol.StatusDelivered {
+		t.Fatalf("SendMessage = %s, %s; want m1, delivered", id, status)
+	}
+	e := bob.next(t, EventMessage, nil)
+	if e.From != "alice" || e.MsgID != "m1" || e.Text != "hi" {
+		t.Fatalf("bob got %+v", e)
+	}
+
+	if err := bob.SendReceipt("alice", "m1", protocol.StatusRead); err != nil {
+		t.Fatal(err)
+	}
+	e = alice.next(t, EventAck, func(e Event) bool { return e.Status == protocol.StatusRead })
+	if e.MsgID != "m1" || e.From != "bob" {
+		t.Fatalf("alice got %+v", e)
+	}
+	alice.mu.Lock()
+	_, pending := alice.sent["m1"]
+	alice.mu.Unlock()
+	if pending {
+		t.Fatal("a read message is still tracked")
+	}
+}
+
+func TestSessionQueuedForOfflinePeer(t *testing.T) {
+	srv := NewMemoryServer()
+	defer srv.Close()
+	alice := startSession(t, srv.Transport(), "alice", nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	_, status, err := alice.SendMessage(ctx, "m1", "carol", "are you there?", protocol.StatusDelivered)
+	if !errors.Is(err, ErrAckTimeout) {
+		t.Fatalf("SendMessage error = %v, want %v", err, ErrAckTimeout)
+	}
+	if status == protocol.StatusDelivered {
+		t.Fatal("delivered to a user who is offline")
+	}
+	alice.next(t, EventAck, func(e Event) bool { return e.MsgID == "m1" && e.Status == protocol.StatusQueued })
+
+	// no key to use yet, so it went with a one-off key carol can read
+	carol := startSession(t, srv.Transport(), "carol", nil)
+	if e := carol.next(t, EventMessage, nil); e.Text != "are you there?" || e.MsgID != "m1" {
+		t.Fatalf("carol got %+v", e)
+	}
+	alice.next(t, EventAck, func(e Event) bool { return e.MsgID == "m1" && e.Status == protocol.StatusDelivered })
+}
+
+func TestSessionReconnects(t *testing.T) {
+	srv := NewMemoryServer()
+	defer srv.Close()
+	tr := srv.Transport()
+	alice := startSession(t, tr, "alice", nil)
+	bob := startSession(t, srv.Transport(), "bob", nil)
+	alice.Introduce(context.Background(), "bob")
+
+	tr.Drop(errors.New("network is down"))
+	alice.next(t, EventConnection, func(e Event) bool { return e.Status == "reconnecting" })
+	alice.next(t, EventConnection, func(e Event) bool { return e.Status == "connected" })
+	if tr.Dials() != 2 {
+		t.Fatalf("dialed %d times, want 2", tr.Dials())
+	}
+	if _, _, err := alice.SendMessage(context.Background(), "", "bob", "back", "sent"); err != nil {
+		t.Fatal(err)
+	}
+	if e := bob.next(t, EventMessage, nil); e.Text != "back" {
+		t.Fatalf("bob got %q", e.Text)
+	}
+}
+
+func TestSessionHistory(t *testing.T) {
+	srv := NewMemoryServer()
+	defer srv.Close()
+	alice := startSession(t, srv.Transport(), "alice", nil)
+	bob := startSession(t, srv.Transport(), "bob", nil)
+	alice.Introduce(context.Background(), "bob")
+	waitFor(t, "bob to learn alice's key", func() bool { return len(bob.keys.knownDevices("alice")) == 1 })
+
+	// what the server stored: alice's messages as she sent them, newest
+	// first, and one under a key nobody has
+	var sent []protocol.Frame
+	capture := func(f protocol.Frame) error {
+		f.Head().ID, f.Head().Device = alice.id, alice.device
+		sent = append(sent, f)
+		return alice.send(f)
+	}
+	for _, text := range []string{"one", "two"} {
+		if err := alice.keys.sendBody(capture, alice.id, alice.device, "bob", text, text); err != nil {
+			t.Fatal(err)
+		}
+		bob.next(t, EventMessage, func(e Event) bool { return e.Text == text })
+	}
+	var page []protocol.HistoryEntry
+	for i, f := range sent {
+		m, ok := f.(*protocol.Message)
+		if !ok {
+			continue
+		}
+		env, err := protocol.Encode(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		page = append([]protocol.HistoryEntry{{Seq: int64(10 + i), Timestamp: time.Now().UnixMilli(), From: "alice", FromDevice: alice.device,
+			To: "bob", ToDevice: m.ToDevice, MsgID: m.MsgID, Envelope: env}}, page...)
+	}
+	lost := protocol.NewMessage("bob", "", "lost", "00112233445566778899aabbccddeeff00112233445566778899")
+	lost.ID = "alice"
+	env, _ := protocol.Encode(lost)
+	page = append(page, protocol.HistoryEntry{Seq: 5, From: "alice", To: "bob", MsgID: "lost", Envelope: json.RawMessage(env)})
+
+	// bob reads it back on a connection that answers history requests
+	tr := NewMemoryTransport()
+	hist := startSession(t, tr, "bob", bob.ks)
+	type result struct {
+		events []Event
+		next   int64
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		events, next, err := hist.History(context.Background(), "alice", 0, 3)
+		done <- result{events, next, err}
+	}()
+	var req *protocol.HistoryRequest
+	for req == nil {
+		select {
+		case f := <-tr.Sent:
+			req, _ = f.(*protocol.HistoryRequest)
+		case <-time.After(5 * time.Second):
+			t.Fatal("no history request")
+		}
+	}
+	if req.Recipient != "alice" || req.Limit != 3 || req.Before != 0 {
+		t.Fatalf("history request %+v", req)
+	}
+	tr.Deliver(protocol.NewHistoryPage("bob", page, 4))
+
+	r := <-done
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	if r.next != 4 {
+		t.Fatalf("next cursor %d, want 4", r.next)
+	}
+	if len(r.events) != 3 {
+		t.Fatalf("got %d events, want 3: %+v", len(r.events), r.events)
+	}
+	if e := r.events[0]; e.MsgID != "lost" || e.Error != "unable to decrypt" {
+		t.Fatalf("oldest event %+v, want an undecryptable message", e)
+	}
+	for i, want := range []string{"one", "two"} {
+		if e := r.events[i+1]; e.Text != want || e.From != "alice" || e.Error != "" {
+			t.Fatalf("event %d = %+v, want %q", i+1, e, want)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package client
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const sessionKeysFile = "session_keys.json"
+
+var (
+	sessionKeysMu     sync.Mutex
+	sessionKeysLoaded bool
+	// every symmetric key ever derived with a peer, oldest first (hex encoded)
+	sessionKeys = make(map[string][]string)
+)
+
+// rememberSessionKey records a derived key for peer so that messages from
+// earlier sessions (e.g. fetched with /history) can still be decrypted.
+func rememberSessionKey(peer string, key []byte) error {
+	sessionKeysMu.Lock()
+	defer sessionKeysMu.Unlock()
+	if err := loadSessionKeysLocked(); err != nil {
+		return err
+	}
+	k := hex.EncodeToString(key)
+	for _, existing := range sessionKeys[peer] {
+		if existing == k {
+			return nil
+		}
+	}
+	sessionKeys[peer] = append(sessionKeys[peer], k)
+
+	b, err := json.Marshal(sessionKeys)
+	if err != nil {
+		return fmt.Errorf("marshal session keys: %w", err)
+	}
+	dir := getKeyDir()
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return fmt.Errorf("mkdir key dir: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, sessionKeysFile), b, 0o600); err != nil {
+		return fmt.Errorf("write session keys: %w", err)
+	}
+	return nil
+}
+
+// knownSessionKeys returns every key derived with peer, newest first.
+func knownSessionKeys(peer string) [][]byte {
+	sessionKeysMu.Lock()
+	defer sessionKeysMu.Unlock()
+	_ = loadSessionKeysLocked()
+	hexKeys := sessionKeys[peer]
+	out := make([][]byte, 0, len(hexKeys))
+	for i := len(hexKeys) - 1; i >= 0; i-- {
+		if kb, err := hex.DecodeString(hexKeys[i]); err == nil {
+			out = append(out, kb)
+		}
+	}
+	return out
+}
+
+func loadSessionKeysLocked() error {
+	if sessionKeysLoaded {
+		return nil
+	}
+	b, err := os.ReadFile(filepath.Join(getKeyDir(), sessionKeysFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			sessionKeysLoaded = true
+			return nil
+		}
+		return fmt.Errorf("read session keys: %w", err)
+	}
+	if err := json.NewDecoder(bytes.NewReader(b)).Decode(&sessionKeys); err != nil {
+		return fmt.Errorf("decode session keys: %w", err)
+	}
+	sessionKeysLoaded = true
+	return nil
+}
@@ -0,0 +1,406 @@
+package client
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	messagesDir   = "messages"
+	retentionFile = "retention"
+	// every process using the store takes this file's lock around what it
+	// does to the logs
+	lockFile = "lock"
+)
+
+// StoredMessage is one sent or received message kept in the local database.
+type StoredMessage struct {
+	MsgID     string    `json:"msg_id"`
+	Owner     string    `json:"owner"` // local user the conversation belongs to
+	Peer      string    `json:"peer"`
+	From      string    `json:"from"`
+	Text      string    `json:"text"`
+	Timestamp time.Time `json:"ts"`
+	Status    string    `json:"status,omitempty"` // "sent", "delivered", "read"
+	Incoming  bool      `json:"incoming,omitempty"`
+}
+
+// MessageStore is an append-only, encrypted, per-conversation message log.
+// Each conversation lives in its own file; every line is one record
+// encrypted with the storage key from the keystore. Re-saving a message with
+// the same MsgID (e.g. after a status change) supersedes the earlier record.
+//
+// The client, its daemon and a purge from the command line may use the
+// store at the same time; appends and rewrites hold a file lock on it, so a
+// purge can't drop what another process appends.
+type MessageStore struct {
+	mu   sync.Mutex
+	dir  string
+	key  []byte
+	open map[string]*os.File
+}
+
+// OpenMessageStore opens (creating if needed) the local message database.
+func OpenMessageStore() (*MessageStore, error) {
+	key, err := GetStorageKey()
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Join(getKeyDir(), messagesDir)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("mkdir message store: %w", err)
+	}
+	return &MessageStore{dir: dir, key: key, open: make(map[string]*os.File)}, nil
+}
+
+// Close releases the open conversation files.
+func (s *MessageStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var firstErr error
+	for path, f := range s.open {
+		if err := f.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(s.open, path)
+	}
+	return firstErr
+}
+
+// lock takes the store's file lock, shared for reading and exclusive for
+// changing the logs, and returns its release. It is taken with s.mu held.
+func (s *MessageStore) lock(exclusive bool) (func(), error) {
+	f, err := os.OpenFile(filepath.Join(s.dir, lockFile), os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("open store lock: %w", err)
+	}
+	if err := flock(f, exclusive); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("lock message store: %w", err)
+	}
+	// closing the file releases the lock
+	return func() { _ = f.Close() }, nil
+}
+
+// conversationPath hex-encodes ids so any id is a safe file name.
+func (s *MessageStore) conversationPath(owner, peer string) string {
+	return filepath.Join(s.dir, hex.EncodeToString([]byte(owner)), hex.EncodeToString([]byte(peer))+".log")
+}
+
+// Save appends m to its conversation log.
+func (s *MessageStore) Save(m StoredMessage) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("marshal message: %w", err)
+	}
+	line, err := Encrypt(s.key, b)
+	if err != nil {
+		return fmt.Errorf("encrypt message: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	unlock, err := s.lock(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	path := s.conversationPath(m.Owner, m.Peer)
+	f, ok := s.open[path]
+	if ok && !sameFile(f, path) {
+		// another process rewrote or removed the log
+		_ = f.Close()
+		delete(s.open, path)
+		ok = false
+	}
+	if !ok {
+		if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+			return fmt.Errorf("mkdir conversation: %w", err)
+		}
+		f, err = os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+		if err != nil {
+			return fmt.Errorf("open conversation: %w", err)
+		}
+		s.open[path] = f
+	}
+	if _, err := f.WriteString(line + "\n"); err != nil {
+		return fmt.Errorf("write message: %w", err)
+	}
+	return nil
+}
+
+// sameFile reports whether f is still the file at path.
+func sameFile(f *os.File, path string) bool {
+	open, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	current, err := os.Stat(path)
+	return err == nil && os.SameFile(open, current)
+}
+
+// Conversation returns the messages between owner and peer, oldest first.
+func (s *MessageStore) Conversation(owner, peer string) ([]StoredMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	unlock, err := s.lock(false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	return s.readLocked(s.conversationPath(owner, peer))
+}
+
+// Conversations lists (owner, peer) pairs that have stored messages. An
+// empty owner lists conversations of every local user.
+func (s *MessageStore) Conversations(owner string) ([][2]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conversationsLocked(owner)
+}
+
+func (s *MessageStore) conversationsLocked(owner string) ([][2]string, error) {
+	owners, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, fmt.Errorf("read message store: %w", err)
+	}
+	var out [][2]string
+	for _, od := range owners {
+		if !od.IsDir() {
+			continue
+		}
+		o, err := hex.DecodeString(od.Name())
+		if err != nil || (owner != "" && string(o) != owner) {
+			continue
+		}
+		peers, err := os.ReadDir(filepath.Join(s.dir, od.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("read conversations: %w", err)
+		}
+		for _, pf := range peers {
+			p, err := hex.DecodeString(strings.TrimSuffix(pf.Name(), ".log"))
+			if err != nil || !strings.HasSuffix(pf.Name(), ".log") {
+				continue
+			}
+			out = append(out, [2]string{string(o), string(p)})
+		}
+	}
+	return out, nil
+}
+
+// Search returns messages whose text contains every whitespace-separated
+// term of query (case-insensitive), oldest first. owner and peer narrow the
+// search when non-empty.
+func (s *MessageStore) Search(owner, peer, query string) ([]StoredMessage, error) {
+	terms := strings.Fields(strings.ToLower(query))
+	if len(terms) == 0 {
+		return nil, fmt.Errorf("empty search query")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	unlock, err := s.lock(false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	convs, err := s.conversationsLocked(owner)
+	if err != nil {
+		return nil, err
+	}
+	var out []StoredMessage
+	for _, c := range convs {
+		if peer != "" && c[1] != peer {
+			continue
+		}
+		msgs, err := s.readLocked(s.conversationPath(c[0], c[1]))
+		if err != nil {
+			return nil, err
+		}
+	next:
+		for _, m := range msgs {
+			text := strings.ToLower(m.Text)
+			for _, t := range terms {
+				if !strings.Contains(text, t) {
+					continue next
+				}
+			}
+			out = append(out, m)
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Timestamp.Before(out[j].Timestamp) })
+	return out, nil
+}
+
+// Purge removes messages older than cutoff and compacts the affected logs.
+// owner and peer narrow the purge when non-empty. It returns the number of
+// messages removed.
+func (s *MessageStore) Purge(owner, peer string, cutoff time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	unlock, err := s.lock(true)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+	convs, err := s.conversationsLocked(owner)
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, c := range convs {
+		if peer != "" && c[1] != peer {
+			continue
+		}
+		path := s.conversationPath(c[0], c[1])
+		msgs, err := s.readLocked(path)
+		if err != nil {
+			return removed, err
+		}
+		keep := msgs[:0]
+		for _, m := range msgs {
+			if m.Timestamp.Before(cutoff) {
+				removed++
+				continue
+			}
+			keep = append(keep, m)
+		}
+		if len(keep) == len(msgs) {
+			continue
+		}
+		if err := s.rewriteLocked(path, keep); err != nil {
+			return removed, err
+		}
+	}
+	return removed, nil
+}
+
+// readLocked decrypts a conversation log, keeping the latest record per MsgID.
+func (s *MessageStore) readLocked(path string) ([]StoredMessage, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("open conversation: %w", err)
+	}
+	defer f.Close()
+
+	var out []StoredMessage
+	index := make(map[string]int)
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" {
+			continue
+		}
+		plain, err := Decrypt(s.key, line)
+		if err != nil {
+			return nil, fmt.Errorf("decrypt message store: %w", err)
+		}
+		var m StoredMessage
+		if err := json.Unmarshal([]byte(plain), &m); err != nil {
+			return nil, fmt.Errorf("decode message: %w", err)
+		}
+		if i, ok := index[m.MsgID]; ok && m.MsgID != "" {
+			out[i] = m
+			continue
+		}
+		index[m.MsgID] = len(out)
+		out = append(out, m)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("read conversation: %w", err)
+	}
+	return out, nil
+}
+
+// rewriteLocked atomically replaces a conversation log with msgs.
+func (s *MessageStore) rewriteLocked(path string, msgs []StoredMessage) error {
+	if f, ok := s.open[path]; ok {
+		_ = f.Close()
+		delete(s.open, path)
+	}
+	if len(msgs) == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("remove conversation: %w", err)
+		}
+		return nil
+	}
+
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("create conversation: %w", err)
+	}
+	w := bufio.NewWriter(f)
+	for _, m := range msgs {
+		b, err := json.Marshal(m)
+		if err != nil {
+			f.Close()
+			return fmt.Errorf("marshal message: %w", err)
+		}
+		line, err := Encrypt(s.key, b)
+		if err != nil {
+			f.Close()
+			return fmt.Errorf("encrypt message: %w", err)
+		}
+		w.WriteString(line + "\n")
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return fmt.Errorf("write conversation: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("close conversation: %w", err)
+	}
+	return os.Rename(tmp, path)
+}
+
+// SetRetention stores how long messages are kept locally. Zero disables
+// automatic purging.
+func (s *MessageStore) SetRetention(d time.Duration) error {
+	path := filepath.Join(s.dir, retentionFile)
+	if d <= 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("clear retention: %w", err)
+		}
+		return nil
+	}
+	return os.WriteFile(path, []byte(strconv.FormatInt(int64(d), 10)), 0o600)
+}
+
+// Retention returns the configured retention period (zero when unset).
+func (s *MessageStore) Retention() (time.Duration, error) {
+	b, err := os.ReadFile(filepath.Join(s.dir, retentionFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("read retention: %w", err)
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("parse retention: %w", err)
+	}
+	return time.Duration(n), nil
+}
+
+// ApplyRetention purges messages older than the configured retention period.
+func (s *MessageStore) ApplyRetention() (int, error) {
+	d, err := s.Retention()
+	if err != nil || d <= 0 {
+		return 0, err
+	}
+	return s.Purge("", "", time.Now().Add(-d))
+}
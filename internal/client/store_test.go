@@ -0,0 +1,116 @@
+package client
+
+import (
+	"crypto/rand"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// openTestStore opens the store in dir with key, as another process would.
+func openTestStore(t *testing.T, dir string, key []byte) *MessageStore {
+	t.Helper()
+	s := &MessageStore{dir: dir, key: key, open: make(map[string]*os.File)}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func storeKey(t *testing.T) []byte {
+	t.Helper()
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestMessageStoreSaveAfterPurgeElsewhere(t *testing.T) {
+	dir, key := t.TempDir(), storeKey(t)
+	daemon, cli := openTestStore(t, dir, key), openTestStore(t, dir, key)
+	old := time.Now().Add(-48 * time.Hour)
+	for _, m := range []StoredMessage{
+		{MsgID: "m1", Owner: "alice", Peer: "bob", Text: "old", Timestamp: old},
+		{MsgID: "m2", Owner: "alice", Peer: "bob", Text: "new", Timestamp: time.Now()},
+	} {
+		if err := daemon.Save(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the log is replaced under the daemon's open file
+	if n, err := cli.Purge("", "", time.Now().Add(-time.Hour)); err != nil || n != 1 {
+		t.Fatalf("Purge = %d, %v; want 1 removed", n, err)
+	}
+	if err := daemon.Save(StoredMessage{MsgID: "m3", Owner: "alice", Peer: "bob", Text: "after", Timestamp: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	msgs, err := cli.Conversation("alice", "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 2 || msgs[0].MsgID != "m2" || msgs[1].MsgID != "m3" {
+		t.Fatalf("conversation %+v, want m2 and m3", msgs)
+	}
+
+	// and removed altogether
+	if _, err := cli.Purge("", "", time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := daemon.Save(StoredMessage{MsgID: "m4", Owner: "alice", Peer: "bob", Timestamp: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	if msgs, _ := cli.Conversation("alice", "bob"); len(msgs) != 1 || msgs[0].MsgID != "m4" {
+		t.Fatalf("conversation %+v, want m4", msgs)
+	}
+}
+
+func TestMessageStoreConcurrentPurge(t *testing.T) {
+	dir, key := t.TempDir(), storeKey(t)
+	daemon, cli := openTestStore(t, dir, key), openTestStore(t, dir, key)
+	old := time.Now().Add(-48 * time.Hour)
+
+	const n = 200
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < n; i++ {
+			ts := time.Now()
+			if i%2 == 1 {
+				ts = old
+			}
+			if err := daemon.Save(StoredMessage{MsgID: fmt.Sprint(i), Owner: "alice", Peer: "bob", Timestamp: ts}); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < n/10; i++ {
+			if _, err := cli.Purge("", "", time.Now().Add(-time.Hour)); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	wg.Wait()
+	if _, err := cli.Purge("", "", time.Now().Add(-time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	msgs, err := cli.Conversation("alice", "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != n/2 {
+		t.Fatalf("%d messages kept, want %d", len(msgs), n/2)
+	}
+	for i, m := range msgs {
+		if m.MsgID != fmt.Sprint(2*i) {
+			t.Fatalf("message %d is %s, want %d", i, m.MsgID, 2*i)
+		}
+	}
+}
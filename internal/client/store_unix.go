@@ -0,0 +1,22 @@
+//go:build unix
+
+package client
+
+import (
+	"os"
+	"syscall"
+)
+
+// flock waits for an advisory lock on f.
+func flock(f *os.File, exclusive bool) error {
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	for {
+		err := syscall.Flock(int(f.Fd()), how)
+		if err != syscall.EINTR {
+			return err
+		}
+	}
+}
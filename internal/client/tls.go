@@ -0,0 +1,118 @@
+package client
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// ErrPinMismatch is returned when the server's certificate has none of the
+// pinned keys.
+var ErrPinMismatch = errors.New("server certificate does not match any pinned key")
+
+// TLSOptions choose how TLS connections (wss://, https://, gRPC and QUIC)
+// check the server and what they show it.
+type TLSOptions struct {
+	// CAFile is a PEM bundle trusted instead of the system roots.
+	CAFile string
+	// Pins are hex SHA-256 digests of server public keys (the
+	// SubjectPublicKeyInfo, as printed by PinOf). With CAFile the chain
+	// verified against it must hold one of them; pins alone accept a
+	// certificate no CA signed, but only if the server's own key is pinned.
+	Pins []string
+	// CertFile and KeyFile are the client certificate for servers that
+	// use mutual TLS.
+	CertFile string
+	KeyFile  string
+}
+
+// Config returns the TLS configuration o asks for, nil if o is empty.
+func (o TLSOptions) Config() (*tls.Config, error) {
+	if o.CAFile == "" && len(o.Pins) == 0 && o.CertFile == "" {
+		return nil, nil
+	}
+	c := &tls.Config{MinVersion: tls.VersionTLS12}
+	if o.CAFile != "" {
+		pem, err := os.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		c.RootCAs = x509.NewCertPool()
+		if !c.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", o.CAFile)
+		}
+	}
+	if o.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("client certificate: %w", err)
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+	if len(o.Pins) > 0 {
+		pins := make(map[string]bool)
+		for _, p := range o.Pins {
+			pins[strings.ToLower(strings.ReplaceAll(p, ":", ""))] = true
+		}
+		pinsOnly := o.CAFile == ""
+		if pinsOnly {
+			// the pins are the trust
+			c.InsecureSkipVerify = true
+		}
+		c.VerifyConnection = func(cs tls.ConnectionState) error {
+			if pinsOnly {
+				// the rest of an unverified chain is whatever the server
+				// sent; only the leaf's key signed the handshake
+				if len(cs.PeerCertificates) > 0 && pins[PinOf(cs.PeerCertificates[0])] {
+					return nil
+				}
+				return ErrPinMismatch
+			}
+			for _, chain := range cs.VerifiedChains {
+				for _, cert := range chain {
+					if pins[PinOf(cert)] {
+						return nil
+					}
+				}
+			}
+			return ErrPinMismatch
+		}
+	}
+	return c, nil
+}
+
+// PinOf returns the pin of cert's public key.
+func PinOf(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return hex.EncodeToString(sum[:])
+}
+
+// tlsConfig is the configuration set with UseTLS, given to new transports
+// and used for the client's plain HTTP calls.
+var (
+	tlsConfig  *tls.Config
+	httpClient = http.DefaultClient
+)
+
+// UseTLS makes c the TLS configuration of Register, the device calls and
+// transports made by NewTransport afterwards. Nil restores the defaults.
+func UseTLS(c *tls.Config) {
+	tlsConfig = c
+	httpClient = httpClientFor(c)
+}
+
+// httpClientFor returns an HTTP client using c, the default one for nil.
+func httpClientFor(c *tls.Config) *http.Client {
+	if c == nil {
+		return http.DefaultClient
+	}
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.TLSClientConfig = c
+	return &http.Client{Transport: tr}
+}
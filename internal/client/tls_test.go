@@ -0,0 +1,122 @@
+package client
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCert returns a certificate for localhost signed by parent, or
+// self-signed if parent is nil.
+func testCert(t *testing.T, parent *tls.Certificate, ca bool) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  ca,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	signer, signerKey := tmpl, any(key)
+	if parent != nil {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+	if parent != nil {
+		cert.Certificate = append(cert.Certificate, parent.Certificate...)
+	}
+	return cert
+}
+
+// tlsHandshake connects to a TLS server presenting cert with opts.
+func tlsHandshake(t *testing.T, cert tls.Certificate, opts TLSOptions) error {
+	t.Helper()
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err == nil {
+			_ = c.(*tls.Conn).Handshake()
+			c.Close()
+		}
+	}()
+	conf, err := opts.Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf.ServerName = "localhost"
+	c, err := tls.Dial("tcp", l.Addr().String(), conf)
+	if err == nil {
+		c.Close()
+	}
+	return err
+}
+
+func TestPins(t *testing.T) {
+	ca := testCert(t, nil, true)
+	server := testCert(t, &ca, false)
+	other := testCert(t, nil, true)
+	// the server chain carries a certificate it has no key of
+	forged := server
+	forged.Certificate = append([][]byte{}, server.Certificate[0], other.Certificate[0])
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Certificate[0]}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		cert tls.Certificate
+		opts TLSOptions
+		ok   bool
+	}{
+		{"leaf pinned", server, TLSOptions{Pins: []string{PinOf(server.Leaf)}}, true},
+		{"only an intermediate pinned", server, TLSOptions{Pins: []string{PinOf(ca.Leaf)}}, false},
+		{"unverified chain certificate pinned", forged, TLSOptions{Pins: []string{PinOf(other.Leaf)}}, false},
+		{"CA pinned and trusted", server, TLSOptions{CAFile: caFile, Pins: []string{PinOf(ca.Leaf)}}, true},
+		{"leaf pinned and CA trusted", server, TLSOptions{CAFile: caFile, Pins: []string{PinOf(server.Leaf)}}, true},
+		{"sent but unverified certificate pinned", forged, TLSOptions{CAFile: caFile, Pins: []string{PinOf(other.Leaf)}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tlsHandshake(t, tt.cert, tt.opts)
+			switch {
+			case tt.ok && err != nil:
+				t.Fatalf("handshake failed: %v", err)
+			case !tt.ok && !errors.Is(err, ErrPinMismatch):
+				t.Fatalf("handshake error = %v, want %v", err, ErrPinMismatch)
+			}
+		})
+	}
+}
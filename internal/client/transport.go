@@ -0,0 +1,382 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/gorilla/websocket"
+	"github.com/marcoantonios1/chat-app/internal/chatrpc"
+	"github.com/marcoantonios1/chat-app/internal/protocol"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Transport kinds for NewTransport.
+const (
+	TransportWebSocket = "ws"
+	TransportGRPC      = "grpc"
+)
+
+// ErrBadFrame marks a frame from the server that could not be decoded;
+// the connection is still usable.
+var ErrBadFrame = errors.New("bad frame from server")
+
+// Transport carries protocol frames between the client and the server.
+// Session logic only talks to a Transport, so it runs the same over any
+// connection type. A Transport can be dialed again after Close or after
+// its connection fails.
+type Transport interface {
+	// Dial connects as id/device, proving the device with secret. The
+	// caller runs the handshake.
+	Dial(ctx context.Context, id, device, secret string) error
+	Send(f protocol.Frame) error
+	// Receive blocks for the next frame.
+	Receive() (protocol.Frame, error)
+	// SetFrameLimit sets the largest frame the server accepts, in its
+	// JSON form, as announced in the welcome.
+	SetFrameLimit(n int)
+	// SetHooks installs callbacks for the connection coming and going.
+	SetHooks(h Hooks)
+	Close() error
+}
+
+// Hooks are called as a Transport's connection comes up and goes down.
+// Disconnected runs once per connection, with the error that ended it
+// (nil after Close).
+type Hooks struct {
+	Connected    func()
+	Disconnected func(err error)
+}
+
+// NewTransport returns a Transport of the given kind for addr: the
+// server's websocket URL (or its stream URL for HTTP), host:port for gRPC
+// and QUIC, or a MemoryServer's Addr.
+func NewTransport(kind, addr string) (Transport, error) {
+	switch kind {
+	case TransportWebSocket:
+		return &WebSocketTransport{URL: addr, Encoding: protocol.SubprotocolCBOR, TLS: tlsConfig}, nil
+	case TransportGRPC:
+		return &GRPCTransport{Addr: addr, TLS: tlsConfig}, nil
+	case TransportHTTP:
+		return &HTTPTransport{URL: streamURL(addr), TLS: tlsConfig}, nil
+	case TransportQUIC:
+		return &QUICTransport{Addr: addr, TLS: tlsConfig}, nil
+	case TransportMemory:
+		s, err := memoryServer(addr)
+		if err != nil {
+			return nil, err
+		}
+		return s.Transport(), nil
+	}
+	return nil, fmt.Errorf("unknown transport %q", kind)
+}
+
+// connState tracks whether a transport is connected and runs its hooks on
+// changes.
+type connState struct {
+	mu    sync.Mutex
+	hooks Hooks
+	up    bool
+	limit int
+}
+
+func (s *connState) SetHooks(h Hooks) {
+	s.mu.Lock()
+	s.hooks = h
+	s.mu.Unlock()
+}
+
+func (s *connState) SetFrameLimit(n int) {
+	s.mu.Lock()
+	s.limit = n
+	s.mu.Unlock()
+}
+
+func (s *connState) connected() {
+	s.mu.Lock()
+	s.up, s.limit = true, protocol.MaxFrameSize
+	fn := s.hooks.Connected
+	s.mu.Unlock()
+	if fn != nil {
+		fn()
+	}
+}
+
+func (s *connState) disconnected(err error) {
+	s.mu.Lock()
+	wasUp := s.up
+	s.up = false
+	fn := s.hooks.Disconnected
+	s.mu.Unlock()
+	if wasUp && fn != nil {
+		fn(err)
+	}
+}
+
+// checkSize returns an error if f is larger than the frame limit in its
+// JSON form, which is how the server handles every frame.
+func (s *connState) checkSize(f protocol.Frame) error {
+	b, err := protocol.Encode(f)
+	if err != nil {
+		return fmt.Errorf("encode error: %w", err)
+	}
+	s.mu.Lock()
+	limit := s.limit
+	s.mu.Unlock()
+	if len(b) > limit {
+		return fmt.Errorf("message too large (%d bytes, server accepts %d)", len(b), limit)
+	}
+	return nil
+}
+
+// WebSocketTransport connects to the server's /message endpoint. If the
+// websocket can't be dialed although the server was reached, as behind
+// proxies that break upgrades, it connects to the /stream endpoint next
+// to it like HTTPTransport instead.
+type WebSocketTransport struct {
+	URL string
+	// Encoding is the frame encoding (a protocol subprotocol) to ask for.
+	// Servers that don't offer it fall back to JSON.
+	Encoding string
+	// TLS configures wss:// connections and the https:// fallback. Nil
+	// uses the system roots.
+	TLS *tls.Config
+
+	connState
+	conn   *websocket.Conn
+	codec  protocol.Codec
+	stream *eventStream // set while connected over the HTTP fallback
+}
+
+func (t *WebSocketTransport) Dial(ctx context.Context, id, device, secret string) error {
+	u, err := url.Parse(t.URL)
+	if err != nil {
+		return fmt.Errorf("dial error: %w", err)
+	}
+	if id != "" {
+		q := u.Query()
+		q.Set("id", id)
+		q.Set("device", device)
+		q.Set("device_name", DeviceName())
+		u.RawQuery = q.Encode()
+	}
+
+	d := *websocket.DefaultDialer
+	d.TLSClientConfig = t.TLS
+	if t.Encoding != "" {
+		d.Subprotocols = []string{t.Encoding}
+	}
+	if t.Encoding != protocol.SubprotocolJSON {
+		d.Subprotocols = append(d.Subprotocols, protocol.SubprotocolJSON)
+	}
+	t.stream = nil
+	conn, resp, err := d.DialContext(ctx, u.String(), http.Header{
+		http.CanonicalHeaderKey(chatrpc.MetadataDeviceSecret): {secret},
+	})
+	if err != nil {
+		var opErr *net.OpError
+		switch {
+		case err == websocket.ErrBadHandshake && resp != nil:
+			err = responseError("connect", resp)
+			// the stream endpoint refuses the same devices and certificates
+			if err == ErrDevicePending || err == ErrDeviceRevoked ||
+				resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+				return err
+			}
+		case errors.As(err, &opErr) && opErr.Op == "dial":
+			// nothing to fall back to
+			return fmt.Errorf("dial error: %w", err)
+		default:
+			err = fmt.Errorf("dial error: %w", err)
+		}
+		return t.dialFallback(ctx, id, device, secret, err)
+	}
+	codec, err := protocol.CodecFor(conn.Subprotocol())
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+	t.conn, t.codec = conn, codec
+	t.connected()
+	return nil
+}
+
+// dialFallback connects over the stream endpoint after the websocket
+// dial failed with wsErr.
+func (t *WebSocketTransport) dialFallback(ctx context.Context, id, device, secret string, wsErr error) error {
+	s, err := dialStream(ctx, httpClientFor(t.TLS), streamURL(t.URL), id, device, secret)
+	switch {
+	case err == ErrDevicePending || err == ErrDeviceRevoked:
+		return err
+	case err != nil:
+		return fmt.Errorf("%w (http fallback: %v)", wsErr, err)
+	}
+	t.stream = s
+	t.connected()
+	return nil
+}
+
+func (t *WebSocketTransport) Send(f protocol.Frame) error {
+	if err := t.checkSize(f); err != nil {
+		return err
+	}
+	if t.stream != nil {
+		return t.stream.send(f)
+	}
+	b, err := t.codec.Marshal(f)
+	if err != nil {
+		return fmt.Errorf("encode error: %w", err)
+	}
+	messageType := websocket.TextMessage
+	if t.codec.Binary() {
+		messageType = websocket.BinaryMessage
+	}
+	return t.conn.WriteMessage(messageType, b)
+}
+
+func (t *WebSocketTransport) Receive() (protocol.Frame, error) {
+	if t.stream != nil {
+		f, err := t.stream.receive()
+		if err != nil && !errors.Is(err, ErrBadFrame) {
+			t.disconnected(err)
+		}
+		return f, err
+	}
+	_, msg, err := t.conn.ReadMessage()
+	if err != nil {
+		var ce *websocket.CloseError
+		if errors.As(err, &ce) && ce.Code >= protocol.CloseHandshakeRequired && ce.Code <= protocol.CloseNoCommonSuite {
+			err = fmt.Errorf("server rejected connection: %s", ce.Text)
+		}
+		t.disconnected(err)
+		return nil, err
+	}
+	f, err := t.codec.Unmarshal(msg)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadFrame, err)
+	}
+	return f, nil
+}
+
+func (t *WebSocketTransport) Close() error {
+	if t.stream != nil {
+		t.stream.close()
+		t.disconnected(nil)
+		return nil
+	}
+	if t.conn == nil {
+		return nil
+	}
+	err := t.conn.Close()
+	t.disconnected(nil)
+	return err
+}
+
+// GRPCTransport connects to the server's gRPC chat service.
+type GRPCTransport struct {
+	Addr string
+	// TLS makes the connection use TLS. Nil connects without it.
+	TLS *tls.Config
+
+	connState
+	cc     *grpc.ClientConn
+	stream grpc.BidiStreamingClient[chatrpc.Frame, chatrpc.Frame]
+	cancel context.CancelFunc
+}
+
+func (t *GRPCTransport) Dial(ctx context.Context, id, device, secret string) error {
+	creds := insecure.NewCredentials()
+	if t.TLS != nil {
+		creds = credentials.NewTLS(t.TLS)
+	}
+	cc, err := grpc.NewClient(t.Addr,
+		grpc.WithTransportCredentials(creds),
+		grpc.WithDefaultCallOptions(chatrpc.CallOption()))
+	if err != nil {
+		return fmt.Errorf("dial error: %w", err)
+	}
+	// the stream outlives ctx, which only bounds dialing
+	streamCtx, cancel := context.WithCancel(context.Background())
+	streamCtx = metadata.AppendToOutgoingContext(streamCtx,
+		chatrpc.MetadataID, id,
+		chatrpc.MetadataDevice, device,
+		chatrpc.MetadataDeviceName, DeviceName(),
+		chatrpc.MetadataDeviceSecret, secret)
+	stop := context.AfterFunc(ctx, cancel)
+	stream, err := chatrpc.NewChatClient(cc).Connect(streamCtx)
+	stop()
+	if err != nil {
+		cancel()
+		_ = cc.Close()
+		return fmt.Errorf("dial error: %w", grpcError(err))
+	}
+	t.cc, t.stream, t.cancel = cc, stream, cancel
+	t.connected()
+	return nil
+}
+
+func (t *GRPCTransport) Send(f protocol.Frame) error {
+	if err := t.checkSize(f); err != nil {
+		return err
+	}
+	if err := t.stream.Send(&chatrpc.Frame{Frame: f}); err != nil {
+		// the reason is reported by Receive
+		return fmt.Errorf("send error: %w", err)
+	}
+	return nil
+}
+
+func (t *GRPCTransport) Receive() (protocol.Frame, error) {
+	in, err := t.stream.Recv()
+	if err != nil {
+		err = grpcError(err)
+		t.disconnected(err)
+		return nil, err
+	}
+	return in.Frame, nil
+}
+
+func (t *GRPCTransport) Close() error {
+	if t.cc == nil {
+		return nil
+	}
+	_ = t.stream.CloseSend()
+	t.cancel()
+	err := t.cc.Close()
+	t.disconnected(nil)
+	return err
+}
+
+// grpcError turns the status errors the server uses to refuse a stream
+// into the errors the websocket transport returns.
+func grpcError(err error) error {
+	st, ok := status.FromError(err)
+	if !ok {
+		return err
+	}
+	switch st.Code() {
+	case codes.PermissionDenied:
+		switch st.Message() {
+		case ErrDevicePending.Error():
+			return ErrDevicePending
+		case ErrDeviceRevoked.Error():
+			return ErrDeviceRevoked
+		}
+		return fmt.Errorf("connect failed: %s", st.Message())
+	case codes.FailedPrecondition:
+		return fmt.Errorf("server rejected connection: %s", st.Message())
+	case codes.Unauthenticated, codes.Unavailable:
+		return fmt.Errorf("connect failed: %s", st.Message())
+	}
+	return err
+}
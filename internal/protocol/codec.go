@@ -0,0 +1,222 @@
+package protocol
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// WebSocket subprotocols naming the frame encodings. A client lists the
+// ones it speaks in Sec-WebSocket-Protocol; a connection without one uses
+// JSON.
+const (
+	SubprotocolJSON = "chatapp.v1.json"
+	SubprotocolCBOR = "chatapp.v1.cbor"
+)
+
+// Subprotocols lists the encodings a server accepts, preferred first.
+var Subprotocols = []string{SubprotocolCBOR, SubprotocolJSON}
+
+// Codec turns frames into bytes on the wire and back.
+type Codec interface {
+	// Name is the codec's WebSocket subprotocol.
+	Name() string
+	// Binary reports whether frames go out as binary WebSocket messages.
+	Binary() bool
+	Marshal(f Frame) ([]byte, error)
+	Unmarshal(b []byte) (Frame, error)
+}
+
+var (
+	// JSON is the default encoding, used by Encode and Decode.
+	JSON Codec = jsonCodec{}
+	// CBOR encodes frames as CBOR maps with the same keys as JSON, and
+	// carries ciphertext and keys as raw bytes instead of hex or base64.
+	CBOR Codec = cborCodec{}
+)
+
+// CodecFor returns the codec for a negotiated subprotocol, JSON for none.
+func CodecFor(subprotocol string) (Codec, error) {
+	switch subprotocol {
+	case SubprotocolJSON, "":
+		return JSON, nil
+	case SubprotocolCBOR:
+		return CBOR, nil
+	}
+	return nil, fmt.Errorf("unknown subprotocol %q", subprotocol)
+}
+
+// Transcode re-encodes a JSON frame produced by Encode with c, numbered
+// seq unless seq is zero.
+func Transcode(b []byte, seq int64, c Codec) ([]byte, error) {
+	if c == JSON && seq == 0 {
+		return b, nil
+	}
+	f, err := decodeJSON(b)
+	if err != nil {
+		return nil, err
+	}
+	if seq != 0 {
+		f.Head().Seq = seq
+	}
+	return c.Marshal(f)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string                      { return SubprotocolJSON }
+func (jsonCodec) Binary() bool                      { return false }
+func (jsonCodec) Marshal(f Frame) ([]byte, error)   { return Encode(f) }
+func (jsonCodec) Unmarshal(b []byte) (Frame, error) { return Decode(b) }
+
+type cborCodec struct{}
+
+func (cborCodec) Name() string { return SubprotocolCBOR }
+func (cborCodec) Binary() bool { return true }
+
+func (cborCodec) Marshal(f Frame) ([]byte, error) {
+	head := f.Head()
+	head.V = Version
+	head.Type = f.Kind()
+	if err := f.Validate(); err != nil {
+		return nil, err
+	}
+	var v any = f
+	switch f := f.(type) {
+	case *Message:
+		v = &cborMessage{
+			Header:       f.Header,
+			Recipient:    f.Recipient,
+			ToDevice:     f.ToDevice,
+			MsgID:        f.MsgID,
+			Body:         hexText.pack(f.Body),
+			EncryptedKey: hexText.pack(f.EncryptedKey),
+		}
+	case *PublicKey:
+		v = &cborPublicKey{
+			Header:         f.Header,
+			Recipient:      f.Recipient,
+			ToDevice:       f.ToDevice,
+			PublicKey:      base64Text.pack(f.PublicKey),
+			IdentityPublic: f.IdentityPublic,
+			PublicKeySig:   f.PublicKeySig,
+		}
+	case *EncapKey:
+		v = &cborEncapKey{
+			Header:       f.Header,
+			Recipient:    f.Recipient,
+			ToDevice:     f.ToDevice,
+			EncryptedKey: base64Text.pack(f.EncryptedKey),
+		}
+	}
+	return cbor.Marshal(v)
+}
+
+func (cborCodec) Unmarshal(b []byte) (Frame, error) {
+	if len(b) > MaxFrameSize {
+		return nil, fmt.Errorf("frame too large (%d bytes)", len(b))
+	}
+	var h Header
+	if err := cbor.Unmarshal(b, &h); err != nil {
+		return nil, fmt.Errorf("invalid frame: %w", err)
+	}
+	f, err := newFrame(h)
+	if err != nil {
+		return nil, err
+	}
+	switch f := f.(type) {
+	case *Message:
+		var w cborMessage
+		if err = cbor.Unmarshal(b, &w); err == nil {
+			*f = Message{Header: w.Header, Recipient: w.Recipient, ToDevice: w.ToDevice, MsgID: w.MsgID}
+			if f.Body, err = hexText.unpack(w.Body); err == nil {
+				f.EncryptedKey, err = hexText.unpack(w.EncryptedKey)
+			}
+		}
+	case *PublicKey:
+		var w cborPublicKey
+		if err = cbor.Unmarshal(b, &w); err == nil {
+			*f = PublicKey{Header: w.Header, Recipient: w.Recipient, ToDevice: w.ToDevice, IdentityPublic: w.IdentityPublic, PublicKeySig: w.PublicKeySig}
+			f.PublicKey, err = base64Text.unpack(w.PublicKey)
+		}
+	case *EncapKey:
+		var w cborEncapKey
+		if err = cbor.Unmarshal(b, &w); err == nil {
+			*f = EncapKey{Header: w.Header, Recipient: w.Recipient, ToDevice: w.ToDevice}
+			f.EncryptedKey, err = base64Text.unpack(w.EncryptedKey)
+		}
+	default:
+		err = cbor.Unmarshal(b, f)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s frame: %w", f.Kind(), err)
+	}
+	if err := finish(f); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// CBOR forms of the frames with binary fields. A field holds []byte when
+// the text decoded cleanly, and the text itself otherwise.
+type cborMessage struct {
+	Header
+	Recipient    string `json:"recipient,omitempty"`
+	ToDevice     string `json:"to_device,omitempty"`
+	MsgID        string `json:"msg_id,omitempty"`
+	Body         any    `json:"body"`
+	EncryptedKey any    `json:"encrypted_key,omitempty"`
+}
+
+type cborPublicKey struct {
+	Header
+	Recipient      string `json:"recipient"`
+	ToDevice       string `json:"to_device,omitempty"`
+	PublicKey      any    `json:"public_key"`
+	IdentityPublic string `json:"identity_public,omitempty"`
+	PublicKeySig   string `json:"public_key_sig,omitempty"`
+}
+
+type cborEncapKey struct {
+	Header
+	Recipient    string `json:"recipient"`
+	ToDevice     string `json:"to_device,omitempty"`
+	EncryptedKey any    `json:"encrypted_key"`
+}
+
+// textBytes is a text encoding of bytes used by JSON frames.
+type textBytes struct {
+	decode func(string) ([]byte, error)
+	encode func([]byte) string
+}
+
+var (
+	hexText    = textBytes{hex.DecodeString, hex.EncodeToString}
+	base64Text = textBytes{base64.StdEncoding.DecodeString, base64.StdEncoding.EncodeToString}
+)
+
+// pack returns the bytes s encodes, or s itself if it would not come back
+// unchanged from unpack.
+func (t textBytes) pack(s string) any {
+	if s == "" {
+		return nil
+	}
+	if b, err := t.decode(s); err == nil && t.encode(b) == s {
+		return b
+	}
+	return s
+}
+
+func (t textBytes) unpack(v any) (string, error) {
+	switch v := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case []byte:
+		return t.encode(v), nil
+	}
+	return "", fmt.Errorf("want bytes or text, got %T", v)
+}
@@ -0,0 +1,187 @@
+package protocol
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+const (
+	// AES-GCM adds a nonce and a tag to every plaintext
+	gcmOverhead = 12 + 16
+	// size of a Kyber-1024 public key and of its KEM ciphertext
+	kyberPublicKey  = 1568
+	kyberCiphertext = 1568
+)
+
+var codecs = []Codec{JSON, CBOR}
+
+type benchSample struct {
+	name  string
+	frame Frame
+}
+
+// benchSamples returns frames shaped like what clients send: key exchange
+// frames and an encrypted message per plaintext size.
+func benchSamples() []benchSample {
+	out := []benchSample{
+		{"pubkey", &PublicKey{Header: Header{ID: "alice", Device: "0123456789abcdef"},
+			Recipient: "bob", PublicKey: base64.StdEncoding.EncodeToString(random(kyberPublicKey))}},
+		{"encap_key", &EncapKey{Header: Header{ID: "alice", Device: "0123456789abcdef"},
+			Recipient: "bob", ToDevice: "fedcba9876543210", EncryptedKey: base64.StdEncoding.EncodeToString(random(kyberCiphertext))}},
+	}
+	for _, n := range []int{32, 512, 4096, 24 * 1024} {
+		m := NewMessage("bob", "fedcba9876543210", hex.EncodeToString(random(16)), hex.EncodeToString(random(n+gcmOverhead)))
+		m.ID, m.Device = "alice", "0123456789abcdef"
+		out = append(out, benchSample{fmt.Sprintf("msg_%dB", n), m})
+	}
+	return out
+}
+
+func random(n int) []byte {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return b
+}
+
+// BenchmarkCodecMarshal compares the cost of encoding each sample, and
+// reports its size on the wire.
+func BenchmarkCodecMarshal(b *testing.B) {
+	for _, s := range benchSamples() {
+		for _, c := range codecs {
+			b.Run(s.name+"/"+c.Name(), func(b *testing.B) {
+				b.ReportAllocs()
+				var wire []byte
+				for i := 0; i < b.N; i++ {
+					wire, _ = c.Marshal(s.frame)
+				}
+				b.ReportMetric(float64(len(wire)), "bytes")
+			})
+		}
+	}
+}
+
+// BenchmarkCodecUnmarshal compares the cost of decoding each sample.
+func BenchmarkCodecUnmarshal(b *testing.B) {
+	for _, s := range benchSamples() {
+		for _, c := range codecs {
+			wire, err := c.Marshal(s.frame)
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.Run(s.name+"/"+c.Name(), func(b *testing.B) {
+				b.ReportAllocs()
+				b.SetBytes(int64(len(wire)))
+				for i := 0; i < b.N; i++ {
+					if _, err := c.Unmarshal(wire); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+// roundTripFrames are the golden frames plus text fields the CBOR codec
+// can't carry as bytes and must keep as they were.
+func roundTripFrames() map[string]Frame {
+	frames := goldenFrames()
+	for _, s := range benchSamples() {
+		frames[s.name] = s.frame
+	}
+	frames["msg_not_hex"] = NewMessage("bob", "", "m1", "not hex")
+	frames["msg_upper_hex"] = NewMessage("bob", "", "m1", "00FF")
+	frames["msg_odd_hex"] = NewMessage("bob", "", "m1", "abc")
+	frames["pubkey_unpadded"] = NewPublicKey("bob", "", "cHVibGlj0")
+	frames["encap_key_url_base64"] = NewEncapKey("bob", "", "-_-_")
+	return frames
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	for name, f := range roundTripFrames() {
+		for _, c := range codecs {
+			t.Run(name+"/"+c.Name(), func(t *testing.T) {
+				b, err := c.Marshal(f)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, err := c.Unmarshal(b)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(got, f) {
+					t.Fatalf("Unmarshal = %#v\nwant %#v", got, f)
+				}
+			})
+		}
+	}
+}
+
+func TestTranscode(t *testing.T) {
+	for name, f := range roundTripFrames() {
+		t.Run(name, func(t *testing.T) {
+			js, err := Encode(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			same, err := Transcode(js, 0, JSON)
+			if err != nil || !bytes.Equal(same, js) {
+				t.Fatalf("Transcode to JSON without a seq = %s, %v; want the frame unchanged", same, err)
+			}
+
+			// JSON to CBOR and back, numbered on the way
+			cb, err := Transcode(js, 9, CBOR)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := CBOR.Unmarshal(cb)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Head().Seq != 9 {
+				t.Fatalf("seq = %d, want 9", got.Head().Seq)
+			}
+			back, err := JSON.Marshal(got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, err := Transcode(js, 9, JSON)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(back, want) {
+				t.Fatalf("JSON -> CBOR -> JSON = %s\nwant %s", back, want)
+			}
+			got.Head().Seq = f.Head().Seq
+			if !reflect.DeepEqual(got, f) {
+				t.Fatalf("CBOR frame = %#v\nwant %#v", got, f)
+			}
+		})
+	}
+}
+
+func TestTranscodeRejectsBadFrames(t *testing.T) {
+	if _, err := Transcode([]byte(`{"v":1,"type":"msg"}`), 1, CBOR); err == nil {
+		t.Fatal("Transcode accepted a message without a body")
+	}
+}
+
+func TestCBORIsSmaller(t *testing.T) {
+	for _, s := range benchSamples() {
+		js, err := JSON.Marshal(s.frame)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cb, err := CBOR.Marshal(s.frame)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(cb) >= len(js) {
+			t.Errorf("%s: CBOR %d bytes, JSON %d", s.name, len(cb), len(js))
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package protocol
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	TypeHello   Type = "hello"   // first frame of a client
+	TypeWelcome Type = "welcome" // server's answer to hello
+)
+
+// SuiteKyberAESGCM is the end-to-end encryption suite: Kyber-1024 key
+// encapsulation, HKDF-SHA256 key derivation and AES-256-GCM.
+const SuiteKyberAESGCM = "kyber1024-hkdf-sha256-aes256gcm"
+
+// Features a server may enable.
+const (
+	FeatureHistory    = "history"    // stored messages and history requests
+	FeatureReceipts   = "receipts"   // delivered/read acks
+	FeatureDevices    = "devices"    // several linked devices per user
+	FeatureFederation = "federation" // user@domain recipients
+	FeatureResume     = "resume"     // resume tokens and replay after a drop
+)
+
+// WebSocket close codes used when a connection is refused during the
+// handshake. The close reason explains the problem to the user.
+const (
+	CloseHandshakeRequired  = 4000 // the first frame was not a hello
+	CloseUnsupportedVersion = 4001 // no protocol version in common
+	CloseNoCommonSuite      = 4002 // no crypto suite in common
+)
+
+// HandshakeTimeout is how long a server waits for hello.
+const HandshakeTimeout = 10 * time.Second
+
+// Hello opens a connection. It lists what the client can speak.
+type Hello struct {
+	Header
+	Versions []int    `json:"versions"`
+	Software string   `json:"software,omitempty"`
+	Suites   []string `json:"suites"`
+	Features []string `json:"features,omitempty"` // features the client wants to use
+	// Resume is the token from the welcome of a dropped connection, and
+	// LastSeq the last frame received on it.
+	Resume  string `json:"resume,omitempty"`
+	LastSeq int64  `json:"last_seq,omitempty"`
+}
+
+// NewHello returns a hello for this package's protocol version and suite.
+func NewHello(software string, features ...string) *Hello {
+	return &Hello{
+		Header:   header(TypeHello),
+		Versions: []int{Version},
+		Software: software,
+		Suites:   []string{SuiteKyberAESGCM},
+		Features: features,
+	}
+}
+
+func (h *Hello) Kind() Type { return TypeHello }
+
+// Validate accepts any header version: a hello from a newer client is how
+// the two sides find a version in common.
+func (h *Hello) Validate() error {
+	if len(h.ID) > MaxIDLength || len(h.Device) > MaxIDLength {
+		return fmt.Errorf("hello frame: sender id too long")
+	}
+	if len(h.Versions) == 0 {
+		return missing(TypeHello, "versions")
+	}
+	if len(h.Suites) == 0 {
+		return missing(TypeHello, "suites")
+	}
+	return nil
+}
+
+// Welcome accepts a connection and tells the client what was agreed and
+// what the server supports.
+type Welcome struct {
+	Header
+	Version      int      `json:"version"`
+	Software     string   `json:"software,omitempty"`
+	Suite        string   `json:"suite"`
+	MaxFrameSize int      `json:"max_frame_size"`
+	Features     []string `json:"features"`
+	ServerTime   int64    `json:"server_time"` // unix millis
+	// ResumeToken resumes this connection's session after a drop. Resumed
+	// reports whether the hello's token was accepted; frames after its
+	// LastSeq are replayed first.
+	ResumeToken string `json:"resume_token,omitempty"`
+	Resumed     bool   `json:"resumed,omitempty"`
+}
+
+func (w *Welcome) Kind() Type { return TypeWelcome }
+
+func (w *Welcome) Validate() error {
+	if err := w.validate(); err != nil {
+		return err
+	}
+	if w.Version < 1 || w.Version > Version {
+		return fmt.Errorf("%w: %d", ErrUnsupportedVersion, w.Version)
+	}
+	if w.Suite == "" {
+		return missing(TypeWelcome, "suite")
+	}
+	if w.MaxFrameSize <= 0 {
+		return missing(TypeWelcome, "max_frame_size")
+	}
+	return nil
+}
+
+// HasFeature reports whether the server enabled feature.
+func (w *Welcome) HasFeature(feature string) bool {
+	for _, f := range w.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// Negotiate picks the highest protocol version and the first of the
+// client's suites that this side also supports. On failure it returns the
+// close code and reason to send.
+func Negotiate(h *Hello, suites []string) (version int, suite string, code int, reason string) {
+	for _, v := range h.Versions {
+		if v <= Version && v > version {
+			version = v
+		}
+	}
+	if version == 0 {
+		return 0, "", CloseUnsupportedVersion, fmt.Sprintf("protocol versions %v not supported, server speaks %d", h.Versions, Version)
+	}
+	for _, s := range h.Suites {
+		for _, ours := range suites {
+			if s == ours {
+				return version, s, 0, ""
+			}
+		}
+	}
+	return 0, "", CloseNoCommonSuite, fmt.Sprintf("crypto suites %v not supported, server accepts %v", h.Suites, suites)
+}
@@ -0,0 +1,443 @@
+// Package protocol defines the frames exchanged between chat clients and the
+// server over the websocket connection. Every frame is an object with a
+// version ("v") and a type; the remaining fields depend on the type. Frames
+// are JSON unless the connection negotiated another Codec.
+package protocol
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Version is the protocol version spoken by this package. Frames without a
+// version are treated as version 1.
+const Version = 1
+
+const (
+	// MaxFrameSize is the largest frame a peer may send.
+	MaxFrameSize = 64 * 1024
+	// MaxIDLength bounds user and device identifiers.
+	MaxIDLength = 256
+)
+
+// Type names a kind of frame.
+type Type string
+
+const (
+	TypeMessage        Type = "msg"          // encrypted message, client to client
+	TypePublicKey      Type = "pubkey"       // KEM public key announcement
+	TypeEncapKey       Type = "encap_key"    // KEM ciphertext establishing a session key
+	TypeAck            Type = "ack"          // delivery status of a message
+	TypeHistoryRequest Type = "history"      // client asks for stored messages
+	TypeHistoryPage    Type = "history_page" // server answers a history request
+	TypeError          Type = "error"        // server reports a problem
+	TypeDeviceLink     Type = "device_link"  // server asks to approve a new device
+)
+
+// Delivery statuses carried by an Ack.
+const (
+	StatusQueued    = "queued"
+	StatusDelivered = "delivered"
+	StatusRead      = "read"
+)
+
+var (
+	ErrUnsupportedVersion = errors.New("unsupported protocol version")
+	ErrUnknownType        = errors.New("unknown frame type")
+)
+
+// Header is common to every frame. ID and Device name the sender; both are
+// empty for frames generated by the server. Seq numbers the frames a server
+// sends on a resumable connection.
+type Header struct {
+	V      int    `json:"v"`
+	Type   Type   `json:"type"`
+	ID     string `json:"id,omitempty"`
+	Device string `json:"device,omitempty"`
+	Seq    int64  `json:"seq,omitempty"`
+}
+
+// Head returns the frame's header.
+func (h *Header) Head() *Header { return h }
+
+func (h *Header) validate() error {
+	if h.V > Version {
+		return fmt.Errorf("%w: %d", ErrUnsupportedVersion, h.V)
+	}
+	if len(h.ID) > MaxIDLength || len(h.Device) > MaxIDLength {
+		return fmt.Errorf("%s frame: sender id too long", h.Type)
+	}
+	return nil
+}
+
+// Frame is implemented by every frame type.
+type Frame interface {
+	Head() *Header
+	Kind() Type
+	Validate() error
+}
+
+// Targeted is implemented by frames the server routes to another user.
+type Targeted interface {
+	Frame
+	// Target returns the recipient and, for frames meant for one of the
+	// recipient's devices, that device.
+	Target() (recipient, toDevice string)
+	SetRecipient(recipient string)
+}
+
+// Message is an encrypted chat message. A message without a recipient is
+// broadcast to every connected client.
+type Message struct {
+	Header
+	Recipient    string `json:"recipient,omitempty"`
+	ToDevice     string `json:"to_device,omitempty"`
+	MsgID        string `json:"msg_id,omitempty"`
+	Body         string `json:"body"`
+	EncryptedKey string `json:"encrypted_key,omitempty"` // one-off hex key used before a session exists
+}
+
+// NewMessage returns a message for one device of to (or all of them when
+// toDevice is empty).
+func NewMessage(to, toDevice, msgID, body string) *Message {
+	return &Message{Header: header(TypeMessage), Recipient: to, ToDevice: toDevice, MsgID: msgID, Body: body}
+}
+
+func (m *Message) Kind() Type                    { return TypeMessage }
+func (m *Message) Target() (string, string)      { return m.Recipient, m.ToDevice }
+func (m *Message) SetRecipient(recipient string) { m.Recipient = recipient }
+
+func (m *Message) Validate() error {
+	if err := m.validate(); err != nil {
+		return err
+	}
+	if m.Body == "" {
+		return missing(TypeMessage, "body")
+	}
+	return checkIDs(TypeMessage, m.Recipient, m.ToDevice)
+}
+
+// PublicKey announces the sender device's KEM public key (base64).
+type PublicKey struct {
+	Header
+	Recipient      string `json:"recipient"`
+	ToDevice       string `json:"to_device,omitempty"`
+	PublicKey      string `json:"public_key"`
+	IdentityPublic string `json:"identity_public,omitempty"`
+	PublicKeySig   string `json:"public_key_sig,omitempty"`
+}
+
+// NewPublicKey returns an announcement of pub for to.
+func NewPublicKey(to, toDevice, pub string) *PublicKey {
+	return &PublicKey{Header: header(TypePublicKey), Recipient: to, ToDevice: toDevice, PublicKey: pub}
+}
+
+func (p *PublicKey) Kind() Type                    { return TypePublicKey }
+func (p *PublicKey) Target() (string, string)      { return p.Recipient, p.ToDevice }
+func (p *PublicKey) SetRecipient(recipient string) { p.Recipient = recipient }
+
+func (p *PublicKey) Validate() error {
+	if err := p.validate(); err != nil {
+		return err
+	}
+	if p.Recipient == "" {
+		return missing(TypePublicKey, "recipient")
+	}
+	if p.PublicKey == "" {
+		return missing(TypePublicKey, "public_key")
+	}
+	return checkIDs(TypePublicKey, p.Recipient, p.ToDevice)
+}
+
+// EncapKey carries a KEM ciphertext (base64) from which the receiving device
+// derives the session key shared with the sender.
+type EncapKey struct {
+	Header
+	Recipient    string `json:"recipient"`
+	ToDevice     string `json:"to_device,omitempty"`
+	EncryptedKey string `json:"encrypted_key"`
+}
+
+// NewEncapKey returns a key encapsulation for one device of to.
+func NewEncapKey(to, toDevice, ciphertext string) *EncapKey {
+	return &EncapKey{Header: header(TypeEncapKey), Recipient: to, ToDevice: toDevice, EncryptedKey: ciphertext}
+}
+
+func (e *EncapKey) Kind() Type                    { return TypeEncapKey }
+func (e *EncapKey) Target() (string, string)      { return e.Recipient, e.ToDevice }
+func (e *EncapKey) SetRecipient(recipient string) { e.Recipient = recipient }
+
+func (e *EncapKey) Validate() error {
+	if err := e.validate(); err != nil {
+		return err
+	}
+	if e.Recipient == "" {
+		return missing(TypeEncapKey, "recipient")
+	}
+	if e.EncryptedKey == "" {
+		return missing(TypeEncapKey, "encrypted_key")
+	}
+	return checkIDs(TypeEncapKey, e.Recipient, e.ToDevice)
+}
+
+// Ack reports the delivery status of message MsgID. The server acks with
+// queued or delivered; the recipient's client acks with delivered and read.
+// Recipient is the user the ack is sent to, or for server acks the user the
+// message was sent to.
+type Ack struct {
+	Header
+	Recipient string `json:"recipient"`
+	MsgID     string `json:"msg_id"`
+	Status    string `json:"body"`
+}
+
+// NewAck returns an ack with status for msgID.
+func NewAck(to, msgID, status string) *Ack {
+	return &Ack{Header: header(TypeAck), Recipient: to, MsgID: msgID, Status: status}
+}
+
+func (a *Ack) Kind() Type                    { return TypeAck }
+func (a *Ack) Target() (string, string)      { return a.Recipient, "" }
+func (a *Ack) SetRecipient(recipient string) { a.Recipient = recipient }
+
+func (a *Ack) Validate() error {
+	if err := a.validate(); err != nil {
+		return err
+	}
+	if a.Recipient == "" {
+		return missing(TypeAck, "recipient")
+	}
+	if a.MsgID == "" {
+		return missing(TypeAck, "msg_id")
+	}
+	switch a.Status {
+	case StatusQueued, StatusDelivered, StatusRead:
+	default:
+		return fmt.Errorf("ack frame: unknown status %q", a.Status)
+	}
+	return checkIDs(TypeAck, a.Recipient, "")
+}
+
+// HistoryRequest asks for up to Limit stored messages exchanged with
+// Recipient, older than the Before cursor (or BeforeTS, unix millis).
+type HistoryRequest struct {
+	Header
+	Recipient string `json:"recipient"`
+	Before    int64  `json:"before,omitempty"`
+	BeforeTS  int64  `json:"before_ts,omitempty"`
+	Limit     int    `json:"limit,omitempty"`
+}
+
+// NewHistoryRequest returns a request for the page before cursor.
+func NewHistoryRequest(with string, before int64, limit int) *HistoryRequest {
+	return &HistoryRequest{Header: header(TypeHistoryRequest), Recipient: with, Before: before, Limit: limit}
+}
+
+func (r *HistoryRequest) Kind() Type { return TypeHistoryRequest }
+
+func (r *HistoryRequest) Validate() error {
+	if err := r.validate(); err != nil {
+		return err
+	}
+	if r.Recipient == "" {
+		return missing(TypeHistoryRequest, "recipient")
+	}
+	if r.Before < 0 || r.BeforeTS < 0 || r.Limit < 0 {
+		return fmt.Errorf("history frame: negative cursor or limit")
+	}
+	return checkIDs(TypeHistoryRequest, r.Recipient, "")
+}
+
+// HistoryEntry is one stored envelope. Seq is a server-assigned, increasing
+// message ID, the same on every instance of a cluster, that clients use as a
+// pagination cursor.
+type HistoryEntry struct {
+	Seq        int64           `json:"seq"`
+	Timestamp  int64           `json:"ts"` // unix millis
+	From       string          `json:"from"`
+	FromDevice string          `json:"from_device,omitempty"`
+	To         string          `json:"to"`
+	MsgID      string          `json:"msg_id,omitempty"`
+	ToDevice   string          `json:"to_device,omitempty"`
+	Envelope   json.RawMessage `json:"envelope"`
+}
+
+// HistoryPage answers a HistoryRequest, newest message first. NextBefore is
+// the cursor for the next older page, zero when there is none.
+type HistoryPage struct {
+	Header
+	Recipient  string         `json:"recipient"`
+	Messages   []HistoryEntry `json:"messages"`
+	NextBefore int64          `json:"next_before,omitempty"`
+}
+
+// NewHistoryPage returns a page of messages for the user to.
+func NewHistoryPage(to string, messages []HistoryEntry, next int64) *HistoryPage {
+	return &HistoryPage{Header: header(TypeHistoryPage), Recipient: to, Messages: messages, NextBefore: next}
+}
+
+func (p *HistoryPage) Kind() Type { return TypeHistoryPage }
+
+func (p *HistoryPage) Validate() error {
+	if err := p.validate(); err != nil {
+		return err
+	}
+	if p.NextBefore < 0 {
+		return fmt.Errorf("history_page frame: negative cursor")
+	}
+	return nil
+}
+
+// Error reports a problem with an earlier frame (MsgID, when known).
+type Error struct {
+	Header
+	MsgID string `json:"msg_id,omitempty"`
+	Text  string `json:"body"`
+}
+
+// NewError returns an error frame with text.
+func NewError(text string) *Error {
+	return &Error{Header: header(TypeError), Text: text}
+}
+
+func (e *Error) Kind() Type { return TypeError }
+
+func (e *Error) Validate() error {
+	if err := e.validate(); err != nil {
+		return err
+	}
+	if e.Text == "" {
+		return missing(TypeError, "body")
+	}
+	return nil
+}
+
+// DeviceLink tells a user's approved devices that a new device (Header.Device)
+// asked to join the account.
+type DeviceLink struct {
+	Header
+	Recipient  string `json:"recipient"`
+	DeviceName string `json:"device_name,omitempty"`
+}
+
+// NewDeviceLink returns a link request for device of user id.
+func NewDeviceLink(id, device, name string) *DeviceLink {
+	d := &DeviceLink{Header: header(TypeDeviceLink), Recipient: id, DeviceName: name}
+	d.Device = device
+	return d
+}
+
+func (d *DeviceLink) Kind() Type { return TypeDeviceLink }
+
+func (d *DeviceLink) Validate() error {
+	if err := d.validate(); err != nil {
+		return err
+	}
+	if d.Recipient == "" {
+		return missing(TypeDeviceLink, "recipient")
+	}
+	if d.Device == "" {
+		return missing(TypeDeviceLink, "device")
+	}
+	return checkIDs(TypeDeviceLink, d.Recipient, "")
+}
+
+// Decode parses and validates one JSON frame. Frames without a type are
+// legacy messages.
+func Decode(b []byte) (Frame, error) {
+	if len(b) > MaxFrameSize {
+		return nil, fmt.Errorf("frame too large (%d bytes)", len(b))
+	}
+	return decodeJSON(b)
+}
+
+// decodeJSON is Decode without the size limit, for frames the server
+// produced itself.
+func decodeJSON(b []byte) (Frame, error) {
+	var h Header
+	if err := json.Unmarshal(b, &h); err != nil {
+		return nil, fmt.Errorf("invalid frame: %w", err)
+	}
+	f, err := newFrame(h)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, f); err != nil {
+		return nil, fmt.Errorf("invalid %s frame: %w", f.Kind(), err)
+	}
+	if err := finish(f); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// newFrame returns an empty frame of the type named by h.
+func newFrame(h Header) (Frame, error) {
+	// a hello from a newer client still gets to negotiate
+	if h.V > Version && h.Type != TypeHello {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, h.V)
+	}
+	switch h.Type {
+	case TypeMessage, "":
+		return &Message{}, nil
+	case TypePublicKey:
+		return &PublicKey{}, nil
+	case TypeEncapKey:
+		return &EncapKey{}, nil
+	case TypeAck:
+		return &Ack{}, nil
+	case TypeHistoryRequest:
+		return &HistoryRequest{}, nil
+	case TypeHistoryPage:
+		return &HistoryPage{}, nil
+	case TypeError:
+		return &Error{}, nil
+	case TypeDeviceLink:
+		return &DeviceLink{}, nil
+	case TypeHello:
+		return &Hello{}, nil
+	case TypeWelcome:
+		return &Welcome{}, nil
+	}
+	return nil, fmt.Errorf("%w: %q", ErrUnknownType, h.Type)
+}
+
+// finish fills in the header of a decoded frame and validates it.
+func finish(f Frame) error {
+	head := f.Head()
+	head.Type = f.Kind()
+	if head.V == 0 {
+		head.V = Version
+	}
+	return f.Validate()
+}
+
+// Encode stamps f with the current version and its type, validates it and
+// returns its JSON encoding.
+func Encode(f Frame) ([]byte, error) {
+	head := f.Head()
+	head.V = Version
+	head.Type = f.Kind()
+	if err := f.Validate(); err != nil {
+		return nil, err
+	}
+	return json.Marshal(f)
+}
+
+func header(t Type) Header {
+	return Header{V: Version, Type: t}
+}
+
+func missing(t Type, field string) error {
+	return fmt.Errorf("%s frame: missing %s", t, field)
+}
+
+func checkIDs(t Type, ids ...string) error {
+	for _, id := range ids {
+		if len(id) > MaxIDLength {
+			return fmt.Errorf("%s frame: id too long", t)
+		}
+	}
+	return nil
+}
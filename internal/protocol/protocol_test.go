@@ -0,0 +1,191 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// goldenFrames are the frames in testdata: one of every type, plus a few
+// variants. Run the tests with -update to rewrite the files.
+func goldenFrames() map[string]Frame {
+	m := NewMessage("bob", "b1", "m1", "00ff")
+	m.ID, m.Device = "alice", "a1"
+	oneOff := NewMessage("bob", "", "m2", "c0ffee")
+	oneOff.ID, oneOff.EncryptedKey = "alice", "0a0b0c"
+	pub := NewPublicKey("bob", "b1", "cHVibGlj")
+	pub.ID, pub.Device, pub.IdentityPublic, pub.PublicKeySig = "alice", "a1", "aWRlbnRpdHk=", "c2ln"
+	encap := NewEncapKey("bob", "b1", "Y2lwaGVydGV4dA==")
+	encap.ID, encap.Device = "alice", "a1"
+	ack := NewAck("alice", "m1", StatusRead)
+	ack.ID, ack.Device = "bob", "b1"
+	req := NewHistoryRequest("bob", 42, 20)
+	req.BeforeTS = 1700000000000
+	page := NewHistoryPage("alice", []HistoryEntry{{
+		Seq: 41, Timestamp: 1700000000000, From: "alice", FromDevice: "a1", To: "bob", MsgID: "m1",
+		Envelope: json.RawMessage(`{"v":1,"type":"msg","id":"alice","recipient":"bob","msg_id":"m1","body":"00ff"}`),
+	}}, 41)
+	e := NewError("recipient not found")
+	e.MsgID = "m1"
+	hello := NewHello("chat-app/test", FeatureHistory, FeatureResume)
+	hello.Resume, hello.LastSeq = "token", 7
+	seq := NewAck("alice", "m1", StatusDelivered)
+	seq.Seq = 8
+	return map[string]Frame{
+		"msg":          m,
+		"msg_one_off":  oneOff,
+		"pubkey":       pub,
+		"encap_key":    encap,
+		"ack":          ack,
+		"ack_seq":      seq,
+		"history":      req,
+		"history_page": page,
+		"error":        e,
+		"device_link":  NewDeviceLink("alice", "a2", "laptop"),
+		"hello":        hello,
+		"welcome": &Welcome{
+			Header: header(TypeWelcome), Version: Version, Software: "chat-app/test", Suite: SuiteKyberAESGCM,
+			MaxFrameSize: MaxFrameSize, Features: []string{FeatureHistory, FeatureResume},
+			ServerTime: 1700000000000, ResumeToken: "token", Resumed: true,
+		},
+	}
+}
+
+func TestGoldenFrames(t *testing.T) {
+	for name, want := range goldenFrames() {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join("testdata", name+".json")
+			got, err := Encode(want)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *update {
+				var out bytes.Buffer
+				_ = json.Indent(&out, got, "", "  ")
+				out.WriteByte('\n')
+				if err := os.WriteFile(path, out.Bytes(), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			golden, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var compact bytes.Buffer
+			if err := json.Compact(&compact, golden); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, compact.Bytes()) {
+				t.Fatalf("Encode = %s\nwant %s", got, compact.Bytes())
+			}
+
+			f, err := Decode(compact.Bytes())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if f.Kind() != want.Kind() {
+				t.Fatalf("decoded a %s frame, want %s", f.Kind(), want.Kind())
+			}
+			if !reflect.DeepEqual(f, want) {
+				t.Fatalf("Decode = %#v\nwant %#v", f, want)
+			}
+		})
+	}
+}
+
+func TestDecodeLegacyMessage(t *testing.T) {
+	f, err := Decode([]byte(`{"recipient":"bob","body":"00ff"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, ok := f.(*Message)
+	if !ok || m.V != Version || m.Type != TypeMessage || m.Recipient != "bob" || m.Body != "00ff" {
+		t.Fatalf("Decode = %#v, want a version %d message", f, Version)
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	long := strings.Repeat("x", MaxIDLength+1)
+	tests := []struct {
+		name  string
+		frame string
+		want  string // substring of the error
+		is    error
+	}{
+		{"not json", `{"type":`, "invalid frame", nil},
+		{"newer version", `{"v":2,"type":"msg","body":"00"}`, "", ErrUnsupportedVersion},
+		{"unknown type", `{"v":1,"type":"gossip"}`, "", ErrUnknownType},
+		{"wrong field type", `{"v":1,"type":"msg","body":5}`, "invalid msg frame", nil},
+		{"sender id too long", `{"v":1,"type":"msg","id":"` + long + `","body":"00"}`, "msg frame: sender id too long", nil},
+		{"msg without body", `{"v":1,"type":"msg","recipient":"bob"}`, "msg frame: missing body", nil},
+		{"msg recipient too long", `{"v":1,"type":"msg","recipient":"` + long + `","body":"00"}`, "msg frame: id too long", nil},
+		{"msg device too long", `{"v":1,"type":"msg","recipient":"bob","to_device":"` + long + `","body":"00"}`, "msg frame: id too long", nil},
+		{"pubkey without recipient", `{"v":1,"type":"pubkey","public_key":"cA=="}`, "pubkey frame: missing recipient", nil},
+		{"pubkey without key", `{"v":1,"type":"pubkey","recipient":"bob"}`, "pubkey frame: missing public_key", nil},
+		{"encap_key without recipient", `{"v":1,"type":"encap_key","encrypted_key":"cA=="}`, "encap_key frame: missing recipient", nil},
+		{"encap_key without key", `{"v":1,"type":"encap_key","recipient":"bob"}`, "encap_key frame: missing encrypted_key", nil},
+		{"ack without recipient", `{"v":1,"type":"ack","msg_id":"m1","body":"read"}`, "ack frame: missing recipient", nil},
+		{"ack without msg_id", `{"v":1,"type":"ack","recipient":"bob","body":"read"}`, "ack frame: missing msg_id", nil},
+		{"ack with unknown status", `{"v":1,"type":"ack","recipient":"bob","msg_id":"m1","body":"lost"}`, `ack frame: unknown status "lost"`, nil},
+		{"history without recipient", `{"v":1,"type":"history"}`, "history frame: missing recipient", nil},
+		{"history with negative cursor", `{"v":1,"type":"history","recipient":"bob","before":-1}`, "history frame: negative cursor or limit", nil},
+		{"history with negative limit", `{"v":1,"type":"history","recipient":"bob","limit":-1}`, "history frame: negative cursor or limit", nil},
+		{"history_page with negative cursor", `{"v":1,"type":"history_page","recipient":"bob","messages":[],"next_before":-1}`, "history_page frame: negative cursor", nil},
+		{"error without body", `{"v":1,"type":"error"}`, "error frame: missing body", nil},
+		{"device_link without recipient", `{"v":1,"type":"device_link","device":"a2"}`, "device_link frame: missing recipient", nil},
+		{"device_link without device", `{"v":1,"type":"device_link","recipient":"alice"}`, "device_link frame: missing device", nil},
+		{"hello without versions", `{"v":1,"type":"hello","suites":["s"]}`, "hello frame: missing versions", nil},
+		{"hello without suites", `{"v":1,"type":"hello","versions":[1]}`, "hello frame: missing suites", nil},
+		{"welcome with version 0", `{"v":1,"type":"welcome","suite":"s","max_frame_size":1}`, "", ErrUnsupportedVersion},
+		{"welcome with a newer version", `{"v":1,"type":"welcome","version":2,"suite":"s","max_frame_size":1}`, "", ErrUnsupportedVersion},
+		{"welcome without suite", `{"v":1,"type":"welcome","version":1,"max_frame_size":1}`, "welcome frame: missing suite", nil},
+		{"welcome without max_frame_size", `{"v":1,"type":"welcome","version":1,"suite":"s"}`, "welcome frame: missing max_frame_size", nil},
+		{"too large", `{"v":1,"type":"msg","body":"` + strings.Repeat("0", MaxFrameSize) + `"}`, "frame too large", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := Decode([]byte(tt.frame))
+			if err == nil {
+				t.Fatalf("Decode = %#v, want an error", f)
+			}
+			if tt.is != nil && !errors.Is(err, tt.is) {
+				t.Fatalf("error %q, want %v", err, tt.is)
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("error %q, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeHelloFromNewerClient(t *testing.T) {
+	f, err := Decode([]byte(`{"v":3,"type":"hello","versions":[3,1],"suites":["` + SuiteKyberAESGCM + `"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	version, suite, code, _ := Negotiate(f.(*Hello), []string{SuiteKyberAESGCM})
+	if version != Version || suite != SuiteKyberAESGCM || code != 0 {
+		t.Fatalf("Negotiate = %d, %q, %d; want %d, %q, 0", version, suite, code, Version, SuiteKyberAESGCM)
+	}
+}
+
+func TestEncodeValidates(t *testing.T) {
+	for _, f := range []Frame{
+		NewMessage("bob", "", "m1", ""),
+		NewAck("bob", "m1", "lost"),
+		NewPublicKey("", "", "cA=="),
+		&Welcome{Version: Version, MaxFrameSize: MaxFrameSize},
+	} {
+		if b, err := Encode(f); err == nil {
+			t.Errorf("Encode(%s) = %s, want an error", f.Kind(), b)
+		}
+	}
+}
@@ -0,0 +1,307 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"sync"
+
+	"github.com/marcoantonios1/chat-app/internal/protocol"
+)
+
+// Backplane message kinds.
+const (
+	bpDeliver   = "deliver"   // a frame for one device connected to Target
+	bpBroadcast = "broadcast" // a frame for every connected client
+	bpKick      = "kick"      // disconnect a revoked device
+	bpPresence  = "presence"  // a device connected to or left Origin
+	bpDevice    = "device"    // a user's device record changed
+	bpHistory   = "history"   // a message was stored in history
+	bpPrekey    = "prekey"    // a device announced its public key
+	bpHello     = "hello"     // Origin joined and wants a snapshot
+	bpLeave     = "leave"     // Origin went away; forget its devices
+)
+
+// BackplaneMessage is what server instances exchange over a Backplane.
+type BackplaneMessage struct {
+	Kind    string                 `json:"kind"`
+	Origin  string                 `json:"origin"`           // publishing instance
+	Target  string                 `json:"target,omitempty"` // receiving instance, empty for all
+	User    string                 `json:"user,omitempty"`
+	Device  string                 `json:"device,omitempty"`
+	Online  bool                   `json:"online,omitempty"`
+	Record  *Device                `json:"record,omitempty"`
+	History *protocol.HistoryEntry `json:"history,omitempty"`
+	Payload []byte                 `json:"payload,omitempty"`
+}
+
+// Backplane connects the hubs of several server instances. The hub publishes
+// frames for devices connected elsewhere and keeps a directory of which
+// instance each device is connected to.
+type Backplane interface {
+	// Instance returns the name of this instance.
+	Instance() string
+	// Publish sends m to the other instances (or to m.Target only).
+	Publish(m BackplaneMessage) error
+	// Subscribe sets the handler for messages from other instances and
+	// starts receiving. The handler must not block.
+	Subscribe(fn func(BackplaneMessage))
+	// SetPresence records that a local device connected or disconnected
+	// and announces it to the other instances.
+	SetPresence(user, device string, online bool) error
+	// Locate returns the instance a device is connected to.
+	Locate(user, device string) (string, bool)
+	Close() error
+}
+
+// NewInstanceID returns a random instance name.
+func NewInstanceID() string {
+	b := make([]byte, 4)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// presenceDirectory maps connected devices to the instance holding them.
+// Both backplane implementations keep one per instance.
+type presenceDirectory struct {
+	mu      sync.RWMutex
+	devices map[deviceRef]string
+}
+
+func newPresenceDirectory() *presenceDirectory {
+	return &presenceDirectory{devices: make(map[deviceRef]string)}
+}
+
+func (d *presenceDirectory) set(user, device, instance string, online bool) {
+	ref := deviceRef{user, device}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if online {
+		d.devices[ref] = instance
+	} else if d.devices[ref] == instance {
+		// a device that already moved on must not be removed by its old instance
+		delete(d.devices, ref)
+	}
+}
+
+func (d *presenceDirectory) locate(user, device string) (string, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	instance, ok := d.devices[deviceRef{user, device}]
+	return instance, ok
+}
+
+// dropInstance forgets every device connected to instance.
+func (d *presenceDirectory) dropInstance(instance string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for ref, in := range d.devices {
+		if in == instance {
+			delete(d.devices, ref)
+		}
+	}
+}
+
+// keepOnly forgets every device not connected to instance.
+func (d *presenceDirectory) keepOnly(instance string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for ref, in := range d.devices {
+		if in != instance {
+			delete(d.devices, ref)
+		}
+	}
+}
+
+// held returns the devices connected to instance.
+func (d *presenceDirectory) held(instance string) []deviceRef {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	var out []deviceRef
+	for ref, in := range d.devices {
+		if in == instance {
+			out = append(out, ref)
+		}
+	}
+	return out
+}
+
+// observe updates the directory from a message received from another
+// instance. It is shared by the backplane implementations.
+func (d *presenceDirectory) observe(m BackplaneMessage) {
+	switch m.Kind {
+	case bpPresence:
+		d.set(m.User, m.Device, m.Origin, m.Online)
+	case bpLeave:
+		d.dropInstance(m.Origin)
+	}
+}
+
+// MemoryBus is an in-process backplane. Every hub joined to it shares the
+// process's user directory and history, so only routing and presence
+// traffic crosses it.
+type MemoryBus struct {
+	mu      sync.RWMutex
+	members map[string]*memoryBackplane
+}
+
+// NewMemoryBus returns an empty in-process bus.
+func NewMemoryBus() *MemoryBus {
+	return &MemoryBus{members: make(map[string]*memoryBackplane)}
+}
+
+// Join adds an instance to the bus.
+func (b *MemoryBus) Join(instance string) Backplane {
+	m := &memoryBackplane{bus: b, instance: instance, dir: newPresenceDirectory()}
+	b.mu.Lock()
+	b.members[instance] = m
+	b.mu.Unlock()
+	return m
+}
+
+type memoryBackplane struct {
+	bus      *MemoryBus
+	instance string
+	dir      *presenceDirectory
+
+	mu      sync.RWMutex
+	handler func(BackplaneMessage)
+}
+
+func (m *memoryBackplane) Instance() string { return m.instance }
+
+func (m *memoryBackplane) Publish(msg BackplaneMessage) error {
+	switch msg.Kind {
+	case bpDevice, bpHistory, bpPrekey:
+		// already shared through the process's globals
+		return nil
+	}
+	msg.Origin = m.instance
+	m.bus.mu.RLock()
+	peers := make([]*memoryBackplane, 0, len(m.bus.members))
+	for name, p := range m.bus.members {
+		if name != m.instance && (msg.Target == "" || msg.Target == name) {
+			peers = append(peers, p)
+		}
+	}
+	m.bus.mu.RUnlock()
+	for _, p := range peers {
+		p.receive(msg)
+	}
+	return nil
+}
+
+func (m *memoryBackplane) receive(msg BackplaneMessage) {
+	m.dir.observe(msg)
+	m.mu.RLock()
+	fn := m.handler
+	m.mu.RUnlock()
+	if fn != nil {
+		fn(msg)
+	}
+}
+
+func (m *memoryBackplane) Subscribe(fn func(BackplaneMessage)) {
+	m.mu.Lock()
+	m.handler = fn
+	m.mu.Unlock()
+}
+
+func (m *memoryBackplane) SetPresence(user, device string, online bool) error {
+	m.dir.set(user, device, m.instance, online)
+	return m.Publish(BackplaneMessage{Kind: bpPresence, User: user, Device: device, Online: online})
+}
+
+func (m *memoryBackplane) Locate(user, device string) (string, bool) {
+	return m.dir.locate(user, device)
+}
+
+func (m *memoryBackplane) Close() error {
+	m.bus.mu.Lock()
+	delete(m.bus.members, m.instance)
+	m.bus.mu.Unlock()
+	return m.Publish(BackplaneMessage{Kind: bpLeave})
+}
+
+// ConfigureBackplane connects the hub to other instances through bp. It must
+// be called before RunHub.
+func ConfigureBackplane(bp Backplane) {
+	hub.backplane = bp
+	history.setNode(bp.Instance())
+}
+
+// publish sends m over the hub's backplane, logging failures.
+func (h *Hub) publish(m BackplaneMessage) error {
+	err := h.backplane.Publish(m)
+	if err != nil {
+		log.Printf("backplane: publish %s failed: %v", m.Kind, err)
+	}
+	return err
+}
+
+// handleBackplane applies a message from another instance. It runs on the
+// backplane's goroutine and only posts work to shards.
+func (h *Hub) handleBackplane(m BackplaneMessage) {
+	switch m.Kind {
+	case bpDeliver:
+		ref := deviceRef{m.User, m.Device}
+		h.shardFor(m.User).post(func(s *shard) { s.deliver(ref, m.Payload) })
+	case bpBroadcast:
+		for _, s := range h.shards {
+			s.postBroadcast(m.Payload)
+		}
+	case bpKick:
+		h.kickLocal(deviceRef{m.User, m.Device})
+	case bpPresence:
+		if m.Online {
+			ref := deviceRef{m.User, m.Device}
+			h.shardFor(m.User).post(func(s *shard) { s.handOver(ref, m.Origin) })
+		}
+	case bpDevice:
+		var d Device
+		if m.Record != nil {
+			d = *m.Record
+		}
+		upsertDevice(m.User, d)
+	case bpHistory:
+		if e := m.History; e != nil {
+			history.insert(*e)
+		}
+	case bpPrekey:
+		if f, err := protocol.Decode(m.Payload); err == nil {
+			if k, ok := f.(*protocol.PublicKey); ok {
+				prekeys.put(m.User, m.Device, *k)
+			}
+		}
+	case bpHello:
+		// bring the new instance up to date with our users and devices
+		for _, rec := range deviceRecords() {
+			_ = h.publish(BackplaneMessage{Kind: bpDevice, Target: m.Origin, User: rec.user, Record: &rec.device})
+		}
+		for _, k := range prekeys.all() {
+			publishPrekey(h, k.ID, k.Device, &k, m.Origin)
+		}
+	case bpLeave:
+		log.Printf("backplane: instance %s left", m.Origin)
+	}
+}
+
+// handOver runs when ref connected to another instance: a stale local
+// connection is dropped and frames queued here are forwarded there.
+func (s *shard) handOver(ref deviceRef, instance string) {
+	if c, ok := s.byID[ref.id][ref.device]; ok {
+		log.Printf("hub: id=%s device=%s moved to instance %s\n", ref.id, ref.device, instance)
+		s.detach(c)
+	}
+	early := s.undelivered[deviceRef{ref.id, ""}]
+	queued := append(early, s.undelivered[ref]...)
+	delete(s.undelivered, deviceRef{ref.id, ""})
+	delete(s.undelivered, ref)
+	for i, msg := range queued {
+		if s.hub.publish(BackplaneMessage{Kind: bpDeliver, Target: instance, User: ref.id, Device: ref.device, Payload: msg}) != nil {
+			// keep what could not be forwarded for the next attempt
+			s.undelivered[ref] = queued[i:]
+			return
+		}
+	}
+}
@@ -0,0 +1,461 @@
+package server
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// lines waiting to be written to one backplane connection
+	backplaneOutbox = 4096
+	// longest line accepted on a backplane connection
+	backplaneMaxLine = 1 << 20
+	// backplaneRetry is the longest wait between reconnect attempts.
+	backplaneRetry = 5 * time.Second
+	// time allowed for the handshake of a broker connection
+	backplaneHandshake = 5 * time.Second
+)
+
+// Handshake line kinds, ahead of the hello.
+const (
+	bpChallenge = "challenge" // the broker's nonce for the instance to sign
+	bpWelcome   = "welcome"   // the broker's signature of the instance's nonce
+)
+
+var (
+	errBackplaneDown   = errors.New("backplane disconnected")
+	errBackplaneFull   = errors.New("backplane outbox full")
+	errBackplaneSecret = errors.New("a backplane secret is required")
+	errBackplaneAuth   = errors.New("backplane authentication failed")
+)
+
+// bpHandshake is a line of the handshake that opens a broker connection.
+// The broker and the instance each sign the other's nonce with the shared
+// secret, so neither applies anything from a peer that doesn't know it.
+type bpHandshake struct {
+	Kind   string `json:"kind"`
+	Origin string `json:"origin,omitempty"`
+	Nonce  string `json:"nonce,omitempty"`
+	Auth   string `json:"auth,omitempty"`
+}
+
+func newNonce() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// bpAuth signs a handshake line of kind for instance origin.
+func bpAuth(secret, kind, nonce, origin string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(kind + "\n" + nonce + "\n" + origin))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// RunBackplaneBroker relays messages between the server instances connected
+// to addr until stop is closed. Each instance answers the broker's
+// challenge with a hello signed with secret, then sends newline-delimited
+// JSON BackplaneMessages; the broker forwards every line to its target (or
+// to all other instances) and announces instances that disconnect.
+func RunBackplaneBroker(addr, secret string, stop <-chan struct{}) error {
+	if secret == "" {
+		return errBackplaneSecret
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	log.Printf("backplane: broker listening on %s", l.Addr())
+	return serveBroker(l, secret, stop)
+}
+
+// serveBroker runs a broker on l until stop is closed.
+func serveBroker(l net.Listener, secret string, stop <-chan struct{}) error {
+	go func() {
+		<-stop
+		_ = l.Close()
+	}()
+	b := &broker{secret: secret, peers: make(map[string]*brokerPeer)}
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			select {
+			case <-stop:
+				return nil
+			default:
+				return err
+			}
+		}
+		go b.serve(conn)
+	}
+}
+
+type broker struct {
+	secret string
+
+	mu    sync.Mutex
+	peers map[string]*brokerPeer
+}
+
+type brokerPeer struct {
+	name string
+	conn net.Conn
+	out  chan []byte
+}
+
+// route is the part of a message the broker looks at.
+type route struct {
+	Kind   string `json:"kind"`
+	Origin string `json:"origin"`
+	Target string `json:"target,omitempty"`
+}
+
+// handshake challenges a new connection and returns the name of the
+// instance once it has proven it knows the secret.
+func (b *broker) handshake(conn net.Conn, sc *bufio.Scanner) (string, error) {
+	_ = conn.SetDeadline(time.Now().Add(backplaneHandshake))
+	defer conn.SetDeadline(time.Time{})
+	nonce := newNonce()
+	if err := json.NewEncoder(conn).Encode(bpHandshake{Kind: bpChallenge, Nonce: nonce}); err != nil {
+		return "", err
+	}
+	if !sc.Scan() {
+		return "", errors.New("no hello")
+	}
+	var hello bpHandshake
+	if err := json.Unmarshal(sc.Bytes(), &hello); err != nil || hello.Kind != bpHello || hello.Origin == "" || hello.Nonce == "" {
+		return "", errors.New("no hello")
+	}
+	if !hmac.Equal([]byte(hello.Auth), []byte(bpAuth(b.secret, bpHello, nonce, hello.Origin))) {
+		return "", errBackplaneAuth
+	}
+	welcome := bpHandshake{Kind: bpWelcome, Auth: bpAuth(b.secret, bpWelcome, hello.Nonce, hello.Origin)}
+	return hello.Origin, json.NewEncoder(conn).Encode(welcome)
+}
+
+func (b *broker) serve(conn net.Conn) {
+	defer conn.Close()
+	sc := bufio.NewScanner(conn)
+	sc.Buffer(make([]byte, 64*1024), backplaneMaxLine)
+	name, err := b.handshake(conn, sc)
+	if err != nil {
+		log.Printf("backplane: refused %s: %v", conn.RemoteAddr(), err)
+		return
+	}
+	p := &brokerPeer{name: name, conn: conn, out: make(chan []byte, backplaneOutbox)}
+	b.mu.Lock()
+	if old, ok := b.peers[p.name]; ok {
+		_ = old.conn.Close()
+	}
+	b.peers[p.name] = p
+	b.mu.Unlock()
+	log.Printf("backplane: instance %s joined from %s", p.name, conn.RemoteAddr())
+
+	go func() {
+		w := bufio.NewWriter(conn)
+		for line := range p.out {
+			w.Write(line)
+			w.WriteByte('\n')
+			if len(p.out) == 0 {
+				if err := w.Flush(); err != nil {
+					_ = conn.Close()
+					return
+				}
+			}
+		}
+	}()
+
+	hello, _ := json.Marshal(BackplaneMessage{Kind: bpHello, Origin: p.name})
+	b.forward(p, route{Kind: bpHello, Origin: p.name}, hello)
+	for sc.Scan() {
+		var r route
+		if err := json.Unmarshal(sc.Bytes(), &r); err != nil {
+			log.Printf("backplane: bad message from %s: %v", p.name, err)
+			continue
+		}
+		if r.Origin != p.name || r.Kind == bpHello || r.Kind == bpLeave {
+			// only the broker speaks for an instance joining or leaving
+			log.Printf("backplane: dropping %s from %s claiming to be %s", r.Kind, p.name, r.Origin)
+			continue
+		}
+		b.forward(p, r, append([]byte(nil), sc.Bytes()...))
+	}
+
+	b.mu.Lock()
+	current := b.peers[p.name] == p
+	if current {
+		delete(b.peers, p.name)
+	}
+	b.mu.Unlock()
+	close(p.out)
+	if !current {
+		// the instance reconnected on another connection
+		return
+	}
+	leave, _ := json.Marshal(BackplaneMessage{Kind: bpLeave, Origin: p.name})
+	b.forward(p, route{Kind: bpLeave, Origin: p.name}, leave)
+	log.Printf("backplane: instance %s left", p.name)
+}
+
+// forward sends line to r.Target, or to every instance except from.
+func (b *broker) forward(from *brokerPeer, r route, line []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for name, p := range b.peers {
+		if p == from || (r.Target != "" && r.Target != name) {
+			continue
+		}
+		select {
+		case p.out <- line:
+		default:
+			// serve cleans up and announces the instance as gone
+			log.Printf("backplane: instance %s is not keeping up, disconnecting", name)
+			_ = p.conn.Close()
+		}
+	}
+}
+
+// tcpBackplane is an instance's connection to a backplane broker. It
+// reconnects on its own; while disconnected Publish fails, so the hub
+// queues frames locally instead.
+type tcpBackplane struct {
+	addr     string
+	instance string
+	secret   string
+	dir      *presenceDirectory
+	out      chan []byte
+	up       atomic.Bool
+	closed   chan struct{}
+
+	mu      sync.Mutex
+	conn    net.Conn
+	in      *bufio.Scanner // reads conn past the handshake
+	handler func(BackplaneMessage)
+}
+
+// DialBackplane connects instance to the broker at addr, proving it
+// knows the broker's secret.
+func DialBackplane(addr, instance, secret string) (Backplane, error) {
+	if secret == "" {
+		return nil, errBackplaneSecret
+	}
+	b := &tcpBackplane{
+		addr:     addr,
+		instance: instance,
+		secret:   secret,
+		dir:      newPresenceDirectory(),
+		out:      make(chan []byte, backplaneOutbox),
+		closed:   make(chan struct{}),
+	}
+	conn, in, err := b.dial()
+	if err != nil {
+		return nil, err
+	}
+	b.conn, b.in = conn, in
+	return b, nil
+}
+
+// dial connects to the broker and does the handshake.
+func (b *tcpBackplane) dial() (net.Conn, *bufio.Scanner, error) {
+	conn, err := net.DialTimeout("tcp", b.addr, backplaneHandshake)
+	if err != nil {
+		return nil, nil, err
+	}
+	in := bufio.NewScanner(conn)
+	in.Buffer(make([]byte, 64*1024), backplaneMaxLine)
+	if err := b.handshake(conn, in); err != nil {
+		_ = conn.Close()
+		return nil, nil, fmt.Errorf("%s: %w", b.addr, err)
+	}
+	return conn, in, nil
+}
+
+// handshake answers the broker's challenge with a signed hello and checks
+// the broker's signature of ours.
+func (b *tcpBackplane) handshake(conn net.Conn, in *bufio.Scanner) error {
+	_ = conn.SetDeadline(time.Now().Add(backplaneHandshake))
+	defer conn.SetDeadline(time.Time{})
+	var challenge, welcome bpHandshake
+	if !in.Scan() || json.Unmarshal(in.Bytes(), &challenge) != nil || challenge.Kind != bpChallenge {
+		return errors.New("no challenge from the broker")
+	}
+	nonce := newNonce()
+	hello := bpHandshake{Kind: bpHello, Origin: b.instance, Nonce: nonce, Auth: bpAuth(b.secret, bpHello, challenge.Nonce, b.instance)}
+	if err := json.NewEncoder(conn).Encode(hello); err != nil {
+		return err
+	}
+	if !in.Scan() || json.Unmarshal(in.Bytes(), &welcome) != nil || welcome.Kind != bpWelcome {
+		// a broker refusing the secret just hangs up
+		return errBackplaneAuth
+	}
+	if !hmac.Equal([]byte(welcome.Auth), []byte(bpAuth(b.secret, bpWelcome, nonce, b.instance))) {
+		return errBackplaneAuth
+	}
+	return nil
+}
+
+func (b *tcpBackplane) Instance() string { return b.instance }
+
+func (b *tcpBackplane) Publish(m BackplaneMessage) error {
+	if !b.up.Load() {
+		return errBackplaneDown
+	}
+	m.Origin = b.instance
+	line, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	select {
+	case b.out <- line:
+		return nil
+	default:
+		return errBackplaneFull
+	}
+}
+
+func (b *tcpBackplane) Subscribe(fn func(BackplaneMessage)) {
+	b.mu.Lock()
+	b.handler = fn
+	b.mu.Unlock()
+	go b.run()
+}
+
+func (b *tcpBackplane) SetPresence(user, device string, online bool) error {
+	b.dir.set(user, device, b.instance, online)
+	return b.Publish(BackplaneMessage{Kind: bpPresence, User: user, Device: device, Online: online})
+}
+
+func (b *tcpBackplane) Locate(user, device string) (string, bool) {
+	return b.dir.locate(user, device)
+}
+
+// Close stops reconnecting and closes the connection once queued messages
+// are written (or after a second).
+func (b *tcpBackplane) Close() error {
+	deadline := time.Now().Add(time.Second)
+	for len(b.out) > 0 && b.up.Load() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(b.closed)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.conn == nil {
+		return nil
+	}
+	return b.conn.Close()
+}
+
+// run keeps a session with the broker going until Close.
+func (b *tcpBackplane) run() {
+	wait := 100 * time.Millisecond
+	for {
+		b.mu.Lock()
+		conn, in := b.conn, b.in
+		b.mu.Unlock()
+		if conn != nil {
+			b.session(conn, in)
+			wait = 100 * time.Millisecond
+		}
+		select {
+		case <-b.closed:
+			return
+		case <-time.After(wait):
+		}
+		if wait *= 2; wait > backplaneRetry {
+			wait = backplaneRetry
+		}
+		conn, in, err := b.dial()
+		if err != nil {
+			log.Printf("backplane: reconnect to %s failed: %v", b.addr, err)
+		}
+		b.mu.Lock()
+		select {
+		case <-b.closed:
+			if conn != nil {
+				_ = conn.Close()
+			}
+			b.mu.Unlock()
+			return
+		default:
+		}
+		b.conn, b.in = conn, in
+		b.mu.Unlock()
+	}
+}
+
+// session announces this instance's connected devices on a connection
+// past the handshake, then pumps messages both ways until it fails.
+func (b *tcpBackplane) session(conn net.Conn, sc *bufio.Scanner) {
+	defer conn.Close()
+	var greeting []BackplaneMessage
+	for _, ref := range b.dir.held(b.instance) {
+		greeting = append(greeting, BackplaneMessage{Kind: bpPresence, Origin: b.instance, User: ref.id, Device: ref.device, Online: true})
+	}
+	enc := json.NewEncoder(conn)
+	for _, m := range greeting {
+		if err := enc.Encode(m); err != nil {
+			log.Printf("backplane: greeting %s failed: %v", b.addr, err)
+			return
+		}
+	}
+	b.up.Store(true)
+	log.Printf("backplane: connected to %s as %s", b.addr, b.instance)
+
+	done := make(chan struct{})
+	go func() {
+		w := bufio.NewWriter(conn)
+		for {
+			select {
+			case line := <-b.out:
+				w.Write(line)
+				w.WriteByte('\n')
+				if len(b.out) > 0 {
+					continue
+				}
+				if err := w.Flush(); err != nil {
+					_ = conn.Close()
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	for sc.Scan() {
+		var m BackplaneMessage
+		if err := json.Unmarshal(sc.Bytes(), &m); err != nil {
+			log.Printf("backplane: bad message: %v", err)
+			continue
+		}
+		if m.Kind == bpHello {
+			// a newcomer needs to know where our devices are
+			for _, ref := range b.dir.held(b.instance) {
+				_ = b.Publish(BackplaneMessage{Kind: bpPresence, Target: m.Origin, User: ref.id, Device: ref.device, Online: true})
+			}
+		}
+		b.dir.observe(m)
+		b.mu.Lock()
+		fn := b.handler
+		b.mu.Unlock()
+		if fn != nil {
+			fn(m)
+		}
+	}
+	close(done)
+	b.up.Store(false)
+	// whatever the other instances held is unknown until we reconnect
+	b.dir.keepOnly(b.instance)
+	log.Printf("backplane: lost connection to %s", b.addr)
+}
@@ -0,0 +1,243 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+// joinBackplane connects instance to the broker at addr and passes what it
+// receives to the returned channel.
+func joinBackplane(t *testing.T, addr, instance string) (Backplane, <-chan BackplaneMessage) {
+	t.Helper()
+	bp, err := DialBackplane(addr, instance, testBackplaneSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = bp.Close() })
+	got := make(chan BackplaneMessage, 64)
+	bp.Subscribe(func(m BackplaneMessage) { got <- m })
+	eventually(t, instance+" to connect", func() bool { return bp.(*tcpBackplane).up.Load() })
+	return bp, got
+}
+
+// nextOf returns the next message of kind in got.
+func nextOf(t *testing.T, got <-chan BackplaneMessage, kind string) BackplaneMessage {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case m := <-got:
+			if m.Kind == kind {
+				return m
+			}
+		case <-timeout:
+			t.Fatalf("no %s message", kind)
+		}
+	}
+}
+
+// rawBroker opens a connection to the broker at addr and answers its
+// challenge as instance, signing with secret.
+func rawBroker(t *testing.T, addr, instance, secret string) (net.Conn, *bufio.Scanner) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	sc := bufio.NewScanner(conn)
+	var challenge bpHandshake
+	if !sc.Scan() || json.Unmarshal(sc.Bytes(), &challenge) != nil || challenge.Kind != bpChallenge {
+		t.Fatal("no challenge")
+	}
+	hello := bpHandshake{Kind: bpHello, Origin: instance, Nonce: newNonce(), Auth: bpAuth(secret, bpHello, challenge.Nonce, instance)}
+	if err := json.NewEncoder(conn).Encode(hello); err != nil {
+		t.Fatal(err)
+	}
+	return conn, sc
+}
+
+func TestBackplaneRefusesWrongSecret(t *testing.T) {
+	addr := startBroker(t)
+	if _, err := DialBackplane(addr, "s1", "guess"); !errors.Is(err, errBackplaneAuth) {
+		t.Fatalf("DialBackplane with the wrong secret: err = %v, want %v", err, errBackplaneAuth)
+	}
+	if _, err := DialBackplane(addr, "s1", ""); !errors.Is(err, errBackplaneSecret) {
+		t.Fatalf("DialBackplane without a secret: err = %v, want %v", err, errBackplaneSecret)
+	}
+
+	// whatever an unauthenticated peer sends goes nowhere
+	_, got := joinBackplane(t, addr, "s1")
+	conn, sc := rawBroker(t, addr, "mallory", "guess")
+	record, _ := json.Marshal(BackplaneMessage{Kind: bpDevice, Origin: "mallory", User: "alice",
+		Record: &Device{ID: "evil", Status: deviceApproved, SecretHash: hashSecret("mine")}})
+	_, _ = conn.Write(append(record, '\n'))
+	if sc.Scan() {
+		t.Fatalf("broker answered a bad signature with %s", sc.Bytes())
+	}
+	joinBackplane(t, addr, "s2")
+	if m := nextOf(t, got, bpHello); m.Origin != "s2" {
+		t.Fatalf("s1 got a hello from %s, want s2", m.Origin)
+	}
+	select {
+	case m := <-got:
+		t.Fatalf("s1 got %+v", m)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestBackplaneDropsSpoofedOrigin(t *testing.T) {
+	addr := startBroker(t)
+	_, got := joinBackplane(t, addr, "s1")
+	conn, sc := rawBroker(t, addr, "s2", testBackplaneSecret)
+	var welcome bpHandshake
+	if !sc.Scan() || json.Unmarshal(sc.Bytes(), &welcome) != nil || welcome.Kind != bpWelcome {
+		t.Fatal("no welcome")
+	}
+	nextOf(t, got, bpHello)
+
+	enc := json.NewEncoder(conn)
+	_ = enc.Encode(BackplaneMessage{Kind: bpKick, Origin: "s3", User: "alice", Device: "a1"})
+	_ = enc.Encode(BackplaneMessage{Kind: bpLeave, Origin: "s2"})
+	_ = enc.Encode(BackplaneMessage{Kind: bpKick, Origin: "s2", User: "bob", Device: "b1"})
+	if m := nextOf(t, got, bpKick); m.User != "bob" {
+		t.Fatalf("s1 got %+v, want only the kick s2 sent as itself", m)
+	}
+}
+
+func TestBackplaneRefusesUnknownBroker(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// a broker that doesn't know the secret can only make up a welcome
+		enc := json.NewEncoder(conn)
+		_ = enc.Encode(bpHandshake{Kind: bpChallenge, Nonce: newNonce()})
+		sc := bufio.NewScanner(conn)
+		sc.Scan()
+		_ = enc.Encode(bpHandshake{Kind: bpWelcome, Auth: bpAuth("guess", bpWelcome, "", "s1")})
+		sc.Scan()
+	}()
+	if _, err := DialBackplane(l.Addr().String(), "s1", testBackplaneSecret); !errors.Is(err, errBackplaneAuth) {
+		t.Fatalf("DialBackplane to an unknown broker: err = %v, want %v", err, errBackplaneAuth)
+	}
+}
+
+// startInstance runs a hub joined to the broker at addr as instance until
+// the test ends. Users the test adds must be added before, so they outlive
+// the hub's backplane traffic.
+func startInstance(t *testing.T, addr, instance string) *Hub {
+	t.Helper()
+	h := newHub(2)
+	bp, err := DialBackplane(addr, instance, testBackplaneSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.backplane = bp
+	done := make(chan struct{})
+	go func() {
+		h.run()
+		close(done)
+	}()
+	t.Cleanup(func() {
+		stopHub(h)
+		<-done
+	})
+	eventually(t, instance+" to connect", func() bool { return bp.(*tcpBackplane).up.Load() })
+	return h
+}
+
+// locatedAt reports whether h sees user/device connected to instance.
+func locatedAt(h *Hub, user, device, instance string) bool {
+	in, ok := h.backplane.Locate(user, device)
+	return ok && in == instance
+}
+
+func TestBackplaneDeliversToOtherInstance(t *testing.T) {
+	addUser(t, "alice", "a1")
+	addUser(t, "bob", "b1")
+	addr := startBroker(t)
+	h1, h2 := startInstance(t, addr, "s1"), startInstance(t, addr, "s2")
+	bob := newTestClient("bob", "b1", 8)
+	attach(t, h2, bob)
+	eventually(t, "s1 to locate bob on s2", func() bool { return locatedAt(h1, "bob", "b1", "s2") })
+
+	h1.sendTargeted(targetedMessage{from: "alice", fromDevice: "a1", to: "bob", msg: []byte("hi")})
+	if got := receive(t, bob); string(got) != "hi" {
+		t.Fatalf("bob got %q, want hi", got)
+	}
+	if counts, _ := h1.queued("bob"); len(counts) != 0 {
+		t.Fatalf("s1 queued %v for a device on s2", counts)
+	}
+
+	h2.detachClient(bob)
+	eventually(t, "s1 to forget bob", func() bool {
+		_, ok := h1.backplane.Locate("bob", "b1")
+		return !ok
+	})
+	h1.sendTargeted(targetedMessage{to: "bob", msg: []byte("later")})
+	eventually(t, "s1 to queue for bob", func() bool {
+		counts, _ := h1.queued("bob")
+		return counts["b1"] == 1
+	})
+}
+
+func TestBackplaneHandsOverQueue(t *testing.T) {
+	addUser(t, "bob", "b1")
+	addr := startBroker(t)
+	h1, h2 := startInstance(t, addr, "s1"), startInstance(t, addr, "s2")
+	for i := 0; i < 3; i++ {
+		h1.sendTargeted(targetedMessage{to: "bob", msg: []byte(fmt.Sprint(i))})
+	}
+	eventually(t, "s1 to queue for bob", func() bool {
+		counts, _ := h1.queued("bob")
+		return counts["b1"] == 3
+	})
+
+	// bob connects to s2, which gets what s1 kept for him, in order
+	bob := newTestClient("bob", "b1", 8)
+	attach(t, h2, bob)
+	for i := 0; i < 3; i++ {
+		if got := receive(t, bob); string(got) != fmt.Sprint(i) {
+			t.Fatalf("frame %d = %q", i, got)
+		}
+	}
+	eventually(t, "s1 to hand its queue over", func() bool {
+		counts, _ := h1.queued("bob")
+		return len(counts) == 0
+	})
+}
+
+func TestBackplaneKicksStaleConnection(t *testing.T) {
+	addUser(t, "bob", "b1")
+	addr := startBroker(t)
+	h1, h2 := startInstance(t, addr, "s1"), startInstance(t, addr, "s2")
+	old := newTestClient("bob", "b1", 8)
+	attach(t, h1, old)
+	eventually(t, "s2 to locate bob on s1", func() bool { return locatedAt(h2, "bob", "b1", "s1") })
+
+	// bob comes back through s2 before s1 noticed the drop
+	c := newTestClient("bob", "b1", 8)
+	attach(t, h2, c)
+	closed(t, old)
+	if n := old.Conn.(*countingConn).closed.Load(); n != 1 {
+		t.Fatalf("stale Conn closed %d times, want 1", n)
+	}
+	eventually(t, "s1 to locate bob on s2", func() bool { return locatedAt(h1, "bob", "b1", "s2") })
+
+	// a revocation on s1 disconnects bob on s2
+	h1.kickDevice(deviceRef{"bob", "b1"})
+	closed(t, c)
+}
@@ -0,0 +1,359 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/marcoantonios1/chat-app/internal/protocol"
+	"gopkg.in/yaml.v3"
+)
+
+// StorageMemory keeps users, history and queues in the server's memory.
+// It is the only storage backend so far.
+const StorageMemory = "memory"
+
+// Config is the server's configuration. LoadConfig reads it from a YAML
+// file whose keys are the yaml names below; the command line fills in
+// the rest.
+type Config struct {
+	// Addr serves websockets, /stream and the REST API. GRPCAddr and
+	// QUICAddr turn on those endpoints.
+	Addr     string `yaml:"addr"`
+	GRPCAddr string `yaml:"grpc_addr"`
+	QUICAddr string `yaml:"quic_addr"`
+	// QUICCert and QUICKey serve QUIC without TLS.CertFile; a
+	// self-signed certificate is created if both are missing.
+	QUICCert string `yaml:"quic_cert"`
+	QUICKey  string `yaml:"quic_key"`
+
+	Timeouts Timeouts `yaml:"timeouts"`
+	Limits   Limits   `yaml:"limits"`
+	// AllowedOrigins are the origins browsers may connect from, like
+	// https://chat.example.com, or "*" for any. Empty allows any.
+	// Requests without an Origin header, from non-browser clients, are
+	// always allowed.
+	AllowedOrigins []string      `yaml:"allowed_origins"`
+	Storage        StorageConfig `yaml:"storage"`
+
+	TLS        TLSConfig        `yaml:"tls"`
+	Backplane  BackplaneConfig  `yaml:"backplane"`
+	Federation FederationConfig `yaml:"federation"`
+	Webhooks   WebhooksConfig   `yaml:"webhooks"`
+}
+
+// Timeouts bound how long the server waits on connections.
+type Timeouts struct {
+	// Write is the time allowed to write a frame to a client.
+	Write time.Duration `yaml:"write"`
+	// Pong is how long a silent websocket is kept; pings go out at 9/10
+	// of it. It is also the idle timeout of QUIC connections.
+	Pong time.Duration `yaml:"pong"`
+	// Shutdown is how long open requests get to finish on interrupt.
+	Shutdown time.Duration `yaml:"shutdown"`
+}
+
+// Limits bound what clients may send and what the server holds for them.
+type Limits struct {
+	// MaxMessageSize is the largest frame accepted, in its JSON form. It
+	// is announced in the welcome and can't exceed protocol.MaxFrameSize.
+	MaxMessageSize int `yaml:"max_message_size"`
+	// SendBuffer is how many frames wait for a connection before the hub
+	// queues them instead.
+	SendBuffer int `yaml:"send_buffer"`
+	// RateBurst frames a connection may send at once, and RatePerSec how
+	// many more it may send per second after that.
+	RateBurst  int     `yaml:"rate_burst"`
+	RatePerSec float64 `yaml:"rate_per_sec"`
+	// MaxQueuedPerDevice frames are kept for an offline or lagging
+	// device; the oldest are dropped beyond this.
+	MaxQueuedPerDevice int `yaml:"max_queued_per_device"`
+	// HubShards route messages in parallel.
+	HubShards int `yaml:"hub_shards"`
+}
+
+// StorageConfig chooses where the server keeps its data.
+type StorageConfig struct {
+	// Backend is StorageMemory.
+	Backend string `yaml:"backend"`
+	// HistoryRetention is how long message history is kept; 0 keeps it
+	// forever.
+	HistoryRetention time.Duration `yaml:"history_retention"`
+}
+
+// BackplaneConfig joins the server to a backplane broker shared with
+// other instances.
+type BackplaneConfig struct {
+	Addr string `yaml:"addr"`
+	// InstanceID names this instance on the backplane; random if empty.
+	InstanceID string `yaml:"instance_id"`
+	// Secret is shared by the broker and every instance; connections that
+	// can't prove they know it are refused.
+	Secret string `yaml:"secret"`
+}
+
+// WebhooksConfig lists webhook subscriptions in the form ParseWebhook
+// reads.
+type WebhooksConfig struct {
+	Subscriptions []string `yaml:"subscriptions"`
+	// DeadLetter logs events that could not be delivered.
+	DeadLetter string `yaml:"dead_letter"`
+}
+
+// DefaultConfig returns the configuration of a server started without
+// options.
+func DefaultConfig() Config {
+	return Config{
+		Addr:     ":8080",
+		QUICCert: "quic_cert.pem",
+		QUICKey:  "quic_key.pem",
+		Timeouts: Timeouts{
+			Write:    10 * time.Second,
+			Pong:     60 * time.Second,
+			Shutdown: 5 * time.Second,
+		},
+		Limits: Limits{
+			MaxMessageSize:     protocol.MaxFrameSize,
+			SendBuffer:         256,
+			RateBurst:          5,
+			RatePerSec:         5,
+			MaxQueuedPerDevice: 1024,
+			HubShards:          runtime.NumCPU(),
+		},
+		Storage: StorageConfig{
+			Backend:          StorageMemory,
+			HistoryRetention: defaultHistoryRetention,
+		},
+		Federation: FederationConfig{IdentityKeyFile: "server_identity.key"},
+		Webhooks:   WebhooksConfig{DeadLetter: "webhook_dead_letter.jsonl"},
+	}
+}
+
+// LoadConfig returns the default configuration overridden by the YAML
+// file at path. Unknown keys are errors, so typos don't go unnoticed.
+func LoadConfig(path string) (Config, error) {
+	cfg := DefaultConfig()
+	switch ext := filepath.Ext(path); ext {
+	case ".yaml", ".yml":
+	default:
+		return cfg, fmt.Errorf("%s: unsupported config format %q, want .yaml or .yml", path, ext)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return cfg, err
+	}
+	defer f.Close()
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(&cfg); err != nil && !errors.Is(err, io.EOF) {
+		return cfg, fmt.Errorf("%s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// Validate reports every problem with c, naming settings by their yaml
+// keys.
+func (c *Config) Validate() error {
+	var errs []error
+	bad := func(key, format string, args ...any) {
+		errs = append(errs, fmt.Errorf("%s: "+format, append([]any{key}, args...)...))
+	}
+	addr := func(key, a string, required bool) {
+		if a == "" {
+			if required {
+				bad(key, "is required")
+			}
+			return
+		}
+		if _, _, err := net.SplitHostPort(a); err != nil {
+			bad(key, "%q is not host:port", a)
+		}
+	}
+	addr("addr", c.Addr, true)
+	addr("grpc_addr", c.GRPCAddr, false)
+	addr("quic_addr", c.QUICAddr, false)
+	addr("backplane.addr", c.Backplane.Addr, false)
+	if c.Backplane.Addr != "" && c.Backplane.Secret == "" {
+		bad("backplane.secret", "is required with backplane.addr")
+	}
+
+	if c.Timeouts.Write <= 0 {
+		bad("timeouts.write", "must be positive")
+	}
+	if c.Timeouts.Pong < time.Second {
+		bad("timeouts.pong", "must be at least 1s")
+	}
+	if c.Timeouts.Shutdown < 0 {
+		bad("timeouts.shutdown", "must not be negative")
+	}
+
+	l := c.Limits
+	if l.MaxMessageSize < 1024 || l.MaxMessageSize > protocol.MaxFrameSize {
+		bad("limits.max_message_size", "must be between 1024 and %d", protocol.MaxFrameSize)
+	}
+	if l.SendBuffer < 1 {
+		bad("limits.send_buffer", "must be at least 1")
+	}
+	if l.RateBurst < 1 {
+		bad("limits.rate_burst", "must be at least 1")
+	}
+	if l.RatePerSec <= 0 {
+		bad("limits.rate_per_sec", "must be positive")
+	}
+	if l.MaxQueuedPerDevice < 1 {
+		bad("limits.max_queued_per_device", "must be at least 1")
+	}
+	if l.HubShards < 1 {
+		bad("limits.hub_shards", "must be at least 1")
+	}
+
+	for _, o := range c.AllowedOrigins {
+		if o == "*" {
+			continue
+		}
+		if !strings.Contains(o, "://") || strings.HasSuffix(o, "/") {
+			bad("allowed_origins", "%q is not an origin like https://chat.example.com", o)
+		}
+	}
+
+	if c.Storage.Backend != StorageMemory {
+		bad("storage.backend", "%q is not available, want %q", c.Storage.Backend, StorageMemory)
+	}
+	if c.Storage.HistoryRetention < 0 {
+		bad("storage.history_retention", "must not be negative")
+	}
+
+	t := c.TLS
+	if t.CertFile == "" && !t.Dev {
+		if t.KeyFile != "" {
+			bad("tls.key", "needs tls.cert")
+		}
+		if t.ClientCAFile != "" || t.RequireClientCert {
+			bad("tls.client_ca", "client certificates need tls.cert or tls.dev")
+		}
+	} else if t.CertFile != "" && t.KeyFile == "" {
+		bad("tls.key", "is required with tls.cert")
+	}
+	if t.RequireClientCert && t.ClientCAFile == "" {
+		bad("tls.require_client_cert", "needs tls.client_ca")
+	}
+
+	if c.Federation.Domain == "" && len(c.Federation.Peers) > 0 {
+		bad("federation.peers", "need federation.domain")
+	}
+	for name, url := range c.Federation.Peers {
+		if name == "" || url == "" {
+			bad("federation.peers", "invalid peer %q=%q, want domain: url", name, url)
+		}
+	}
+	for _, s := range c.Webhooks.Subscriptions {
+		if _, err := ParseWebhook(s); err != nil {
+			bad("webhooks.subscriptions", "%v", err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// restartKeys are the settings Reload can't change, by yaml key.
+var restartKeys = []struct {
+	key string
+	get func(c *Config) any
+}{
+	{"addr", func(c *Config) any { return c.Addr }},
+	{"grpc_addr", func(c *Config) any { return c.GRPCAddr }},
+	{"quic_addr", func(c *Config) any { return c.QUICAddr }},
+	{"quic_cert", func(c *Config) any { return c.QUICCert }},
+	{"quic_key", func(c *Config) any { return c.QUICKey }},
+	{"limits.max_message_size", func(c *Config) any { return c.Limits.MaxMessageSize }},
+	{"limits.hub_shards", func(c *Config) any { return c.Limits.HubShards }},
+	{"storage.backend", func(c *Config) any { return c.Storage.Backend }},
+	{"tls", func(c *Config) any { return c.TLS }},
+	{"backplane", func(c *Config) any { return c.Backplane }},
+	{"federation", func(c *Config) any { return c.Federation }},
+	{"webhooks", func(c *Config) any { return c.Webhooks }},
+}
+
+// config is the configuration the server runs with; nil before Configure.
+var config atomic.Pointer[Config]
+
+var defaultConfig = DefaultConfig()
+
+// settings returns the configuration in effect.
+func settings() *Config {
+	if c := config.Load(); c != nil {
+		return c
+	}
+	return &defaultConfig
+}
+
+// Configure sets the configuration the server starts with. It must be
+// called before RunHub; the TLS, backplane, federation and webhook
+// sections are applied with their own Configure functions.
+func Configure(cfg Config) {
+	config.Store(&cfg)
+	ConfigureHub(cfg.Limits.HubShards)
+	SetHistoryRetention(cfg.Storage.HistoryRetention)
+}
+
+// Reload switches a running server to cfg. Settings that need a restart
+// keep their current value and are returned by yaml key.
+func Reload(cfg Config) (restart []string) {
+	old := settings()
+	for _, k := range restartKeys {
+		if !reflect.DeepEqual(k.get(old), k.get(&cfg)) {
+			restart = append(restart, k.key)
+		}
+	}
+	cfg.Addr, cfg.GRPCAddr, cfg.QUICAddr = old.Addr, old.GRPCAddr, old.QUICAddr
+	cfg.QUICCert, cfg.QUICKey = old.QUICCert, old.QUICKey
+	cfg.Limits.MaxMessageSize, cfg.Limits.HubShards = old.Limits.MaxMessageSize, old.Limits.HubShards
+	cfg.Storage.Backend = old.Storage.Backend
+	cfg.TLS, cfg.Backplane, cfg.Federation, cfg.Webhooks = old.TLS, old.Backplane, old.Federation, old.Webhooks
+	config.Store(&cfg)
+	SetHistoryRetention(cfg.Storage.HistoryRetention)
+	log.Printf("config: reloaded")
+	for _, key := range restart {
+		log.Printf("config: %s changed; restart to apply", key)
+	}
+	return restart
+}
+
+// writeWait is the time allowed to write a frame to a client.
+func writeWait() time.Duration { return settings().Timeouts.Write }
+
+// pongWait is the time allowed to read the next pong from a client.
+func pongWait() time.Duration { return settings().Timeouts.Pong }
+
+// pingPeriod is how often clients are pinged; less than pongWait.
+func pingPeriod() time.Duration { return pongWait() * 9 / 10 }
+
+// maxMessageSize is the largest frame accepted from a client.
+func maxMessageSize() int { return settings().Limits.MaxMessageSize }
+
+// newSendBuffer returns the Send channel of a new client.
+func newSendBuffer() chan []byte { return make(chan []byte, settings().Limits.SendBuffer) }
+
+// originAllowed reports whether a browser on the origin of r may connect.
+func originAllowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	allowed := settings().AllowedOrigins
+	if origin == "" || len(allowed) == 0 {
+		return true
+	}
+	for _, o := range allowed {
+		if o == "*" || strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+	return false
+}
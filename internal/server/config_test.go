@@ -0,0 +1,164 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/marcoantonios1/chat-app/internal/protocol"
+)
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "server.yaml")
+	yaml := "addr: 127.0.0.1:9000\ntimeouts:\n  write: 3s\nlimits:\n  rate_burst: 9\nallowed_origins: [https://chat.example.com]\n"
+	if err := os.WriteFile(path, []byte(yaml), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := DefaultConfig()
+	want.Addr, want.Timeouts.Write, want.Limits.RateBurst = "127.0.0.1:9000", 3*time.Second, 9
+	want.AllowedOrigins = []string{"https://chat.example.com"}
+	if cfg.Addr != want.Addr || cfg.Timeouts != want.Timeouts || cfg.Limits != want.Limits ||
+		!slices.Equal(cfg.AllowedOrigins, want.AllowedOrigins) || cfg.Storage != want.Storage {
+		t.Fatalf("config %+v, want %+v", cfg, want)
+	}
+
+	empty := filepath.Join(dir, "empty.yml")
+	if err := os.WriteFile(empty, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if cfg, err := LoadConfig(empty); err != nil || cfg.Limits != DefaultConfig().Limits {
+		t.Fatalf("empty file: %+v, %v", cfg, err)
+	}
+
+	typo := filepath.Join(dir, "typo.yaml")
+	if err := os.WriteFile(typo, []byte("limits:\n  rate_brust: 9\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadConfig(typo); err == nil || !strings.Contains(err.Error(), "rate_brust") {
+		t.Fatalf("unknown key: err = %v", err)
+	}
+	if _, err := LoadConfig(filepath.Join(dir, "server.json")); err == nil || !strings.Contains(err.Error(), "unsupported config format") {
+		t.Fatalf("json file: err = %v", err)
+	}
+	if _, err := LoadConfig(filepath.Join(dir, "missing.yaml")); !os.IsNotExist(err) {
+		t.Fatalf("missing file: err = %v", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	def := DefaultConfig()
+	if err := def.Validate(); err != nil {
+		t.Fatalf("defaults: %v", err)
+	}
+	for _, c := range []struct {
+		key    string
+		change func(c *Config)
+	}{
+		{"addr", func(c *Config) { c.Addr = "" }},
+		{"addr", func(c *Config) { c.Addr = "8080" }},
+		{"grpc_addr", func(c *Config) { c.GRPCAddr = "localhost" }},
+		{"quic_addr", func(c *Config) { c.QUICAddr = "localhost" }},
+		{"backplane.addr", func(c *Config) { c.Backplane = BackplaneConfig{Addr: "broker", Secret: "s"} }},
+		{"backplane.secret", func(c *Config) { c.Backplane.Addr = "127.0.0.1:7400" }},
+		{"timeouts.write", func(c *Config) { c.Timeouts.Write = 0 }},
+		{"timeouts.pong", func(c *Config) { c.Timeouts.Pong = 500 * time.Millisecond }},
+		{"timeouts.shutdown", func(c *Config) { c.Timeouts.Shutdown = -time.Second }},
+		{"limits.max_message_size", func(c *Config) { c.Limits.MaxMessageSize = 1023 }},
+		{"limits.max_message_size", func(c *Config) { c.Limits.MaxMessageSize = protocol.MaxFrameSize + 1 }},
+		{"limits.send_buffer", func(c *Config) { c.Limits.SendBuffer = 0 }},
+		{"limits.rate_burst", func(c *Config) { c.Limits.RateBurst = 0 }},
+		{"limits.rate_per_sec", func(c *Config) { c.Limits.RatePerSec = 0 }},
+		{"limits.max_queued_per_device", func(c *Config) { c.Limits.MaxQueuedPerDevice = 0 }},
+		{"limits.hub_shards", func(c *Config) { c.Limits.HubShards = 0 }},
+		{"allowed_origins", func(c *Config) { c.AllowedOrigins = []string{"chat.example.com"} }},
+		{"allowed_origins", func(c *Config) { c.AllowedOrigins = []string{"https://chat.example.com/"} }},
+		{"storage.backend", func(c *Config) { c.Storage.Backend = "postgres" }},
+		{"storage.history_retention", func(c *Config) { c.Storage.HistoryRetention = -time.Hour }},
+		{"tls.key", func(c *Config) { c.TLS.KeyFile = "key.pem" }},
+		{"tls.key", func(c *Config) { c.TLS.CertFile = "cert.pem" }},
+		{"tls.client_ca", func(c *Config) { c.TLS.ClientCAFile = "ca.pem" }},
+		{"tls.require_client_cert", func(c *Config) { c.TLS = TLSConfig{Dev: true, RequireClientCert: true} }},
+		{"federation.peers", func(c *Config) { c.Federation.Peers = map[string]string{"b.example": "https://b.example"} }},
+		{"federation.peers", func(c *Config) {
+			c.Federation = FederationConfig{Domain: "a.example", Peers: map[string]string{"b.example": ""}}
+		}},
+		{"webhooks.subscriptions", func(c *Config) { c.Webhooks.Subscriptions = []string{"https://hooks.example.com"} }},
+	} {
+		cfg := DefaultConfig()
+		c.change(&cfg)
+		err := cfg.Validate()
+		if err == nil || !strings.HasPrefix(err.Error(), c.key+": ") || strings.Contains(err.Error(), "\n") {
+			t.Errorf("%s: err = %v, want only an error for it", c.key, err)
+		}
+	}
+
+	// every problem is reported at once
+	cfg := DefaultConfig()
+	cfg.Addr, cfg.Limits.RateBurst, cfg.Storage.Backend = "", 0, "postgres"
+	if err := cfg.Validate(); err == nil || strings.Count(err.Error(), "\n") != 2 {
+		t.Fatalf("three problems: err = %v", err)
+	}
+	cfg = DefaultConfig()
+	cfg.AllowedOrigins = []string{"*", "http://localhost:3000"}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("wildcard origin: %v", err)
+	}
+}
+
+func TestReload(t *testing.T) {
+	old := config.Load()
+	t.Cleanup(func() {
+		config.Store(old)
+		SetHistoryRetention(settings().Storage.HistoryRetention)
+	})
+	running := DefaultConfig()
+	running.Addr, running.Limits.HubShards = "127.0.0.1:8080", 2
+	config.Store(&running)
+
+	next := running
+	next.Addr, next.GRPCAddr = "127.0.0.1:9090", "127.0.0.1:9091"
+	next.Limits.MaxMessageSize, next.Limits.HubShards = 4096, 8
+	next.TLS = TLSConfig{Dev: true}
+	next.Backplane = BackplaneConfig{Addr: "127.0.0.1:7400", Secret: "s"}
+	next.Timeouts.Write, next.Timeouts.Pong = 2*time.Second, 30*time.Second
+	next.Limits.RateBurst, next.Limits.RatePerSec, next.Limits.SendBuffer = 20, 10, 64
+	next.AllowedOrigins = []string{"https://chat.example.com"}
+	next.Storage.HistoryRetention = time.Hour
+
+	restart := Reload(next)
+	want := []string{"addr", "grpc_addr", "limits.max_message_size", "limits.hub_shards", "tls", "backplane"}
+	if !slices.Equal(restart, want) {
+		t.Fatalf("Reload returned %v, want %v", restart, want)
+	}
+	got := settings()
+	if got.Addr != running.Addr || got.GRPCAddr != "" || got.Limits.MaxMessageSize != running.Limits.MaxMessageSize ||
+		got.Limits.HubShards != 2 || got.TLS.Dev || got.Backplane.Addr != "" {
+		t.Fatalf("a setting that needs a restart changed: %+v", got)
+	}
+	if got.Timeouts != next.Timeouts || got.Limits.RateBurst != 20 || got.Limits.RatePerSec != 10 || got.Limits.SendBuffer != 64 ||
+		!slices.Equal(got.AllowedOrigins, next.AllowedOrigins) {
+		t.Fatalf("reloaded settings %+v, want those of %+v", got, next)
+	}
+	if cap(newSendBuffer()) != 64 || writeWait() != 2*time.Second {
+		t.Fatal("the reloaded settings are not in effect")
+	}
+	history.mu.Lock()
+	retention := history.retention
+	history.mu.Unlock()
+	if retention != time.Hour {
+		t.Fatalf("history retention %v, want 1h", retention)
+	}
+
+	// nothing to restart for when only safe settings change
+	if restart := Reload(*got); len(restart) != 0 {
+		t.Fatalf("reloading the same config: restart %v", restart)
+	}
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/marcoantonios1/chat-app/internal/protocol"
+)
+
+const (
+	// how long the delivery status of a message can be looked up
+	deliveryTTL = 24 * time.Hour
+	// most messages tracked at once; the oldest are forgotten beyond this
+	maxTrackedDeliveries = 100_000
+	// status of a message the server took but hasn't routed yet
+	statusAccepted = "accepted"
+)
+
+// deliveryRank orders statuses; a status only ever moves up.
+var deliveryRank = map[string]int{
+	statusAccepted:           0,
+	protocol.StatusQueued:    1,
+	protocol.StatusDelivered: 2,
+	protocol.StatusRead:      3,
+}
+
+// Delivery is how far a message sent through this instance got.
+type Delivery struct {
+	MsgID     string    `json:"msg_id"`
+	Recipient string    `json:"recipient"`
+	Status    string    `json:"status"`
+	Updated   time.Time `json:"updated"`
+}
+
+type deliveryKey struct {
+	from  string
+	msgID string
+}
+
+// deliveryTracker keeps the status of recent messages per sender, from the
+// hub's routing and the receipts recipients send back.
+type deliveryTracker struct {
+	mu      sync.Mutex
+	entries map[deliveryKey]*Delivery
+	order   []deliveryKey // oldest first
+}
+
+var deliveries = &deliveryTracker{entries: make(map[deliveryKey]*Delivery)}
+
+// track starts tracking message msgID from from to to.
+func (t *deliveryTracker) track(from, msgID, to string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	k := deliveryKey{from, msgID}
+	if _, ok := t.entries[k]; ok {
+		// a retry of a message we know
+		return
+	}
+	t.entries[k] = &Delivery{MsgID: msgID, Recipient: to, Status: statusAccepted, Updated: time.Now()}
+	t.order = append(t.order, k)
+	for len(t.order) > maxTrackedDeliveries {
+		delete(t.entries, t.order[0])
+		t.order = t.order[1:]
+	}
+}
+
+// update raises the status of msgID from from, as reported by by: the hub
+// (empty) or the recipient.
+func (t *deliveryTracker) update(from, msgID, by, status string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	d, ok := t.entries[deliveryKey{from, msgID}]
+	if !ok || (by != "" && by != d.Recipient) {
+		return
+	}
+	if deliveryRank[status] > deliveryRank[d.Status] {
+		d.Status, d.Updated = status, time.Now()
+	}
+}
+
+// get returns the status of msgID sent by from.
+func (t *deliveryTracker) get(from, msgID string) (Delivery, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	d, ok := t.entries[deliveryKey{from, msgID}]
+	if !ok {
+		return Delivery{}, false
+	}
+	return *d, true
+}
+
+// prune forgets messages older than deliveryTTL and reports how many.
+func (t *deliveryTracker) prune(now time.Time) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := 0
+	for n < len(t.order) {
+		d, ok := t.entries[t.order[n]]
+		if ok && now.Sub(d.Updated) < deliveryTTL {
+			break
+		}
+		delete(t.entries, t.order[n])
+		n++
+	}
+	t.order = t.order[n:]
+	return n
+}
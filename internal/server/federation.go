@@ -0,0 +1,578 @@
+package server
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/marcoantonios1/chat-app/internal/protocol"
+)
+
+const (
+	// how far a signed request's timestamp may be from our clock
+	federationClockSkew = 5 * time.Minute
+	// frames waiting for one unreachable domain
+	maxFederationQueue = 10000
+	// a frame is given up after this many failed attempts or this long
+	federationMaxAttempts = 20
+	federationMaxAge      = 24 * time.Hour
+	// longest wait between attempts for one domain
+	federationMaxBackoff = 5 * time.Minute
+	// largest federated request accepted
+	maxFederationBody = 4 * protocol.MaxFrameSize
+
+	// signed request headers
+	headerFedOrigin    = "X-Chat-Origin"
+	headerFedTimestamp = "X-Chat-Timestamp"
+	headerFedSignature = "X-Chat-Signature"
+)
+
+var (
+	errFederationDenied = errors.New("federation with this domain is not allowed")
+	errFederationQueue  = errors.New("too many messages waiting for this domain")
+	errFederationAuth   = errors.New("invalid server signature")
+)
+
+// FederationConfig enables server-to-server delivery for addresses of the
+// form user@domain.
+type FederationConfig struct {
+	// Domain is this server's name; user@Domain addresses are local.
+	Domain string `yaml:"domain"`
+	// IdentityKeyFile holds the server's Ed25519 signing key. It is created
+	// on first start.
+	IdentityKeyFile string `yaml:"identity_key"`
+	// Peers maps a domain to the base URL of its server, optionally followed
+	// by "#<hex public key>" to pin its identity. Domains not listed are
+	// reached at https://<domain>, and their key is pinned on first contact.
+	Peers map[string]string `yaml:"peers"`
+	// Allow, when not empty, lists the only domains we federate with. Deny
+	// lists domains we never federate with.
+	Allow []string `yaml:"allow"`
+	Deny  []string `yaml:"deny"`
+}
+
+// fedEnvelope is the body of a POST /federation/inbox request.
+type fedEnvelope struct {
+	From       string          `json:"from"` // user@origin
+	FromDevice string          `json:"from_device,omitempty"`
+	To         string          `json:"to"` // local user on the receiving server
+	ToDevice   string          `json:"to_device,omitempty"`
+	MsgID      string          `json:"msg_id,omitempty"`
+	Frame      json.RawMessage `json:"frame"`
+}
+
+type fedReceipt struct {
+	Status string `json:"status"`
+}
+
+type fedIdentity struct {
+	Domain    string `json:"domain"`
+	PublicKey string `json:"public_key"`
+}
+
+// fedItem is a frame waiting in a domain's retry queue.
+type fedItem struct {
+	env          fedEnvelope
+	senderID     string
+	senderDevice string
+	ack          bool
+	queued       time.Time
+	attempts     int
+}
+
+type federator struct {
+	domain string
+	key    ed25519.PrivateKey
+	allow  map[string]bool
+	deny   map[string]bool
+	client *http.Client
+	hub    *Hub // delivers incoming frames and tells senders how theirs went
+
+	mu     sync.Mutex
+	peers  map[string]string            // domain -> base URL
+	keys   map[string]ed25519.PublicKey // pinned identities
+	queues map[string]*peerQueue
+	seen   map[string]time.Time // signatures seen recently, against replays
+}
+
+// federation is nil unless ConfigureFederation was called.
+var federation *federator
+
+// ConfigureFederation enables federation. It must be called after
+// Configure and before the server starts accepting connections.
+func ConfigureFederation(cfg FederationConfig) error {
+	f, err := newFederator(cfg, hub)
+	if err != nil {
+		return err
+	}
+	federation = f
+	log.Printf("federation: serving %s with identity %x", f.domain, f.key.Public())
+	return nil
+}
+
+func newFederator(cfg FederationConfig, h *Hub) (*federator, error) {
+	if cfg.Domain == "" {
+		return nil, errors.New("federation needs a domain")
+	}
+	key, err := loadIdentityKey(cfg.IdentityKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	f := &federator{
+		domain: strings.ToLower(cfg.Domain),
+		key:    key,
+		allow:  make(map[string]bool),
+		deny:   make(map[string]bool),
+		client: &http.Client{Timeout: 10 * time.Second},
+		hub:    h,
+		peers:  make(map[string]string),
+		keys:   make(map[string]ed25519.PublicKey),
+		queues: make(map[string]*peerQueue),
+		seen:   make(map[string]time.Time),
+	}
+	for _, d := range cfg.Allow {
+		f.allow[strings.ToLower(d)] = true
+	}
+	for _, d := range cfg.Deny {
+		f.deny[strings.ToLower(d)] = true
+	}
+	for domain, target := range cfg.Peers {
+		domain = strings.ToLower(domain)
+		base, pin, _ := strings.Cut(target, "#")
+		f.peers[domain] = strings.TrimRight(base, "/")
+		if pin != "" {
+			pub, err := hex.DecodeString(pin)
+			if err != nil || len(pub) != ed25519.PublicKeySize {
+				return nil, fmt.Errorf("invalid pinned key for %s", domain)
+			}
+			f.keys[domain] = pub
+		}
+	}
+	return f, nil
+}
+
+// loadIdentityKey reads the server's signing key, creating it if missing.
+func loadIdentityKey(path string) (ed25519.PrivateKey, error) {
+	if b, err := os.ReadFile(path); err == nil {
+		seed, err := hex.DecodeString(strings.TrimSpace(string(b)))
+		if err != nil || len(seed) != ed25519.SeedSize {
+			return nil, fmt.Errorf("invalid identity key in %s", path)
+		}
+		return ed25519.NewKeyFromSeed(seed), nil
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("read identity key: %w", err)
+	}
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("generate identity key: %w", err)
+	}
+	if err := os.WriteFile(path, []byte(hex.EncodeToString(key.Seed())), 0o600); err != nil {
+		return nil, fmt.Errorf("write identity key: %w", err)
+	}
+	return key, nil
+}
+
+// splitAddress splits user@domain. Without federation, or for our own
+// domain, every address is local and domain is empty.
+func splitAddress(addr string) (user, domain string) {
+	if federation == nil {
+		return addr, ""
+	}
+	return federation.split(addr)
+}
+
+// split splits user@domain, leaving domain empty for addresses of ours.
+func (f *federator) split(addr string) (user, domain string) {
+	i := strings.LastIndex(addr, "@")
+	if i <= 0 || i == len(addr)-1 {
+		return addr, ""
+	}
+	user, domain = addr[:i], strings.ToLower(addr[i+1:])
+	if domain == f.domain {
+		return user, ""
+	}
+	return user, domain
+}
+
+func (f *federator) allowed(domain string) bool {
+	if f.deny[domain] {
+		return false
+	}
+	return len(f.allow) == 0 || f.allow[domain]
+}
+
+// baseURL returns where domain's server is reached.
+func (f *federator) baseURL(domain string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if u, ok := f.peers[domain]; ok {
+		return u
+	}
+	return "https://" + domain
+}
+
+// forward queues a frame from a local device for a user on another server.
+func (f *federator) forward(id, device string, t protocol.Targeted) error {
+	recipient, toDevice := t.Target()
+	user, domain := f.split(recipient)
+	if !f.allowed(domain) {
+		return errFederationDenied
+	}
+	from := id + "@" + f.domain
+	// the receiving server and client see fully qualified addresses
+	t.Head().ID = from
+	t.SetRecipient(user)
+	frame, err := protocol.Encode(t)
+	if err != nil {
+		return err
+	}
+	item := &fedItem{
+		env: fedEnvelope{
+			From:       from,
+			FromDevice: device,
+			To:         user,
+			ToDevice:   toDevice,
+			Frame:      frame,
+		},
+		senderID:     id,
+		senderDevice: device,
+		queued:       time.Now(),
+	}
+	if m, ok := t.(*protocol.Message); ok && m.MsgID != "" {
+		item.env.MsgID, item.ack = m.MsgID, true
+	}
+	return f.queueFor(domain).push(item)
+}
+
+func (f *federator) queueFor(domain string) *peerQueue {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	q, ok := f.queues[domain]
+	if !ok {
+		q = &peerQueue{domain: domain, wake: make(chan struct{}, 1)}
+		f.queues[domain] = q
+		go q.run(f)
+	}
+	return q
+}
+
+// notify sends a server frame to the device that sent item.
+func (f *federator) notify(item *fedItem, frame protocol.Frame) {
+	b, err := protocol.Encode(frame)
+	if err != nil {
+		return
+	}
+	f.hub.sendTargeted(targetedMessage{to: item.senderID, toDevice: item.senderDevice, msg: b})
+}
+
+// peerQueue delivers frames for one domain in order, backing off while the
+// domain is unreachable.
+type peerQueue struct {
+	domain string
+	wake   chan struct{}
+
+	mu    sync.Mutex
+	items []*fedItem
+}
+
+func (q *peerQueue) push(item *fedItem) error {
+	q.mu.Lock()
+	if len(q.items) >= maxFederationQueue {
+		q.mu.Unlock()
+		return errFederationQueue
+	}
+	q.items = append(q.items, item)
+	q.mu.Unlock()
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (q *peerQueue) head() *fedItem {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.items) == 0 {
+		return nil
+	}
+	return q.items[0]
+}
+
+func (q *peerQueue) pop() {
+	q.mu.Lock()
+	q.items = q.items[1:]
+	q.mu.Unlock()
+}
+
+func (q *peerQueue) run(f *federator) {
+	backoff := time.Second
+	for {
+		item := q.head()
+		if item == nil {
+			select {
+			case <-q.wake:
+				continue
+			case <-f.hub.shutdown:
+				return
+			}
+		}
+		status, permanent, err := f.post(q.domain, item.env)
+		if err == nil {
+			q.pop()
+			backoff = time.Second
+			if item.ack {
+				f.notify(item, protocol.NewAck(item.env.To+"@"+q.domain, item.env.MsgID, status))
+			}
+			continue
+		}
+		item.attempts++
+		if permanent || item.attempts >= federationMaxAttempts || time.Since(item.queued) > federationMaxAge {
+			q.pop()
+			log.Printf("federation: giving up on message for %s@%s after %d attempts: %v", item.env.To, q.domain, item.attempts, err)
+			e := protocol.NewError(fmt.Sprintf("delivery to %s@%s failed: %v", item.env.To, q.domain, err))
+			e.MsgID = item.env.MsgID
+			f.notify(item, e)
+			continue
+		}
+		log.Printf("federation: %s unreachable (%v), retrying in %s", q.domain, err, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-f.hub.shutdown:
+			return
+		}
+		if backoff *= 2; backoff > federationMaxBackoff {
+			backoff = federationMaxBackoff
+		}
+	}
+}
+
+// post sends env to domain's inbox. permanent reports failures that retrying
+// will not fix.
+func (f *federator) post(domain string, env fedEnvelope) (status string, permanent bool, err error) {
+	body, err := json.Marshal(env)
+	if err != nil {
+		return "", true, err
+	}
+	req, err := http.NewRequest(http.MethodPost, f.baseURL(domain)+"/federation/inbox", bytes.NewReader(body))
+	if err != nil {
+		return "", true, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	f.sign(req, domain, body)
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return "", false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		err := fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+		switch resp.StatusCode {
+		case http.StatusBadRequest, http.StatusForbidden, http.StatusNotFound:
+			return "", true, err
+		}
+		return "", false, err
+	}
+	var receipt fedReceipt
+	if err := json.NewDecoder(resp.Body).Decode(&receipt); err != nil {
+		return "", false, err
+	}
+	return receipt.Status, false, nil
+}
+
+// signedString is what a server signs for a request to dest.
+func signedString(method, path, origin, dest, ts string, body []byte) []byte {
+	sum := sha256.Sum256(body)
+	return []byte(strings.Join([]string{method, path, origin, dest, ts, hex.EncodeToString(sum[:])}, "\n"))
+}
+
+func (f *federator) sign(req *http.Request, dest string, body []byte) {
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	sig := ed25519.Sign(f.key, signedString(req.Method, req.URL.Path, f.domain, dest, ts, body))
+	req.Header.Set(headerFedOrigin, f.domain)
+	req.Header.Set(headerFedTimestamp, ts)
+	req.Header.Set(headerFedSignature, hex.EncodeToString(sig))
+}
+
+// verify checks that r was signed by origin's server for us.
+func (f *federator) verify(r *http.Request, origin string, body []byte) error {
+	ts := r.Header.Get(headerFedTimestamp)
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return errFederationAuth
+	}
+	if d := time.Since(time.Unix(sec, 0)); d > federationClockSkew || d < -federationClockSkew {
+		return fmt.Errorf("request timestamp outside the allowed window")
+	}
+	sig, err := hex.DecodeString(r.Header.Get(headerFedSignature))
+	if err != nil {
+		return errFederationAuth
+	}
+	pub, err := f.identityOf(origin)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(pub, signedString(r.Method, r.URL.Path, origin, f.domain, ts, body), sig) {
+		return errFederationAuth
+	}
+
+	// refuse to process the same signed request twice
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := time.Now()
+	for s, exp := range f.seen {
+		if now.After(exp) {
+			delete(f.seen, s)
+		}
+	}
+	key := hex.EncodeToString(sig)
+	if _, dup := f.seen[key]; dup {
+		return fmt.Errorf("replayed request")
+	}
+	f.seen[key] = now.Add(2 * federationClockSkew)
+	return nil
+}
+
+// identityOf returns origin's public key, fetching and pinning it on first
+// contact.
+func (f *federator) identityOf(origin string) (ed25519.PublicKey, error) {
+	f.mu.Lock()
+	pub, ok := f.keys[origin]
+	f.mu.Unlock()
+	if ok {
+		return pub, nil
+	}
+	resp, err := f.client.Get(f.baseURL(origin) + "/federation/identity")
+	if err != nil {
+		return nil, fmt.Errorf("fetch identity of %s: %w", origin, err)
+	}
+	defer resp.Body.Close()
+	var id fedIdentity
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetch identity of %s: %s", origin, resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&id); err != nil {
+		return nil, fmt.Errorf("decode identity of %s: %w", origin, err)
+	}
+	pub, err = hex.DecodeString(id.PublicKey)
+	if err != nil || len(pub) != ed25519.PublicKeySize || !strings.EqualFold(id.Domain, origin) {
+		return nil, fmt.Errorf("invalid identity for %s", origin)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if pinned, ok := f.keys[origin]; ok {
+		return pinned, nil
+	}
+	f.keys[origin] = pub
+	log.Printf("federation: pinned identity of %s: %x", origin, []byte(pub))
+	return pub, nil
+}
+
+// HandleFederationIdentity serves GET /federation/identity with this
+// server's domain and public key.
+func HandleFederationIdentity(w http.ResponseWriter, r *http.Request) {
+	if federation == nil {
+		http.Error(w, "federation disabled", http.StatusNotFound)
+		return
+	}
+	federation.serveIdentity(w, r)
+}
+
+func (f *federator) serveIdentity(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(fedIdentity{
+		Domain:    f.domain,
+		PublicKey: hex.EncodeToString(f.key.Public().(ed25519.PublicKey)),
+	})
+}
+
+// HandleFederationInbox accepts signed POST /federation/inbox requests from
+// other servers and delivers the frame to a local user.
+func HandleFederationInbox(w http.ResponseWriter, r *http.Request) {
+	if federation == nil {
+		http.Error(w, "federation disabled", http.StatusNotFound)
+		return
+	}
+	federation.serveInbox(w, r)
+}
+
+func (f *federator) serveInbox(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	origin := strings.ToLower(r.Header.Get(headerFedOrigin))
+	if origin == "" || origin == f.domain {
+		http.Error(w, "missing origin", http.StatusBadRequest)
+		return
+	}
+	if !f.allowed(origin) {
+		http.Error(w, errFederationDenied.Error(), http.StatusForbidden)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxFederationBody+1))
+	if err != nil || len(body) > maxFederationBody {
+		http.Error(w, "invalid body", http.StatusBadRequest)
+		return
+	}
+	if err := f.verify(r, origin, body); err != nil {
+		log.Printf("federation: rejected request from %s: %v", origin, err)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	var env fedEnvelope
+	if err := json.Unmarshal(body, &env); err != nil {
+		http.Error(w, "invalid body", http.StatusBadRequest)
+		return
+	}
+	frame, err := protocol.Decode(env.Frame)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	t, ok := frame.(protocol.Targeted)
+	if !ok {
+		http.Error(w, fmt.Sprintf("unexpected %s frame", frame.Kind()), http.StatusBadRequest)
+		return
+	}
+	// a server may only speak for its own users
+	if to, _ := t.Target(); !strings.HasSuffix(strings.ToLower(env.From), "@"+origin) || t.Head().ID != env.From || to != env.To {
+		http.Error(w, "sender does not belong to origin", http.StatusForbidden)
+		return
+	}
+	if !IsRegistered(env.To) {
+		http.Error(w, "recipient not found", http.StatusNotFound)
+		return
+	}
+
+	if a, ok := frame.(*protocol.Ack); ok {
+		deliveries.update(a.Recipient, a.MsgID, env.From, a.Status)
+	}
+	storeHistory(env.From, env.FromDevice, frame, env.Frame)
+	f.hub.sendTargeted(targetedMessage{
+		to:         env.To,
+		toDevice:   env.ToDevice,
+		from:       env.From,
+		fromDevice: env.FromDevice,
+		msgID:      env.MsgID,
+		msg:        env.Frame,
+	})
+	log.Printf("federation: delivered len=%d from=%q to=%q", len(env.Frame), env.From, env.To)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(fedReceipt{Status: "queued"})
+}
@@ -0,0 +1,236 @@
+package server
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/marcoantonios1/chat-app/internal/protocol"
+)
+
+// fedPeer is a federation server on a local port. Its federator can be
+// replaced to play a server that changed its identity.
+type fedPeer struct {
+	srv *httptest.Server
+	fed atomic.Pointer[federator]
+}
+
+func startFedPeer(t *testing.T) *fedPeer {
+	t.Helper()
+	p := &fedPeer{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/federation/identity", func(w http.ResponseWriter, r *http.Request) { p.fed.Load().serveIdentity(w, r) })
+	mux.HandleFunc("/federation/inbox", func(w http.ResponseWriter, r *http.Request) { p.fed.Load().serveInbox(w, r) })
+	p.srv = httptest.NewServer(mux)
+	t.Cleanup(p.srv.Close)
+	return p
+}
+
+func newTestFederator(t *testing.T, h *Hub, cfg FederationConfig) *federator {
+	t.Helper()
+	cfg.IdentityKeyFile = filepath.Join(t.TempDir(), "identity")
+	f, err := newFederator(cfg, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+// fedMessage returns the envelope of a message from user@domain to a user
+// of another server.
+func fedMessage(t *testing.T, from, to, msgID string) fedEnvelope {
+	t.Helper()
+	m := protocol.NewMessage(to, "", msgID, "hello")
+	m.ID = from
+	frame, err := protocol.Encode(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fedEnvelope{From: from, FromDevice: "d1", To: to, MsgID: msgID, Frame: frame}
+}
+
+// signInbox returns env's body and the headers f signs it with for dest.
+func signInbox(t *testing.T, f *federator, dest string, env fedEnvelope) ([]byte, http.Header) {
+	t.Helper()
+	body, err := json.Marshal(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest(http.MethodPost, "http://"+dest+"/federation/inbox", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.sign(req, dest, body)
+	return body, req.Header
+}
+
+// sendInbox posts body with hdr to p's inbox and returns the status code.
+func sendInbox(t *testing.T, p *fedPeer, body []byte, hdr http.Header) int {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, p.srv.URL+"/federation/inbox", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header = hdr.Clone()
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestFederationDelivers(t *testing.T) {
+	h := startHub(t, 2)
+	addUser(t, "alice", "a1")
+	addUser(t, "bob", "b1")
+	a, b := startFedPeer(t), startFedPeer(t)
+	fa := newTestFederator(t, h, FederationConfig{Domain: "a.test", Peers: map[string]string{"b.test": b.srv.URL}})
+	fb := newTestFederator(t, h, FederationConfig{Domain: "b.test", Peers: map[string]string{"a.test": a.srv.URL}})
+	a.fed.Store(fa)
+	b.fed.Store(fb)
+	alice := newTestClient("alice", "a1", 8)
+	attach(t, h, alice)
+	bob := newTestClient("bob", "b1", 8)
+	attach(t, h, bob)
+
+	if err := fa.forward("alice", "a1", protocol.NewMessage("bob@b.test", "", "m1", "hi")); err != nil {
+		t.Fatal(err)
+	}
+	f, err := protocol.Decode(receive(t, bob))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m, ok := f.(*protocol.Message); !ok || m.ID != "alice@a.test" || m.Recipient != "bob" || m.Body != "hi" {
+		t.Fatalf("bob got %#v", f)
+	}
+	f, err = protocol.Decode(receive(t, alice))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ack, ok := f.(*protocol.Ack); !ok || ack.Recipient != "bob@b.test" || ack.MsgID != "m1" || ack.Status != "queued" {
+		t.Fatalf("alice got %#v, want a queued ack of m1", f)
+	}
+
+	// b.test pinned a.test's key on first contact
+	fb.mu.Lock()
+	pinned := fb.keys["a.test"]
+	fb.mu.Unlock()
+	if !pinned.Equal(fa.key.Public()) {
+		t.Fatalf("b.test pinned %x, want %x", []byte(pinned), fa.key.Public())
+	}
+}
+
+func TestFederationPinsIdentity(t *testing.T) {
+	h := startHub(t, 1)
+	addUser(t, "bob", "b1")
+	a, b := startFedPeer(t), startFedPeer(t)
+	fa := newTestFederator(t, h, FederationConfig{Domain: "a.test", Peers: map[string]string{"b.test": b.srv.URL}})
+	a.fed.Store(fa)
+	b.fed.Store(newTestFederator(t, h, FederationConfig{Domain: "b.test", Peers: map[string]string{"a.test": a.srv.URL}}))
+
+	if _, _, err := fa.post("b.test", fedMessage(t, "alice@a.test", "bob", "m1")); err != nil {
+		t.Fatalf("first contact: %v", err)
+	}
+	// a.test comes back with another key, which b.test must not accept
+	impostor := newTestFederator(t, h, FederationConfig{Domain: "a.test", Peers: map[string]string{"b.test": b.srv.URL}})
+	a.fed.Store(impostor)
+	if _, _, err := impostor.post("b.test", fedMessage(t, "alice@a.test", "bob", "m2")); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Fatalf("new key after pinning: err = %v, want 401", err)
+	}
+
+	// a key pinned in the configuration wins over what the peer serves
+	c := startFedPeer(t)
+	other, _, _ := ed25519.GenerateKey(nil)
+	c.fed.Store(newTestFederator(t, h, FederationConfig{Domain: "c.test", Peers: map[string]string{"a.test": a.srv.URL + "#" + hex.EncodeToString(other)}}))
+	fa.mu.Lock()
+	fa.peers["c.test"] = c.srv.URL
+	fa.mu.Unlock()
+	if _, _, err := fa.post("c.test", fedMessage(t, "alice@a.test", "bob", "m3")); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Fatalf("key other than the configured pin: err = %v, want 401", err)
+	}
+}
+
+func TestFederationRejectsForgedAndReplayed(t *testing.T) {
+	h := startHub(t, 1)
+	addUser(t, "bob", "b1")
+	bob := newTestClient("bob", "b1", 8)
+	attach(t, h, bob)
+	a, b := startFedPeer(t), startFedPeer(t)
+	fa := newTestFederator(t, h, FederationConfig{Domain: "a.test"})
+	a.fed.Store(fa)
+	b.fed.Store(newTestFederator(t, h, FederationConfig{Domain: "b.test", Peers: map[string]string{"a.test": a.srv.URL}}))
+
+	body, hdr := signInbox(t, fa, "b.test", fedMessage(t, "alice@a.test", "bob", "m1"))
+	if code := sendInbox(t, b, body, hdr); code != http.StatusOK {
+		t.Fatalf("signed request: status %d", code)
+	}
+	receive(t, bob)
+	if code := sendInbox(t, b, body, hdr); code != http.StatusUnauthorized {
+		t.Fatalf("replayed request: status %d, want 401", code)
+	}
+
+	tampered := bytes.Replace(body, []byte(`"m1"`), []byte(`"m9"`), 1)
+	body2, hdr2 := signInbox(t, fa, "b.test", fedMessage(t, "alice@a.test", "bob", "m2"))
+	if code := sendInbox(t, b, tampered, hdr2); code != http.StatusUnauthorized {
+		t.Fatalf("tampered body: status %d, want 401", code)
+	}
+	body3, hdr3 := signInbox(t, fa, "c.test", fedMessage(t, "alice@a.test", "bob", "m3"))
+	if code := sendInbox(t, b, body3, hdr3); code != http.StatusUnauthorized {
+		t.Fatalf("signed for another server: status %d, want 401", code)
+	}
+	stale := hdr2.Clone()
+	stale.Set(headerFedTimestamp, strconv.FormatInt(time.Now().Add(-2*federationClockSkew).Unix(), 10))
+	if code := sendInbox(t, b, body2, stale); code != http.StatusUnauthorized {
+		t.Fatalf("old timestamp: status %d, want 401", code)
+	}
+	body4, hdr4 := signInbox(t, fa, "b.test", fedMessage(t, "mallory@c.test", "bob", "m4"))
+	if code := sendInbox(t, b, body4, hdr4); code != http.StatusForbidden {
+		t.Fatalf("sender of another domain: status %d, want 403", code)
+	}
+	// the genuine request behind the tampered one still goes through
+	if code := sendInbox(t, b, body2, hdr2); code != http.StatusOK {
+		t.Fatalf("untampered request: status %d", code)
+	}
+}
+
+func TestFederationAllowDeny(t *testing.T) {
+	h := startHub(t, 1)
+	addUser(t, "bob", "b1")
+	b := startFedPeer(t)
+	b.fed.Store(newTestFederator(t, h, FederationConfig{Domain: "b.test", Deny: []string{"evil.test"}}))
+	c := startFedPeer(t)
+	c.fed.Store(newTestFederator(t, h, FederationConfig{Domain: "c.test", Allow: []string{"a.test"}}))
+
+	for _, tt := range []struct {
+		origin string
+		peer   *fedPeer
+		dest   string
+	}{
+		{"evil.test", b, "b.test"},
+		{"other.test", c, "c.test"},
+	} {
+		f := newTestFederator(t, h, FederationConfig{Domain: tt.origin, Peers: map[string]string{tt.dest: tt.peer.srv.URL}})
+		_, permanent, err := f.post(tt.dest, fedMessage(t, "alice@"+tt.origin, "bob", "m1"))
+		if err == nil || !strings.Contains(err.Error(), "403") || !permanent {
+			t.Fatalf("%s to %s: err = %v permanent = %v, want a permanent 403", tt.origin, tt.dest, err, permanent)
+		}
+	}
+
+	out := newTestFederator(t, h, FederationConfig{Domain: "a.test", Allow: []string{"b.test", "c.test"}, Deny: []string{"c.test"}})
+	for _, to := range []string{"bob@c.test", "bob@d.test"} {
+		if err := out.forward("alice", "a1", protocol.NewMessage(to, "", "m1", "hi")); !errors.Is(err, errFederationDenied) {
+			t.Fatalf("forward to %s: err = %v, want %v", to, err, errFederationDenied)
+		}
+	}
+}
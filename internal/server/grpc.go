@@ -0,0 +1,240 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log"
+	"net"
+
+	"github.com/marcoantonios1/chat-app/internal/chatrpc"
+	"github.com/marcoantonios1/chat-app/internal/protocol"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// grpcService serves the chat service over gRPC. Connect streams are
+// clients of the same hub as websocket connections.
+type grpcService struct{}
+
+// NewGRPCServer returns a gRPC server with the chat service registered,
+// serving TLS with tlsConf unless it is nil.
+func NewGRPCServer(tlsConf *tls.Config) *grpc.Server {
+	opts := []grpc.ServerOption{grpc.MaxRecvMsgSize(maxMessageSize())}
+	if tlsConf != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConf)))
+	}
+	s := grpc.NewServer(opts...)
+	chatrpc.RegisterChatServer(s, grpcService{})
+	return s
+}
+
+// ServeGRPC serves s on addr until s is stopped.
+func ServeGRPC(s *grpc.Server, addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	log.Printf("grpc: listening on %s", l.Addr())
+	return s.Serve(l)
+}
+
+// caller returns the id, device, device name and device secret a call was
+// made as.
+func caller(ctx context.Context) (id, device, name, secret string) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	get := func(key string) string {
+		if v := md.Get(key); len(v) > 0 {
+			return v[0]
+		}
+		return ""
+	}
+	id, device, name = get(chatrpc.MetadataID), get(chatrpc.MetadataDevice), get(chatrpc.MetadataDeviceName)
+	if device == "" {
+		device = defaultDevice
+	}
+	return id, device, name, get(chatrpc.MetadataDeviceSecret)
+}
+
+// approvedCaller returns the caller of a unary call, which must be an
+// approved device of a registered user.
+func approvedCaller(ctx context.Context) (string, string, error) {
+	id, device, _, secret := caller(ctx)
+	if id == "" {
+		return "", "", status.Error(codes.Unauthenticated, "missing "+chatrpc.MetadataID+" metadata")
+	}
+	if err := callerCert(ctx, id); err != nil {
+		return "", "", err
+	}
+	switch err := authDevice(id, device, secret); err {
+	case nil:
+	case errNoSecret, errWrongSecret:
+		return "", "", status.Error(codes.Unauthenticated, err.Error())
+	default:
+		return "", "", status.Error(codes.PermissionDenied, "device is not approved for this id")
+	}
+	return id, device, nil
+}
+
+// callerCert checks the client certificate of the call in ctx for id
+// under mutual TLS.
+func callerCert(ctx context.Context, id string) error {
+	var cs *tls.ConnectionState
+	if p, ok := peer.FromContext(ctx); ok {
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			cs = &info.State
+		}
+	}
+	err := checkClientCert(cs, id)
+	switch err {
+	case nil:
+		return nil
+	case errClientCertRequired:
+		return status.Error(codes.Unauthenticated, err.Error())
+	}
+	return status.Error(codes.PermissionDenied, err.Error())
+}
+
+func (grpcService) Connect(stream grpc.BidiStreamingServer[chatrpc.Frame, chatrpc.Frame]) error {
+	id, device, name, secret := caller(stream.Context())
+	if id == "" {
+		return status.Error(codes.Unauthenticated, "missing "+chatrpc.MetadataID+" metadata")
+	}
+	if err := callerCert(stream.Context(), id); err != nil {
+		return err
+	}
+	if err := admit(id, device, name, secret); err != nil {
+		return status.Error(codes.PermissionDenied, err.Error())
+	}
+
+	first, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	hello, ok := first.Frame.(*protocol.Hello)
+	if !ok {
+		return status.Error(codes.FailedPrecondition, "expected a hello frame")
+	}
+	welcome, session, code, reason := accept(hello, id, device)
+	if code != 0 {
+		return status.Error(codes.FailedPrecondition, reason)
+	}
+	defer resumes.release(session)
+	if err := stream.Send(&chatrpc.Frame{Frame: welcome}); err != nil {
+		return err
+	}
+	log.Printf("grpc: handshake id=%q software=%q", id, hello.Software)
+
+	client := &Client{ID: id, Device: device, Send: newSendBuffer()}
+	if !hub.attachClient(client) {
+		return status.Error(codes.Unavailable, "server shutting down")
+	}
+	log.Printf("grpc: client connected id=%q device=%q", id, device)
+
+	// reader: the stream ends once this handler returns
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		rateTokens := newRateLimit()
+		for {
+			in, err := stream.Recv()
+			if err != nil {
+				log.Printf("grpc: read error/closed for id=%q: %v", id, err)
+				break
+			}
+			if !allow(client, rateTokens) {
+				continue
+			}
+			if !handleFrame(client, in.Frame, nil) {
+				break
+			}
+		}
+		hub.detachClient(client)
+	}()
+
+	// writer: until the hub closes Send, replaying what the client missed
+	// before resuming first
+	var writeErr error
+	write := func(msg []byte, seq int64) {
+		b, err := protocol.Transcode(msg, seq, protocol.CBOR)
+		if err != nil {
+			log.Printf("grpc: cannot encode frame for id=%q: %v", id, err)
+			return
+		}
+		if writeErr = stream.Send(chatrpc.Encoded(b)); writeErr != nil {
+			log.Printf("grpc: write error for id=%q: %v", id, writeErr)
+			hub.detachClient(client)
+		}
+	}
+	for _, f := range session.since(hello.LastSeq) {
+		write(f.msg, f.seq)
+	}
+	for msg := range client.Send {
+		seq := session.number(msg)
+		if writeErr != nil {
+			// kept in the session for a resume
+			continue
+		}
+		write(msg, seq)
+		if len(client.Send) == 0 && client.spilled.Load() {
+			hub.requestFlush(client)
+		}
+	}
+	log.Printf("grpc: disconnected id=%q", id)
+	return writeErr
+}
+
+func (grpcService) Register(ctx context.Context, req *chatrpc.RegisterRequest) (*chatrpc.RegisterResponse, error) {
+	if req.ID == "" {
+		return nil, status.Error(codes.InvalidArgument, "missing id")
+	}
+	if err := callerCert(ctx, req.ID); err != nil {
+		return nil, err
+	}
+	if err := registerUser(req.ID, req.Device, req.DeviceName, req.DeviceSecret); err != nil {
+		switch {
+		case errors.Is(err, errIDTaken):
+			return nil, status.Error(codes.AlreadyExists, err.Error())
+		case errors.Is(err, errNoSecret):
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	log.Printf("grpc: registered user %q", req.ID)
+	return &chatrpc.RegisterResponse{}, nil
+}
+
+func (grpcService) FetchHistory(ctx context.Context, req *chatrpc.FetchHistoryRequest) (*chatrpc.FetchHistoryResponse, error) {
+	id, device, err := approvedCaller(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if req.With == "" {
+		return nil, status.Error(codes.InvalidArgument, "missing with")
+	}
+	msgs, next := history.page(id, req.With, historyQuery{Before: req.Before, Limit: req.Limit, Device: device})
+	return &chatrpc.FetchHistoryResponse{Messages: msgs, NextBefore: next}, nil
+}
+
+func (grpcService) GetPrekeys(ctx context.Context, req *chatrpc.GetPrekeysRequest) (*chatrpc.GetPrekeysResponse, error) {
+	if _, _, err := approvedCaller(ctx); err != nil {
+		return nil, err
+	}
+	if !IsRegistered(req.User) {
+		return nil, status.Error(codes.NotFound, "user not registered")
+	}
+	resp := &chatrpc.GetPrekeysResponse{Keys: []chatrpc.Prekey{}}
+	for _, k := range prekeys.forUser(req.User) {
+		resp.Keys = append(resp.Keys, chatrpc.Prekey{
+			Device:         k.Device,
+			PublicKey:      k.PublicKey,
+			IdentityPublic: k.IdentityPublic,
+			PublicKeySig:   k.PublicKeySig,
+		})
+	}
+	return resp, nil
+}
@@ -0,0 +1,269 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/marcoantonios1/chat-app/internal/chatrpc"
+	"github.com/marcoantonios1/chat-app/internal/protocol"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// startGRPC serves the chat service on a loopback port until the test
+// ends and returns a client of it.
+func startGRPC(t *testing.T) *chatrpc.ChatClient {
+	t.Helper()
+	runGlobalHub()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewGRPCServer(nil)
+	go func() { _ = s.Serve(l) }()
+	t.Cleanup(s.Stop)
+	cc, err := grpc.NewClient(l.Addr().String(),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(chatrpc.CallOption()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = cc.Close() })
+	return chatrpc.NewChatClient(cc)
+}
+
+// as returns a context that calls as id/device with secret.
+func as(t *testing.T, id, device, secret string) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+	return metadata.AppendToOutgoingContext(ctx,
+		chatrpc.MetadataID, id, chatrpc.MetadataDevice, device, chatrpc.MetadataDeviceSecret, secret)
+}
+
+// forgetUser drops id when the test ends.
+func forgetUser(t *testing.T, id string) {
+	t.Cleanup(func() {
+		usersMu.Lock()
+		delete(users, id)
+		usersMu.Unlock()
+	})
+}
+
+func wantCode(t *testing.T, what string, err error, code codes.Code) {
+	t.Helper()
+	if status.Code(err) != code {
+		t.Fatalf("%s: err = %v, want %s", what, err, code)
+	}
+}
+
+// connectGRPC opens a Connect stream as id/device and does the handshake.
+func connectGRPC(t *testing.T, c *chatrpc.ChatClient, id, device, secret string) grpc.BidiStreamingClient[chatrpc.Frame, chatrpc.Frame] {
+	t.Helper()
+	stream, err := c.Connect(as(t, id, device, secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Send(&chatrpc.Frame{Frame: protocol.NewHello("chat-app/test")}); err != nil {
+		t.Fatal(err)
+	}
+	in, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := in.Frame.(*protocol.Welcome); !ok {
+		t.Fatalf("handshake answered with %#v", in.Frame)
+	}
+	return stream
+}
+
+// dialWS connects to the WebSocket endpoint at url as id/device with JSON
+// frames and does the handshake.
+func dialWS(t *testing.T, url, id, device, secret string) *websocket.Conn {
+	t.Helper()
+	d := websocket.Dialer{Subprotocols: []string{protocol.SubprotocolJSON}}
+	conn, _, err := d.Dial(url+"?id="+id+"&device="+device, http.Header{chatrpc.MetadataDeviceSecret: {secret}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	b, _ := protocol.Encode(protocol.NewHello("chat-app/test"))
+	if err := conn.WriteMessage(websocket.TextMessage, b); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := readWS(t, conn).(*protocol.Welcome); !ok {
+		t.Fatal("no welcome")
+	}
+	return conn
+}
+
+func readWS(t *testing.T, conn *websocket.Conn) protocol.Frame {
+	t.Helper()
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, b, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := protocol.Decode(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestGRPCRegister(t *testing.T) {
+	c := startGRPC(t)
+	forgetUser(t, "gus")
+	ctx := context.Background()
+	if _, err := c.Register(ctx, &chatrpc.RegisterRequest{ID: "gus", Device: "g1", DeviceSecret: "sg"}); err != nil {
+		t.Fatal(err)
+	}
+	if !isApprovedDevice("gus", "g1") {
+		t.Fatal("the registering device is not approved")
+	}
+	_, err := c.Register(ctx, &chatrpc.RegisterRequest{ID: "gus"})
+	wantCode(t, "registering a taken id", err, codes.AlreadyExists)
+	_, err = c.Register(ctx, &chatrpc.RegisterRequest{})
+	wantCode(t, "registering without an id", err, codes.InvalidArgument)
+	_, err = c.Register(ctx, &chatrpc.RegisterRequest{ID: "gwen", Device: "g1"})
+	wantCode(t, "registering a device without its secret", err, codes.InvalidArgument)
+	if IsRegistered("gwen") {
+		t.Fatal("registered without a device secret")
+	}
+}
+
+func TestGRPCTalksToWebSocket(t *testing.T) {
+	c := startGRPC(t)
+	ws := httptest.NewServer(http.HandlerFunc(HandleMessage))
+	defer ws.Close()
+	for id, dev := range map[string]string{"gus": "g1", "wes": "w1"} {
+		forgetUser(t, id)
+		if err := registerUser(id, dev, "", "s"+dev); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Cleanup(func() {
+		history.mu.Lock()
+		delete(history.conversations, conversationKey("gus", "wes"))
+		history.mu.Unlock()
+	})
+	gus := connectGRPC(t, c, "gus", "g1", "sg1")
+	wes := dialWS(t, "ws"+strings.TrimPrefix(ws.URL, "http"), "wes", "w1", "sw1")
+
+	m := protocol.NewMessage("wes", "", "m1", "00ff")
+	m.ID, m.Device = "gus", "g1"
+	if err := gus.Send(&chatrpc.Frame{Frame: m}); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		if got, ok := readWS(t, wes).(*protocol.Message); ok {
+			if got.ID != "gus" || got.Device != "g1" || got.MsgID != "m1" || got.Body != "00ff" {
+				t.Fatalf("wes got %#v", got)
+			}
+			break
+		}
+	}
+
+	reply := protocol.NewMessage("gus", "", "m2", "ff00")
+	reply.ID, reply.Device = "wes", "w1"
+	b, _ := protocol.Encode(reply)
+	if err := wes.WriteMessage(websocket.TextMessage, b); err != nil {
+		t.Fatal(err)
+	}
+	acked := false
+	for {
+		in, err := gus.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch f := in.Frame.(type) {
+		case *protocol.Ack:
+			acked = acked || f.MsgID == "m1"
+			continue
+		case *protocol.Message:
+			if f.ID != "wes" || f.MsgID != "m2" || f.Body != "ff00" || f.Seq == 0 {
+				t.Fatalf("gus got %#v", f)
+			}
+		default:
+			continue
+		}
+		break
+	}
+	if !acked {
+		t.Fatal("gus's message was not acknowledged before wes's reply")
+	}
+
+	// both sides of the conversation are in the history
+	resp, err := c.FetchHistory(as(t, "gus", "g1", "sg1"), &chatrpc.FetchHistoryRequest{With: "wes"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Messages) != 2 || resp.Messages[0].MsgID != "m2" || resp.Messages[1].MsgID != "m1" {
+		t.Fatalf("history %+v, want m2 and m1", resp.Messages)
+	}
+}
+
+func TestGRPCApprovedCaller(t *testing.T) {
+	c := startGRPC(t)
+	forgetUser(t, "gus")
+	forgetUser(t, "wes")
+	if err := registerUser("gus", "g1", "", "sg1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := registerUser("wes", "w1", "", "sw1"); err != nil {
+		t.Fatal(err)
+	}
+	prekeys.put("wes", "w1", protocol.PublicKey{PublicKey: "pub-w1"})
+	prekeys.put("wes", "w2", protocol.PublicKey{PublicKey: "pub-w2"}) // never approved
+	t.Cleanup(func() {
+		prekeys.mu.Lock()
+		delete(prekeys.keys, deviceRef{"wes", "w1"})
+		delete(prekeys.keys, deviceRef{"wes", "w2"})
+		prekeys.mu.Unlock()
+	})
+
+	// a device seen for the first time waits for approval
+	stream, err := c.Connect(as(t, "gus", "g2", "sg2"))
+	if err == nil {
+		_, err = stream.Recv()
+	}
+	wantCode(t, "connecting a new device", err, codes.PermissionDenied)
+
+	for _, call := range []struct {
+		what string
+		ctx  context.Context
+		code codes.Code
+	}{
+		{"no id", context.Background(), codes.Unauthenticated},
+		{"no secret", as(t, "gus", "g1", ""), codes.Unauthenticated},
+		{"wrong secret", as(t, "gus", "g1", "sg2"), codes.Unauthenticated},
+		{"pending device", as(t, "gus", "g2", "sg2"), codes.PermissionDenied},
+		{"unknown user", as(t, "mallory", "m1", "s"), codes.PermissionDenied},
+	} {
+		_, err := c.FetchHistory(call.ctx, &chatrpc.FetchHistoryRequest{With: "wes"})
+		wantCode(t, "FetchHistory with "+call.what, err, call.code)
+		_, err = c.GetPrekeys(call.ctx, &chatrpc.GetPrekeysRequest{User: "wes"})
+		wantCode(t, "GetPrekeys with "+call.what, err, call.code)
+	}
+
+	ctx := as(t, "gus", "g1", "sg1")
+	_, err = c.FetchHistory(ctx, &chatrpc.FetchHistoryRequest{})
+	wantCode(t, "FetchHistory without a peer", err, codes.InvalidArgument)
+	_, err = c.GetPrekeys(ctx, &chatrpc.GetPrekeysRequest{User: "nobody"})
+	wantCode(t, "GetPrekeys of an unknown user", err, codes.NotFound)
+	resp, err := c.GetPrekeys(ctx, &chatrpc.GetPrekeysRequest{User: "wes"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Keys) != 1 || resp.Keys[0].Device != "w1" || resp.Keys[0].PublicKey != "pub-w1" {
+		t.Fatalf("prekeys %+v, want w1's only", resp.Keys)
+	}
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/marcoantonios1/chat-app/internal/protocol"
+)
+
+// SoftwareVersion is announced to clients in the welcome frame.
+var SoftwareVersion = "chatapp-server/0.1.0"
+
+// supportedSuites are the end-to-end crypto suites clients may use here.
+var supportedSuites = []string{protocol.SuiteKyberAESGCM}
+
+// serverFeatures lists what this server enables for its clients.
+func serverFeatures() []string {
+	features := []string{protocol.FeatureHistory, protocol.FeatureReceipts, protocol.FeatureDevices, protocol.FeatureResume}
+	if federation != nil {
+		features = append(features, protocol.FeatureFederation)
+	}
+	return features
+}
+
+// handshake waits for the client's hello and answers with a welcome. If
+// the two sides have nothing in common the connection is closed with one
+// of the protocol close codes and an error is returned. The caller
+// releases the returned resume session when the connection ends.
+func handshake(conn *websocket.Conn, codec protocol.Codec, id, device string) (*protocol.Hello, *resumeSession, error) {
+	_ = conn.SetReadDeadline(time.Now().Add(protocol.HandshakeTimeout))
+	_, msg, err := conn.ReadMessage()
+	if err != nil {
+		return nil, nil, err
+	}
+	frame, err := codec.Unmarshal(msg)
+	hello, ok := frame.(*protocol.Hello)
+	if err != nil || !ok {
+		return nil, nil, refuse(conn, protocol.CloseHandshakeRequired, "expected a hello frame")
+	}
+	welcome, session, code, reason := accept(hello, id, device)
+	if code != 0 {
+		return nil, nil, refuse(conn, code, reason)
+	}
+	b, err := codec.Marshal(welcome)
+	if err == nil {
+		_ = conn.SetWriteDeadline(time.Now().Add(writeWait()))
+		err = conn.WriteMessage(messageType(codec), b)
+	}
+	if err != nil {
+		resumes.release(session)
+		return nil, nil, err
+	}
+	return hello, session, nil
+}
+
+// accept answers the hello of id/device with a welcome and opens the
+// connection's resume session, or returns the close code and reason to
+// refuse the connection with.
+func accept(hello *protocol.Hello, id, device string) (*protocol.Welcome, *resumeSession, int, string) {
+	if (hello.ID != "" && hello.ID != id) || (hello.Device != "" && hello.Device != device) {
+		return nil, nil, protocol.CloseHandshakeRequired, "hello sender does not match connection"
+	}
+	version, suite, code, reason := protocol.Negotiate(hello, supportedSuites)
+	if code != 0 {
+		return nil, nil, code, reason
+	}
+	session, resumed := resumes.open(hello.Resume, id, device)
+	if resumed {
+		log.Printf("ws: resumed session id=%q device=%q after seq %d", id, device, hello.LastSeq)
+	}
+	return &protocol.Welcome{
+		Version:      version,
+		Software:     SoftwareVersion,
+		Suite:        suite,
+		MaxFrameSize: maxMessageSize(),
+		Features:     serverFeatures(),
+		ServerTime:   time.Now().UnixMilli(),
+		ResumeToken:  session.token,
+		Resumed:      resumed,
+	}, session, 0, ""
+}
+
+// messageType is the websocket message type frames in codec are sent as.
+func messageType(codec protocol.Codec) int {
+	if codec.Binary() {
+		return websocket.BinaryMessage
+	}
+	return websocket.TextMessage
+}
+
+// refuse closes conn with code and reason.
+func refuse(conn *websocket.Conn, code int, reason string) error {
+	_ = conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(writeWait()))
+	_ = conn.Close()
+	return fmt.Errorf("handshake refused (%d): %s", code, reason)
+}
@@ -0,0 +1,306 @@
+package server
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/marcoantonios1/chat-app/internal/protocol"
+)
+
+const (
+	// default time a stored envelope is kept before being pruned.
+	defaultHistoryRetention = 7 * 24 * time.Hour
+	// default and maximum page size for history queries.
+	defaultHistoryLimit = 50
+	maxHistoryLimit     = 500
+)
+
+// History seqs are ordered across instances: the milliseconds since
+// seqEpoch, then the storing instance's node number, then a counter for
+// messages stored in the same millisecond. Instances joined by a backplane
+// keep the seq a message got where it was sent, so a cursor from one of
+// them pages the same way on any other.
+const (
+	seqEpoch     = 1704067200000 // 2024-01-01 UTC, unix millis
+	seqNodeBits  = 10
+	seqCountBits = 12
+	seqNodeShift = seqCountBits
+	seqTimeShift = seqNodeBits + seqCountBits
+	seqCountMax  = 1<<seqCountBits - 1
+)
+
+// historyQuery selects a page of a conversation, newest first. Before and
+// BeforeTS are exclusive upper bounds; zero means "from the newest message".
+// Copies encrypted for a specific device are only returned to that Device,
+// or to the device that sent them (one copy per message).
+type historyQuery struct {
+	Before   int64
+	BeforeTS int64
+	Limit    int
+	Device   string
+}
+
+type historyStore struct {
+	mu            sync.Mutex
+	seq           int64 // last seq assigned here
+	node          int64
+	retention     time.Duration
+	conversations map[string][]protocol.HistoryEntry
+}
+
+var history = &historyStore{
+	retention:     defaultHistoryRetention,
+	conversations: make(map[string][]protocol.HistoryEntry),
+}
+
+// conversationKey returns the same key for (a, b) and (b, a).
+func conversationKey(a, b string) string {
+	if a < b {
+		return a + "\x00" + b
+	}
+	return b + "\x00" + a
+}
+
+// SetHistoryRetention sets how long envelopes are kept. A zero or negative
+// duration disables pruning.
+func SetHistoryRetention(d time.Duration) {
+	history.mu.Lock()
+	history.retention = d
+	history.mu.Unlock()
+}
+
+// setNode derives the node number put in new seqs from the instance name.
+// Two instances rarely share one; if they do, messages they store in the
+// same millisecond may get the same seq.
+func (s *historyStore) setNode(instance string) {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(instance))
+	s.mu.Lock()
+	s.node = int64(h.Sum32() % (1 << seqNodeBits))
+	s.mu.Unlock()
+}
+
+// nextSeq returns a seq greater than every one assigned here before.
+func (s *historyStore) nextSeq(now time.Time) int64 {
+	ms := now.UnixMilli() - seqEpoch
+	if last := s.seq >> seqTimeShift; ms <= last {
+		if s.seq&seqCountMax < seqCountMax {
+			s.seq++
+			return s.seq
+		}
+		ms = last + 1
+	}
+	s.seq = ms<<seqTimeShift | s.node<<seqNodeShift
+	return s.seq
+}
+
+// append stores an encrypted envelope exchanged between from and to.
+func (s *historyStore) append(from, fromDevice, to, toDevice, msgID string, envelope []byte) protocol.HistoryEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	seq := s.nextSeq(time.Now())
+	e := protocol.HistoryEntry{
+		Seq:        seq,
+		Timestamp:  seqEpoch + seq>>seqTimeShift,
+		From:       from,
+		FromDevice: fromDevice,
+		To:         to,
+		MsgID:      msgID,
+		ToDevice:   toDevice,
+		Envelope:   append(json.RawMessage(nil), envelope...),
+	}
+	k := conversationKey(from, to)
+	s.conversations[k] = append(s.conversations[k], e)
+	return e
+}
+
+// insert stores an entry another instance appended, keeping its seq and
+// timestamp. Entries arrive roughly in order, so it searches from the end.
+func (s *historyStore) insert(e protocol.HistoryEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k := conversationKey(e.From, e.To)
+	conv := s.conversations[k]
+	i := len(conv)
+	for i > 0 && conv[i-1].Seq > e.Seq {
+		i--
+	}
+	if i > 0 && conv[i-1].Seq == e.Seq && conv[i-1].MsgID == e.MsgID && conv[i-1].ToDevice == e.ToDevice {
+		return // already have it
+	}
+	conv = append(conv, protocol.HistoryEntry{})
+	copy(conv[i+1:], conv[i:])
+	conv[i] = e
+	s.conversations[k] = conv
+}
+
+// page returns up to q.Limit entries of the conversation between a (the
+// requester) and b, newest first, plus the cursor for the next (older) page
+// or 0 when done.
+func (s *historyStore) page(a, b string, q historyQuery) ([]protocol.HistoryEntry, int64) {
+	limit := q.Limit
+	if limit <= 0 {
+		limit = defaultHistoryLimit
+	}
+	if limit > maxHistoryLimit {
+		limit = maxHistoryLimit
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	conv := s.conversations[conversationKey(a, b)]
+
+	// entries are kept in seq order, so find the first one past the cursor
+	end := len(conv)
+	if q.Before > 0 {
+		end = sort.Search(len(conv), func(i int) bool { return conv[i].Seq >= q.Before })
+	}
+	if q.BeforeTS > 0 {
+		if i := sort.Search(end, func(i int) bool { return conv[i].Timestamp >= q.BeforeTS }); i < end {
+			end = i
+		}
+	}
+
+	out := make([]protocol.HistoryEntry, 0, limit)
+	ownCopies := make(map[string]bool)
+	i := end - 1
+	for ; i >= 0 && len(out) < limit; i-- {
+		e := conv[i]
+		if e.ToDevice != "" && e.ToDevice != q.Device {
+			if e.From != a || e.FromDevice != q.Device || e.MsgID == "" || ownCopies[e.MsgID] {
+				continue
+			}
+			ownCopies[e.MsgID] = true
+		}
+		out = append(out, e)
+	}
+	var next int64
+	if len(out) == limit && i >= 0 {
+		next = out[len(out)-1].Seq
+	}
+	return out, next
+}
+
+// prune drops entries older than the retention period.
+func (s *historyStore) prune(now time.Time) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.retention <= 0 {
+		return 0
+	}
+	cutoff := now.Add(-s.retention).UnixMilli()
+	dropped := 0
+	for k, conv := range s.conversations {
+		i := sort.Search(len(conv), func(i int) bool { return conv[i].Timestamp >= cutoff })
+		if i == 0 {
+			continue
+		}
+		dropped += i
+		if i == len(conv) {
+			delete(s.conversations, k)
+			continue
+		}
+		s.conversations[k] = append([]protocol.HistoryEntry(nil), conv[i:]...)
+	}
+	return dropped
+}
+
+// RunHistoryPruner periodically removes envelopes past the retention period.
+func RunHistoryPruner(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			if n := history.prune(now); n > 0 {
+				log.Printf("history: pruned %d expired messages", n)
+			}
+			deliveries.prune(now)
+		case <-hub.shutdown:
+			return
+		}
+	}
+}
+
+// storeHistory records a targeted message. Key exchange and receipts are
+// session state and are not kept. Neither is the key of a message sent
+// before the peers exchanged keys: it is the one-off key in the clear, and
+// history must not hand out what decrypts the body.
+func storeHistory(from, fromDevice string, f protocol.Frame, raw []byte) {
+	m, ok := f.(*protocol.Message)
+	if !ok || m.Recipient == "" {
+		return
+	}
+	if m.EncryptedKey != "" {
+		stripped := *m
+		stripped.EncryptedKey = ""
+		b, err := protocol.Encode(&stripped)
+		if err != nil {
+			log.Printf("history: cannot store message from id=%q: %v", from, err)
+			return
+		}
+		raw = b
+	}
+	e := history.append(from, fromDevice, m.Recipient, m.ToDevice, m.MsgID, raw)
+	_ = hub.publish(BackplaneMessage{Kind: bpHistory, History: &e})
+}
+
+// historyResponse is the body returned by GET /history.
+type historyResponse struct {
+	Messages   []protocol.HistoryEntry `json:"messages"`
+	NextBefore int64                   `json:"next_before,omitempty"`
+}
+
+// HandleHistory serves GET /history?id=alice&device=d&with=bob[&before=seq][&before_ts=ms][&limit=n].
+// The caller must be an approved device of id, with its secret in the
+// Chat-Device-Secret header. Only conversations id takes part in are
+// returned.
+func HandleHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	qs := r.URL.Query()
+	id, with := qs.Get("id"), qs.Get("with")
+	q := historyQuery{Device: qs.Get("device")}
+	if id == "" || with == "" || q.Device == "" {
+		http.Error(w, "missing id, device or with query parameter", http.StatusBadRequest)
+		return
+	}
+	if !clientCertOK(w, r, id) {
+		return
+	}
+	if err := authDevice(id, q.Device, deviceSecret(r)); err != nil {
+		http.Error(w, err.Error(), deviceErrorCode(err))
+		return
+	}
+
+	for name, dst := range map[string]*int64{"before": &q.Before, "before_ts": &q.BeforeTS} {
+		if v := qs.Get(name); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n < 0 {
+				http.Error(w, "invalid "+name, http.StatusBadRequest)
+				return
+			}
+			*dst = n
+		}
+	}
+	if v := qs.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		q.Limit = n
+	}
+
+	msgs, next := history.page(id, with, q)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(historyResponse{Messages: msgs, NextBefore: next})
+}
@@ -0,0 +1,175 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/marcoantonios1/chat-app/internal/protocol"
+)
+
+func newTestHistory(instance string) *historyStore {
+	s := &historyStore{conversations: make(map[string][]protocol.HistoryEntry)}
+	s.setNode(instance)
+	return s
+}
+
+// testBackplaneSecret is the secret of the brokers tests start.
+const testBackplaneSecret = "s3cret"
+
+// startBroker runs a backplane broker on a free port until the test ends.
+func startBroker(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		_ = serveBroker(l, testBackplaneSecret, stop)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		close(stop)
+		<-done
+	})
+	return l.Addr().String()
+}
+
+// joinHistory connects a history store to the broker at addr the way a hub
+// does: entries other instances store are inserted into it. hellos receives
+// the instances that join after it.
+func joinHistory(t *testing.T, addr, instance string, hellos chan<- string) (Backplane, *historyStore) {
+	t.Helper()
+	bp, err := DialBackplane(addr, instance, testBackplaneSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = bp.Close() })
+	store := newTestHistory(instance)
+	bp.Subscribe(func(m BackplaneMessage) {
+		switch {
+		case m.Kind == bpHistory && m.History != nil:
+			store.insert(*m.History)
+		case m.Kind == bpHello && hellos != nil:
+			hellos <- m.Origin
+		}
+	})
+	eventually(t, instance+" to connect", func() bool { return bp.(*tcpBackplane).up.Load() })
+	return bp, store
+}
+
+// seqs returns the seqs of the whole conversation of alice and bob in s,
+// newest first.
+func seqs(s *historyStore) []int64 {
+	msgs, _ := s.page("alice", "bob", historyQuery{Limit: maxHistoryLimit})
+	out := make([]int64, len(msgs))
+	for i, e := range msgs {
+		out[i] = e.Seq
+	}
+	return out
+}
+
+func TestHistoryAcrossInstances(t *testing.T) {
+	addr := startBroker(t)
+	hellos := make(chan string, 1)
+	east, eastStore := joinHistory(t, addr, "east", hellos)
+	west, westStore := joinHistory(t, addr, "west", nil)
+	select {
+	case <-hellos:
+	case <-time.After(5 * time.Second):
+		t.Fatal("east never heard west join")
+	}
+
+	// both instances store messages of the same conversation at once
+	const n = 60
+	for i := 0; i < n; i++ {
+		bp, store, from := east, eastStore, "alice"
+		if i%3 == 0 {
+			bp, store, from = west, westStore, "bob"
+		}
+		to := map[string]string{"alice": "bob", "bob": "alice"}[from]
+		env, _ := json.Marshal(fmt.Sprint("body ", i))
+		e := store.append(from, "d1", to, "", fmt.Sprint("m", i), env)
+		if err := bp.Publish(BackplaneMessage{Kind: bpHistory, History: &e}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	eventually(t, "history to reach both instances", func() bool {
+		return len(seqs(eastStore)) == n && len(seqs(westStore)) == n
+	})
+
+	want := seqs(eastStore)
+	if got := seqs(westStore); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("instances disagree on seqs:\neast %v\nwest %v", want, got)
+	}
+	for i := 1; i < len(want); i++ {
+		if want[i] >= want[i-1] {
+			t.Fatalf("seqs not strictly decreasing at %d: %v", i, want)
+		}
+	}
+
+	// a cursor from one instance pages on the other
+	var walked []int64
+	var before int64
+	stores := []*historyStore{eastStore, westStore}
+	for i := 0; ; i++ {
+		msgs, next := stores[i%2].page("bob", "alice", historyQuery{Before: before, Limit: 7, Device: "d1"})
+		for _, e := range msgs {
+			walked = append(walked, e.Seq)
+		}
+		if next == 0 {
+			break
+		}
+		before = next
+	}
+	if fmt.Sprint(walked) != fmt.Sprint(want) {
+		t.Fatalf("paging across instances got %v, want %v", walked, want)
+	}
+}
+
+func TestHistoryInsertOutOfOrder(t *testing.T) {
+	origin := newTestHistory("east")
+	var entries []protocol.HistoryEntry
+	for i := 0; i < 10; i++ {
+		entries = append(entries, origin.append("alice", "d1", "bob", "", fmt.Sprint("m", i), []byte(`"x"`)))
+	}
+
+	replica := newTestHistory("west")
+	for _, i := range []int{3, 0, 9, 1, 2, 8, 4, 7, 5, 6, 3, 9} {
+		replica.insert(entries[i])
+	}
+	if got, want := seqs(replica), seqs(origin); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("replica seqs %v, want %v", got, want)
+	}
+	msgs, _ := replica.page("alice", "bob", historyQuery{Limit: maxHistoryLimit})
+	for i := 1; i < len(msgs); i++ {
+		if msgs[i].Timestamp > msgs[i-1].Timestamp {
+			t.Fatalf("timestamps out of order: %v", msgs)
+		}
+	}
+}
+
+func TestHistorySeqOrder(t *testing.T) {
+	s := newTestHistory("east")
+	now := time.Now()
+	// more than fit in one millisecond, then the clock going back
+	last := s.nextSeq(now)
+	for i := 0; i < 2*seqCountMax; i++ {
+		at := now
+		if i > seqCountMax {
+			at = now.Add(-time.Second)
+		}
+		seq := s.nextSeq(at)
+		if seq <= last {
+			t.Fatalf("seq %d after %d", seq, last)
+		}
+		if node := seq >> seqNodeShift & (1<<seqNodeBits - 1); node != s.node {
+			t.Fatalf("seq %d has node %d, want %d", seq, node, s.node)
+		}
+		last = seq
+	}
+}
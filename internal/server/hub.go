@@ -1,177 +1,570 @@
 package server
 
 import (
-	"encoding/json"
+	"hash/fnv"
+	"io"
 	"log"
+	"runtime"
+	"sync"
+	"sync/atomic"
 
-	"github.com/gorilla/websocket"
+	"github.com/marcoantonios1/chat-app/internal/protocol"
 )
 
+const (
+	// number of clients a shard fans a broadcast out to before it checks
+	// for targeted traffic again.
+	broadcastChunk = 256
+)
+
+// connState is the lifecycle state of a Client. Only the client's shard
+// changes it, and only the shard closes Client.Send (exactly once, when the
+// client moves to stateClosed).
+type connState int32
+
+const (
+	stateConnecting connState = iota // created, not yet attached to the hub
+	stateActive                      // attached; the hub delivers to Send
+	stateClosed                      // detached; Send is closed
+)
+
+func (s connState) String() string {
+	switch s {
+	case stateConnecting:
+		return "connecting"
+	case stateActive:
+		return "active"
+	case stateClosed:
+		return "closed"
+	}
+	return "unknown"
+}
+
 type Client struct {
-	ID   string
-	Conn *websocket.Conn
-	Send chan []byte
+	ID     string
+	Device string
+	Conn   io.Closer // closed when the hub detaches the client
+	Send   chan []byte
+
+	state   atomic.Int32
+	spilled atomic.Bool // frames for this client are waiting in the hub's queue
 }
 
-type Hub struct {
-	clients     map[*Client]bool
-	byID        map[string]*Client
-	register    chan *Client
-	unregister  chan *Client
-	broadcast   chan []byte
-	targeted    chan targetedMessage
-	undelivered map[string][][]byte
-	shutdown    chan struct{}
+// State returns the client's current lifecycle state.
+func (c *Client) State() connState {
+	return connState(c.state.Load())
+}
+
+// deviceRef addresses one device of a user. An empty device stands for
+// "whichever device of id connects first" and is used to queue messages for
+// users that have no approved device yet.
+type deviceRef struct {
+	id     string
+	device string
 }
 
+// targetedMessage is a frame routed to one user. When toDevice is empty it is
+// fanned out to every approved device of to, and mirrored to the sender's
+// other devices; otherwise only the named device (of the recipient or, for
+// sync copies, of the sender) receives it.
 type targetedMessage struct {
-	to   string
-	msg  []byte
-	from string
+	to         string
+	toDevice   string
+	from       string
+	fromDevice string
+	msgID      string
+	ack        bool // acknowledge delivery to the sending device
+	msg        []byte
+}
+
+// Hub routes frames between connected clients. Users are partitioned into
+// shards by a hash of their ID; each shard owns the connections, queues and
+// Send channels of its users and runs its own loop, so traffic for different
+// users proceeds in parallel. Work for a shard is posted to its mailbox,
+// which never blocks, so shards can route to each other without deadlock.
+type Hub struct {
+	shards    []*shard
+	shutdown  chan struct{}
+	wg        sync.WaitGroup
+	backplane Backplane // reaches devices connected to other instances
 }
 
-var hub = &Hub{
-	clients:     make(map[*Client]bool),
-	byID:        make(map[string]*Client),
-	register:    make(chan *Client),
-	unregister:  make(chan *Client),
-	broadcast:   make(chan []byte),
-	targeted:    make(chan targetedMessage),
-	undelivered: make(map[string][][]byte),
-	shutdown:    make(chan struct{}),
+func newHub(shards int) *Hub {
+	if shards < 1 {
+		shards = 1
+	}
+	h := &Hub{shutdown: make(chan struct{}), backplane: NewMemoryBus().Join("local")}
+	for i := 0; i < shards; i++ {
+		h.shards = append(h.shards, newShard(h, i))
+	}
+	return h
 }
 
+var hub = newHub(runtime.NumCPU())
+
+// ConfigureHub sets the number of hub shards. It must be called before RunHub.
+func ConfigureHub(shards int) {
+	hub = newHub(shards)
+}
+
+// RunHub runs the hub until ShutdownHub is called.
 func RunHub() {
-	log.Println("hub: started")
-	for {
-		select {
-		case c := <-hub.register:
-			if c.ID != "" {
-				if existing, ok := hub.byID[c.ID]; ok {
-					log.Printf("hub: replacing existing client for id=%s (closing old conn=%p)\n", c.ID, existing)
-					_ = existing.Conn.Close()
-					delete(hub.clients, existing)
-					delete(hub.byID, c.ID)
-				}
+	hub.run()
+}
+
+func (h *Hub) run() {
+	log.Printf("hub: started with %d shards (instance %s)", len(h.shards), h.backplane.Instance())
+	for _, s := range h.shards {
+		h.wg.Add(1)
+		go s.run()
+	}
+	h.backplane.Subscribe(h.handleBackplane)
+	h.wg.Wait()
+	_ = h.backplane.Close()
+	log.Println("hub: stopped")
+}
+
+// shardFor returns the shard owning user id.
+func (h *Hub) shardFor(id string) *shard {
+	if len(h.shards) == 1 {
+		return h.shards[0]
+	}
+	f := fnv.New32a()
+	f.Write([]byte(id))
+	return h.shards[f.Sum32()%uint32(len(h.shards))]
+}
+
+func (h *Hub) stopped() bool {
+	select {
+	case <-h.shutdown:
+		return true
+	default:
+		return false
+	}
+}
+
+// The methods below are used by connection goroutines to talk to the hub.
+// None of them block; they report false once the hub has shut down.
+
+// attachClient registers c with its shard.
+func (h *Hub) attachClient(c *Client) bool {
+	return h.shardFor(c.ID).post(func(s *shard) { s.attach(c) })
+}
+
+// detachClient asks the hub to drop c; it is safe to call for a client the
+// hub has already detached.
+func (h *Hub) detachClient(c *Client) {
+	h.shardFor(c.ID).post(func(s *shard) { s.detach(c) })
+}
+
+// sendTargeted routes t to the shard owning its destination.
+func (h *Hub) sendTargeted(t targetedMessage) bool {
+	owner := t.to
+	if t.toDevice != "" && !isApprovedDevice(t.to, t.toDevice) && isApprovedDevice(t.from, t.toDevice) {
+		// a sync copy for one of the sender's own devices
+		owner = t.from
+	}
+	return h.shardFor(owner).post(func(s *shard) { s.dispatch(owner, t) })
+}
+
+// sendBroadcast hands msg to every shard for fan-out to all clients.
+func (h *Hub) sendBroadcast(msg []byte) bool {
+	if h.stopped() {
+		return false
+	}
+	for _, s := range h.shards {
+		s.postBroadcast(msg)
+	}
+	_ = h.publish(BackplaneMessage{Kind: bpBroadcast, Payload: msg})
+	return true
+}
+
+// kickDevice drops queued frames for ref and disconnects it, on whichever
+// instance it is connected to.
+func (h *Hub) kickDevice(ref deviceRef) {
+	h.kickLocal(ref)
+	_ = h.publish(BackplaneMessage{Kind: bpKick, User: ref.id, Device: ref.device})
+}
+
+func (h *Hub) kickLocal(ref deviceRef) {
+	h.shardFor(ref.id).post(func(s *shard) {
+		delete(s.undelivered, ref)
+		if c, ok := s.byID[ref.id][ref.device]; ok {
+			log.Printf("hub: disconnecting revoked device id=%s device=%s\n", ref.id, ref.device)
+			s.detach(c)
+		}
+	})
+}
+
+// reply sends a server-generated frame (error, history page, ...) to c alone.
+func (h *Hub) reply(c *Client, f protocol.Frame) {
+	b, err := protocol.Encode(f)
+	if err != nil {
+		log.Printf("hub: marshal error for id=%s: %v", c.ID, err)
+		return
+	}
+	h.shardFor(c.ID).post(func(s *shard) {
+		if c.State() == stateActive {
+			s.deliver(deviceRef{c.ID, c.Device}, b)
+		}
+	})
+}
+
+// mirror copies msg to every approved device of from except fromDevice.
+func (h *Hub) mirror(from, fromDevice string, msg []byte) {
+	h.shardFor(from).post(func(s *shard) {
+		for _, d := range approvedDevices(from) {
+			if d != fromDevice {
+				s.deliver(deviceRef{from, d}, msg)
 			}
+		}
+	})
+}
 
-			hub.clients[c] = true
-			if c.ID != "" {
-				hub.byID[c.ID] = c
-				log.Printf("hub: registered id=%s client=%p\n", c.ID, c)
-				// deliver queued messages (if any)
-				if queued, ok := hub.undelivered[c.ID]; ok {
-					for _, m := range queued {
-						select {
-						case c.Send <- m:
-						default:
-							log.Printf("hub: unable to deliver queued msg to id=%s (client busy)", c.ID)
-						}
-					}
-					delete(hub.undelivered, c.ID)
-				}
-			} else {
-				log.Printf("hub: registered anonymous client=%p\n", c)
+// queued returns how many frames wait for each device of id; the empty
+// device stands for the first one to connect. It reports false once the
+// hub has stopped.
+func (h *Hub) queued(id string) (map[string]int, bool) {
+	counts := make(chan map[string]int, 1)
+	posted := h.shardFor(id).post(func(s *shard) {
+		c := make(map[string]int)
+		for ref, q := range s.undelivered {
+			if ref.id == id {
+				c[ref.device] = len(q)
 			}
-		case c := <-hub.unregister:
-			delete(hub.clients, c)
-			if c.ID != "" {
-				delete(hub.byID, c.ID)
-				log.Printf("hub: unregistered id=%s client=%p\n", c.ID, c)
-			} else {
-				log.Printf("hub: unregistered anonymous client=%p\n", c)
+		}
+		counts <- c
+	})
+	if !posted {
+		return nil, false
+	}
+	select {
+	case c := <-counts:
+		return c, true
+	case <-h.shutdown:
+		return nil, false
+	}
+}
+
+// requestFlush is called by c's writer after draining Send while frames are
+// still queued for it.
+func (h *Hub) requestFlush(c *Client) {
+	h.shardFor(c.ID).post(func(s *shard) { s.flush(c) })
+}
+
+// shard owns a subset of users. All fields except the mailbox are only
+// touched by the shard's own goroutine.
+type shard struct {
+	hub         *Hub
+	index       int
+	clients     map[*Client]bool
+	byID        map[string]map[string]*Client // id -> device -> client
+	undelivered map[deviceRef][][]byte
+
+	mu         sync.Mutex
+	ops        []func(*shard)
+	broadcasts [][]byte
+	closed     bool // set once the shard has stopped taking work
+	wake       chan struct{}
+}
+
+func newShard(h *Hub, index int) *shard {
+	return &shard{
+		hub:         h,
+		index:       index,
+		clients:     make(map[*Client]bool),
+		byID:        make(map[string]map[string]*Client),
+		undelivered: make(map[deviceRef][][]byte),
+		wake:        make(chan struct{}, 1),
+	}
+}
+
+// post queues op to run on the shard's goroutine. It reports false if the
+// shard has stopped, in which case op never runs.
+func (s *shard) post(op func(*shard)) bool {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return false
+	}
+	s.ops = append(s.ops, op)
+	s.mu.Unlock()
+	s.signal()
+	return true
+}
+
+// postBroadcast queues msg for fan-out. Broadcasts are kept apart from ops
+// so that a large fan-out can yield to targeted traffic.
+func (s *shard) postBroadcast(msg []byte) {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.broadcasts = append(s.broadcasts, msg)
+	s.mu.Unlock()
+	s.signal()
+}
+
+func (s *shard) signal() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *shard) takeOps() []func(*shard) {
+	s.mu.Lock()
+	ops := s.ops
+	s.ops = nil
+	s.mu.Unlock()
+	return ops
+}
+
+func (s *shard) takeBroadcast() ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.broadcasts) == 0 {
+		return nil, false
+	}
+	msg := s.broadcasts[0]
+	s.broadcasts = s.broadcasts[1:]
+	return msg, true
+}
+
+func (s *shard) run() {
+	defer s.hub.wg.Done()
+	for {
+		select {
+		case <-s.wake:
+		case <-s.hub.shutdown:
+			// finish work that was accepted, then close every client
+			s.mu.Lock()
+			s.closed = true
+			s.mu.Unlock()
+			s.runOps()
+			for c := range s.clients {
+				s.detach(c)
 			}
-			close(c.Send)
-		case msg := <-hub.broadcast:
-			log.Printf("hub: broadcast msg(len=%d)\n", len(msg))
-			for c := range hub.clients {
-				select {
-				case c.Send <- msg:
-				default:
-					// drop or cleanup slow client
-					log.Printf("hub: dropping slow client=%p id=%s\n", c, c.ID)
-					close(c.Send)
-					delete(hub.clients, c)
-					if c.ID != "" {
-						delete(hub.byID, c.ID)
-					}
-				}
+			return
+		}
+		for {
+			s.runOps()
+			msg, ok := s.takeBroadcast()
+			if !ok {
+				break
 			}
-		case t := <-hub.targeted:
-			if dest, ok := hub.byID[t.to]; ok {
-				// deliver to recipient
-				select {
-				case dest.Send <- t.msg:
-					log.Printf("hub: targeted delivered to id=%s\n", t.to)
-					// send ack to sender if present
-					if t.from != "" {
-						if sender, ok := hub.byID[t.from]; ok {
-							ack := messagePayload{Type: "ack", Recipient: t.to, Body: "delivered"}
-							if b, err := jsonMarshal(ack); err == nil {
-								select {
-								case sender.Send <- b:
-								default:
-								}
-							}
-						}
-					}
-				default:
-					log.Printf("hub: target busy id=%s, queueing msg\n", t.to)
-					// queue for recipient
-					hub.undelivered[t.to] = append(hub.undelivered[t.to], t.msg)
-					// ack as queued to sender
-					if t.from != "" {
-						if sender, ok := hub.byID[t.from]; ok {
-							ack := messagePayload{Type: "ack", Recipient: t.to, Body: "queued"}
-							if b, err := jsonMarshal(ack); err == nil {
-								select {
-								case sender.Send <- b:
-								default:
-								}
-							}
-						}
-					}
-				}
-			} else {
-				// recipient offline — queue message
-				log.Printf("hub: target not found id=%s, queuing\n", t.to)
-				hub.undelivered[t.to] = append(hub.undelivered[t.to], t.msg)
-				// ack queued to sender if possible
-				if t.from != "" {
-					if sender, ok := hub.byID[t.from]; ok {
-						ack := messagePayload{Type: "ack", Recipient: t.to, Body: "queued"}
-						if b, err := jsonMarshal(ack); err == nil {
-							select {
-							case sender.Send <- b:
-							default:
-							}
-						}
-					}
-				}
+			s.fanOut(msg)
+		}
+	}
+}
+
+func (s *shard) runOps() {
+	for ops := s.takeOps(); len(ops) > 0; ops = s.takeOps() {
+		for _, op := range ops {
+			op(s)
+		}
+	}
+}
+
+// fanOut delivers a broadcast to every client of the shard, running pending
+// targeted work between chunks so a broadcast never holds it up for long.
+func (s *shard) fanOut(msg []byte) {
+	targets := make([]*Client, 0, len(s.clients))
+	for c := range s.clients {
+		targets = append(targets, c)
+	}
+	for i, c := range targets {
+		if i > 0 && i%broadcastChunk == 0 {
+			s.runOps()
+		}
+		if c.State() == stateActive {
+			s.deliver(deviceRef{c.ID, c.Device}, msg)
+		}
+	}
+}
+
+// attach makes c the active connection of its device, replacing (and
+// detaching) any previous connection, and hands it queued frames.
+func (s *shard) attach(c *Client) {
+	if !c.state.CompareAndSwap(int32(stateConnecting), int32(stateActive)) {
+		log.Printf("hub: ignoring register of %s client=%p\n", c.State(), c)
+		return
+	}
+	if existing, ok := s.byID[c.ID][c.Device]; ok {
+		log.Printf("hub: replacing existing client for id=%s device=%s (closing old conn=%p)\n", c.ID, c.Device, existing)
+		s.detach(existing)
+	}
+	// after the detach, which drops the map of a user left without devices
+	devices := s.byID[c.ID]
+	if devices == nil {
+		devices = make(map[string]*Client)
+		s.byID[c.ID] = devices
+	}
+	s.clients[c] = true
+	devices[c.Device] = c
+	log.Printf("hub: registered id=%s device=%s client=%p shard=%d\n", c.ID, c.Device, c, s.index)
+	_ = s.hub.backplane.SetPresence(c.ID, c.Device, true)
+	emitWebhook(WebhookEvent{Type: EventUserOnline, User: c.ID, Device: c.Device})
+
+	// frames queued before the user had any device go to the first one
+	ref := deviceRef{c.ID, c.Device}
+	if early, ok := s.undelivered[deviceRef{c.ID, ""}]; ok {
+		s.undelivered[ref] = append(early, s.undelivered[ref]...)
+		delete(s.undelivered, deviceRef{c.ID, ""})
+	}
+	if len(s.undelivered[ref]) > 0 {
+		c.spilled.Store(true)
+		s.flush(c)
+	}
+}
+
+// detach removes c from the hub and closes its Send channel. It is the only
+// place Send is closed, and it is a no-op for clients already detached.
+func (s *shard) detach(c *Client) {
+	if !c.state.CompareAndSwap(int32(stateActive), int32(stateClosed)) {
+		return
+	}
+	delete(s.clients, c)
+	devices := s.byID[c.ID]
+	if devices[c.Device] == c {
+		delete(devices, c.Device)
+	}
+	if len(devices) == 0 {
+		delete(s.byID, c.ID)
+	}
+	close(c.Send)
+	_ = s.hub.backplane.SetPresence(c.ID, c.Device, false)
+	if c.Conn != nil {
+		_ = c.Conn.Close()
+	}
+	log.Printf("hub: unregistered id=%s device=%s client=%p\n", c.ID, c.Device, c)
+}
+
+// dispatch delivers a targeted message whose destination (owner) belongs to
+// this shard. Sync copies and acks for the sender are posted to the
+// sender's shard.
+func (s *shard) dispatch(owner string, t targetedMessage) {
+	delivered := false
+	if t.toDevice != "" {
+		delivered = s.deliver(deviceRef{owner, t.toDevice}, t.msg)
+	} else {
+		devices := approvedDevices(t.to)
+		if len(devices) == 0 {
+			// no device yet; hand it to the first one that connects
+			s.queue(deviceRef{t.to, ""}, t.msg)
+		}
+		for _, d := range devices {
+			if s.deliver(deviceRef{t.to, d}, t.msg) {
+				delivered = true
 			}
-		case <-hub.shutdown:
-			log.Println("hub: shutdown initiated")
-			// close all client connections and send channels
-			for c := range hub.clients {
-				_ = c.Conn.Close()
-				close(c.Send)
-				delete(hub.clients, c)
-				if c.ID != "" {
-					delete(hub.byID, c.ID)
+		}
+		// keep the sender's other devices in sync
+		if t.from != "" && t.from != t.to {
+			s.hub.mirror(t.from, t.fromDevice, t.msg)
+		}
+	}
+
+	status := protocol.StatusQueued
+	if delivered {
+		status = protocol.StatusDelivered
+	} else if t.msgID != "" {
+		emitWebhook(WebhookEvent{Type: EventMessageQueued, User: t.to, From: t.from, MsgID: t.msgID})
+	}
+	if t.ack && t.from != "" {
+		deliveries.update(t.from, t.msgID, "", status)
+		if b, err := protocol.Encode(protocol.NewAck(t.to, t.msgID, status)); err == nil {
+			// acks are for a connected sender; one that is not keeping
+			// up gets them from its queue, in order, like any frame
+			sender := deviceRef{t.from, t.fromDevice}
+			s.hub.shardFor(t.from).post(func(s *shard) {
+				if s.online(sender) {
+					s.deliver(sender, b)
 				}
+			})
+		}
+	}
+}
+
+// deliver hands msg to an online device. Frames for offline devices, and
+// for devices that are not keeping up, are spilled to the device's queue
+// (preserving order) instead of being dropped. It reports whether the
+// message was handed over immediately.
+func (s *shard) deliver(ref deviceRef, msg []byte) bool {
+	dest, ok := s.byID[ref.id][ref.device]
+	if !ok && ref.device != "" {
+		if instance, found := s.hub.backplane.Locate(ref.id, ref.device); found && instance != s.hub.backplane.Instance() {
+			err := s.hub.backplane.Publish(BackplaneMessage{Kind: bpDeliver, Target: instance, User: ref.id, Device: ref.device, Payload: msg})
+			if err == nil {
+				return true
 			}
-			// exit RunHub
-			log.Println("hub: stopped")
-			return
+			log.Printf("hub: forwarding to instance %s failed: %v\n", instance, err)
+		}
+	}
+	if !ok {
+		s.queue(ref, msg)
+		return false
+	}
+	if len(s.undelivered[ref]) > 0 {
+		// earlier frames are still waiting; keep them in order
+		s.queue(ref, msg)
+		return false
+	}
+	select {
+	case dest.Send <- msg:
+		return true
+	default:
+		// logged once until the client catches up
+		if !dest.spilled.Swap(true) {
+			log.Printf("hub: slow client id=%s device=%s, spilling to queue\n", ref.id, ref.device)
 		}
+		s.queue(ref, msg)
+		return false
 	}
 }
 
-// small helper to avoid importing encoding/json in this file twice
-func jsonMarshal(v interface{}) ([]byte, error) {
-	// avoid circular import by using encoding/json here
-	type js interface{}
-	return json.Marshal(v)
+// online reports whether ref is connected to this instance or another.
+func (s *shard) online(ref deviceRef) bool {
+	if _, ok := s.byID[ref.id][ref.device]; ok {
+		return true
+	}
+	_, found := s.hub.backplane.Locate(ref.id, ref.device)
+	return found
+}
+
+// flush moves as many queued frames into c.Send as fit. The writer asks for
+// another flush once it has drained Send.
+func (s *shard) flush(c *Client) {
+	if c.State() != stateActive {
+		return
+	}
+	ref := deviceRef{c.ID, c.Device}
+	queued := s.undelivered[ref]
+	n := 0
+fill:
+	for n < len(queued) {
+		select {
+		case c.Send <- queued[n]:
+			n++
+		default:
+			break fill
+		}
+	}
+	if n == len(queued) {
+		delete(s.undelivered, ref)
+		c.spilled.Store(false)
+		return
+	}
+	s.undelivered[ref] = queued[n:]
+}
+
+func (s *shard) queue(ref deviceRef, msg []byte) {
+	q := append(s.undelivered[ref], msg)
+	if maxQueuedPerDevice := settings().Limits.MaxQueuedPerDevice; len(q) > maxQueuedPerDevice {
+		log.Printf("hub: queue full for id=%s device=%s, dropping %d oldest\n", ref.id, ref.device, len(q)-maxQueuedPerDevice)
+		q = q[len(q)-maxQueuedPerDevice:]
+	}
+	s.undelivered[ref] = q
 }
 
 // ShutdownHub requests hub to stop (call from main/startup shutdown handler)
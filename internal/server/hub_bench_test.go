@@ -0,0 +1,160 @@
+package server
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// hubLoad describes a simulated workload run against an in-process hub.
+// Clients are attached directly to the hub without sockets, so the numbers
+// measure routing cost only.
+type hubLoad struct {
+	clients    int // simulated connected users
+	shards     int // hub shards
+	senders    int // goroutines sending targeted messages concurrently
+	broadcasts int // broadcasts interleaved with the targeted traffic
+	sendBuffer int // size of each client's Send channel
+}
+
+const (
+	loadTargeted  = 'T'
+	loadBroadcast = 'B'
+	loadDevice    = "load"
+)
+
+// BenchmarkHubTargeted routes b.N targeted messages between random pairs of
+// simulated clients, for several shard counts.
+func BenchmarkHubTargeted(b *testing.B) {
+	for _, shards := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			runHubLoad(b, hubLoad{clients: 10000, shards: shards, senders: 64, sendBuffer: 256})
+		})
+	}
+}
+
+// BenchmarkHubBroadcast mixes broadcasts into the targeted traffic, to see
+// how much fan-out holds it up.
+func BenchmarkHubBroadcast(b *testing.B) {
+	for _, shards := range []int{1, 4} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			runHubLoad(b, hubLoad{clients: 10000, shards: shards, senders: 64, broadcasts: 5, sendBuffer: 256})
+		})
+	}
+}
+
+// runHubLoad attaches cfg.clients users to a fresh hub, sends b.N targeted
+// messages between random pairs (with broadcasts mixed in) and reports the
+// latency from handing a message to the hub until its client reads it.
+func runHubLoad(b *testing.B, cfg hubLoad) {
+	log.SetOutput(io.Discard)
+	b.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	ids := make([]string, cfg.clients)
+	for i := range ids {
+		ids[i] = fmt.Sprintf("loadtest-%d", i)
+		addUser(b, ids[i], loadDevice)
+	}
+	h := startHub(b, cfg.shards)
+
+	var delivered, broadcast atomic.Int64
+	latencies := make([][]time.Duration, cfg.clients)
+	var readers sync.WaitGroup
+	clients := make([]*Client, cfg.clients)
+	for i, id := range ids {
+		c := &Client{ID: id, Device: loadDevice, Send: make(chan []byte, cfg.sendBuffer)}
+		clients[i] = c
+		readers.Add(1)
+		go func(i int, c *Client) {
+			defer readers.Done()
+			for msg := range c.Send {
+				switch msg[0] {
+				case loadTargeted:
+					sent := int64(binary.BigEndian.Uint64(msg[1:]))
+					latencies[i] = append(latencies[i], time.Duration(time.Now().UnixNano()-sent))
+					delivered.Add(1)
+				case loadBroadcast:
+					broadcast.Add(1)
+				}
+				if len(c.Send) == 0 && c.spilled.Load() {
+					h.requestFlush(c)
+				}
+			}
+		}(i, c)
+		h.attachClient(c)
+	}
+	for _, c := range clients {
+		eventually(b, "clients to attach", func() bool { return c.State() == stateActive })
+	}
+
+	b.ResetTimer()
+	var senders sync.WaitGroup
+	per := b.N / cfg.senders
+	for s := 0; s < cfg.senders; s++ {
+		n := per
+		if s == cfg.senders-1 {
+			n = b.N - per*(cfg.senders-1)
+		}
+		senders.Add(1)
+		go func(seed int64, n int) {
+			defer senders.Done()
+			rng := rand.New(rand.NewSource(seed))
+			for i := 0; i < n; i++ {
+				from, to := ids[rng.Intn(len(ids))], ids[rng.Intn(len(ids))]
+				msg := make([]byte, 9)
+				msg[0] = loadTargeted
+				binary.BigEndian.PutUint64(msg[1:], uint64(time.Now().UnixNano()))
+				h.sendTargeted(targetedMessage{to: to, toDevice: loadDevice, from: from, fromDevice: loadDevice, msg: msg})
+			}
+		}(int64(s), n)
+	}
+	if cfg.broadcasts > 0 {
+		senders.Add(1)
+		go func() {
+			defer senders.Done()
+			every := b.N / (cfg.broadcasts + 1)
+			for i := 0; i < cfg.broadcasts; i++ {
+				for delivered.Load() < int64(every*(i+1)) {
+					time.Sleep(100 * time.Microsecond)
+				}
+				h.sendBroadcast([]byte{loadBroadcast})
+			}
+		}()
+	}
+	senders.Wait()
+
+	wantBroadcast := int64(cfg.broadcasts) * int64(cfg.clients)
+	deadline := time.Now().Add(2 * time.Minute)
+	for delivered.Load() < int64(b.N) || broadcast.Load() < wantBroadcast {
+		if time.Now().After(deadline) {
+			b.Fatalf("timed out: %d/%d messages, %d/%d broadcast frames delivered",
+				delivered.Load(), b.N, broadcast.Load(), wantBroadcast)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	b.StopTimer()
+
+	// stop the hub so every Send is closed and the readers finish
+	stopHub(h)
+	readers.Wait()
+
+	var all []time.Duration
+	for _, l := range latencies {
+		all = append(all, l...)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i] < all[j] })
+	pct := func(p float64) time.Duration {
+		return all[int(float64(len(all)-1)*p)]
+	}
+	b.ReportMetric(float64(pct(0.50).Nanoseconds()), "p50-ns")
+	b.ReportMetric(float64(pct(0.99).Nanoseconds()), "p99-ns")
+	b.ReportMetric(float64(all[len(all)-1].Nanoseconds()), "max-ns")
+}
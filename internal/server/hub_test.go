@@ -0,0 +1,294 @@
+package server
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/marcoantonios1/chat-app/internal/protocol"
+)
+
+// startHub runs a new hub with shards shards until the test ends.
+func startHub(t testing.TB, shards int) *Hub {
+	t.Helper()
+	h := newHub(shards)
+	done := make(chan struct{})
+	go func() {
+		h.run()
+		close(done)
+	}()
+	t.Cleanup(func() {
+		stopHub(h)
+		<-done
+	})
+	return h
+}
+
+func stopHub(h *Hub) {
+	select {
+	case <-h.shutdown:
+	default:
+		close(h.shutdown)
+	}
+}
+
+// addUser registers id with approved devices until the test ends.
+func addUser(t testing.TB, id string, devices ...string) {
+	t.Helper()
+	u := &userRecord{devices: make(map[string]*Device)}
+	for _, d := range devices {
+		u.devices[d] = &Device{ID: d, Status: deviceApproved, Created: time.Now()}
+	}
+	usersMu.Lock()
+	users[id] = u
+	usersMu.Unlock()
+	t.Cleanup(func() {
+		usersMu.Lock()
+		delete(users, id)
+		usersMu.Unlock()
+	})
+}
+
+// countingConn counts Close calls.
+type countingConn struct{ closed atomic.Int32 }
+
+func (c *countingConn) Close() error {
+	c.closed.Add(1)
+	return nil
+}
+
+func newTestClient(id, device string, buffer int) *Client {
+	return &Client{ID: id, Device: device, Conn: &countingConn{}, Send: make(chan []byte, buffer)}
+}
+
+func eventually(t testing.TB, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func attach(t testing.TB, h *Hub, c *Client) {
+	t.Helper()
+	if !h.attachClient(c) {
+		t.Fatal("attachClient: hub stopped")
+	}
+	eventually(t, "client to attach", func() bool { return c.State() == stateActive })
+}
+
+// receive returns the next frame sent to c.
+func receive(t *testing.T, c *Client) []byte {
+	t.Helper()
+	select {
+	case msg, ok := <-c.Send:
+		if !ok {
+			t.Fatalf("Send of %s/%s closed", c.ID, c.Device)
+		}
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no frame for %s/%s", c.ID, c.Device)
+	}
+	return nil
+}
+
+// closed waits for c's Send to be closed, discarding what is left in it.
+func closed(t *testing.T, c *Client) {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case _, ok := <-c.Send:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("Send of %s/%s not closed", c.ID, c.Device)
+		}
+	}
+}
+
+func TestHubAttachDetach(t *testing.T) {
+	h := startHub(t, 4)
+	addUser(t, "alice", "d1")
+	c := newTestClient("alice", "d1", 8)
+	attach(t, h, c)
+
+	h.sendTargeted(targetedMessage{to: "alice", toDevice: "d1", msg: []byte("one")})
+	if got := receive(t, c); string(got) != "one" {
+		t.Fatalf("got %q, want one", got)
+	}
+
+	h.detachClient(c)
+	closed(t, c)
+	if c.State() != stateClosed {
+		t.Fatalf("state = %s, want closed", c.State())
+	}
+	// detaching twice is harmless
+	h.detachClient(c)
+	counts, _ := h.queued("alice")
+	if len(counts) != 0 {
+		t.Fatalf("queued after detach: %v", counts)
+	}
+	if n := c.Conn.(*countingConn).closed.Load(); n != 1 {
+		t.Fatalf("Conn closed %d times, want 1", n)
+	}
+
+	// a detached client can't come back
+	h.attachClient(c)
+	h.sendTargeted(targetedMessage{to: "alice", toDevice: "d1", msg: []byte("two")})
+	eventually(t, "frame to be queued", func() bool {
+		counts, _ := h.queued("alice")
+		return counts["d1"] == 1
+	})
+}
+
+func TestHubReplacesConnection(t *testing.T) {
+	h := startHub(t, 2)
+	addUser(t, "alice", "d1")
+	old := newTestClient("alice", "d1", 8)
+	attach(t, h, old)
+	c := newTestClient("alice", "d1", 8)
+	attach(t, h, c)
+	closed(t, old)
+	if n := old.Conn.(*countingConn).closed.Load(); n != 1 {
+		t.Fatalf("old Conn closed %d times, want 1", n)
+	}
+
+	h.sendTargeted(targetedMessage{to: "alice", toDevice: "d1", msg: []byte("hi")})
+	if got := receive(t, c); string(got) != "hi" {
+		t.Fatalf("got %q, want hi", got)
+	}
+	// the old connection detaching late leaves the new one alone
+	h.detachClient(old)
+	h.sendTargeted(targetedMessage{to: "alice", toDevice: "d1", msg: []byte("again")})
+	if got := receive(t, c); string(got) != "again" {
+		t.Fatalf("got %q, want again", got)
+	}
+}
+
+func TestHubQueuesForOfflineDevice(t *testing.T) {
+	h := startHub(t, 2)
+	addUser(t, "alice", "d1")
+	for i := 0; i < 3; i++ {
+		h.sendTargeted(targetedMessage{to: "alice", msg: []byte(fmt.Sprint(i))})
+	}
+	eventually(t, "frames to be queued", func() bool {
+		counts, _ := h.queued("alice")
+		return counts["d1"] == 3
+	})
+
+	c := newTestClient("alice", "d1", 8)
+	attach(t, h, c)
+	for i := 0; i < 3; i++ {
+		if got := receive(t, c); string(got) != fmt.Sprint(i) {
+			t.Fatalf("frame %d = %q", i, got)
+		}
+	}
+}
+
+func TestHubSpillsForSlowClient(t *testing.T) {
+	h := startHub(t, 4)
+	addUser(t, "alice", "d1")
+	c := newTestClient("alice", "d1", 2)
+	attach(t, h, c)
+
+	const n = 50
+	for i := 0; i < n; i++ {
+		h.sendTargeted(targetedMessage{to: "alice", toDevice: "d1", msg: []byte(fmt.Sprint(i))})
+	}
+	eventually(t, "frames to spill", func() bool { return c.spilled.Load() })
+
+	// read like a writer does: drain Send, then ask for the rest
+	for i := 0; i < n; i++ {
+		if got := receive(t, c); string(got) != fmt.Sprint(i) {
+			t.Fatalf("frame %d = %q, frames out of order or lost", i, got)
+		}
+		if len(c.Send) == 0 && c.spilled.Load() {
+			h.requestFlush(c)
+		}
+	}
+	eventually(t, "queue to empty", func() bool {
+		counts, _ := h.queued("alice")
+		return len(counts) == 0 && !c.spilled.Load()
+	})
+}
+
+func TestHubSpillsAcksForSlowSender(t *testing.T) {
+	h := startHub(t, 4)
+	addUser(t, "alice", "d1")
+	addUser(t, "bob", "b1")
+	sender := newTestClient("alice", "d1", 1)
+	attach(t, h, sender)
+	bob := newTestClient("bob", "b1", 64)
+	attach(t, h, bob)
+
+	const n = 10
+	for i := 0; i < n; i++ {
+		h.sendTargeted(targetedMessage{
+			to: "bob", toDevice: "b1", from: "alice", fromDevice: "d1",
+			msgID: fmt.Sprint("m", i), ack: true, msg: []byte("hi"),
+		})
+	}
+	for i := 0; i < n; i++ {
+		receive(t, bob)
+	}
+	eventually(t, "acks to spill", func() bool { return sender.spilled.Load() })
+
+	for i := 0; i < n; i++ {
+		f, err := protocol.Decode(receive(t, sender))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ack, ok := f.(*protocol.Ack)
+		if !ok || ack.MsgID != fmt.Sprint("m", i) || ack.Status != protocol.StatusDelivered {
+			t.Fatalf("frame %d = %#v, want delivered ack of m%d", i, f, i)
+		}
+		if len(sender.Send) == 0 && sender.spilled.Load() {
+			h.requestFlush(sender)
+		}
+	}
+}
+
+func TestHubShutdown(t *testing.T) {
+	h := startHub(t, 4)
+	var clients []*Client
+	for i := 0; i < 20; i++ {
+		id := fmt.Sprint("user", i)
+		addUser(t, id, "d1")
+		c := newTestClient(id, "d1", 1)
+		attach(t, h, c)
+		clients = append(clients, c)
+	}
+	// keep the shards busy while they stop
+	for _, c := range clients {
+		for i := 0; i < 5; i++ {
+			h.sendTargeted(targetedMessage{to: c.ID, toDevice: "d1", msg: []byte("x")})
+		}
+	}
+	h.sendBroadcast([]byte("all"))
+
+	stopHub(h)
+	for _, c := range clients {
+		closed(t, c)
+		if c.State() != stateClosed {
+			t.Fatalf("%s state = %s, want closed", c.ID, c.State())
+		}
+	}
+	eventually(t, "hub to refuse work", func() bool {
+		return !h.attachClient(newTestClient("late", "d1", 1))
+	})
+	if h.sendTargeted(targetedMessage{to: "user0", toDevice: "d1", msg: []byte("x")}) {
+		t.Fatal("sendTargeted succeeded after shutdown")
+	}
+	if h.sendBroadcast([]byte("x")) {
+		t.Fatal("sendBroadcast succeeded after shutdown")
+	}
+	if _, ok := h.queued("user0"); ok {
+		t.Fatal("queued answered after shutdown")
+	}
+}
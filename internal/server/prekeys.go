@@ -0,0 +1,71 @@
+package server
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/marcoantonios1/chat-app/internal/protocol"
+)
+
+// prekeyStore remembers the public key each device last announced, so a
+// sender can set up a session with a device that is offline.
+type prekeyStore struct {
+	mu   sync.RWMutex
+	keys map[deviceRef]protocol.PublicKey
+}
+
+var prekeys = &prekeyStore{keys: make(map[deviceRef]protocol.PublicKey)}
+
+func (p *prekeyStore) put(user, device string, k protocol.PublicKey) {
+	// only the key matters, not who it was last sent to
+	k.Recipient, k.ToDevice = "", ""
+	k.ID, k.Device = user, device
+	p.mu.Lock()
+	p.keys[deviceRef{user, device}] = k
+	p.mu.Unlock()
+}
+
+// forUser returns the keys of user's approved devices, ordered by device.
+func (p *prekeyStore) forUser(user string) []protocol.PublicKey {
+	p.mu.RLock()
+	var out []protocol.PublicKey
+	for ref, k := range p.keys {
+		if ref.id == user {
+			out = append(out, k)
+		}
+	}
+	p.mu.RUnlock()
+	approved := out[:0]
+	for _, k := range out {
+		if isApprovedDevice(user, k.Device) {
+			approved = append(approved, k)
+		}
+	}
+	sort.Slice(approved, func(i, j int) bool { return approved[i].Device < approved[j].Device })
+	return approved
+}
+
+func (p *prekeyStore) all() []protocol.PublicKey {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	out := make([]protocol.PublicKey, 0, len(p.keys))
+	for _, k := range p.keys {
+		out = append(out, k)
+	}
+	return out
+}
+
+// recordPrekey stores a key announced by a local device and shares it with
+// the other instances.
+func recordPrekey(user, device string, k *protocol.PublicKey) {
+	prekeys.put(user, device, *k)
+	publishPrekey(hub, user, device, k, "")
+}
+
+func publishPrekey(h *Hub, user, device string, k *protocol.PublicKey, target string) {
+	b, err := protocol.Encode(k)
+	if err != nil {
+		return
+	}
+	_ = h.publish(BackplaneMessage{Kind: bpPrekey, Target: target, User: user, Device: device, Payload: b})
+}
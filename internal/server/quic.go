@@ -0,0 +1,252 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"time"
+
+	"github.com/marcoantonios1/chat-app/internal/chatquic"
+	"github.com/marcoantonios1/chat-app/internal/protocol"
+	"github.com/quic-go/quic-go"
+)
+
+// most conversation streams the server opens on one connection; frames of
+// further conversations go on the control stream
+const maxQUICStreams = 64
+
+// QUICServer serves the chat protocol over QUIC (see package chatquic).
+// Connections get 0-RTT resumption and follow the client to a new address.
+type QUICServer struct {
+	l *quic.EarlyListener
+}
+
+// ListenQUIC listens on the UDP address addr with tlsConf, as made by
+// ConfigureTLS or holding just a certificate.
+func ListenQUIC(addr string, tlsConf *tls.Config) (*QUICServer, error) {
+	tlsConf = tlsConf.Clone()
+	tlsConf.NextProtos = []string{chatquic.ALPN}
+	tlsConf.MinVersion = tls.VersionTLS13
+	conf := chatquic.Config(pongWait())
+	// reloaded timeouts apply to the next connections
+	conf.GetConfigForClient = func(*quic.ClientInfo) (*quic.Config, error) {
+		return chatquic.Config(pongWait()), nil
+	}
+	l, err := quic.ListenAddrEarly(addr, tlsConf, conf)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("quic: listening on %s", l.Addr())
+	return &QUICServer{l: l}, nil
+}
+
+// Addr returns the address the server listens on.
+func (s *QUICServer) Addr() net.Addr {
+	return s.l.Addr()
+}
+
+// Serve accepts connections until Close.
+func (s *QUICServer) Serve() error {
+	for {
+		conn, err := s.l.Accept(context.Background())
+		if err != nil {
+			if errors.Is(err, quic.ErrServerClosed) {
+				return nil
+			}
+			return err
+		}
+		go serveQUIC(conn)
+	}
+}
+
+// Close stops accepting connections. Connections already open end with
+// the hub.
+func (s *QUICServer) Close() error {
+	return s.l.Close()
+}
+
+// quicConn lets the hub close a connection it detaches.
+type quicConn struct{ *quic.Conn }
+
+func (c quicConn) Close() error {
+	return c.CloseWithError(chatquic.CodeClosed, "")
+}
+
+// serveQUIC runs one connection like HandleMessage: control stream
+// handshake, then the hub client, with a reader per stream the client
+// opens and a stream per conversation for what goes out.
+func serveQUIC(conn *quic.Conn) {
+	refuse := func(code quic.ApplicationErrorCode, reason string) {
+		_ = conn.CloseWithError(code, reason)
+		log.Printf("quic: refused %s: %s", conn.RemoteAddr(), reason)
+	}
+	ctx, cancel := context.WithTimeout(conn.Context(), protocol.HandshakeTimeout)
+	defer cancel()
+	ctrl, err := conn.AcceptStream(ctx)
+	if err != nil {
+		refuse(protocol.CloseHandshakeRequired, "expected a control stream")
+		return
+	}
+	_ = ctrl.SetReadDeadline(time.Now().Add(protocol.HandshakeTimeout))
+	r := bufio.NewReader(ctrl)
+	p, err := chatquic.ReadPreface(r)
+	if err != nil {
+		refuse(protocol.CloseHandshakeRequired, "expected a preface")
+		return
+	}
+	// 0-RTT data can be replayed by anyone who saw it; act on it only
+	// once the handshake has proven the client live
+	select {
+	case <-conn.HandshakeComplete():
+	case <-ctx.Done():
+		refuse(protocol.CloseHandshakeRequired, "handshake timed out")
+		return
+	}
+	id, device := p.ID, p.Device
+	if id == "" {
+		refuse(chatquic.CodeRefused, "missing id")
+		return
+	}
+	if device == "" {
+		device = defaultDevice
+	}
+	cs := conn.ConnectionState().TLS
+	if err := checkClientCert(&cs, id); err != nil {
+		refuse(chatquic.CodeRefused, err.Error())
+		return
+	}
+	if err := admit(id, device, p.DeviceName, p.DeviceSecret); err != nil {
+		refuse(chatquic.CodeRefused, err.Error())
+		return
+	}
+
+	b, err := chatquic.ReadRecord(r, maxMessageSize())
+	if err != nil {
+		refuse(protocol.CloseHandshakeRequired, "expected a hello frame")
+		return
+	}
+	frame, err := protocol.CBOR.Unmarshal(b)
+	hello, ok := frame.(*protocol.Hello)
+	if err != nil || !ok {
+		refuse(protocol.CloseHandshakeRequired, "expected a hello frame")
+		return
+	}
+	welcome, session, code, reason := accept(hello, id, device)
+	if code != 0 {
+		refuse(quic.ApplicationErrorCode(code), reason)
+		return
+	}
+	defer resumes.release(session)
+	if b, err = protocol.CBOR.Marshal(welcome); err == nil {
+		_ = ctrl.SetWriteDeadline(time.Now().Add(writeWait()))
+		err = chatquic.WriteRecord(ctrl, b)
+	}
+	if err != nil {
+		_ = conn.CloseWithError(chatquic.CodeClosed, "")
+		log.Printf("quic: handshake with id=%q device=%q failed: %v", id, device, err)
+		return
+	}
+	_ = ctrl.SetReadDeadline(time.Time{})
+	log.Printf("quic: handshake id=%q software=%q 0rtt=%t", id, hello.Software, conn.ConnectionState().Used0RTT)
+
+	client := &Client{ID: id, Device: device, Conn: quicConn{conn}, Send: newSendBuffer()}
+	if !hub.attachClient(client) {
+		_ = conn.CloseWithError(chatquic.CodeClosed, errHubStopped.Error())
+		return
+	}
+	log.Printf("quic: client connected id=%q device=%q remote=%s", id, device, conn.RemoteAddr())
+
+	// readers: the control stream, whose end ends the connection, and a
+	// stream per conversation the client opens. Each keeps its order.
+	limit := newRateLimit()
+	read := func(r *bufio.Reader) error {
+		for {
+			b, err := chatquic.ReadRecord(r, maxMessageSize())
+			if err != nil {
+				return err
+			}
+			if !allow(client, limit) {
+				continue
+			}
+			frame, err := protocol.CBOR.Unmarshal(b)
+			if err != nil {
+				hub.reply(client, protocol.NewError(err.Error()))
+				log.Printf("quic: invalid frame from id=%q: %v", id, err)
+				continue
+			}
+			if !handleFrame(client, frame, nil) {
+				return errHubStopped
+			}
+		}
+	}
+	go func() {
+		err := read(r)
+		log.Printf("quic: read error/closed for id=%q: %v", id, err)
+		hub.detachClient(client)
+	}()
+	go func() {
+		for {
+			s, err := conn.AcceptUniStream(conn.Context())
+			if err != nil {
+				return
+			}
+			go func() {
+				if err := read(bufio.NewReader(s)); err == errHubStopped {
+					hub.detachClient(client)
+				}
+			}()
+		}
+	}()
+
+	// writer: until the hub closes Send, replaying what the client missed
+	// before resuming first
+	streams := make(map[string]*quic.SendStream) // nil: on the control stream
+	var writeErr error
+	write := func(msg []byte, seq int64) {
+		f, err := protocol.Decode(msg)
+		if err == nil {
+			f.Head().Seq = seq
+			msg, err = protocol.CBOR.Marshal(f)
+		}
+		if err != nil {
+			log.Printf("quic: cannot encode frame for id=%q: %v", id, err)
+			return
+		}
+		var w io.Writer = ctrl
+		_ = ctrl.SetWriteDeadline(time.Now().Add(writeWait()))
+		if key := chatquic.Conversation(f, id); key != "" {
+			s, ok := streams[key]
+			if !ok && len(streams) < maxQUICStreams {
+				s, _ = conn.OpenUniStream()
+			}
+			streams[key] = s
+			if s != nil {
+				_ = s.SetWriteDeadline(time.Now().Add(writeWait()))
+				w = s
+			}
+		}
+		if writeErr = chatquic.WriteRecord(w, msg); writeErr != nil {
+			log.Printf("quic: write error for id=%q: %v", id, writeErr)
+			hub.detachClient(client)
+		}
+	}
+	for _, f := range session.since(hello.LastSeq) {
+		write(f.msg, f.seq)
+	}
+	for msg := range client.Send {
+		seq := session.number(msg)
+		if writeErr != nil {
+			// kept in the session for a resume
+			continue
+		}
+		write(msg, seq)
+		if len(client.Send) == 0 && client.spilled.Load() {
+			hub.requestFlush(client)
+		}
+	}
+	log.Printf("quic: disconnected id=%q", id)
+}
@@ -0,0 +1,250 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/marcoantonios1/chat-app/internal/chatquic"
+	"github.com/marcoantonios1/chat-app/internal/protocol"
+	"github.com/quic-go/quic-go"
+)
+
+var globalHub sync.Once
+
+// runGlobalHub runs the hub QUIC connections attach to, for the rest of
+// the test binary.
+func runGlobalHub() {
+	globalHub.Do(func() { go hub.run() })
+}
+
+// startQUIC serves QUIC on a loopback port until the test ends and returns
+// its address and a client TLS config that trusts it, with a session cache
+// so redials can use 0-RTT.
+func startQUIC(t *testing.T) (string, *tls.Config) {
+	t.Helper()
+	runGlobalHub()
+	dir := t.TempDir()
+	cert, err := loadCertificate(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := ListenQUIC("127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = s.Serve() }()
+	t.Cleanup(func() { _ = s.Close() })
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(leaf)
+	return s.Addr().String(), &tls.Config{
+		RootCAs:            roots,
+		ServerName:         "localhost",
+		NextProtos:         []string{chatquic.ALPN},
+		ClientSessionCache: tls.NewLRUClientSessionCache(4),
+	}
+}
+
+// quicClient is a client connection that has done the handshake.
+type quicClient struct {
+	conn *quic.Conn
+	ctrl *quic.Stream
+	r    *bufio.Reader
+}
+
+// dialQUIC connects as id/device, sending the preface and hello without
+// waiting for the TLS handshake, and reads the welcome.
+func dialQUIC(t *testing.T, addr string, tlsConf *tls.Config, id, device string) *quicClient {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := quic.DialAddrEarly(ctx, addr, tlsConf, chatquic.Config(chatquic.DefaultIdleTimeout))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.CloseWithError(chatquic.CodeClosed, "") })
+	ctrl, err := conn.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := chatquic.WritePreface(ctrl, chatquic.Preface{ID: id, Device: device, DeviceSecret: "secret-" + device}); err != nil {
+		t.Fatal(err)
+	}
+	writeQUIC(t, ctrl, protocol.NewHello("chat-app/test"))
+	c := &quicClient{conn: conn, ctrl: ctrl, r: bufio.NewReader(ctrl)}
+	_ = ctrl.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if w, ok := readQUIC(t, c.r).(*protocol.Welcome); !ok || w.Version != protocol.Version {
+		t.Fatalf("handshake answered with %#v", w)
+	}
+	return c
+}
+
+func writeQUIC(t *testing.T, w interface{ Write([]byte) (int, error) }, f protocol.Frame) {
+	t.Helper()
+	b, err := protocol.CBOR.Marshal(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := chatquic.WriteRecord(w, b); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readQUIC(t *testing.T, r *bufio.Reader) protocol.Frame {
+	t.Helper()
+	b, err := chatquic.ReadRecord(r, protocol.MaxFrameSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := protocol.CBOR.Unmarshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+// deliverTo hands a message from one user to another to the hub, as if
+// it came from a connection of from.
+func deliverTo(t *testing.T, from, to, body string) {
+	t.Helper()
+	m := protocol.NewMessage(to, "", "", body)
+	m.ID, m.Device = from, from+"1"
+	raw, err := protocol.Encode(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hub.sendTargeted(targetedMessage{to: to, msg: raw}) {
+		t.Fatal("hub stopped")
+	}
+}
+
+func TestQUICStreamPerConversation(t *testing.T) {
+	addr, tlsConf := startQUIC(t)
+	addUser(t, "alice")
+	addUser(t, "bob", "b1")
+	addUser(t, "carol", "c1")
+	bob := newTestClient("bob", "b1", 8)
+	attach(t, hub, bob)
+	t.Cleanup(func() { hub.detachClient(bob) })
+	alice := dialQUIC(t, addr, tlsConf, "alice", "a1")
+
+	// what alice writes on a stream of her own reaches bob
+	s, err := alice.conn.OpenUniStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := protocol.NewMessage("bob", "", "", "00ff")
+	m.ID, m.Device = "alice", "a1"
+	writeQUIC(t, s, m)
+	f, err := protocol.Decode(receive(t, bob))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := f.(*protocol.Message); !ok || got.ID != "alice" || got.Device != "a1" || got.Body != "00ff" {
+		t.Fatalf("bob got %#v", f)
+	}
+
+	// what bob and carol send, interleaved, comes on a stream each
+	for _, body := range []string{"01", "02"} {
+		deliverTo(t, "bob", "alice", "b"+body)
+		deliverTo(t, "carol", "alice", "c"+body)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	bodies := make(map[string][]string)
+	for i := 0; i < 2; i++ {
+		s, err := alice.conn.AcceptUniStream(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = s.SetReadDeadline(time.Now().Add(5 * time.Second))
+		r := bufio.NewReader(s)
+		var from string
+		for j := 0; j < 2; j++ {
+			m, ok := readQUIC(t, r).(*protocol.Message)
+			if !ok || (from != "" && m.ID != from) {
+				t.Fatalf("stream %d mixes conversations: %#v after frames of %s", i, m, from)
+			}
+			from = m.ID
+			bodies[from] = append(bodies[from], m.Body)
+			if m.Seq == 0 {
+				t.Fatalf("frame without a seq: %#v", m)
+			}
+		}
+	}
+	if b, c := bodies["bob"], bodies["carol"]; len(b) != 2 || b[0] != "b01" || b[1] != "b02" || len(c) != 2 || c[0] != "c01" || c[1] != "c02" {
+		t.Fatalf("got %v, want each conversation in order", bodies)
+	}
+
+	// frames of no conversation stay on the control stream
+	if err := chatquic.WriteRecord(alice.ctrl, []byte{0xff}); err != nil {
+		t.Fatal(err)
+	}
+	if e, ok := readQUIC(t, alice.r).(*protocol.Error); !ok {
+		t.Fatalf("control stream got %#v, want an error", e)
+	}
+}
+
+func TestQUICRefusesUnknownUser(t *testing.T) {
+	addr, tlsConf := startQUIC(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := quic.DialAddrEarly(ctx, addr, tlsConf, chatquic.Config(chatquic.DefaultIdleTimeout))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.CloseWithError(chatquic.CodeClosed, "")
+	ctrl, err := conn.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := chatquic.WritePreface(ctrl, chatquic.Preface{ID: "mallory", Device: "m1", DeviceSecret: "secret"}); err != nil {
+		t.Fatal(err)
+	}
+	writeQUIC(t, ctrl, protocol.NewHello("chat-app/test"))
+	_ = ctrl.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = chatquic.ReadRecord(bufio.NewReader(ctrl), protocol.MaxFrameSize)
+	var ae *quic.ApplicationError
+	if !errors.As(err, &ae) || ae.ErrorCode != chatquic.CodeRefused {
+		t.Fatalf("read error %v, want the connection refused", err)
+	}
+}
+
+func TestQUICRedialUses0RTT(t *testing.T) {
+	addr, tlsConf := startQUIC(t)
+	addUser(t, "alice")
+	first := dialQUIC(t, addr, tlsConf, "alice", "a1")
+	if first.conn.ConnectionState().Used0RTT {
+		t.Fatal("first connection used 0-RTT without a session ticket")
+	}
+	_ = first.conn.CloseWithError(chatquic.CodeClosed, "")
+
+	// the preface and hello go in the first flight, and the server
+	// answers them once the handshake is done
+	again := dialQUIC(t, addr, tlsConf, "alice", "a1")
+	if !again.conn.ConnectionState().Used0RTT {
+		t.Fatal("redial did not use 0-RTT")
+	}
+	deliverTo(t, "bob", "alice", "00")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	s, err := again.conn.AcceptUniStream(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = s.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if m, ok := readQUIC(t, bufio.NewReader(s)).(*protocol.Message); !ok || m.ID != "bob" {
+		t.Fatalf("got %#v after the redial", m)
+	}
+}
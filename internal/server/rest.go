@@ -0,0 +1,200 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/marcoantonios1/chat-app/internal/chatrpc"
+	"github.com/marcoantonios1/chat-app/internal/protocol"
+)
+
+// number of API callers whose rate limit is kept before idle ones are
+// dropped
+const maxAPILimits = 1024
+
+// apiMessage is the body of POST /api/messages: a message already
+// encrypted for the recipient, as the body of a message frame.
+type apiMessage struct {
+	Recipient    string `json:"recipient"`
+	ToDevice     string `json:"to_device,omitempty"`
+	MsgID        string `json:"msg_id,omitempty"`
+	Body         string `json:"body"`
+	EncryptedKey string `json:"encrypted_key,omitempty"`
+}
+
+// queuedDevice is one entry of GET /api/queued.
+type queuedDevice struct {
+	Device string `json:"device,omitempty"` // empty: the first device to connect
+	Queued int    `json:"queued"`
+}
+
+type queuedResponse struct {
+	Total   int            `json:"total"`
+	Devices []queuedDevice `json:"devices"`
+}
+
+var (
+	apiLimitsMu sync.Mutex
+	apiLimits   = make(map[deviceRef]*rateLimit)
+)
+
+// HandleAPI serves the REST API for services that don't keep a
+// connection open:
+//
+//	POST /api/messages        send an encrypted message, answers 202 with its Delivery
+//	GET  /api/messages/{id}   the Delivery of a message the caller sent
+//	GET  /api/queued          frames waiting for the caller's devices
+//
+// Callers name themselves in the Chat-Id and Chat-Device headers, like the
+// gRPC metadata, and prove they are that device with its secret in
+// Chat-Device-Secret; the device must be approved. Each device has the
+// rate limit of a connection. Delivery status is kept by the instance the
+// message was sent through, for a day.
+func HandleAPI(w http.ResponseWriter, r *http.Request) {
+	id, device := r.Header.Get(chatrpc.MetadataID), r.Header.Get(chatrpc.MetadataDevice)
+	for _, h := range []struct{ key, value string }{
+		{chatrpc.MetadataID, id},
+		{chatrpc.MetadataDevice, device},
+		{chatrpc.MetadataDeviceSecret, deviceSecret(r)},
+	} {
+		if h.value == "" {
+			http.Error(w, "missing "+http.CanonicalHeaderKey(h.key)+" header", http.StatusUnauthorized)
+			return
+		}
+	}
+	if !clientCertOK(w, r, id) {
+		return
+	}
+	switch err := authDevice(id, device, deviceSecret(r)); err {
+	case nil:
+	case errNoSecret, errWrongSecret:
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	default:
+		http.Error(w, "device is not approved for this id", http.StatusForbidden)
+		return
+	}
+	if !apiLimit(id, device).take() {
+		log.Printf("api: rate limit hit for id=%q", id)
+		http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+		return
+	}
+
+	msgID, isMsg := strings.CutPrefix(r.URL.Path, "/api/messages/")
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/api/messages":
+		apiSend(w, r, id, device)
+	case r.Method == http.MethodGet && isMsg && msgID != "":
+		d, ok := deliveries.get(id, msgID)
+		if !ok {
+			http.Error(w, "unknown message", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, d)
+	case r.Method == http.MethodGet && r.URL.Path == "/api/queued":
+		counts, ok := hub.queued(id)
+		if !ok {
+			http.Error(w, errHubStopped.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		resp := queuedResponse{Devices: []queuedDevice{}}
+		for d, n := range counts {
+			resp.Total += n
+			resp.Devices = append(resp.Devices, queuedDevice{Device: d, Queued: n})
+		}
+		sort.Slice(resp.Devices, func(i, j int) bool { return resp.Devices[i].Device < resp.Devices[j].Device })
+		writeJSON(w, http.StatusOK, resp)
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+// apiSend routes the message in r's body as if device of id had sent it
+// over its connection.
+func apiSend(w http.ResponseWriter, r *http.Request, id, device string) {
+	var req apiMessage
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, int64(maxMessageSize()))).Decode(&req); err != nil {
+		http.Error(w, "invalid body", http.StatusBadRequest)
+		return
+	}
+	if req.Recipient == "" {
+		http.Error(w, "missing recipient", http.StatusBadRequest)
+		return
+	}
+	if req.MsgID == "" {
+		req.MsgID = newAPIMessageID()
+	}
+	m := protocol.NewMessage(req.Recipient, req.ToDevice, req.MsgID, req.Body)
+	m.EncryptedKey = req.EncryptedKey
+	m.ID, m.Device = id, device
+	if err := m.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	raw, err := protocol.Encode(m)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(raw) > maxMessageSize() {
+		http.Error(w, "frame too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	if err := routeFrom(id, device, m, raw); err != nil {
+		code := http.StatusBadGateway // federation
+		switch {
+		case errors.Is(err, errRecipientNotFound):
+			code = http.StatusNotFound
+		case errors.Is(err, errHubStopped):
+			code = http.StatusServiceUnavailable
+		}
+		http.Error(w, err.Error(), code)
+		return
+	}
+	log.Printf("api: message %s from id=%q to=%q", m.MsgID, id, m.Recipient)
+	d, _ := deliveries.get(id, m.MsgID)
+	w.Header().Set("Location", "/api/messages/"+m.MsgID)
+	writeJSON(w, http.StatusAccepted, d)
+}
+
+// apiLimit returns the rate limit of device of id.
+func apiLimit(id, device string) *rateLimit {
+	apiLimitsMu.Lock()
+	defer apiLimitsMu.Unlock()
+	ref := deviceRef{id, device}
+	l, ok := apiLimits[ref]
+	if !ok {
+		if len(apiLimits) >= maxAPILimits {
+			now := time.Now()
+			for r, l := range apiLimits {
+				if l.idle(now) {
+					delete(apiLimits, r)
+				}
+			}
+		}
+		l = newRateLimit()
+		apiLimits[ref] = l
+	}
+	return l
+}
+
+func newAPIMessageID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,209 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/marcoantonios1/chat-app/internal/chatrpc"
+	"github.com/marcoantonios1/chat-app/internal/protocol"
+)
+
+// callAPI makes a request to the REST API as id/device with secret; an
+// empty header is left out.
+func callAPI(t *testing.T, method, path, body, id, device, secret string) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	for key, value := range map[string]string{
+		chatrpc.MetadataID:           id,
+		chatrpc.MetadataDevice:       device,
+		chatrpc.MetadataDeviceSecret: secret,
+	} {
+		if value != "" {
+			r.Header.Set(key, value)
+		}
+	}
+	w := httptest.NewRecorder()
+	HandleAPI(w, r)
+	return w
+}
+
+// decodeAPI decodes the JSON answer in w into v.
+func decodeAPI(t *testing.T, w *httptest.ResponseRecorder, v any) {
+	t.Helper()
+	if err := json.NewDecoder(w.Body).Decode(v); err != nil {
+		t.Fatalf("answer %q: %v", w.Body, err)
+	}
+}
+
+func TestAPIAuth(t *testing.T) {
+	runGlobalHub()
+	forgetUser(t, "rita")
+	if err := registerUser("rita", "r1", "", "rs1"); err != nil {
+		t.Fatal(err)
+	}
+	usersMu.Lock()
+	users["rita"].devices["r2"] = &Device{ID: "r2", Status: devicePending, SecretHash: hashSecret("rs2")}
+	usersMu.Unlock()
+
+	for _, c := range []struct {
+		id, device, secret string
+		want               int
+	}{
+		{"", "r1", "rs1", http.StatusUnauthorized},
+		{"rita", "", "rs1", http.StatusUnauthorized},
+		{"rita", "r1", "", http.StatusUnauthorized},
+		{"rita", "r1", "guess", http.StatusUnauthorized},
+		{"rita", "r2", "rs2", http.StatusForbidden},
+		{"rita", "r3", "rs3", http.StatusForbidden},
+		{"mallory", "m1", "s", http.StatusForbidden},
+		{"rita", "r1", "rs1", http.StatusOK},
+	} {
+		if w := callAPI(t, http.MethodGet, "/api/queued", "", c.id, c.device, c.secret); w.Code != c.want {
+			t.Fatalf("%q/%q with %q: status %d, want %d", c.id, c.device, c.secret, w.Code, c.want)
+		}
+	}
+	if w := callAPI(t, http.MethodGet, "/api/nothing", "", "rita", "r1", "rs1"); w.Code != http.StatusNotFound {
+		t.Fatalf("unknown path: status %d", w.Code)
+	}
+}
+
+func TestAPIRateLimit(t *testing.T) {
+	withLimits(t, func(l *Limits) { l.RateBurst, l.RatePerSec = 2, 0.001 })
+	runGlobalHub()
+	forgetUser(t, "rhea")
+	if err := registerUser("rhea", "h1", "", "hs1"); err != nil {
+		t.Fatal(err)
+	}
+	usersMu.Lock()
+	users["rhea"].devices["h2"] = &Device{ID: "h2", Status: deviceApproved, SecretHash: hashSecret("hs2")}
+	usersMu.Unlock()
+
+	for i := 0; i < 2; i++ {
+		if w := callAPI(t, http.MethodGet, "/api/queued", "", "rhea", "h1", "hs1"); w.Code != http.StatusOK {
+			t.Fatalf("request %d: status %d", i, w.Code)
+		}
+	}
+	if w := callAPI(t, http.MethodGet, "/api/queued", "", "rhea", "h1", "hs1"); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("request over the limit: status %d", w.Code)
+	}
+	// each device has a limit of its own
+	if w := callAPI(t, http.MethodGet, "/api/queued", "", "rhea", "h2", "hs2"); w.Code != http.StatusOK {
+		t.Fatalf("other device: status %d", w.Code)
+	}
+}
+
+func TestAPISend(t *testing.T) {
+	withLimits(t, func(l *Limits) { l.RateBurst, l.RatePerSec = 100, 100 })
+	runGlobalHub()
+	forgetUser(t, "rosa")
+	if err := registerUser("rosa", "o1", "", "os1"); err != nil {
+		t.Fatal(err)
+	}
+	addUser(t, "ross", "x1")
+	ross := newTestClient("ross", "x1", 8)
+	attach(t, hub, ross)
+	t.Cleanup(func() { hub.detachClient(ross) })
+	t.Cleanup(func() {
+		history.mu.Lock()
+		delete(history.conversations, conversationKey("rosa", "ross"))
+		history.mu.Unlock()
+	})
+
+	for _, c := range []struct {
+		body string
+		want int
+	}{
+		{`{`, http.StatusBadRequest},
+		{`{"body":"00ff"}`, http.StatusBadRequest},
+		{`{"recipient":"ross"}`, http.StatusBadRequest},
+		{`{"recipient":"ross","to_device":"` + strings.Repeat("x", protocol.MaxIDLength+1) + `","body":"00ff"}`, http.StatusBadRequest},
+		{`{"recipient":"ross","body":"` + strings.Repeat("0", maxMessageSize()) + `"}`, http.StatusBadRequest},
+		{`{"recipient":"nobody","body":"00ff"}`, http.StatusNotFound},
+	} {
+		w := callAPI(t, http.MethodPost, "/api/messages", c.body, "rosa", "o1", "os1")
+		if w.Code != c.want {
+			t.Fatalf("body %.40q: status %d, want %d", c.body, w.Code, c.want)
+		}
+	}
+
+	w := callAPI(t, http.MethodPost, "/api/messages", `{"recipient":"ross","msg_id":"m1","body":"00ff"}`, "rosa", "o1", "os1")
+	if w.Code != http.StatusAccepted || w.Header().Get("Location") != "/api/messages/m1" {
+		t.Fatalf("send: status %d, location %q", w.Code, w.Header().Get("Location"))
+	}
+	f, err := protocol.Decode(receive(t, ross))
+	if m, ok := f.(*protocol.Message); err != nil || !ok || m.ID != "rosa" || m.Device != "o1" || m.MsgID != "m1" || m.Body != "00ff" {
+		t.Fatalf("ross got %#v, %v", f, err)
+	}
+	eventually(t, "m1 to be delivered", func() bool {
+		w := callAPI(t, http.MethodGet, "/api/messages/m1", "", "rosa", "o1", "os1")
+		var d Delivery
+		decodeAPI(t, w, &d)
+		return w.Code == http.StatusOK && d.MsgID == "m1" && d.Recipient == "ross" && d.Status == protocol.StatusDelivered
+	})
+
+	if w := callAPI(t, http.MethodGet, "/api/messages/unknown", "", "rosa", "o1", "os1"); w.Code != http.StatusNotFound {
+		t.Fatalf("unknown message: status %d", w.Code)
+	}
+	// the status is only the sender's to see
+	if w := callAPI(t, http.MethodGet, "/api/messages/m1", "", "ross", "x1", ""); w.Code != http.StatusUnauthorized {
+		t.Fatalf("status of another's message: status %d", w.Code)
+	}
+
+	// to a device that is offline, the message is queued
+	hub.detachClient(ross)
+	w = callAPI(t, http.MethodPost, "/api/messages", `{"recipient":"ross","msg_id":"m2","body":"00ff"}`, "rosa", "o1", "os1")
+	var d Delivery
+	decodeAPI(t, w, &d)
+	if w.Code != http.StatusAccepted || d.MsgID != "m2" {
+		t.Fatalf("send to offline: status %d, %+v", w.Code, d)
+	}
+	eventually(t, "m2 to be queued", func() bool {
+		w := callAPI(t, http.MethodGet, "/api/messages/m2", "", "rosa", "o1", "os1")
+		var d Delivery
+		decodeAPI(t, w, &d)
+		return d.Status == protocol.StatusQueued
+	})
+}
+
+func TestAPIQueued(t *testing.T) {
+	runGlobalHub()
+	forgetUser(t, "rory")
+	if err := registerUser("rory", "y1", "", "ys1"); err != nil {
+		t.Fatal(err)
+	}
+	usersMu.Lock()
+	users["rory"].devices["y2"] = &Device{ID: "y2", Status: deviceApproved, SecretHash: hashSecret("ys2")}
+	usersMu.Unlock()
+	t.Cleanup(func() {
+		// take what was queued for rory, so it doesn't outlive the test
+		for _, dev := range []string{"y1", "y2"} {
+			c := newTestClient("rory", dev, 8)
+			attach(t, hub, c)
+			hub.detachClient(c)
+		}
+	})
+
+	var resp queuedResponse
+	w := callAPI(t, http.MethodGet, "/api/queued", "", "rory", "y1", "ys1")
+	decodeAPI(t, w, &resp)
+	if w.Code != http.StatusOK || resp.Total != 0 || resp.Devices == nil || len(resp.Devices) != 0 {
+		t.Fatalf("nothing queued: status %d, %+v", w.Code, resp)
+	}
+
+	deliverTo(t, "rosa", "rory", "00")
+	deliverTo(t, "rosa", "rory", "01")
+	eventually(t, "frames to be queued", func() bool {
+		counts, _ := hub.queued("rory")
+		return counts["y1"] == 2 && counts["y2"] == 2
+	})
+	resp = queuedResponse{}
+	w = callAPI(t, http.MethodGet, "/api/queued", "", "rory", "y2", "ys2")
+	decodeAPI(t, w, &resp)
+	want := []queuedDevice{{Device: "y1", Queued: 2}, {Device: "y2", Queued: 2}}
+	if resp.Total != 4 || len(resp.Devices) != 2 || resp.Devices[0] != want[0] || resp.Devices[1] != want[1] {
+		t.Fatalf("queued %+v, want 2 for each device", resp)
+	}
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// how long a dropped connection can be resumed
+	resumeWindow = 2 * time.Minute
+	// frames kept per connection for replay after a resume
+	resumeBuffer = 256
+)
+
+// resumeSession numbers the frames sent on one connection and keeps the
+// latest of them, so a client that reconnects with the session's token
+// gets what it may have missed. Every connection gets a fresh token; a
+// resumed connection carries the numbering and the frames over once the
+// old connection's writer has stopped.
+//
+// Sessions live in the instance that issued them. A client resuming on
+// another instance starts a new session and relies on the hub's queue.
+type resumeSession struct {
+	token  string
+	id     string
+	device string
+
+	mu      sync.Mutex
+	seq     int64          // last number handed out
+	frames  []seqFrame     // the latest frames, oldest first
+	ended   time.Time      // when the connection went away, zero while attached
+	prev    *resumeSession // the session resumed, until it is taken over
+	stopped chan struct{}  // closed by release
+}
+
+type seqFrame struct {
+	seq int64
+	msg []byte
+}
+
+// number assigns the next sequence number to msg and remembers it.
+func (s *resumeSession) number(msg []byte) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seq++
+	if len(s.frames) == resumeBuffer {
+		s.frames = append(s.frames[:0], s.frames[1:]...)
+	}
+	s.frames = append(s.frames, seqFrame{s.seq, msg})
+	return s.seq
+}
+
+// since returns the remembered frames numbered after seq. The writer of
+// a connection calls it before numbering anything.
+func (s *resumeSession) since(seq int64) []seqFrame {
+	s.takeOver()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, f := range s.frames {
+		if f.seq > seq {
+			return append([]seqFrame(nil), s.frames[i:]...)
+		}
+	}
+	return nil
+}
+
+// takeOver carries the numbering and frames of the resumed session over.
+// The old connection's writer may still be draining its Send, which the
+// hub closes when this connection attaches; what it numbers until it
+// stops belongs in the replay too.
+func (s *resumeSession) takeOver() {
+	s.mu.Lock()
+	old := s.prev
+	s.prev = nil
+	s.mu.Unlock()
+	if old == nil {
+		return
+	}
+	select {
+	case <-old.stopped:
+	case <-time.After(writeWait()):
+		log.Printf("ws: resuming id=%q device=%q while the old connection is still writing", s.id, s.device)
+	}
+	old.mu.Lock()
+	seq, frames := old.seq, old.frames
+	old.frames = nil
+	old.mu.Unlock()
+	s.mu.Lock()
+	s.seq, s.frames = seq, frames
+	s.mu.Unlock()
+}
+
+type resumeStore struct {
+	mu       sync.Mutex
+	sessions map[string]*resumeSession
+}
+
+var resumes = &resumeStore{sessions: make(map[string]*resumeSession)}
+
+// open starts the session for a new connection of id/device. If token
+// names a recent session of the same device, it is taken over and open
+// reports true.
+func (r *resumeStore) open(token, id, device string) (*resumeSession, bool) {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	s := &resumeSession{token: hex.EncodeToString(b), id: id, device: device, stopped: make(chan struct{})}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	for t, old := range r.sessions {
+		old.mu.Lock()
+		expired := !old.ended.IsZero() && now.Sub(old.ended) > resumeWindow
+		old.mu.Unlock()
+		if expired {
+			delete(r.sessions, t)
+		}
+	}
+	r.sessions[s.token] = s
+
+	old, ok := r.sessions[token]
+	if !ok || token == "" || old.id != id || old.device != device {
+		return s, false
+	}
+	// the old connection may not have noticed the drop yet; its frames
+	// are taken over by since
+	delete(r.sessions, token)
+	s.prev = old
+	return s, true
+}
+
+// release starts the resume window of a session whose connection ended.
+// It is called once the connection's writer has stopped numbering frames.
+func (r *resumeStore) release(s *resumeSession) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ended.IsZero() {
+		s.ended = time.Now()
+		close(s.stopped)
+	}
+}
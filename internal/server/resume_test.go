@@ -0,0 +1,60 @@
+package server
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestResumeWaitsForOldWriter(t *testing.T) {
+	r := &resumeStore{sessions: make(map[string]*resumeSession)}
+	old, _ := r.open("", "alice", "a1")
+	for i := 1; i <= 2; i++ {
+		old.number([]byte(fmt.Sprint(i)))
+	}
+
+	s, resumed := r.open(old.token, "alice", "a1")
+	if !resumed {
+		t.Fatal("session not resumed")
+	}
+	replay := make(chan []seqFrame, 1)
+	go func() { replay <- s.since(1) }()
+	select {
+	case <-replay:
+		t.Fatal("replayed before the old connection stopped writing")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	// the old writer drains what was left in its Send
+	old.number([]byte("3"))
+	r.release(old)
+	var got []seqFrame
+	select {
+	case got = <-replay:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no replay after the old connection stopped")
+	}
+	if len(got) != 2 || got[0].seq != 2 || string(got[1].msg) != "3" {
+		t.Fatalf("replay %+v, want frames 2 and 3", got)
+	}
+	if seq := s.number([]byte("4")); seq != 4 {
+		t.Fatalf("next seq %d, want 4", seq)
+	}
+	if _, resumed := r.open(old.token, "alice", "a1"); resumed {
+		t.Fatal("a session was resumed twice")
+	}
+}
+
+func TestResumeOtherDevice(t *testing.T) {
+	r := &resumeStore{sessions: make(map[string]*resumeSession)}
+	old, _ := r.open("", "alice", "a1")
+	old.number([]byte("1"))
+	r.release(old)
+	s, resumed := r.open(old.token, "alice", "a2")
+	if resumed || len(s.since(0)) != 0 {
+		t.Fatal("another device resumed the session")
+	}
+	// releasing twice is harmless
+	r.release(s)
+	r.release(s)
+}
@@ -1,41 +1,23 @@
 package server
 
 import (
-	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/marcoantonios1/chat-app/internal/protocol"
 )
 
-const (
-	// time allowed to write a message to the peer.
-	writeWait = 10 * time.Second
-	// time allowed to read the next pong message from the peer.
-	pongWait = 60 * time.Second
-	// send pings to peer with this period. Must be less than pongWait.
-	pingPeriod = (pongWait * 9) / 10
-	// maximum message size allowed from peer.
-	maxMessageSize = 64 * 1024
-)
-
-type messagePayload struct {
-	Type           string `json:"type,omitempty"`
-	ID             string `json:"id"`
-	Recipient      string `json:"recipient"`
-	Body           string `json:"body,omitempty"`
-	MsgID          string `json:"msg_id,omitempty"`
-	PublicKey      string `json:"public_key,omitempty"`
-	EncryptedKey   string `json:"encrypted_key,omitempty"`
-	IdentityPublic string `json:"identity_public,omitempty"`
-	PublicKeySig   string `json:"public_key_sig,omitempty"`
-}
-
 var (
 	upgrader = websocket.Upgrader{
-		// for local/dev only — tighten in production
-		CheckOrigin: func(r *http.Request) bool { return true },
+		// browsers only from allowed_origins; see Config.AllowedOrigins
+		CheckOrigin: originAllowed,
+		// frame encodings, preferred first; clients that ask for none get JSON
+		Subprotocols: protocol.Subprotocols,
 	}
 )
 
@@ -45,8 +27,15 @@ func HandleMessage(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "missing id query parameter", http.StatusBadRequest)
 		return
 	}
-	if !IsRegistered(id) {
-		http.Error(w, "id not registered", http.StatusForbidden)
+	device := r.URL.Query().Get("device")
+	if device == "" {
+		device = defaultDevice
+	}
+	if !clientCertOK(w, r, id) {
+		return
+	}
+	if err := admit(id, device, r.URL.Query().Get("device_name"), deviceSecret(r)); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
 		return
 	}
 
@@ -55,66 +44,104 @@ func HandleMessage(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "upgrade failed", http.StatusBadRequest)
 		return
 	}
+	codec, err := protocol.CodecFor(conn.Subprotocol())
+	if err != nil {
+		_ = conn.Close()
+		return
+	}
+	hello, session, err := handshake(conn, codec, id, device)
+	if err != nil {
+		_ = conn.Close()
+		log.Printf("ws: handshake with id=%q device=%q failed: %v", id, device, err)
+		return
+	}
+	log.Printf("ws: handshake id=%q software=%q encoding=%s", id, hello.Software, codec.Name())
+
 	client := &Client{
-		ID:   id,
-		Conn: conn,
-		Send: make(chan []byte, 256),
+		ID:     id,
+		Device: device,
+		Conn:   conn,
+		Send:   newSendBuffer(),
+	}
+
+	// register client with hub; from here on the hub owns client.Send
+	if !hub.attachClient(client) {
+		resumes.release(session)
+		_ = conn.Close()
+		return
 	}
+	log.Printf("ws: client connected id=%q device=%q remote=%s", id, device, conn.RemoteAddr())
 
-	// register client with hub
-	hub.register <- client
-	log.Printf("ws: client connected id=%q remote=%s", id, conn.RemoteAddr())
+	// done is closed when the reader exits and stops the helper goroutines
+	done := make(chan struct{})
+	defer close(done)
 
-	// writer goroutine: sends messages from client.Send to websocket
+	// writer goroutine: sends messages from client.Send to websocket until
+	// the hub closes Send. The hub routes JSON frames; they are numbered
+	// for the resume session and re-encoded here for clients that picked
+	// another encoding.
 	go func(c *Client) {
-		defer c.Conn.Close()
-		for msg := range c.Send {
-			_ = c.Conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
-			if err := c.Conn.WriteMessage(websocket.TextMessage, msg); err != nil {
-				log.Printf("ws: write error for id=%q: %v", c.ID, err)
+		defer conn.Close()
+		defer resumes.release(session)
+		failed := false
+		write := func(msg []byte, seq int64) {
+			out, err := protocol.Transcode(msg, seq, codec)
+			if err != nil {
+				log.Printf("ws: cannot encode frame for id=%q: %v", c.ID, err)
 				return
 			}
+			_ = conn.SetWriteDeadline(time.Now().Add(writeWait()))
+			if err := conn.WriteMessage(messageType(codec), out); err != nil {
+				log.Printf("ws: write error for id=%q: %v", c.ID, err)
+				failed = true
+				_ = conn.Close()
+			}
+		}
+		// what the client missed before resuming goes first
+		for _, f := range session.since(hello.LastSeq) {
+			write(f.msg, f.seq)
+		}
+		for msg := range c.Send {
+			seq := session.number(msg)
+			if failed {
+				// kept in the session for a resume
+				continue
+			}
+			write(msg, seq)
+			if len(c.Send) == 0 && c.spilled.Load() {
+				hub.requestFlush(c)
+			}
 		}
 	}(client)
 
 	// Configure read limits, initial deadline and pong handler
-	conn.SetReadLimit(maxMessageSize)
-	_ = conn.SetReadDeadline(time.Now().Add(pongWait))
+	conn.SetReadLimit(int64(maxMessageSize()))
+	_ = conn.SetReadDeadline(time.Now().Add(pongWait()))
 	conn.SetPongHandler(func(string) error {
-		_ = conn.SetReadDeadline(time.Now().Add(pongWait))
+		_ = conn.SetReadDeadline(time.Now().Add(pongWait()))
 		return nil
 	})
 
 	// Pinger goroutine: sends periodic ping frames
-	pingTicker := time.NewTicker(pingPeriod)
-	defer pingTicker.Stop()
 	go func(c *Client) {
-		for range pingTicker.C {
-			_ = c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
-			if err := c.Conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+		pingTicker := time.NewTicker(pingPeriod())
+		defer pingTicker.Stop()
+		for {
+			select {
+			case <-pingTicker.C:
+			case <-done:
+				return
+			}
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait())); err != nil {
 				log.Printf("ws: ping error for id=%q: %v", c.ID, err)
 				// close connection to trigger cleanup
-				_ = c.Conn.Close()
+				_ = conn.Close()
 				return
 			}
 		}
 	}(client)
 
-	// Simple token-bucket rate limiter (5 messages burst, refill ~5/sec)
-	rateTokens := make(chan struct{}, 5)
-	for i := 0; i < 5; i++ {
-		rateTokens <- struct{}{}
-	}
-	go func() {
-		ticker := time.NewTicker(200 * time.Millisecond)
-		defer ticker.Stop()
-		for range ticker.C {
-			select {
-			case rateTokens <- struct{}{}:
-			default:
-			}
-		}
-	}()
+	rateTokens := newRateLimit()
 
 	// reader: receive messages from this socket and route to hub
 	for {
@@ -124,50 +151,228 @@ func HandleMessage(w http.ResponseWriter, r *http.Request) {
 			break
 		}
 
-		if len(msg) > maxMessageSize {
+		if len(msg) > maxMessageSize() {
 			log.Printf("ws: dropping oversized message from id=%q len=%d", id, len(msg))
 			continue
 		}
-
-		select {
-		case <-rateTokens:
-			// allowed
-		default:
-			// notify sender about rate limit (send via client.Send, non-blocking)
-			er := messagePayload{Type: "error", Body: "rate limit exceeded"}
-			if b, _ := json.Marshal(er); b != nil {
-				select {
-				case client.Send <- b:
-				default:
-				}
-			}
-			log.Printf("ws: rate limit hit for id=%q", id)
+		if !allow(client, rateTokens) {
 			continue
 		}
 
-		var payload messagePayload
-		if err := json.Unmarshal(msg, &payload); err == nil && payload.Recipient != "" {
-			if !IsRegistered(payload.Recipient) {
-				er := messagePayload{Type: "error", Body: "recipient not found"}
-				if b, _ := json.Marshal(er); b != nil {
-					select {
-					case client.Send <- b:
-					default:
-					}
-				}
-				log.Printf("ws: target not found id=%s from=%s", payload.Recipient, id)
-				continue
-			}
-			hub.targeted <- targetedMessage{to: payload.Recipient, msg: msg, from: id}
-			log.Printf("ws: got msg len=%d targeted to=%q from id=%q", len(msg), payload.Recipient, id)
-		} else {
-			hub.broadcast <- msg
-			log.Printf("ws: got msg broadcast len=%d from id=%q", len(msg), id)
+		frame, err := codec.Unmarshal(msg)
+		if err != nil {
+			hub.reply(client, protocol.NewError(err.Error()))
+			log.Printf("ws: invalid frame from id=%q: %v", id, err)
+			continue
+		}
+		if codec != protocol.JSON {
+			msg = nil
+		}
+		if !handleFrame(client, frame, msg) {
+			break
 		}
 	}
 
-	// cleanup on disconnect
-	hub.unregister <- client
-	_ = conn.Close()
+	// cleanup on disconnect; the hub closes Send and the connection, and
+	// the writer releases the session
+	hub.detachClient(client)
 	log.Printf("ws: disconnected id=%q", id)
 }
+
+// admit checks that device may connect as id with secret. A device seen
+// for the first time is announced to the user's approved devices so they
+// can link it.
+func admit(id, device, deviceName, secret string) error {
+	created, err := admitDevice(id, device, deviceName, secret)
+	if created {
+		// ask the user's approved devices to link the new one
+		if b, err := protocol.Encode(protocol.NewDeviceLink(id, device, deviceName)); err == nil {
+			hub.sendTargeted(targetedMessage{to: id, msg: b})
+		}
+		log.Printf("ws: new device pending approval id=%q device=%q", id, device)
+	}
+	return err
+}
+
+// rateLimit is the token bucket of one connection or API caller.
+type rateLimit struct {
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimit returns a full bucket.
+func newRateLimit() *rateLimit {
+	return &rateLimit{tokens: float64(settings().Limits.RateBurst), last: time.Now()}
+}
+
+// take takes a token if there is one.
+func (l *rateLimit) take() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now, limits := time.Now(), settings().Limits
+	l.tokens = min(float64(limits.RateBurst), l.tokens+now.Sub(l.last).Seconds()*limits.RatePerSec)
+	l.last = now
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// idle reports whether the bucket went unused for a minute, by which time
+// it is full again and can be dropped.
+func (l *rateLimit) idle(now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return now.Sub(l.last) > time.Minute
+}
+
+// allow takes a token for a frame from c, telling c when there is none.
+func allow(c *Client, limit *rateLimit) bool {
+	if limit.take() {
+		return true
+	}
+	// notify sender about rate limit
+	hub.reply(c, protocol.NewError("rate limit exceeded"))
+	log.Printf("ws: rate limit hit for id=%q", c.ID)
+	return false
+}
+
+// handleFrame checks a frame received from c and routes it. raw is the
+// frame's JSON encoding when it arrived as JSON, nil otherwise. It reports
+// false once the hub has stopped.
+func handleFrame(c *Client, frame protocol.Frame, raw []byte) bool {
+	// clients speak for themselves only
+	h := frame.Head()
+	if h.ID != c.ID || (h.Device != "" && h.Device != c.Device) {
+		hub.reply(c, protocol.NewError("frame sender does not match connection"))
+		log.Printf("ws: spoofed sender %q/%q from id=%q", h.ID, h.Device, c.ID)
+		return true
+	}
+	if h.Device == "" || raw == nil {
+		// recipients tell devices apart by this field, and everything
+		// past this point handles the frame as JSON
+		h.Device = c.Device
+		var err error
+		if raw, err = protocol.Encode(frame); err != nil {
+			return true
+		}
+		if len(raw) > maxMessageSize() {
+			hub.reply(c, protocol.NewError("frame too large"))
+			return true
+		}
+	}
+
+	switch f := frame.(type) {
+	case *protocol.HistoryRequest:
+		handleHistoryRequest(c, f)
+		return true
+	case *protocol.PublicKey:
+		recordPrekey(c.ID, c.Device, f)
+	}
+	f, ok := frame.(protocol.Targeted)
+	if !ok {
+		hub.reply(c, protocol.NewError(fmt.Sprintf("unexpected %s frame", frame.Kind())))
+		return true
+	}
+	return routeTargeted(c, f, raw)
+}
+
+var (
+	errRecipientNotFound = errors.New("recipient not found")
+	errHubStopped        = errors.New("server shutting down")
+)
+
+// routeTargeted hands a frame from c to its recipient and tells c if that
+// failed. raw is the frame as received. It reports false once the hub has
+// stopped.
+func routeTargeted(c *Client, f protocol.Targeted, raw []byte) bool {
+	err := routeFrom(c.ID, c.Device, f, raw)
+	if err == errHubStopped {
+		return false
+	}
+	if err != nil {
+		e := protocol.NewError(err.Error())
+		if m, ok := f.(*protocol.Message); ok {
+			e.MsgID = m.MsgID
+		}
+		hub.reply(c, e)
+	}
+	return true
+}
+
+// routeFrom hands a frame from device fromDevice of from to its recipient: a
+// broadcast for a message without one, another server for federated
+// addresses, or the hub. raw is the frame's JSON encoding.
+func routeFrom(from, fromDevice string, f protocol.Targeted, raw []byte) error {
+	recipient, toDevice := f.Target()
+	m, isMsg := f.(*protocol.Message)
+	if recipient == "" {
+		if !hub.sendBroadcast(raw) {
+			return errHubStopped
+		}
+		log.Printf("ws: got msg broadcast len=%d from id=%q", len(raw), from)
+		return nil
+	}
+	if a, ok := f.(*protocol.Ack); ok {
+		// a receipt from the recipient of a.MsgID
+		deliveries.update(a.Recipient, a.MsgID, from, a.Status)
+	}
+	tracked := isMsg && m.MsgID != ""
+	if tracked {
+		deliveries.track(from, m.MsgID, recipient)
+	}
+
+	user, domain := splitAddress(recipient)
+	if domain != "" {
+		// a user on another server
+		storeHistory(from, fromDevice, f, raw)
+		if err := federation.forward(from, fromDevice, f); err != nil {
+			log.Printf("ws: federation to %q from=%s failed: %v", recipient, from, err)
+			return err
+		}
+		if tracked {
+			deliveries.update(from, m.MsgID, "", protocol.StatusQueued)
+		}
+		if toDevice == "" {
+			hub.mirror(from, fromDevice, raw)
+		}
+		log.Printf("ws: got msg len=%d federated to=%q from id=%q", len(raw), recipient, from)
+		return nil
+	}
+
+	if !IsRegistered(user) {
+		log.Printf("ws: target not found id=%s from=%s", user, from)
+		return errRecipientNotFound
+	}
+	storeHistory(from, fromDevice, f, raw)
+	t := targetedMessage{
+		to:         user,
+		toDevice:   toDevice,
+		from:       from,
+		fromDevice: fromDevice,
+		msg:        raw,
+	}
+	if tracked {
+		t.msgID, t.ack = m.MsgID, true
+	}
+	if !hub.sendTargeted(t) {
+		return errHubStopped
+	}
+	log.Printf("ws: got msg len=%d targeted to=%q from id=%q", len(raw), user, from)
+	return nil
+}
+
+// handleHistoryRequest answers a history request with a page of the
+// conversation between the client and req.Recipient.
+func handleHistoryRequest(c *Client, req *protocol.HistoryRequest) {
+	msgs, next := history.page(c.ID, req.Recipient, historyQuery{
+		Before:   req.Before,
+		BeforeTS: req.BeforeTS,
+		Limit:    req.Limit,
+		Device:   c.Device,
+	})
+	hub.reply(c, protocol.NewHistoryPage(c.ID, msgs, next))
+	log.Printf("ws: history id=%q with=%q returned=%d", c.ID, req.Recipient, len(msgs))
+}
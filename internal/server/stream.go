@@ -0,0 +1,289 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/marcoantonios1/chat-app/internal/protocol"
+)
+
+// streamConn is one connection over the HTTP fallback: a server-sent
+// event stream carries frames to the client and the client POSTs its
+// frames one at a time.
+type streamConn struct {
+	token  string
+	hello  chan *protocol.Hello // the first POSTed frame, for the handshake
+	cancel context.CancelFunc   // ends the event stream
+
+	mu     sync.Mutex // held while a POSTed frame is handled, to keep order
+	client *Client    // set once the handshake is done
+	limit  *rateLimit
+}
+
+// Close ends the event stream; the hub calls it when it detaches the client.
+func (s *streamConn) Close() error {
+	s.cancel()
+	return nil
+}
+
+var (
+	streamsMu sync.Mutex
+	streams   = make(map[string]*streamConn)
+)
+
+// HandleStream serves the HTTP fallback for clients whose network breaks
+// websocket upgrades:
+//
+//	GET  /stream?id=..&device=..   the connection, as a server-sent event stream
+//	POST /stream/send?stream=..    one JSON frame from the client
+//
+// The event stream opens with a "stream" event naming the stream to POST
+// to, and the client's first POST must be its hello. After that it works
+// like HandleMessage with the JSON encoding: the same device check, hub
+// client, resume numbering (as event ids) and rate limit. The connection
+// ends with the event stream.
+func HandleStream(w http.ResponseWriter, r *http.Request) {
+	if !originAllowed(r) {
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/stream":
+		streamEvents(w, r)
+	case r.Method == http.MethodPost && r.URL.Path == "/stream/send":
+		streamSend(w, r)
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+// streamEvents runs one fallback connection.
+func streamEvents(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		http.Error(w, "missing id query parameter", http.StatusBadRequest)
+		return
+	}
+	device := r.URL.Query().Get("device")
+	if device == "" {
+		device = defaultDevice
+	}
+	if !clientCertOK(w, r, id) {
+		return
+	}
+	if err := admit(id, device, r.URL.Query().Get("device_name"), deviceSecret(r)); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	sc := &streamConn{
+		token:  newStreamToken(),
+		hello:  make(chan *protocol.Hello, 1),
+		cancel: cancel,
+		limit:  newRateLimit(),
+	}
+	streamsMu.Lock()
+	streams[sc.token] = sc
+	streamsMu.Unlock()
+	defer func() {
+		streamsMu.Lock()
+		delete(streams, sc.token)
+		streamsMu.Unlock()
+	}()
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // keep proxies from holding events back
+	w.WriteHeader(http.StatusOK)
+	// event writes one event; an empty name is a frame, a nil data a
+	// keepalive comment
+	event := func(name string, seq int64, data []byte) error {
+		var b bytes.Buffer
+		switch {
+		case data == nil:
+			b.WriteString(": ping\n")
+		case name != "":
+			fmt.Fprintf(&b, "event: %s\n", name)
+		}
+		if seq != 0 {
+			fmt.Fprintf(&b, "id: %d\n", seq)
+		}
+		if data != nil {
+			fmt.Fprintf(&b, "data: %s\n", data)
+		}
+		b.WriteByte('\n')
+		_ = rc.SetWriteDeadline(time.Now().Add(writeWait()))
+		if _, err := w.Write(b.Bytes()); err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
+	if err := event("stream", 0, []byte(sc.token)); err != nil {
+		return
+	}
+
+	var hello *protocol.Hello
+	select {
+	case hello = <-sc.hello:
+	case <-time.After(protocol.HandshakeTimeout):
+		log.Printf("sse: no hello from id=%q device=%q", id, device)
+		return
+	case <-ctx.Done():
+		return
+	}
+	// frames POSTed once the client has the welcome wait for the client
+	sc.mu.Lock()
+	welcome, session, code, reason := accept(hello, id, device)
+	if code != 0 {
+		sc.mu.Unlock()
+		_ = event("refused", 0, []byte(reason))
+		log.Printf("sse: handshake with id=%q device=%q refused (%d): %s", id, device, code, reason)
+		return
+	}
+	defer resumes.release(session)
+	b, err := protocol.Encode(welcome)
+	if err == nil {
+		err = event("", 0, b)
+	}
+	if err != nil {
+		sc.mu.Unlock()
+		log.Printf("sse: handshake with id=%q device=%q failed: %v", id, device, err)
+		return
+	}
+	log.Printf("sse: handshake id=%q software=%q", id, hello.Software)
+
+	client := &Client{ID: id, Device: device, Conn: sc, Send: newSendBuffer()}
+	if !hub.attachClient(client) {
+		sc.mu.Unlock()
+		return
+	}
+	sc.client = client
+	sc.mu.Unlock()
+	log.Printf("sse: client connected id=%q device=%q remote=%s", id, device, r.RemoteAddr)
+
+	// writer: until the hub closes Send, replaying what the client missed
+	// before resuming first. Once the stream is gone frames are only
+	// numbered, and kept in the session for a resume.
+	failed := false
+	fail := func(err error) {
+		if err != nil {
+			log.Printf("sse: write error for id=%q: %v", id, err)
+		}
+		failed = true
+		hub.detachClient(client)
+	}
+	write := func(msg []byte, seq int64) {
+		out, err := protocol.Transcode(msg, seq, protocol.JSON)
+		if err != nil {
+			log.Printf("sse: cannot encode frame for id=%q: %v", id, err)
+			return
+		}
+		if err := event("", seq, out); err != nil {
+			fail(err)
+		}
+	}
+	for _, f := range session.since(hello.LastSeq) {
+		write(f.msg, f.seq)
+	}
+	keepalive := time.NewTicker(pingPeriod())
+	defer keepalive.Stop()
+	done := ctx.Done()
+	for {
+		select {
+		case msg, ok := <-client.Send:
+			if !ok {
+				log.Printf("sse: disconnected id=%q", id)
+				return
+			}
+			seq := session.number(msg)
+			if failed {
+				continue
+			}
+			write(msg, seq)
+			if len(client.Send) == 0 && client.spilled.Load() {
+				hub.requestFlush(client)
+			}
+		case <-keepalive.C:
+			if !failed {
+				if err := event("", 0, nil); err != nil {
+					fail(err)
+				}
+			}
+		case <-done:
+			log.Printf("sse: stream closed for id=%q", id)
+			done = nil
+			fail(nil)
+		}
+	}
+}
+
+// streamSend hands one frame POSTed by the client to its connection.
+// Problems with the frame itself are answered on the event stream, as on
+// a websocket.
+func streamSend(w http.ResponseWriter, r *http.Request) {
+	streamsMu.Lock()
+	sc := streams[r.URL.Query().Get("stream")]
+	streamsMu.Unlock()
+	if sc == nil {
+		http.Error(w, "unknown stream", http.StatusGone)
+		return
+	}
+	msg, err := io.ReadAll(http.MaxBytesReader(w, r.Body, int64(maxMessageSize())))
+	if err != nil {
+		http.Error(w, "frame too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	c := sc.client
+	if c == nil {
+		frame, err := protocol.Decode(msg)
+		hello, ok := frame.(*protocol.Hello)
+		if err != nil || !ok {
+			http.Error(w, "expected a hello frame", http.StatusBadRequest)
+			return
+		}
+		select {
+		case sc.hello <- hello:
+			w.WriteHeader(http.StatusAccepted)
+		default:
+			http.Error(w, "handshake in progress", http.StatusConflict)
+		}
+		return
+	}
+	if c.State() == stateClosed {
+		http.Error(w, "unknown stream", http.StatusGone)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	if !allow(c, sc.limit) {
+		return
+	}
+	frame, err := protocol.Decode(msg)
+	if err != nil {
+		hub.reply(c, protocol.NewError(err.Error()))
+		log.Printf("sse: invalid frame from id=%q: %v", c.ID, err)
+		return
+	}
+	if !handleFrame(c, frame, msg) {
+		hub.detachClient(c)
+	}
+}
+
+func newStreamToken() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
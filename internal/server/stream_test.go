@@ -0,0 +1,264 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/marcoantonios1/chat-app/internal/chatrpc"
+	"github.com/marcoantonios1/chat-app/internal/protocol"
+)
+
+// sseClient is a client of the HTTP fallback.
+type sseClient struct {
+	url, token string
+	events     chan sseEvent
+}
+
+type sseEvent struct {
+	name string
+	id   int64
+	data string
+}
+
+// withLimits runs the rest of the test with the limits set changes.
+func withLimits(t *testing.T, set func(*Limits)) {
+	t.Helper()
+	old := config.Load()
+	cfg := *settings()
+	set(&cfg.Limits)
+	config.Store(&cfg)
+	t.Cleanup(func() { config.Store(old) })
+}
+
+// startStream serves the HTTP fallback until the test ends and returns
+// its URL.
+func startStream(t *testing.T) string {
+	t.Helper()
+	runGlobalHub()
+	srv := httptest.NewServer(http.HandlerFunc(HandleStream))
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+// openStream opens the event stream of id/device. It returns the status
+// of a refused request.
+func openStream(t *testing.T, url, id, device, secret string) (*sseClient, int) {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, url+"/stream?id="+id+"&device="+device, nil)
+	req.Header.Set(chatrpc.MetadataDeviceSecret, secret)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, resp.StatusCode
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	c := &sseClient{url: url, events: make(chan sseEvent, 64)}
+	go func() {
+		defer close(c.events)
+		sc := bufio.NewScanner(resp.Body)
+		var e sseEvent
+		for sc.Scan() {
+			field, value, _ := strings.Cut(sc.Text(), ": ")
+			switch field {
+			case "event":
+				e.name = value
+			case "id":
+				e.id, _ = strconv.ParseInt(value, 10, 64)
+			case "data":
+				e.data = value
+			case "":
+				if e.data != "" {
+					c.events <- e
+				}
+				e = sseEvent{}
+			}
+		}
+	}()
+	if e := c.next(t); e.name != "stream" {
+		t.Fatalf("stream opened with %+v", e)
+	}
+	return c, http.StatusOK
+}
+
+func (c *sseClient) next(t *testing.T) sseEvent {
+	t.Helper()
+	select {
+	case e, ok := <-c.events:
+		if !ok {
+			t.Fatal("event stream closed")
+		}
+		if e.name == "stream" {
+			c.token = e.data
+		}
+		return e
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event")
+	}
+	return sseEvent{}
+}
+
+// frame returns the frame of the next event.
+func (c *sseClient) frame(t *testing.T) (protocol.Frame, int64) {
+	t.Helper()
+	e := c.next(t)
+	f, err := protocol.Decode([]byte(e.data))
+	if err != nil {
+		t.Fatalf("event %+v: %v", e, err)
+	}
+	return f, e.id
+}
+
+// post POSTs f to the stream and returns the response status.
+func (c *sseClient) post(t *testing.T, f protocol.Frame) int {
+	t.Helper()
+	b, err := protocol.Encode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Post(c.url+"/stream/send?stream="+c.token, "application/json", bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+// connectStream opens the stream of id/device and does the handshake.
+func connectStream(t *testing.T, url, id, device, secret string) *sseClient {
+	t.Helper()
+	c, code := openStream(t, url, id, device, secret)
+	if c == nil {
+		t.Fatalf("stream of %s/%s refused with %d", id, device, code)
+	}
+	if code := c.post(t, protocol.NewHello("chat-app/test")); code != http.StatusAccepted {
+		t.Fatalf("hello answered with %d", code)
+	}
+	if f, _ := c.frame(t); f.Kind() != protocol.TypeWelcome {
+		t.Fatalf("handshake answered with %#v", f)
+	}
+	return c
+}
+
+func TestStreamOrder(t *testing.T) {
+	url := startStream(t)
+	forgetUser(t, "sam")
+	if err := registerUser("sam", "s1", "", "ss1"); err != nil {
+		t.Fatal(err)
+	}
+	addUser(t, "wes", "w1")
+	wes := newTestClient("wes", "w1", 16)
+	attach(t, hub, wes)
+	t.Cleanup(func() { hub.detachClient(wes) })
+	sam := connectStream(t, url, "sam", "s1", "ss1")
+
+	// POSTs reach the hub in the order they were made
+	for i := 0; i < settings().Limits.RateBurst; i++ {
+		m := protocol.NewMessage("wes", "", fmt.Sprint("m", i), "00")
+		m.ID, m.Device = "sam", "s1"
+		if code := sam.post(t, m); code != http.StatusAccepted {
+			t.Fatalf("POST %d answered with %d", i, code)
+		}
+	}
+	for i := 0; i < settings().Limits.RateBurst; i++ {
+		f, err := protocol.Decode(receive(t, wes))
+		if m, ok := f.(*protocol.Message); err != nil || !ok || m.MsgID != fmt.Sprint("m", i) {
+			t.Fatalf("wes got %#v as frame %d", f, i)
+		}
+	}
+
+	// and what comes down the event stream is numbered in order
+	for i := 0; i < 5; i++ {
+		deliverTo(t, "wes", "sam", fmt.Sprintf("%02d", i))
+	}
+	var last int64
+	for i := 0; i < 5; {
+		f, seq := sam.frame(t)
+		m, ok := f.(*protocol.Message)
+		if !ok {
+			continue // acks of what sam sent
+		}
+		if m.Body != fmt.Sprintf("%02d", i) || seq <= last || m.Seq != seq {
+			t.Fatalf("event %d: %#v with id %d after %d", i, m, seq, last)
+		}
+		last = seq
+		i++
+	}
+}
+
+func TestStreamRateLimit(t *testing.T) {
+	withLimits(t, func(l *Limits) { l.RateBurst, l.RatePerSec = 3, 0.001 })
+	url := startStream(t)
+	forgetUser(t, "sam")
+	if err := registerUser("sam", "s1", "", "ss1"); err != nil {
+		t.Fatal(err)
+	}
+	addUser(t, "wes", "w1")
+	wes := newTestClient("wes", "w1", 16)
+	attach(t, hub, wes)
+	t.Cleanup(func() { hub.detachClient(wes) })
+	sam := connectStream(t, url, "sam", "s1", "ss1")
+
+	for i := 0; i < 5; i++ {
+		m := protocol.NewMessage("wes", "", fmt.Sprint("m", i), "00")
+		m.ID, m.Device = "sam", "s1"
+		sam.post(t, m)
+	}
+	for i := 0; i < 3; i++ {
+		receive(t, wes)
+	}
+	limited := 0
+	for limited < 2 {
+		f, _ := sam.frame(t)
+		if e, ok := f.(*protocol.Error); ok && strings.Contains(e.Text, "rate limit") {
+			limited++
+		}
+	}
+	select {
+	case msg := <-wes.Send:
+		t.Fatalf("wes got a frame over the limit: %s", msg)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestStreamRefusals(t *testing.T) {
+	url := startStream(t)
+	forgetUser(t, "sam")
+	if err := registerUser("sam", "s1", "", "ss1"); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		what, id, device, secret string
+	}{
+		{"an unknown user", "mallory", "m1", "s"},
+		{"a new device", "sam", "s2", "ss2"},
+		{"the device again", "sam", "s2", "ss2"},
+		{"a wrong secret", "sam", "s1", "ss2"},
+		{"no secret", "sam", "s1", ""},
+	} {
+		if _, code := openStream(t, url, c.id, c.device, c.secret); code != http.StatusForbidden {
+			t.Fatalf("stream of %s answered with %d", c.what, code)
+		}
+	}
+	if isApprovedDevice("sam", "s2") {
+		t.Fatal("a new device was approved")
+	}
+
+	c, _ := openStream(t, url, "sam", "s1", "ss1")
+	if code := c.post(t, protocol.NewAck("wes", "m1", protocol.StatusRead)); code != http.StatusBadRequest {
+		t.Fatalf("a frame before the hello answered with %d", code)
+	}
+	c.token = "nope"
+	if code := c.post(t, protocol.NewHello("chat-app/test")); code != http.StatusGone {
+		t.Fatalf("POST to an unknown stream answered with %d", code)
+	}
+}
@@ -0,0 +1,213 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	errClientCertRequired = errors.New("client certificate required")
+	errClientCertMismatch = errors.New("client certificate is not for this id")
+)
+
+// TLSConfig configures TLS for every listener: HTTPS, gRPC and QUIC.
+type TLSConfig struct {
+	CertFile string `yaml:"cert"`
+	KeyFile  string `yaml:"key"`
+	// Dev creates a self-signed certificate in CertFile and KeyFile when
+	// neither exists.
+	Dev bool `yaml:"dev"`
+	// ClientCAFile enables mutual TLS: client certificates are verified
+	// against this PEM bundle and must be for the id they connect as.
+	ClientCAFile string `yaml:"client_ca"`
+	// RequireClientCert turns away users without a client certificate.
+	// Federation peers and /health never need one.
+	RequireClientCert bool `yaml:"require_client_cert"`
+	// ClientIDs maps certificate identities (common name, DNS, email or
+	// URI name) to user ids. A certificate without a mapped identity is
+	// for the user named by its common name.
+	ClientIDs map[string]string `yaml:"client_ids"`
+}
+
+// clientCertPolicy is how user connections are checked against their
+// client certificate; nil without mutual TLS.
+type clientCertPolicy struct {
+	require bool
+	ids     map[string]string
+}
+
+var clientCerts *clientCertPolicy
+
+// ConfigureTLS loads the certificate and client CA in cfg and returns the
+// server side TLS configuration.
+func ConfigureTLS(cfg TLSConfig) (*tls.Config, error) {
+	if cfg.CertFile == "" || cfg.KeyFile == "" {
+		return nil, errors.New("a certificate and key file are required")
+	}
+	var hosts []string
+	if cfg.Dev {
+		if h, err := os.Hostname(); err == nil {
+			hosts = append(hosts, h)
+		}
+	}
+	cert, err := loadCertificate(cfg.CertFile, cfg.KeyFile, cfg.Dev, hosts...)
+	if err != nil {
+		return nil, err
+	}
+	conf := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if cfg.ClientCAFile == "" {
+		if cfg.RequireClientCert {
+			return nil, errors.New("requiring client certificates needs a client CA")
+		}
+		return conf, nil
+	}
+	pemBytes, err := os.ReadFile(cfg.ClientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pemBytes) {
+		return nil, fmt.Errorf("no certificates in %s", cfg.ClientCAFile)
+	}
+	// checked per user connection by checkClientCert, so federation and
+	// health checks still get through
+	conf.ClientAuth = tls.VerifyClientCertIfGiven
+	conf.ClientCAs = pool
+	clientCerts = &clientCertPolicy{require: cfg.RequireClientCert, ids: cfg.ClientIDs}
+	return conf, nil
+}
+
+// ParseClientID parses a --tls-client-id value: identity=id.
+func ParseClientID(s string) (identity, id string, err error) {
+	identity, id, ok := strings.Cut(s, "=")
+	if !ok || identity == "" || id == "" {
+		return "", "", fmt.Errorf("invalid client id mapping %q, want identity=id", s)
+	}
+	return identity, id, nil
+}
+
+// LoadCertificate loads the key pair in certFile and keyFile. If neither
+// file exists it creates a self-signed certificate for localhost there
+// first, which clients have to be told to trust.
+func LoadCertificate(certFile, keyFile string) (tls.Certificate, error) {
+	return loadCertificate(certFile, keyFile, true)
+}
+
+func loadCertificate(certFile, keyFile string, create bool, hosts ...string) (tls.Certificate, error) {
+	_, certErr := os.Stat(certFile)
+	_, keyErr := os.Stat(keyFile)
+	if create && errors.Is(certErr, os.ErrNotExist) && errors.Is(keyErr, os.ErrNotExist) {
+		if err := writeSelfSigned(certFile, keyFile, hosts); err != nil {
+			return tls.Certificate{}, err
+		}
+		log.Printf("tls: created a self-signed certificate in %s", certFile)
+	}
+	return tls.LoadX509KeyPair(certFile, keyFile)
+}
+
+func writeSelfSigned(certFile, keyFile string, hosts []string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "chatapp server"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(1, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else if h != "" {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		return err
+	}
+	return os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644)
+}
+
+// certUser returns the user id a verified client certificate is for.
+func (p *clientCertPolicy) certUser(cert *x509.Certificate) string {
+	identities := []string{cert.Subject.CommonName}
+	identities = append(identities, cert.DNSNames...)
+	identities = append(identities, cert.EmailAddresses...)
+	for _, u := range cert.URIs {
+		identities = append(identities, u.String())
+	}
+	for _, name := range identities {
+		if id, ok := p.ids[name]; ok && name != "" {
+			return id
+		}
+	}
+	return cert.Subject.CommonName
+}
+
+// checkClientCert checks that the client on a connection with state cs
+// may act as id under mutual TLS.
+func checkClientCert(cs *tls.ConnectionState, id string) error {
+	p := clientCerts
+	if p == nil {
+		return nil
+	}
+	if cs == nil || len(cs.VerifiedChains) == 0 {
+		if p.require {
+			return errClientCertRequired
+		}
+		return nil
+	}
+	if p.certUser(cs.VerifiedChains[0][0]) != id {
+		return errClientCertMismatch
+	}
+	return nil
+}
+
+// clientCertOK answers r with an error unless its client certificate
+// allows acting as id.
+func clientCertOK(w http.ResponseWriter, r *http.Request, id string) bool {
+	err := checkClientCert(r.TLS, id)
+	switch err {
+	case nil:
+		return true
+	case errClientCertRequired:
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+	default:
+		http.Error(w, err.Error(), http.StatusForbidden)
+	}
+	log.Printf("tls: refused %s as id=%q: %v", r.RemoteAddr, id, err)
+	return false
+}
@@ -1,23 +1,110 @@
 package server
 
 import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
 	"net/http"
+	"sort"
 	"sync"
+	"time"
+
+	"github.com/marcoantonios1/chat-app/internal/chatrpc"
+)
+
+// defaultDevice is used for clients that do not identify a device.
+const defaultDevice = "default"
+
+// A user can have at most maxPendingDevices devices awaiting approval,
+// and a new one at most every deviceRequestInterval, since each asks the
+// user's approved devices to link it.
+const (
+	maxPendingDevices     = 5
+	deviceRequestInterval = 10 * time.Second
+)
+
+// device states
+const (
+	devicePending  = "pending"
+	deviceApproved = "approved"
+	deviceRevoked  = "revoked"
+)
+
+var (
+	errIDTaken         = errors.New("id already taken")
+	errUnknownUser     = errors.New("id not registered")
+	errUnknownDevice   = errors.New("unknown device")
+	errDevicePending   = errors.New("device pending approval")
+	errDeviceRevoked   = errors.New("device revoked")
+	errNotApprovedPeer = errors.New("acting device is not an approved device of this id")
+	errNoSecret        = errors.New("missing device secret")
+	errWrongSecret     = errors.New("wrong device secret")
+	errTooManyPending  = errors.New("too many devices pending approval; approve or revoke them from a linked device")
+	errDeviceRequests  = errors.New("new devices are requested too often, try again later")
 )
 
 type registerRequest struct {
-	ID string `json:"id"`
+	ID         string `json:"id"`
+	Device     string `json:"device,omitempty"`
+	DeviceName string `json:"device_name,omitempty"`
+}
+
+// Device is one linked device of a user. Each device holds its own keys,
+// and proves it is the device with the secret it chose when it was first
+// seen: device IDs are stamped on frames and history, so anyone may know
+// them.
+type Device struct {
+	ID       string    `json:"id"`
+	Name     string    `json:"name,omitempty"`
+	Status   string    `json:"status"`
+	Created  time.Time `json:"created"`
+	LastSeen time.Time `json:"last_seen,omitempty"`
+	// SecretHash is the SHA-256 of the device secret. It is shared with
+	// the other instances but never listed.
+	SecretHash string `json:"secret_hash,omitempty"`
+}
+
+// hashSecret returns the SecretHash of secret.
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// checkSecret reports whether secret is d's.
+func (d *Device) checkSecret(secret string) error {
+	if secret == "" {
+		return errNoSecret
+	}
+	if subtle.ConstantTimeCompare([]byte(hashSecret(secret)), []byte(d.SecretHash)) != 1 {
+		return errWrongSecret
+	}
+	return nil
+}
+
+// deviceSecret returns the device secret of an HTTP request.
+func deviceSecret(r *http.Request) string {
+	return r.Header.Get(chatrpc.MetadataDeviceSecret)
+}
+
+type userRecord struct {
+	devices map[string]*Device
+	// when a device last asked to be linked
+	lastRequest time.Time
 }
 
 var (
-	users   = make(map[string]bool)
-	usersMu sync.Mutex
+	users   = make(map[string]*userRecord)
+	usersMu sync.RWMutex
 )
 
-// HandleRegister accepts POST {"id":"..."} and registers the id if available.
-// Returns 201 on success, 409 if id already taken.
+// HandleRegister accepts POST {"id":"...","device":"..."} and registers the id
+// if available. The registering device (if given) becomes the first approved
+// device, with the secret in the Chat-Device-Secret header. Returns 201 on
+// success, 409 if id already taken.
 func HandleRegister(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
@@ -30,22 +117,348 @@ func HandleRegister(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	usersMu.Lock()
-	defer usersMu.Unlock()
-	if users[req.ID] {
-		http.Error(w, "id already taken", http.StatusConflict)
+	if !clientCertOK(w, r, req.ID) {
+		return
+	}
+	if err := registerUser(req.ID, req.Device, req.DeviceName, deviceSecret(r)); err != nil {
+		code := http.StatusBadRequest
+		if err == errIDTaken {
+			code = http.StatusConflict
+		}
+		http.Error(w, err.Error(), code)
 		return
 	}
-	users[req.ID] = true
 
 	w.WriteHeader(http.StatusCreated)
 	w.Write([]byte("ok"))
 	fmt.Println("🆕 Registered user:", req.ID)
 }
 
+// registerUser claims id. The registering device (if given) becomes the
+// first approved device, with secret.
+func registerUser(id, device, deviceName, secret string) error {
+	if device != "" && secret == "" {
+		return errNoSecret
+	}
+	usersMu.Lock()
+	if users[id] != nil {
+		usersMu.Unlock()
+		return errIDTaken
+	}
+	u := &userRecord{devices: make(map[string]*Device)}
+	var first *Device
+	if device != "" {
+		first = &Device{ID: device, Name: deviceName, Status: deviceApproved, Created: time.Now(), SecretHash: hashSecret(secret)}
+		u.devices[device] = first
+	}
+	users[id] = u
+	usersMu.Unlock()
+	announceDevice(id, first)
+	emitWebhook(WebhookEvent{Type: EventUserRegistered, User: id, Device: device})
+	return nil
+}
+
 // IsRegistered returns whether an id is present (helpful for server logic).
 func IsRegistered(id string) bool {
+	usersMu.RLock()
+	defer usersMu.RUnlock()
+	return users[id] != nil
+}
+
+// admitDevice decides whether device may connect as id with secret. The
+// first device of a user is approved automatically; any later unknown
+// device is recorded as pending, with its secret, and must be approved from
+// an existing device, unless the user has too many pending already or
+// asked for one too recently. The returned bool reports whether a new
+// pending request was created.
+func admitDevice(id, dev, name, secret string) (bool, error) {
+	if secret == "" {
+		return false, errNoSecret
+	}
 	usersMu.Lock()
+	u := users[id]
+	if u == nil {
+		usersMu.Unlock()
+		return false, errUnknownUser
+	}
+	d, ok := u.devices[dev]
+	if !ok {
+		status := devicePending
+		if len(u.devices) == 0 {
+			status = deviceApproved
+		} else if err := u.canRequest(); err != nil {
+			usersMu.Unlock()
+			return false, err
+		}
+		d = &Device{ID: dev, Name: name, Status: status, Created: time.Now(), SecretHash: hashSecret(secret)}
+		u.devices[dev] = d
+		created := *d
+		usersMu.Unlock()
+		announceDevice(id, &created)
+		if status == devicePending {
+			return true, errDevicePending
+		}
+		return false, nil
+	}
 	defer usersMu.Unlock()
-	return users[id]
+	if err := d.checkSecret(secret); err != nil {
+		return false, err
+	}
+	switch d.Status {
+	case devicePending:
+		return false, errDevicePending
+	case deviceRevoked:
+		return false, errDeviceRevoked
+	}
+	d.LastSeen = time.Now()
+	return false, nil
+}
+
+// canRequest reports whether another device may ask to be linked to u,
+// and counts the request if so. The caller holds usersMu.
+func (u *userRecord) canRequest() error {
+	pending := 0
+	for _, d := range u.devices {
+		if d.Status == devicePending {
+			pending++
+		}
+	}
+	if pending >= maxPendingDevices {
+		return errTooManyPending
+	}
+	now := time.Now()
+	if now.Sub(u.lastRequest) < deviceRequestInterval {
+		return errDeviceRequests
+	}
+	u.lastRequest = now
+	return nil
+}
+
+// approvedDevices returns the ids of id's approved devices.
+func approvedDevices(id string) []string {
+	usersMu.RLock()
+	defer usersMu.RUnlock()
+	u := users[id]
+	if u == nil {
+		return nil
+	}
+	out := make([]string, 0, len(u.devices))
+	for _, d := range u.devices {
+		if d.Status == deviceApproved {
+			out = append(out, d.ID)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// isApprovedDevice reports whether dev is an approved device of id.
+func isApprovedDevice(id, dev string) bool {
+	usersMu.RLock()
+	defer usersMu.RUnlock()
+	u := users[id]
+	if u == nil {
+		return false
+	}
+	d, ok := u.devices[dev]
+	return ok && d.Status == deviceApproved
+}
+
+// authDevice checks that dev is an approved device of id and that secret
+// is its secret, for requests made outside a connection.
+func authDevice(id, dev, secret string) error {
+	usersMu.RLock()
+	defer usersMu.RUnlock()
+	u := users[id]
+	if u == nil {
+		return errUnknownUser
+	}
+	return u.authorize(dev, secret)
+}
+
+// authorize checks that dev is one of u's approved devices and that secret
+// is its secret. The caller holds usersMu.
+func (u *userRecord) authorize(dev, secret string) error {
+	d, ok := u.devices[dev]
+	if !ok {
+		return errNotApprovedPeer
+	}
+	if err := d.checkSecret(secret); err != nil {
+		return err
+	}
+	if d.Status != deviceApproved {
+		return errNotApprovedPeer
+	}
+	return nil
+}
+
+// listDevices returns every device of id, oldest first.
+func listDevices(id string) ([]Device, error) {
+	usersMu.RLock()
+	defer usersMu.RUnlock()
+	u := users[id]
+	if u == nil {
+		return nil, errUnknownUser
+	}
+	out := make([]Device, 0, len(u.devices))
+	for _, d := range u.devices {
+		listed := *d
+		listed.SecretHash = ""
+		out = append(out, listed)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Created.Before(out[j].Created) })
+	return out, nil
+}
+
+// setDeviceStatus changes target's status on behalf of the approved device
+// actor, which proves itself with its secret.
+func setDeviceStatus(id, actor, secret, target, status string) error {
+	usersMu.Lock()
+	u := users[id]
+	if u == nil {
+		usersMu.Unlock()
+		return errUnknownUser
+	}
+	if err := u.authorize(actor, secret); err != nil {
+		usersMu.Unlock()
+		return err
+	}
+	d, ok := u.devices[target]
+	if !ok {
+		usersMu.Unlock()
+		return errUnknownDevice
+	}
+	if status == deviceApproved && d.Status == deviceRevoked {
+		usersMu.Unlock()
+		return errDeviceRevoked
+	}
+	d.Status = status
+	changed := *d
+	usersMu.Unlock()
+	announceDevice(id, &changed)
+	return nil
+}
+
+// announceDevice tells the other instances about a new user (d == nil) or a
+// changed device record.
+func announceDevice(id string, d *Device) {
+	_ = hub.publish(BackplaneMessage{Kind: bpDevice, User: id, Record: d})
+}
+
+// upsertDevice applies a user or device record received from another
+// instance. A record without an ID only registers the user.
+func upsertDevice(id string, d Device) {
+	usersMu.Lock()
+	defer usersMu.Unlock()
+	u := users[id]
+	if u == nil {
+		u = &userRecord{devices: make(map[string]*Device)}
+		users[id] = u
+	}
+	if d.ID == "" {
+		return
+	}
+	if existing, ok := u.devices[d.ID]; ok && existing.Status == deviceRevoked {
+		// revocation is final everywhere
+		return
+	}
+	u.devices[d.ID] = &d
+}
+
+type userDevice struct {
+	user   string
+	device Device
+}
+
+// deviceRecords returns every user and device, for bringing a new instance
+// up to date. Users without devices have an empty device.
+func deviceRecords() []userDevice {
+	usersMu.RLock()
+	defer usersMu.RUnlock()
+	var out []userDevice
+	for id, u := range users {
+		if len(u.devices) == 0 {
+			out = append(out, userDevice{user: id})
+		}
+		for _, d := range u.devices {
+			out = append(out, userDevice{user: id, device: *d})
+		}
+	}
+	return out
+}
+
+type deviceRequest struct {
+	ID     string `json:"id"`
+	Device string `json:"device"` // acting (approved) device
+	Target string `json:"target"`
+}
+
+// HandleDevices serves GET /devices?id=..&device=.. (list), and
+// POST /devices/approve and /devices/revoke with a deviceRequest body. Every
+// request must come from an approved device of the id, with its secret in
+// the Chat-Device-Secret header.
+func HandleDevices(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/devices":
+		id, dev := r.URL.Query().Get("id"), r.URL.Query().Get("device")
+		if id == "" || dev == "" {
+			http.Error(w, "missing id or device query parameter", http.StatusBadRequest)
+			return
+		}
+		if !clientCertOK(w, r, id) {
+			return
+		}
+		if err := authDevice(id, dev, deviceSecret(r)); err != nil {
+			http.Error(w, err.Error(), deviceErrorCode(err))
+			return
+		}
+		devices, err := listDevices(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(devices)
+
+	case r.Method == http.MethodPost && (r.URL.Path == "/devices/approve" || r.URL.Path == "/devices/revoke"):
+		var req deviceRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ID == "" || req.Device == "" || req.Target == "" {
+			http.Error(w, "invalid body", http.StatusBadRequest)
+			return
+		}
+		if !clientCertOK(w, r, req.ID) {
+			return
+		}
+		status := deviceApproved
+		if r.URL.Path == "/devices/revoke" {
+			status = deviceRevoked
+		}
+		if err := setDeviceStatus(req.ID, req.Device, deviceSecret(r), req.Target, status); err != nil {
+			http.Error(w, err.Error(), deviceErrorCode(err))
+			return
+		}
+		if status == deviceRevoked {
+			hub.kickDevice(deviceRef{id: req.ID, device: req.Target})
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ok"))
+		log.Printf("devices: %s id=%q device=%q by device=%q", status, req.ID, req.Target, req.Device)
+
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+// deviceErrorCode is the HTTP status for an error of authDevice or
+// setDeviceStatus.
+func deviceErrorCode(err error) int {
+	switch err {
+	case errNoSecret, errWrongSecret:
+		return http.StatusUnauthorized
+	case errNotApprovedPeer:
+		return http.StatusForbidden
+	case errUnknownUser, errUnknownDevice:
+		return http.StatusNotFound
+	}
+	return http.StatusBadRequest
 }
@@ -0,0 +1,170 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/marcoantonios1/chat-app/internal/chatrpc"
+	"github.com/marcoantonios1/chat-app/internal/protocol"
+)
+
+// allowRequest lets id's next device ask to be linked right away.
+func allowRequest(id string) {
+	usersMu.Lock()
+	users[id].lastRequest = time.Time{}
+	usersMu.Unlock()
+}
+
+func TestAdmitDevice(t *testing.T) {
+	runGlobalHub()
+	addUser(t, "dana")
+	if err := admit("dana", "a1", "laptop", "s1"); err != nil {
+		t.Fatalf("first device: %v", err)
+	}
+	for _, c := range []struct {
+		id, dev, secret string
+		want            error
+	}{
+		{"mallory", "m1", "s", errUnknownUser},
+		{"dana", "a1", "", errNoSecret},
+		{"dana", "a1", "s2", errWrongSecret},
+		{"dana", "a1", "s1", nil},
+	} {
+		if err := admit(c.id, c.dev, "", c.secret); err != c.want {
+			t.Fatalf("admit %s/%s with %q: err = %v, want %v", c.id, c.dev, c.secret, err, c.want)
+		}
+	}
+
+	// a new device waits for approval, and the approved one is asked to link
+	// it
+	a1 := newTestClient("dana", "a1", 8)
+	attach(t, hub, a1)
+	t.Cleanup(func() { hub.detachClient(a1) })
+	if err := admit("dana", "a2", "phone", "s2"); err != errDevicePending {
+		t.Fatalf("new device: err = %v, want %v", err, errDevicePending)
+	}
+	f, err := protocol.Decode(receive(t, a1))
+	if link, ok := f.(*protocol.DeviceLink); err != nil || !ok || link.Device != "a2" || link.DeviceName != "phone" {
+		t.Fatalf("a1 got %#v, %v; want a link request for a2", f, err)
+	}
+	if err := admit("dana", "a2", "phone", "s2"); err != errDevicePending {
+		t.Fatalf("pending device again: err = %v, want %v", err, errDevicePending)
+	}
+	if err := admit("dana", "a3", "", "s3"); err != errDeviceRequests {
+		t.Fatalf("second new device right away: err = %v, want %v", err, errDeviceRequests)
+	}
+	select {
+	case msg := <-a1.Send:
+		t.Fatalf("a1 got another push: %s", msg)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	// only an approved device with its secret may approve or revoke
+	if err := setDeviceStatus("dana", "a2", "s2", "a2", deviceApproved); err != errNotApprovedPeer {
+		t.Fatalf("pending device approving itself: err = %v", err)
+	}
+	if err := setDeviceStatus("dana", "a1", "s2", "a2", deviceApproved); err != errWrongSecret {
+		t.Fatalf("approving with the wrong secret: err = %v", err)
+	}
+	if err := setDeviceStatus("dana", "a1", "s1", "a9", deviceApproved); err != errUnknownDevice {
+		t.Fatalf("approving an unknown device: err = %v", err)
+	}
+	if err := setDeviceStatus("dana", "a1", "s1", "a2", deviceApproved); err != nil {
+		t.Fatal(err)
+	}
+	if err := admit("dana", "a2", "", "s2"); err != nil {
+		t.Fatalf("approved device: %v", err)
+	}
+	if err := authDevice("dana", "a2", "s2"); err != nil {
+		t.Fatalf("authDevice: %v", err)
+	}
+
+	if err := setDeviceStatus("dana", "a1", "s1", "a2", deviceRevoked); err != nil {
+		t.Fatal(err)
+	}
+	if err := admit("dana", "a2", "", "s2"); err != errDeviceRevoked {
+		t.Fatalf("revoked device: err = %v, want %v", err, errDeviceRevoked)
+	}
+	if err := setDeviceStatus("dana", "a1", "s1", "a2", deviceApproved); err != errDeviceRevoked {
+		t.Fatalf("approving a revoked device: err = %v, want %v", err, errDeviceRevoked)
+	}
+	if err := authDevice("dana", "a2", "s2"); err != errNotApprovedPeer {
+		t.Fatalf("authDevice of a revoked device: err = %v", err)
+	}
+}
+
+func TestAdmitDeviceCapsPending(t *testing.T) {
+	runGlobalHub()
+	addUser(t, "erin")
+	if err := admit("erin", "a1", "", "s1"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < maxPendingDevices; i++ {
+		allowRequest("erin")
+		if err := admit("erin", fmt.Sprint("p", i), "", "s"); err != errDevicePending {
+			t.Fatalf("pending device %d: err = %v", i, err)
+		}
+	}
+	allowRequest("erin")
+	if err := admit("erin", "extra", "", "s"); err != errTooManyPending {
+		t.Fatalf("device over the cap: err = %v, want %v", err, errTooManyPending)
+	}
+	if devices, _ := listDevices("erin"); len(devices) != maxPendingDevices+1 {
+		t.Fatalf("%d devices recorded, want %d", len(devices), maxPendingDevices+1)
+	}
+
+	// revoking one makes room
+	if err := setDeviceStatus("erin", "a1", "s1", "p0", deviceRevoked); err != nil {
+		t.Fatal(err)
+	}
+	if err := admit("erin", "extra", "", "s"); !errors.Is(err, errDevicePending) {
+		t.Fatalf("device after a revocation: err = %v, want %v", err, errDevicePending)
+	}
+}
+
+func TestHandleDevices(t *testing.T) {
+	runGlobalHub()
+	addUser(t, "fay")
+	_ = admit("fay", "a1", "laptop", "s1")
+	_ = admit("fay", "a2", "phone", "s2")
+
+	do := func(method, path, secret, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		if secret != "" {
+			r.Header.Set(chatrpc.MetadataDeviceSecret, secret)
+		}
+		w := httptest.NewRecorder()
+		HandleDevices(w, r)
+		return w
+	}
+	for _, c := range []struct {
+		method, path, secret, body string
+		want                       int
+	}{
+		{"GET", "/devices?id=fay&device=a1", "", "", http.StatusUnauthorized},
+		{"GET", "/devices?id=fay&device=a1", "s2", "", http.StatusUnauthorized},
+		{"GET", "/devices?id=fay&device=a2", "s2", "", http.StatusForbidden},
+		{"GET", "/devices?id=bob&device=b1", "s", "", http.StatusNotFound},
+		{"GET", "/devices?id=fay", "s1", "", http.StatusBadRequest},
+		{"POST", "/devices/approve", "s2", `{"id":"fay","device":"a2","target":"a2"}`, http.StatusForbidden},
+		{"POST", "/devices/approve", "s1", `{"id":"fay","device":"a1"}`, http.StatusBadRequest},
+		{"POST", "/devices/approve", "s1", `{"id":"fay","device":"a1","target":"a2"}`, http.StatusOK},
+	} {
+		if w := do(c.method, c.path, c.secret, c.body); w.Code != c.want {
+			t.Fatalf("%s %s: %d %s, want %d", c.method, c.path, w.Code, w.Body, c.want)
+		}
+	}
+
+	w := do("GET", "/devices?id=fay&device=a2", "s2", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("list from the approved device: %d %s", w.Code, w.Body)
+	}
+	if body := w.Body.String(); strings.Contains(body, "secret") || !strings.Contains(body, `"status":"approved"`) {
+		t.Fatalf("list %s", body)
+	}
+}
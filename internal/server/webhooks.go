@@ -0,0 +1,436 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Webhook event types.
+const (
+	EventUserRegistered = "user.registered"
+	EventUserOnline     = "user.online"    // a device of the user connected
+	EventMessageQueued  = "message.queued" // no device of the recipient was online
+)
+
+const (
+	// an event is given up after this many failed attempts
+	webhookMaxAttempts = 6
+	// longest wait between attempts
+	webhookMaxBackoff = time.Minute
+	// events waiting for one subscription
+	maxWebhookQueue = 10000
+	// deliveries kept per subscription for GET /webhooks/deliveries
+	webhookHistorySize = 1000
+
+	// delivery statuses
+	webhookPending   = "pending"
+	webhookDelivered = "delivered"
+	webhookFailed    = "failed"
+
+	// webhook request headers; the signature is "sha256=" and the hex HMAC
+	// of the timestamp, a dot and the body, keyed with the subscription's
+	// secret
+	headerWebhookEvent     = "X-Chat-Event"
+	headerWebhookDelivery  = "X-Chat-Delivery"
+	headerWebhookTimestamp = "X-Chat-Timestamp"
+	headerWebhookSignature = "X-Chat-Signature"
+)
+
+var webhookEventTypes = map[string]bool{EventUserRegistered: true, EventUserOnline: true, EventMessageQueued: true}
+
+var (
+	// webhookBackoff is the wait after the first failed attempt; it
+	// doubles with every retry.
+	webhookBackoff = time.Second
+
+	errUnknownWebhook = errors.New("no webhook with this secret")
+)
+
+// WebhookConfig is one webhook subscription.
+type WebhookConfig struct {
+	URL string
+	// Secret keys the HMAC signature of every request.
+	Secret string
+	// Events lists the event types to send; empty sends all of them.
+	Events []string
+}
+
+// ParseWebhook parses a subscription written as [event,event=]url#secret.
+func ParseWebhook(s string) (WebhookConfig, error) {
+	var cfg WebhookConfig
+	if events, rest, ok := strings.Cut(s, "="); ok && !strings.Contains(events, "/") {
+		cfg.Events = strings.Split(events, ",")
+		s = rest
+	}
+	i := strings.LastIndex(s, "#")
+	if i < 0 {
+		return cfg, fmt.Errorf("webhook %q has no #secret", s)
+	}
+	cfg.URL, cfg.Secret = s[:i], s[i+1:]
+	return cfg, nil
+}
+
+// WebhookEvent is the JSON body of a webhook request. It carries metadata
+// only, never message bodies.
+type WebhookEvent struct {
+	ID       string    `json:"id"`
+	Type     string    `json:"type"`
+	Time     time.Time `json:"time"`
+	Instance string    `json:"instance"`
+	// User is who the event is about: the new or connecting user, or the
+	// recipient of a queued message.
+	User   string `json:"user"`
+	Device string `json:"device,omitempty"`
+	// From and MsgID identify a queued message.
+	From  string `json:"from,omitempty"`
+	MsgID string `json:"msg_id,omitempty"`
+}
+
+// WebhookDelivery is the state of one event sent to one subscription.
+type WebhookDelivery struct {
+	Event     WebhookEvent `json:"event"`
+	URL       string       `json:"url"`
+	Status    string       `json:"status"` // pending, delivered or failed
+	Attempts  int          `json:"attempts"`
+	LastError string       `json:"last_error,omitempty"`
+	Updated   time.Time    `json:"updated"`
+}
+
+type webhookSub struct {
+	cfg    WebhookConfig
+	events map[string]bool // nil: all
+	wake   chan struct{}
+
+	mu      sync.Mutex
+	queue   []*WebhookDelivery
+	history []*WebhookDelivery // oldest first
+}
+
+type webhookDispatcher struct {
+	subs       []*webhookSub
+	client     *http.Client
+	backoff    time.Duration
+	hub        *Hub
+	deadLetter string
+	deadQueue  chan WebhookDelivery // waiting to be appended to deadLetter
+}
+
+// webhooks is nil unless ConfigureWebhooks was called with subscriptions.
+var webhooks *webhookDispatcher
+
+// ConfigureWebhooks starts sending events to subs. Events that can't be
+// delivered are appended to deadLetterFile as JSON lines, unless it is
+// empty. It must be called before the server starts accepting connections.
+func ConfigureWebhooks(subs []WebhookConfig, deadLetterFile string) error {
+	if len(subs) == 0 {
+		return nil
+	}
+	d, err := newWebhookDispatcher(subs, deadLetterFile, hub)
+	if err != nil {
+		return err
+	}
+	d.start()
+	webhooks = d
+	return nil
+}
+
+func newWebhookDispatcher(subs []WebhookConfig, deadLetterFile string, h *Hub) (*webhookDispatcher, error) {
+	d := &webhookDispatcher{
+		client:     &http.Client{Timeout: 10 * time.Second},
+		backoff:    webhookBackoff,
+		hub:        h,
+		deadLetter: deadLetterFile,
+		deadQueue:  make(chan WebhookDelivery, maxWebhookQueue),
+	}
+	for _, cfg := range subs {
+		u, err := url.Parse(cfg.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid webhook URL %q", cfg.URL)
+		}
+		if cfg.Secret == "" {
+			return nil, fmt.Errorf("webhook %s has no secret", cfg.URL)
+		}
+		sub := &webhookSub{cfg: cfg, wake: make(chan struct{}, 1)}
+		for _, e := range cfg.Events {
+			if !webhookEventTypes[e] {
+				return nil, fmt.Errorf("unknown webhook event %q", e)
+			}
+			if sub.events == nil {
+				sub.events = make(map[string]bool)
+			}
+			sub.events[e] = true
+		}
+		d.subs = append(d.subs, sub)
+	}
+	return d, nil
+}
+
+// start runs the subscriptions and the dead-letter log until the hub
+// stops.
+func (d *webhookDispatcher) start() {
+	for _, sub := range d.subs {
+		go sub.run(d)
+	}
+	go d.writeDeadLetters()
+}
+
+// emitWebhook queues e for every subscription that wants it. It never
+// blocks.
+func emitWebhook(e WebhookEvent) {
+	if webhooks != nil {
+		webhooks.emit(e)
+	}
+}
+
+func (d *webhookDispatcher) emit(e WebhookEvent) {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	e.ID, e.Time, e.Instance = hex.EncodeToString(b), time.Now().UTC(), d.hub.backplane.Instance()
+	for _, sub := range d.subs {
+		if sub.events == nil || sub.events[e.Type] {
+			sub.push(d, e)
+		}
+	}
+}
+
+func (s *webhookSub) push(d *webhookDispatcher, e WebhookEvent) {
+	del := &WebhookDelivery{Event: e, URL: s.cfg.URL, Status: webhookPending, Updated: e.Time}
+	s.mu.Lock()
+	full := len(s.queue) >= maxWebhookQueue
+	if full {
+		del.Status, del.LastError = webhookFailed, "too many events waiting"
+	} else {
+		s.queue = append(s.queue, del)
+	}
+	s.history = append(s.history, del)
+	if len(s.history) > webhookHistorySize {
+		s.history = s.history[len(s.history)-webhookHistorySize:]
+	}
+	s.mu.Unlock()
+	if full {
+		d.dead(*del)
+		return
+	}
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *webhookSub) head() *WebhookDelivery {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.queue) == 0 {
+		return nil
+	}
+	return s.queue[0]
+}
+
+// done records the outcome of an attempt at del, the head of the queue,
+// and takes it off the queue unless it is to be retried. It returns a
+// copy of del.
+func (s *webhookSub) done(del *WebhookDelivery, status string, err error) WebhookDelivery {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	del.Attempts++
+	del.Status, del.Updated = status, time.Now().UTC()
+	if err != nil {
+		del.LastError = err.Error()
+	}
+	if status != webhookPending {
+		s.queue = s.queue[1:]
+	}
+	return *del
+}
+
+// run delivers the subscription's events in order, backing off while its
+// endpoint fails.
+func (s *webhookSub) run(d *webhookDispatcher) {
+	backoff := d.backoff
+	for {
+		del := s.head()
+		if del == nil {
+			select {
+			case <-s.wake:
+				continue
+			case <-d.hub.shutdown:
+				return
+			}
+		}
+		permanent, err := d.post(s.cfg, del.Event)
+		if err == nil {
+			s.done(del, webhookDelivered, nil)
+			backoff = d.backoff
+			continue
+		}
+		if permanent || del.Attempts+1 >= webhookMaxAttempts {
+			failed := s.done(del, webhookFailed, err)
+			log.Printf("webhook: giving up on %s event %s for %s after %d attempts: %v", del.Event.Type, del.Event.ID, s.cfg.URL, failed.Attempts, err)
+			d.dead(failed)
+			backoff = d.backoff
+			continue
+		}
+		s.done(del, webhookPending, err)
+		log.Printf("webhook: %s failed (%v), retrying in %s", s.cfg.URL, err, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-d.hub.shutdown:
+			return
+		}
+		if backoff *= 2; backoff > webhookMaxBackoff {
+			backoff = webhookMaxBackoff
+		}
+	}
+}
+
+// post sends e to the subscription. permanent reports failures that
+// retrying will not fix.
+func (d *webhookDispatcher) post(cfg WebhookConfig, e WebhookEvent) (permanent bool, err error) {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return true, err
+	}
+	req, err := http.NewRequest(http.MethodPost, cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return true, err
+	}
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(headerWebhookEvent, e.Type)
+	req.Header.Set(headerWebhookDelivery, e.ID)
+	req.Header.Set(headerWebhookTimestamp, ts)
+	req.Header.Set(headerWebhookSignature, "sha256="+webhookSignature(cfg.Secret, ts, body))
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		return false, nil
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	err = fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	switch {
+	case resp.StatusCode == http.StatusRequestTimeout, resp.StatusCode == http.StatusTooManyRequests:
+		return false, err
+	case resp.StatusCode/100 == 4:
+		return true, err
+	}
+	return false, err
+}
+
+// webhookSignature returns the hex HMAC-SHA256 of ts.body under secret.
+func webhookSignature(secret, ts string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// dead hands a delivery that failed for good to the dead-letter log. It
+// never blocks: push calls it from hub shards.
+func (d *webhookDispatcher) dead(del WebhookDelivery) {
+	if d.deadLetter == "" {
+		return
+	}
+	select {
+	case d.deadQueue <- del:
+	default:
+		log.Printf("webhook: dead-letter log is behind, dropping %s event %s", del.Event.Type, del.Event.ID)
+	}
+}
+
+// writeDeadLetters appends failed deliveries to the dead-letter log until
+// the hub stops.
+func (d *webhookDispatcher) writeDeadLetters() {
+	for {
+		select {
+		case del := <-d.deadQueue:
+			if err := appendJSONLine(d.deadLetter, del); err != nil {
+				log.Printf("webhook: dead-letter log: %v", err)
+			}
+		case <-d.hub.shutdown:
+			return
+		}
+	}
+}
+
+func appendJSONLine(path string, v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// HandleWebhookDeliveries serves GET /webhooks/deliveries[?status=failed]:
+// the latest deliveries of the subscription whose secret is given as
+// "Authorization: Bearer <secret>", newest first.
+func HandleWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	webhooks.serveDeliveries(w, r)
+}
+
+// serveDeliveries serves GET /webhooks/deliveries; d may be nil.
+func (d *webhookDispatcher) serveDeliveries(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	secret, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || secret == "" {
+		http.Error(w, "missing bearer secret", http.StatusUnauthorized)
+		return
+	}
+	sub := d.bySecret(secret)
+	if sub == nil {
+		http.Error(w, errUnknownWebhook.Error(), http.StatusForbidden)
+		return
+	}
+	status := r.URL.Query().Get("status")
+	sub.mu.Lock()
+	out := make([]WebhookDelivery, 0, len(sub.history))
+	for i := len(sub.history) - 1; i >= 0; i-- {
+		if status == "" || sub.history[i].Status == status {
+			out = append(out, *sub.history[i])
+		}
+	}
+	sub.mu.Unlock()
+	writeJSON(w, http.StatusOK, out)
+}
+
+// bySecret returns the subscription with secret, nil if there is none.
+func (d *webhookDispatcher) bySecret(secret string) *webhookSub {
+	if d == nil {
+		return nil
+	}
+	for _, sub := range d.subs {
+		if subtle.ConstantTimeCompare([]byte(sub.cfg.Secret), []byte(secret)) == 1 {
+			return sub
+		}
+	}
+	return nil
+}
@@ -0,0 +1,284 @@
+package server
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookReceiver is a webhook endpoint that answers with the status codes
+// it is given, in turn, and 200 once they run out.
+type webhookReceiver struct {
+	srv *httptest.Server
+
+	mu       sync.Mutex
+	statuses []int
+	requests []*receivedWebhook
+}
+
+type receivedWebhook struct {
+	header http.Header
+	body   []byte
+	at     time.Time
+}
+
+func startReceiver(t *testing.T, statuses ...int) *webhookReceiver {
+	t.Helper()
+	rcv := &webhookReceiver{statuses: statuses}
+	rcv.srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		rcv.mu.Lock()
+		rcv.requests = append(rcv.requests, &receivedWebhook{header: r.Header.Clone(), body: body, at: time.Now()})
+		status := http.StatusOK
+		if len(rcv.statuses) > 0 {
+			status, rcv.statuses = rcv.statuses[0], rcv.statuses[1:]
+		}
+		rcv.mu.Unlock()
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(rcv.srv.Close)
+	return rcv
+}
+
+func (rcv *webhookReceiver) received() []*receivedWebhook {
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+	return append([]*receivedWebhook(nil), rcv.requests...)
+}
+
+// startWebhooks runs a dispatcher for subs on h, retrying after a
+// millisecond instead of a second.
+func startWebhooks(t *testing.T, h *Hub, deadLetter string, subs ...WebhookConfig) *webhookDispatcher {
+	t.Helper()
+	d, err := newWebhookDispatcher(subs, deadLetter, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.backoff = time.Millisecond
+	d.start()
+	return d
+}
+
+// webhookDeliveries returns what GET /webhooks/deliveries answers d.
+func webhookDeliveries(t *testing.T, d *webhookDispatcher, secret, query string) (int, []WebhookDelivery) {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodGet, "/webhooks/deliveries"+query, nil)
+	if secret != "" {
+		r.Header.Set("Authorization", "Bearer "+secret)
+	}
+	w := httptest.NewRecorder()
+	d.serveDeliveries(w, r)
+	var out []WebhookDelivery
+	if w.Code == http.StatusOK {
+		if err := json.Unmarshal(w.Body.Bytes(), &out); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return w.Code, out
+}
+
+// deadLetters returns the deliveries in the dead-letter log at path.
+func deadLetters(t *testing.T, path string) []WebhookDelivery {
+	t.Helper()
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var out []WebhookDelivery
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var del WebhookDelivery
+		if err := json.Unmarshal(sc.Bytes(), &del); err != nil {
+			t.Fatalf("dead-letter line %q: %v", sc.Text(), err)
+		}
+		out = append(out, del)
+	}
+	return out
+}
+
+func TestWebhookSignature(t *testing.T) {
+	h := startHub(t, 1)
+	all := startReceiver(t)
+	online := startReceiver(t)
+	d := startWebhooks(t, h, "",
+		WebhookConfig{URL: all.srv.URL, Secret: "s3cret"},
+		WebhookConfig{URL: online.srv.URL, Secret: "other", Events: []string{EventUserOnline}})
+
+	d.emit(WebhookEvent{Type: EventUserRegistered, User: "alice", Device: "a1"})
+	d.emit(WebhookEvent{Type: EventUserOnline, User: "alice", Device: "a1"})
+	eventually(t, "both events to arrive", func() bool { return len(all.received()) == 2 && len(online.received()) == 1 })
+
+	for _, req := range all.received() {
+		var e WebhookEvent
+		if err := json.Unmarshal(req.body, &e); err != nil {
+			t.Fatal(err)
+		}
+		if req.header.Get(headerWebhookEvent) != e.Type || req.header.Get(headerWebhookDelivery) != e.ID || e.ID == "" {
+			t.Fatalf("headers %v for event %+v", req.header, e)
+		}
+		ts := req.header.Get(headerWebhookTimestamp)
+		mac := hmac.New(sha256.New, []byte("s3cret"))
+		mac.Write([]byte(ts + "."))
+		mac.Write(req.body)
+		if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); req.header.Get(headerWebhookSignature) != want {
+			t.Fatalf("signature %q, want %q", req.header.Get(headerWebhookSignature), want)
+		}
+		if e.User != "alice" || e.Device != "a1" || e.Instance != "local" {
+			t.Fatalf("event %+v", e)
+		}
+	}
+	var e WebhookEvent
+	_ = json.Unmarshal(online.received()[0].body, &e)
+	if e.Type != EventUserOnline {
+		t.Fatalf("filtered subscription got %s", e.Type)
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	h := startHub(t, 1)
+	rcv := startReceiver(t, http.StatusInternalServerError, http.StatusTooManyRequests, http.StatusBadGateway)
+	d := startWebhooks(t, h, "", WebhookConfig{URL: rcv.srv.URL, Secret: "s3cret"})
+
+	d.emit(WebhookEvent{Type: EventUserRegistered, User: "alice"})
+	eventually(t, "the event to be delivered", func() bool {
+		_, dels := webhookDeliveries(t, d, "s3cret", "?status=delivered")
+		return len(dels) == 1
+	})
+	reqs := rcv.received()
+	if len(reqs) != 4 {
+		t.Fatalf("%d attempts, want 4", len(reqs))
+	}
+	// every retry waits twice as long as the one before
+	for i := 1; i < len(reqs); i++ {
+		if gap, min := reqs[i].at.Sub(reqs[i-1].at), d.backoff<<(i-1); gap < min {
+			t.Fatalf("attempt %d came %s after the one before, want at least %s", i+1, gap, min)
+		}
+		if reqs[i].header.Get(headerWebhookDelivery) != reqs[0].header.Get(headerWebhookDelivery) {
+			t.Fatal("a retry has a new delivery ID")
+		}
+	}
+	_, dels := webhookDeliveries(t, d, "s3cret", "")
+	if dels[0].Attempts != 4 || !strings.Contains(dels[0].LastError, "502") {
+		t.Fatalf("delivery %+v, want 4 attempts and the last error", dels[0])
+	}
+}
+
+func TestWebhookDeadLetter(t *testing.T) {
+	h := startHub(t, 1)
+	failing := make([]int, webhookMaxAttempts)
+	for i := range failing {
+		failing[i] = http.StatusServiceUnavailable
+	}
+	down := startReceiver(t, failing...)
+	gone := startReceiver(t, http.StatusNotFound)
+	path := filepath.Join(t.TempDir(), "dead.jsonl")
+	d := startWebhooks(t, h, path,
+		WebhookConfig{URL: down.srv.URL, Secret: "down"},
+		WebhookConfig{URL: gone.srv.URL, Secret: "gone"})
+
+	d.emit(WebhookEvent{Type: EventMessageQueued, User: "bob", From: "alice", MsgID: "m1"})
+	eventually(t, "both deliveries to be dead-lettered", func() bool { return len(deadLetters(t, path)) == 2 })
+
+	byURL := make(map[string]WebhookDelivery)
+	for _, del := range deadLetters(t, path) {
+		byURL[del.URL] = del
+	}
+	if del := byURL[down.srv.URL]; del.Status != webhookFailed || del.Attempts != webhookMaxAttempts || !strings.Contains(del.LastError, "503") {
+		t.Fatalf("failing endpoint: %+v, want failed after %d attempts", del, webhookMaxAttempts)
+	}
+	// a client error is not retried
+	if del := byURL[gone.srv.URL]; del.Status != webhookFailed || del.Attempts != 1 || del.Event.MsgID != "m1" {
+		t.Fatalf("missing endpoint: %+v, want failed after 1 attempt", del)
+	}
+	if n := len(gone.received()); n != 1 {
+		t.Fatalf("missing endpoint got %d requests, want 1", n)
+	}
+}
+
+func TestWebhookQueueOverflowIsDeadLettered(t *testing.T) {
+	h := startHub(t, 1)
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { <-release }))
+	t.Cleanup(srv.Close)
+	t.Cleanup(func() { close(release) })
+	path := filepath.Join(t.TempDir(), "dead.jsonl")
+	d := startWebhooks(t, h, path, WebhookConfig{URL: srv.URL, Secret: "s3cret"})
+
+	// the endpoint hangs, so the queue fills up and what doesn't fit
+	// fails at once
+	for i := 0; i < maxWebhookQueue+1; i++ {
+		d.emit(WebhookEvent{Type: EventUserOnline, User: fmt.Sprint("user", i)})
+	}
+	eventually(t, "the overflow to be dead-lettered", func() bool { return len(deadLetters(t, path)) >= 1 })
+	del := deadLetters(t, path)[0]
+	if del.Status != webhookFailed || del.LastError != "too many events waiting" {
+		t.Fatalf("dead letter %+v", del)
+	}
+}
+
+func TestWebhookDeliveriesEndpoint(t *testing.T) {
+	h := startHub(t, 1)
+	ok := startReceiver(t)
+	bad := startReceiver(t, http.StatusBadRequest)
+	d := startWebhooks(t, h, "",
+		WebhookConfig{URL: ok.srv.URL, Secret: "mine"},
+		WebhookConfig{URL: bad.srv.URL, Secret: "theirs", Events: []string{EventUserRegistered}})
+
+	d.emit(WebhookEvent{Type: EventUserRegistered, User: "alice"})
+	d.emit(WebhookEvent{Type: EventUserOnline, User: "alice"})
+	eventually(t, "deliveries to finish", func() bool {
+		_, mine := webhookDeliveries(t, d, "mine", "?status=delivered")
+		_, theirs := webhookDeliveries(t, d, "theirs", "?status=failed")
+		return len(mine) == 2 && len(theirs) == 1
+	})
+
+	code, mine := webhookDeliveries(t, d, "mine", "")
+	if code != http.StatusOK || len(mine) != 2 {
+		t.Fatalf("status %d, %d deliveries", code, len(mine))
+	}
+	if mine[0].Event.Type != EventUserOnline || mine[1].Event.Type != EventUserRegistered {
+		t.Fatalf("deliveries not newest first: %s, %s", mine[0].Event.Type, mine[1].Event.Type)
+	}
+	for _, del := range mine {
+		if del.URL != ok.srv.URL {
+			t.Fatalf("delivery of another subscription: %+v", del)
+		}
+	}
+	if _, failed := webhookDeliveries(t, d, "mine", "?status=failed"); len(failed) != 0 {
+		t.Fatalf("failed deliveries %+v, want none", failed)
+	}
+	if _, theirs := webhookDeliveries(t, d, "theirs", "?status=delivered"); len(theirs) != 0 {
+		t.Fatalf("delivered %+v, want none", theirs)
+	}
+
+	if code, _ := webhookDeliveries(t, d, "", ""); code != http.StatusUnauthorized {
+		t.Fatalf("no secret: status %d, want 401", code)
+	}
+	if code, _ := webhookDeliveries(t, d, "guess", ""); code != http.StatusForbidden {
+		t.Fatalf("wrong secret: status %d, want 403", code)
+	}
+	var none *webhookDispatcher
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/webhooks/deliveries", nil)
+	r.Header.Set("Authorization", "Bearer mine")
+	none.serveDeliveries(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("no webhooks configured: status %d, want 403", w.Code)
+	}
+}
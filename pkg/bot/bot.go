@@ -0,0 +1,291 @@
+// Package bot builds chat bots on the client SDK. A Bot answers messages
+// that start with /command with the handler registered for the command;
+// anything else goes to its default handler:
+//
+//	b := bot.New()
+//	b.Use(bot.RateLimit(5, time.Minute))
+//	b.Handle("deploy", "deploy a service: /deploy <service> --env=<env>", func(c *bot.Context) error {
+//		env, _ := c.Flag("env")
+//		return c.Replyf("deploying %s to %s", c.Arg(0), env)
+//	}, bot.AllowUsers("alice", "bob"))
+//
+//	s, err := client.Connect(ctx, client.Options{ID: "deploybot"})
+//	if err != nil {
+//		return err
+//	}
+//	defer s.Close()
+//	return b.Run(ctx, s)
+//
+// Package bottest runs bots against an in-memory server, so they can be
+// tested without a network.
+package bot
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/marcoantonios1/chat-app/pkg/client"
+)
+
+// HandlerFunc handles a message. An error it returns is sent back to the
+// sender.
+type HandlerFunc func(c *Context) error
+
+// Middleware wraps a handler, to run before or instead of it.
+type Middleware func(next HandlerFunc) HandlerFunc
+
+// how many messages of one conversation may wait for its handler
+const conversationQueue = 16
+
+// how long a conversation's handler goroutine waits for another message
+// before it goes away; a var so tests can shorten it
+var conversationIdle = 5 * time.Minute
+
+// Command is a registered command.
+type Command struct {
+	Name string // without the slash
+	Help string // what it does, shown by /help
+}
+
+type command struct {
+	Command
+	h HandlerFunc
+}
+
+// Bot routes messages to handlers. Set it up before Run; its methods are
+// not meant to be called while it runs.
+type Bot struct {
+	// State keeps what handlers remember per conversation; in memory if
+	// nil.
+	State StateStore
+
+	commands   map[string]*command
+	order      []string
+	middleware []Middleware
+	fallback   HandlerFunc
+	active     atomic.Int32 // conversations with a handler goroutine
+}
+
+// New returns a bot that knows /help and answers other text with a hint
+// to use it.
+func New() *Bot {
+	b := &Bot{commands: make(map[string]*command)}
+	b.Handle("help", "list the commands", b.help)
+	return b
+}
+
+// Handle registers h for /name, wrapped in mw after the bot's own
+// middleware. Names are case insensitive; registering a name again
+// replaces its handler.
+func (b *Bot) Handle(name, help string, h HandlerFunc, mw ...Middleware) {
+	name = strings.ToLower(strings.TrimPrefix(name, "/"))
+	for i := len(mw) - 1; i >= 0; i-- {
+		h = mw[i](h)
+	}
+	if _, ok := b.commands[name]; !ok {
+		b.order = append(b.order, name)
+	}
+	b.commands[name] = &command{Command: Command{Name: name, Help: help}, h: h}
+}
+
+// Default handles messages that aren't commands.
+func (b *Bot) Default(h HandlerFunc) {
+	b.fallback = h
+}
+
+// Use adds middleware that runs for every message, in the order given.
+func (b *Bot) Use(mw ...Middleware) {
+	b.middleware = append(b.middleware, mw...)
+}
+
+// Commands lists the registered commands in the order they were added.
+func (b *Bot) Commands() []Command {
+	out := make([]Command, len(b.order))
+	for i, name := range b.order {
+		out[i] = b.commands[name].Command
+	}
+	return out
+}
+
+func (b *Bot) help(c *Context) error {
+	var sb strings.Builder
+	sb.WriteString("Commands:")
+	for _, cmd := range b.Commands() {
+		fmt.Fprintf(&sb, "\n/%s", cmd.Name)
+		if cmd.Help != "" {
+			sb.WriteString(" — " + cmd.Help)
+		}
+	}
+	return c.Reply(sb.String())
+}
+
+// route picks the handler for c, wrapped in the bot's middleware.
+func (b *Bot) route(c *Context) HandlerFunc {
+	var h HandlerFunc
+	switch cmd, ok := b.commands[c.Command]; {
+	case ok:
+		h = cmd.h
+	case c.Command != "":
+		h = func(c *Context) error {
+			return fmt.Errorf("unknown command /%s, try /help", c.Command)
+		}
+	case b.fallback != nil:
+		h = b.fallback
+	default:
+		h = func(c *Context) error {
+			return c.Reply("Send /help for what I can do.")
+		}
+	}
+	for i := len(b.middleware) - 1; i >= 0; i-- {
+		h = b.middleware[i](h)
+	}
+	return h
+}
+
+// Run answers the messages that reach s until ctx ends or the session
+// does. Messages of one conversation are handled one at a time, in order;
+// conversations don't wait for each other. Each handled message is marked
+// read. A conversation that has been quiet for a while gives its
+// goroutine up. Run returns once every handler has, with the session's
+// error or ctx's.
+func (b *Bot) Run(ctx context.Context, s *client.Session) error {
+	if b.State == nil {
+		b.State = NewMemoryState()
+	}
+	ctx, cancel := context.WithCancel(ctx)
+
+	var wg sync.WaitGroup
+	queues := make(map[string]chan client.Message)
+	idle := make(chan string)
+	defer func() {
+		cancel()
+		for _, q := range queues {
+			close(q)
+		}
+		wg.Wait()
+	}()
+
+	for {
+		var m client.Message
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case from := <-idle:
+			// a message may have come in since the handler asked
+			if q := queues[from]; len(q) == 0 {
+				close(q)
+				delete(queues, from)
+			}
+			continue
+		case e, ok := <-s.Events():
+			if !ok {
+				return s.Err()
+			}
+			msg, isMsg := e.(client.Message)
+			if !isMsg || msg.From == s.ID() || msg.Err != nil {
+				continue
+			}
+			m = msg
+		}
+
+		q, ok := queues[m.From]
+		if !ok {
+			q = make(chan client.Message, conversationQueue)
+			queues[m.From] = q
+			wg.Add(1)
+			b.active.Add(1)
+			go func() {
+				defer wg.Done()
+				defer b.active.Add(-1)
+				b.serve(ctx, s, m.From, q, idle)
+			}()
+		}
+		select {
+		case q <- m:
+		default:
+			log.Printf("bot: dropped message %s from %s, too many waiting", m.ID, m.From)
+			go s.Send(ctx, m.From, "Too many messages at once, try again in a moment.")
+		}
+	}
+}
+
+// serve handles the messages of the conversation with from until q is
+// closed. Whenever the conversation has been quiet for conversationIdle,
+// it tells Run on idle, which closes q unless a message is waiting.
+func (b *Bot) serve(ctx context.Context, s *client.Session, from string, q <-chan client.Message, idle chan<- string) {
+	t := time.NewTimer(conversationIdle)
+	defer t.Stop()
+	for {
+		select {
+		case m, ok := <-q:
+			if !ok {
+				return
+			}
+			b.handle(ctx, s, m)
+		case <-t.C:
+			select {
+			case idle <- from:
+			case <-ctx.Done():
+			}
+		}
+		t.Reset(conversationIdle)
+	}
+}
+
+// handle runs the handler for m and replies with its error, if any.
+func (b *Bot) handle(ctx context.Context, s *client.Session, m client.Message) {
+	c := newContext(ctx, b, s, m)
+	if err := b.route(c)(c); err != nil {
+		if rerr := c.Reply("⚠️ " + err.Error()); rerr != nil {
+			log.Printf("bot: reply to %s: %v", m.From, rerr)
+		}
+	}
+	if m.ID != "" {
+		_ = s.MarkRead(m.From, m.ID)
+	}
+}
+
+var (
+	registryMu sync.Mutex
+	registry   = make(map[string]func() *Bot)
+)
+
+// Register makes a bot available to chatapp bot run --bot name. It
+// panics if name is taken.
+func Register(name string, newBot func() *Bot) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if _, ok := registry[name]; ok {
+		panic("bot: " + name + " registered twice")
+	}
+	registry[name] = newBot
+}
+
+// Lookup returns a new instance of the bot registered as name.
+func Lookup(name string) (*Bot, error) {
+	registryMu.Lock()
+	newBot, ok := registry[name]
+	registryMu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown bot %q, have %s", name, strings.Join(Names(), ", "))
+	}
+	return newBot(), nil
+}
+
+// Names lists the registered bots, sorted.
+func Names() []string {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,165 @@
+package bot_test
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/marcoantonios1/chat-app/pkg/bot"
+	"github.com/marcoantonios1/chat-app/pkg/bot/bottest"
+)
+
+// start runs b as testbot and connects users to talk to it.
+func start(t *testing.T, b *bot.Bot, users ...string) []*bottest.User {
+	t.Helper()
+	srv := bottest.NewServer()
+	t.Cleanup(srv.Close)
+	if err := srv.Start("testbot", b); err != nil {
+		t.Fatal(err)
+	}
+	out := make([]*bottest.User, len(users))
+	for i, id := range users {
+		u, err := srv.User(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out[i] = u
+	}
+	return out
+}
+
+// ask sends text to the bot and checks its reply.
+func ask(t *testing.T, u *bottest.User, text, want string) {
+	t.Helper()
+	reply, err := u.Ask(context.Background(), "testbot", text)
+	if err != nil {
+		t.Fatalf("%s: %v", text, err)
+	}
+	if reply != want {
+		t.Fatalf("%s %s: got %q, want %q", u.ID(), text, reply, want)
+	}
+}
+
+func TestRouting(t *testing.T) {
+	b := bot.New()
+	b.Handle("/Greet", "greet somebody", func(c *bot.Context) error {
+		greeting, ok := c.Flag("greeting")
+		if !ok {
+			greeting = "hello"
+		}
+		return c.Replyf("%s %s (%d args)", greeting, c.Arg(0), len(c.Args))
+	})
+	b.Handle("fail", "", func(c *bot.Context) error { return fmt.Errorf("%s failed", c.Raw) })
+	alice := start(t, b, "alice")[0]
+
+	ask(t, alice, `/greet "bob and carol" --greeting=hi`, "hi bob and carol (1 args)")
+	ask(t, alice, "/GREET dave -- --greeting", "hello dave (2 args)")
+	ask(t, alice, "/fail the job", "⚠️ the job failed")
+	ask(t, alice, "/help", "Commands:\n/help — list the commands\n/greet — greet somebody\n/fail")
+	ask(t, alice, "good morning", "Send /help for what I can do.")
+}
+
+func TestDefaultHandler(t *testing.T) {
+	alice := start(t, bot.Echo(), "alice")[0]
+	ask(t, alice, "hello there", "hello there")
+	ask(t, alice, "/echo --upper shout", "SHOUT")
+}
+
+func TestUnknownCommand(t *testing.T) {
+	b := bot.New()
+	b.Default(func(c *bot.Context) error { return c.Reply("not a command") })
+	alice := start(t, b, "alice")[0]
+	ask(t, alice, "/deploy web", "⚠️ unknown command /deploy, try /help")
+	ask(t, alice, "deploy web", "not a command")
+}
+
+func TestAllowUsers(t *testing.T) {
+	b := bot.New()
+	b.Handle("deploy", "", func(c *bot.Context) error { return c.Reply("deploying " + c.Arg(0)) }, bot.AllowUsers("alice"))
+	users := start(t, b, "alice", "mallory")
+	alice, mallory := users[0], users[1]
+
+	ask(t, alice, "/deploy web", "deploying web")
+	ask(t, mallory, "/deploy web", "⚠️ "+bot.ErrNotAllowed.Error())
+	// the other commands stay open
+	ask(t, mallory, "/help", "Commands:\n/help — list the commands\n/deploy")
+}
+
+func TestRateLimit(t *testing.T) {
+	b := bot.New()
+	b.Use(bot.RateLimit(2, time.Hour))
+	b.Default(func(c *bot.Context) error { return c.Reply("ok") })
+	users := start(t, b, "alice", "bob")
+	alice, bob := users[0], users[1]
+
+	ask(t, alice, "one", "ok")
+	ask(t, alice, "two", "ok")
+	ask(t, alice, "three", "⚠️ "+bot.ErrRateLimited.Error())
+	// every user has a limit of their own
+	ask(t, bob, "one", "ok")
+}
+
+func TestConversationState(t *testing.T) {
+	users := start(t, bot.Echo(), "alice", "bob")
+	alice, bob := users[0], users[1]
+
+	ask(t, alice, "hi", "hi")
+	ask(t, alice, "again", "again")
+	ask(t, bob, "hi", "hi")
+	ask(t, alice, "/count", "You sent me 3 messages.")
+	ask(t, bob, "/count", "You sent me 2 messages.")
+	ask(t, alice, "/reset", "Count reset.")
+	ask(t, alice, "/count", "You sent me 1 messages.")
+	ask(t, bob, "/count", "You sent me 3 messages.")
+}
+
+func TestConversationOrder(t *testing.T) {
+	b := bot.New()
+	b.Default(func(c *bot.Context) error { return c.Reply(strings.ToUpper(c.Raw)) })
+	alice := start(t, b, "alice")[0]
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	const n = 10
+	for i := 0; i < n; i++ {
+		if _, err := alice.Send(ctx, "testbot", fmt.Sprint("m", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < n; i++ {
+		m, err := alice.Next(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := fmt.Sprint("M", i); m.Text != want {
+			t.Fatalf("reply %d is %q, want %q", i, m.Text, want)
+		}
+	}
+}
+
+func TestIdleConversationsEnd(t *testing.T) {
+	defer bot.SetConversationIdle(20 * time.Millisecond)()
+	b := bot.Echo()
+	users := start(t, b, "alice", "bob")
+	alice, bob := users[0], users[1]
+
+	ask(t, alice, "hi", "hi")
+	ask(t, bob, "hi", "hi")
+	waitIdle(t, b)
+	// a conversation that comes back gets a goroutine again, and its state
+	ask(t, alice, "/count", "You sent me 2 messages.")
+	waitIdle(t, b)
+}
+
+func waitIdle(t *testing.T, b *bot.Bot) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for b.Conversations() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d conversations still have a goroutine", b.Conversations())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
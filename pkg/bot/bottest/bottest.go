@@ -0,0 +1,160 @@
+// Package bottest runs bots against an in-memory chat server, so their
+// logic can be tested without a network or a running server:
+//
+//	func TestEcho(t *testing.T) {
+//		srv := bottest.NewServer()
+//		defer srv.Close()
+//		if err := srv.Start("echobot", bot.Echo()); err != nil {
+//			t.Fatal(err)
+//		}
+//		alice, err := srv.User("alice")
+//		if err != nil {
+//			t.Fatal(err)
+//		}
+//		reply, err := alice.Ask(context.Background(), "echobot", "/echo hi")
+//		if err != nil || reply != "hi" {
+//			t.Fatalf("got %q, %v", reply, err)
+//		}
+//	}
+//
+// The server accepts any ID and keeps messages for users until they
+// connect; it keeps no history.
+package bottest
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/marcoantonios1/chat-app/internal/client"
+	"github.com/marcoantonios1/chat-app/pkg/bot"
+	sdk "github.com/marcoantonios1/chat-app/pkg/client"
+)
+
+// how long Ask waits for a reply unless its context ends first
+const replyTimeout = 5 * time.Second
+
+// Server is an in-memory chat server.
+type Server struct {
+	srv    *client.MemoryServer
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu       sync.Mutex
+	sessions []*sdk.Session
+	bots     sync.WaitGroup
+}
+
+// NewServer starts a server.
+func NewServer() *Server {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Server{srv: client.NewMemoryServer(), ctx: ctx, cancel: cancel}
+}
+
+// Options returns the options to connect to the server as id, as a new
+// device with its keys in memory.
+func (s *Server) Options(id string) sdk.Options {
+	return sdk.Options{
+		ID:        id,
+		Transport: sdk.TransportMemory,
+		Server:    s.srv.Addr(),
+		Keys:      sdk.NewMemoryKeyStore(),
+	}
+}
+
+// Connect connects a session as id. Close closes it.
+func (s *Server) Connect(ctx context.Context, id string) (*sdk.Session, error) {
+	sess, err := sdk.Connect(ctx, s.Options(id))
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	s.sessions = append(s.sessions, sess)
+	s.mu.Unlock()
+	return sess, nil
+}
+
+// Start runs b as user id until the server is closed.
+func (s *Server) Start(id string, b *bot.Bot) error {
+	sess, err := s.Connect(s.ctx, id)
+	if err != nil {
+		return err
+	}
+	s.bots.Add(1)
+	go func() {
+		defer s.bots.Done()
+		b.Run(s.ctx, sess)
+	}()
+	return nil
+}
+
+// User connects id as a user to talk to bots with.
+func (s *Server) User(id string) (*User, error) {
+	sess, err := s.Connect(s.ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return &User{Session: sess}, nil
+}
+
+// Close stops the bots, closes every session and shuts the server down.
+func (s *Server) Close() {
+	s.cancel()
+	s.bots.Wait()
+	s.mu.Lock()
+	sessions := s.sessions
+	s.sessions = nil
+	s.mu.Unlock()
+	for _, sess := range sessions {
+		sess.Close()
+	}
+	s.srv.Close()
+}
+
+// User is a session that reads only the messages sent to it.
+type User struct {
+	*sdk.Session
+}
+
+// Next returns the next message from somebody else.
+func (u *User) Next(ctx context.Context) (sdk.Message, error) {
+	for {
+		select {
+		case <-ctx.Done():
+			return sdk.Message{}, ctx.Err()
+		case e, ok := <-u.Events():
+			if !ok {
+				if err := u.Err(); err != nil {
+					return sdk.Message{}, err
+				}
+				return sdk.Message{}, errors.New("session closed")
+			}
+			if m, ok := e.(sdk.Message); ok && m.From != u.ID() {
+				return m, nil
+			}
+		}
+	}
+}
+
+// Ask sends text to user to and returns the text of the next message
+// from them. It waits up to five seconds unless ctx has a deadline.
+func (u *User) Ask(ctx context.Context, to, text string) (string, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, replyTimeout)
+		defer cancel()
+	}
+	if _, err := u.Send(ctx, to, text); err != nil {
+		return "", err
+	}
+	for {
+		m, err := u.Next(ctx)
+		if err != nil {
+			return "", err
+		}
+		if m.From == to {
+			return m.Text, nil
+		}
+	}
+}
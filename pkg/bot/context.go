@@ -0,0 +1,142 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/marcoantonios1/chat-app/pkg/client"
+)
+
+// Context is one message being handled. Its context ends with the bot.
+type Context struct {
+	context.Context
+	Message client.Message
+	// Command is the lowercased command without its slash, empty when the
+	// message isn't one.
+	Command string
+	// Args are the words after the command that aren't flags. Quotes group
+	// words: /say "hello world" has one argument.
+	Args []string
+	// Flags are the --name=value and --name arguments, the latter with an
+	// empty value. An argument -- ends the flags.
+	Flags map[string]string
+	// Raw is the text after the command as it was sent, or the whole text
+	// of a message that isn't a command.
+	Raw string
+
+	bot     *Bot
+	session *client.Session
+}
+
+func newContext(ctx context.Context, b *Bot, s *client.Session, m client.Message) *Context {
+	c := &Context{Context: ctx, Message: m, Flags: make(map[string]string), bot: b, session: s}
+	text := strings.TrimSpace(m.Text)
+	if !strings.HasPrefix(text, "/") {
+		c.Raw = text
+		return c
+	}
+	name, rest, _ := strings.Cut(text[1:], " ")
+	c.Command = strings.ToLower(name)
+	c.Raw = strings.TrimSpace(rest)
+	flags := true
+	for _, w := range splitArgs(c.Raw) {
+		switch {
+		case flags && w == "--":
+			flags = false
+		case flags && strings.HasPrefix(w, "--") && len(w) > 2:
+			name, value, _ := strings.Cut(w[2:], "=")
+			c.Flags[name] = value
+		default:
+			c.Args = append(c.Args, w)
+		}
+	}
+	return c
+}
+
+// splitArgs splits s into words at spaces outside of double or single
+// quotes. A backslash keeps the next character as it is.
+func splitArgs(s string) []string {
+	var (
+		words []string
+		word  strings.Builder
+		quote rune
+		inArg bool
+		esc   bool
+	)
+	for _, r := range s {
+		switch {
+		case esc:
+			word.WriteRune(r)
+			esc = false
+		case r == '\\':
+			esc, inArg = true, true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '"' || r == '\'':
+			quote, inArg = r, true
+		case unicode.IsSpace(r):
+			if inArg {
+				words = append(words, word.String())
+				word.Reset()
+				inArg = false
+			}
+		default:
+			word.WriteRune(r)
+			inArg = true
+		}
+	}
+	if inArg {
+		words = append(words, word.String())
+	}
+	return words
+}
+
+// From returns the user who sent the message.
+func (c *Context) From() string { return c.Message.From }
+
+// Arg returns argument i, or "" if there are fewer.
+func (c *Context) Arg(i int) string {
+	if i < 0 || i >= len(c.Args) {
+		return ""
+	}
+	return c.Args[i]
+}
+
+// Flag returns the value of flag name and whether it was given.
+func (c *Context) Flag(name string) (string, bool) {
+	v, ok := c.Flags[name]
+	return v, ok
+}
+
+// Reply sends text to the sender.
+func (c *Context) Reply(text string) error {
+	_, err := c.session.Send(c, c.Message.From, text)
+	return err
+}
+
+// Replyf formats a reply as fmt.Sprintf does.
+func (c *Context) Replyf(format string, args ...any) error {
+	return c.Reply(fmt.Sprintf(format, args...))
+}
+
+// Session returns the bot's session, to message other users.
+func (c *Context) Session() *client.Session { return c.session }
+
+// Get returns what was stored under key in this conversation, "" if
+// nothing.
+func (c *Context) Get(key string) (string, error) {
+	v, _, err := c.bot.State.Get(c.Message.From, key)
+	return v, err
+}
+
+// Set stores value under key in this conversation; an empty value
+// deletes the key.
+func (c *Context) Set(key, value string) error {
+	return c.bot.State.Set(c.Message.From, key, value)
+}
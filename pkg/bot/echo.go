@@ -0,0 +1,59 @@
+package bot
+
+import (
+	"strconv"
+	"strings"
+)
+
+func init() {
+	Register("echo", Echo)
+}
+
+// Echo returns a bot that repeats what it is sent, for trying out
+// connections. It counts the messages of each conversation in its state.
+func Echo() *Bot {
+	b := New()
+	b.Use(count)
+	b.Handle("echo", "repeat the text after it, in capitals with --upper", func(c *Context) error {
+		text := strings.Join(c.Args, " ")
+		if _, ok := c.Flag("upper"); ok {
+			text = strings.ToUpper(text)
+		}
+		if text == "" {
+			return c.Reply("usage: /echo <text>")
+		}
+		return c.Reply(text)
+	})
+	b.Handle("count", "how many messages you sent me", func(c *Context) error {
+		n, err := c.Get("count")
+		if err != nil {
+			return err
+		}
+		return c.Replyf("You sent me %s messages.", n)
+	})
+	b.Handle("reset", "forget the count", func(c *Context) error {
+		if err := c.Set("count", ""); err != nil {
+			return err
+		}
+		return c.Reply("Count reset.")
+	})
+	b.Default(func(c *Context) error {
+		return c.Reply(c.Raw)
+	})
+	return b
+}
+
+// count adds one to the conversation's message count.
+func count(next HandlerFunc) HandlerFunc {
+	return func(c *Context) error {
+		v, err := c.Get("count")
+		if err != nil {
+			return err
+		}
+		n, _ := strconv.Atoi(v)
+		if err := c.Set("count", strconv.Itoa(n+1)); err != nil {
+			return err
+		}
+		return next(c)
+	}
+}
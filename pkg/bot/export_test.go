@@ -0,0 +1,14 @@
+package bot
+
+import "time"
+
+// SetConversationIdle shortens how long a quiet conversation keeps its
+// goroutine, until the returned func is called.
+func SetConversationIdle(d time.Duration) (restore func()) {
+	old := conversationIdle
+	conversationIdle = d
+	return func() { conversationIdle = old }
+}
+
+// Conversations returns how many conversations have a handler goroutine.
+func (b *Bot) Conversations() int { return int(b.active.Load()) }
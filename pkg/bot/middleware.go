@@ -0,0 +1,74 @@
+package bot
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrNotAllowed is returned by AllowUsers to everybody else.
+	ErrNotAllowed = errors.New("you are not allowed to do that")
+	// ErrRateLimited is returned by RateLimit to users who sent too much.
+	ErrRateLimited = errors.New("slow down, too many messages")
+)
+
+// AllowUsers lets only the given users through; everybody else gets
+// ErrNotAllowed.
+func AllowUsers(ids ...string) Middleware {
+	allowed := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		allowed[id] = true
+	}
+	return func(next HandlerFunc) HandlerFunc {
+		return func(c *Context) error {
+			if !allowed[c.From()] {
+				return ErrNotAllowed
+			}
+			return next(c)
+		}
+	}
+}
+
+// RateLimit lets each user through n times per period, in bursts of up to
+// n; messages over the limit get ErrRateLimited.
+func RateLimit(n int, per time.Duration) Middleware {
+	if n <= 0 || per <= 0 {
+		panic(fmt.Sprintf("bot: invalid rate limit %d per %s", n, per))
+	}
+	type bucket struct {
+		tokens float64
+		last   time.Time
+	}
+	var (
+		mu      sync.Mutex
+		buckets = make(map[string]*bucket)
+		rate    = float64(n) / float64(per)
+	)
+	allow := func(user string) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		now := time.Now()
+		b, ok := buckets[user]
+		if !ok {
+			b = &bucket{tokens: float64(n), last: now}
+			buckets[user] = b
+		}
+		b.tokens = min(float64(n), b.tokens+rate*float64(now.Sub(b.last)))
+		b.last = now
+		if b.tokens < 1 {
+			return false
+		}
+		b.tokens--
+		return true
+	}
+	return func(next HandlerFunc) HandlerFunc {
+		return func(c *Context) error {
+			if !allow(c.From()) {
+				return ErrRateLimited
+			}
+			return next(c)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package bot
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// StateStore keeps string values per conversation, named after the user
+// the bot talks to. Implementations must be safe for concurrent use.
+type StateStore interface {
+	// Get returns the value of key in conversation and whether it is set.
+	Get(conversation, key string) (string, bool, error)
+	// Set stores value under key in conversation; an empty value deletes
+	// the key.
+	Set(conversation, key, value string) error
+}
+
+// MemoryState is a StateStore that forgets everything when the program
+// exits.
+type MemoryState struct {
+	mu   sync.Mutex
+	data map[string]map[string]string
+}
+
+// NewMemoryState returns an empty MemoryState.
+func NewMemoryState() *MemoryState {
+	return &MemoryState{data: make(map[string]map[string]string)}
+}
+
+func (s *MemoryState) Get(conversation, key string) (string, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.data[conversation][key]
+	return v, ok, nil
+}
+
+func (s *MemoryState) Set(conversation, key, value string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	set(s.data, conversation, key, value)
+	return nil
+}
+
+func set(data map[string]map[string]string, conversation, key, value string) {
+	if value == "" {
+		delete(data[conversation], key)
+		if len(data[conversation]) == 0 {
+			delete(data, conversation)
+		}
+		return
+	}
+	if data[conversation] == nil {
+		data[conversation] = make(map[string]string)
+	}
+	data[conversation][key] = value
+}
+
+// FileState is a StateStore kept in a JSON file, rewritten on every Set.
+type FileState struct {
+	path string
+	mu   sync.Mutex
+	data map[string]map[string]string
+}
+
+// OpenFileState loads the state in path, creating the file on the first
+// Set if it doesn't exist.
+func OpenFileState(path string) (*FileState, error) {
+	s := &FileState{path: path, data: make(map[string]map[string]string)}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read bot state: %w", err)
+	}
+	if err := json.Unmarshal(b, &s.data); err != nil {
+		return nil, fmt.Errorf("parse bot state %s: %w", path, err)
+	}
+	return s, nil
+}
+
+func (s *FileState) Get(conversation, key string) (string, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.data[conversation][key]
+	return v, ok, nil
+}
+
+func (s *FileState) Set(conversation, key, value string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	set(s.data, conversation, key, value)
+	b, err := json.MarshalIndent(s.data, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal bot state: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o700); err != nil {
+		return fmt.Errorf("create bot state dir: %w", err)
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return fmt.Errorf("write bot state: %w", err)
+	}
+	return os.Rename(tmp, s.path)
+}
@@ -0,0 +1,340 @@
+// Package client is the Go SDK for chatapp. A Session connects as one
+// user, keeps the connection alive across drops, end-to-end encrypts what
+// it sends and decrypts what arrives:
+//
+//	s, err := client.Connect(ctx, client.Options{ID: "bot"})
+//	if err != nil {
+//		return err
+//	}
+//	defer s.Close()
+//	if _, err := s.Send(ctx, "alice", "hello"); err != nil {
+//		return err
+//	}
+//	for e := range s.Events() {
+//		if m, ok := e.(client.Message); ok && m.From != s.ID() {
+//			fmt.Printf("%s: %s\n", m.From, m.Text)
+//		}
+//	}
+//	return s.Err()
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+
+	"github.com/marcoantonios1/chat-app/internal/client"
+	"github.com/marcoantonios1/chat-app/internal/protocol"
+)
+
+// Transports a Session can connect over.
+const (
+	TransportWebSocket = client.TransportWebSocket
+	TransportGRPC      = client.TransportGRPC
+	// TransportHTTP uses the server's HTTP stream endpoint, which
+	// TransportWebSocket also falls back to when a websocket can't be
+	// dialed.
+	TransportHTTP = client.TransportHTTP
+	// TransportQUIC connects to the server's QUIC endpoint, for lossy
+	// networks.
+	TransportQUIC = client.TransportQUIC
+	// TransportMemory connects to a bottest.Server in the same process.
+	TransportMemory = client.TransportMemory
+)
+
+const (
+	defaultServer      = "ws://localhost:8080/message"
+	defaultEventBuffer = 256
+)
+
+var (
+	// ErrAckTimeout is returned by SendMessage when the message went out
+	// but was not acknowledged as asked before its context ended.
+	ErrAckTimeout = client.ErrAckTimeout
+	// ErrOffline is returned for sends while the connection is down.
+	ErrOffline = client.ErrOffline
+	// ErrDevicePending is returned by Connect while this device still has
+	// to be approved from one of the user's other devices.
+	ErrDevicePending = client.ErrDevicePending
+	// ErrDeviceRevoked is returned by Connect for a revoked device.
+	ErrDeviceRevoked = client.ErrDeviceRevoked
+	// ErrEventsLost ends a session whose events weren't read fast enough.
+	ErrEventsLost = errors.New("events not read in time, session closed")
+)
+
+// Options configure a Session.
+type Options struct {
+	// ID is the user to connect as. It must be registered.
+	ID string
+	// Server is the websocket URL to connect to (also with
+	// TransportHTTP), with TransportGRPC and TransportQUIC the host:port
+	// of the server, and with TransportMemory the Addr of a
+	// bottest.Server.
+	Server string
+	// Transport is TransportWebSocket (the default), TransportHTTP,
+	// TransportGRPC, TransportQUIC or TransportMemory.
+	Transport string
+	// TLS configures wss:// and https:// connections, TransportGRPC (which
+	// uses TLS only when it is set) and TransportQUIC, e.g. to trust the
+	// server's self-signed certificate. Nil uses the system roots.
+	TLS *tls.Config
+	// Encoding is the websocket frame encoding: "cbor" (the default) or
+	// "json".
+	Encoding string
+	// Keys holds the device ID and keys; by default those of the command
+	// line client.
+	Keys KeyStore
+	// KeepMessages saves messages to the command line client's local
+	// message database.
+	KeepMessages bool
+	// EventBuffer is how many events may wait to be read from Events
+	// before the session gives up on the reader.
+	EventBuffer int
+}
+
+// Contact is a user the session has a key from or, with KeepMessages, a
+// stored conversation with.
+type Contact struct {
+	ID      string
+	Devices []string // devices whose key we have
+}
+
+// Session is a connection as one user. Its methods are safe for
+// concurrent use.
+type Session struct {
+	s      *client.Session
+	store  *client.MessageStore
+	events chan Event
+	done   chan struct{}
+	err    error // set before done is closed
+}
+
+// Connect dials the server and authenticates as opts.ID; ctx bounds only
+// that. The session lasts until Close is called or the server turns the
+// device away, and reconnects by itself after a drop.
+func Connect(ctx context.Context, opts Options) (*Session, error) {
+	if opts.ID == "" {
+		return nil, errors.New("no ID to connect as")
+	}
+	t, err := newTransport(opts)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Keys == nil {
+		opts.Keys = FileKeyStore()
+	}
+	if opts.EventBuffer <= 0 {
+		opts.EventBuffer = defaultEventBuffer
+	}
+
+	var store *client.MessageStore
+	if opts.KeepMessages {
+		if store, err = client.OpenMessageStore(); err != nil {
+			return nil, err
+		}
+	}
+	cs, err := client.NewSession(t, opts.ID, opts.Keys, store)
+	if err == nil {
+		s := &Session{s: cs, store: store, events: make(chan Event), done: make(chan struct{})}
+		sub, _ := cs.Subscribe(opts.EventBuffer)
+		if err = cs.Connect(ctx); err == nil {
+			go s.run(sub)
+			return s, nil
+		}
+		cs.Close()
+	}
+	if store != nil {
+		store.Close()
+	}
+	return nil, err
+}
+
+// newTransport builds the transport opts ask for.
+func newTransport(opts Options) (client.Transport, error) {
+	if opts.Transport == "" {
+		opts.Transport = TransportWebSocket
+	}
+	if opts.Server == "" && (opts.Transport == TransportWebSocket || opts.Transport == TransportHTTP) {
+		opts.Server = defaultServer
+	}
+	t, err := client.NewTransport(opts.Transport, opts.Server)
+	if err != nil {
+		return nil, err
+	}
+	switch t := t.(type) {
+	case *client.WebSocketTransport:
+		t.TLS = opts.TLS
+	case *client.HTTPTransport:
+		t.TLS = opts.TLS
+	case *client.GRPCTransport:
+		t.TLS = opts.TLS
+	case *client.QUICTransport:
+		t.TLS = opts.TLS
+	}
+	if ws, ok := t.(*client.WebSocketTransport); ok {
+		switch opts.Encoding {
+		case "", "cbor":
+			ws.Encoding = protocol.SubprotocolCBOR
+		case "json":
+			ws.Encoding = protocol.SubprotocolJSON
+		default:
+			return nil, fmt.Errorf("unknown encoding %q, want cbor or json", opts.Encoding)
+		}
+	}
+	return t, nil
+}
+
+// run hands the session's events to Events until it ends.
+func (s *Session) run(sub <-chan client.Event) {
+	var runErr error
+	ran := make(chan struct{})
+	go func() {
+		runErr = s.s.Run()
+		close(ran)
+	}()
+
+	for e := range sub {
+		select {
+		case s.events <- convert(e):
+		case <-s.s.Done():
+		}
+	}
+	// the subscription ends with the session, or when we fell behind
+	closed := false
+	select {
+	case <-s.s.Done():
+		closed = true
+	default:
+	}
+	s.s.Close()
+	<-ran
+	switch {
+	case runErr != nil:
+		s.err = runErr
+	case !closed:
+		s.err = ErrEventsLost
+	}
+	if s.store != nil {
+		s.store.Close()
+	}
+	close(s.events)
+	close(s.done)
+}
+
+// ID returns the user the session is connected as.
+func (s *Session) ID() string { return s.s.ID() }
+
+// Device returns this device's ID.
+func (s *Session) Device() string { return s.s.Device() }
+
+// Online reports whether the connection is up; it is down while the
+// session reconnects.
+func (s *Session) Online() bool { return s.s.Online() }
+
+// Events returns the channel of the session's events. It is closed when
+// the session ends. Events must be read promptly: a reader that falls
+// behind by more than Options.EventBuffer ends the session with
+// ErrEventsLost. There is one channel per session.
+func (s *Session) Events() <-chan Event { return s.events }
+
+// Done is closed when the session has ended.
+func (s *Session) Done() <-chan struct{} { return s.done }
+
+// Err returns why the session ended once Done is closed: nil after
+// Close, or the connection error that couldn't be recovered from.
+func (s *Session) Err() error {
+	select {
+	case <-s.done:
+		return s.err
+	default:
+		return nil
+	}
+}
+
+// Close ends the session and waits until Events is closed.
+func (s *Session) Close() error {
+	s.s.Close()
+	// nobody may be reading the rest of the events
+	for range s.events {
+	}
+	<-s.done
+	return nil
+}
+
+// Send sends text to user to, encrypted for each of their devices, and
+// returns the message's ID once it is on its way. Receipts for it come in
+// as Receipt events.
+func (s *Session) Send(ctx context.Context, to, text string) (string, error) {
+	id, _, err := s.SendMessage(ctx, Outgoing{To: to, Text: text})
+	return id, err
+}
+
+// Outgoing is a message for SendMessage.
+type Outgoing struct {
+	To   string
+	Text string
+	// ID is the message ID, empty for a new one. A message sent again
+	// under its ID is a retry.
+	ID string
+	// Wait is the status to wait for; StatusSent, the default, returns
+	// as soon as the message is on its way.
+	Wait Status
+}
+
+// SendMessage sends m and waits until it is acknowledged with at least
+// m.Wait. It returns the message ID and the status reached; the error is
+// ErrAckTimeout if ctx ended first.
+func (s *Session) SendMessage(ctx context.Context, m Outgoing) (string, Status, error) {
+	if m.Wait == "" {
+		m.Wait = StatusSent
+	}
+	if client.StatusRank(string(m.Wait)) < 0 {
+		return "", "", fmt.Errorf("cannot wait for status %q", m.Wait)
+	}
+	id, status, err := s.s.SendMessage(ctx, m.ID, m.To, m.Text, string(m.Wait))
+	return id, Status(status), err
+}
+
+// Introduce sends our key to the devices of user to, so they can encrypt
+// for this device, and waits briefly for their keys in return. Send
+// introduces us by itself the first time; introducing early saves the
+// first message a round trip.
+func (s *Session) Introduce(ctx context.Context, to string) {
+	s.s.Introduce(ctx, to)
+}
+
+// MarkRead tells user from that their message msgID has been read.
+// Delivery is acknowledged by the session itself.
+func (s *Session) MarkRead(from, msgID string) error {
+	return s.s.SendReceipt(from, msgID, protocol.StatusRead)
+}
+
+// History returns up to limit messages of the conversation with user
+// with that the server stored before the cursor before (0 for the most
+// recent), oldest first, and the cursor of the page before them, 0 when
+// there is none.
+func (s *Session) History(ctx context.Context, with string, before int64, limit int) ([]Message, int64, error) {
+	page, next, err := s.s.History(ctx, with, before, limit)
+	if err != nil {
+		return nil, 0, err
+	}
+	out := make([]Message, 0, len(page))
+	for _, e := range page {
+		out = append(out, messageOf(e))
+	}
+	return out, next, nil
+}
+
+// Contacts lists the users the session knows, sorted by ID.
+func (s *Session) Contacts() ([]Contact, error) {
+	cs, err := s.s.Contacts()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]Contact, len(cs))
+	for i, c := range cs {
+		out[i] = Contact{ID: c.ID, Devices: c.Devices}
+	}
+	return out, nil
+}
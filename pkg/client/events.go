@@ -0,0 +1,134 @@
+package client
+
+import (
+	"errors"
+	"time"
+
+	"github.com/marcoantonios1/chat-app/internal/client"
+)
+
+// Status is how far a sent message got. Statuses only move forward.
+type Status string
+
+const (
+	StatusSent      Status = "sent"      // written to the connection
+	StatusQueued    Status = "queued"    // stored by the server
+	StatusDelivered Status = "delivered" // received by a device of the recipient
+	StatusRead      Status = "read"      // read by the recipient
+)
+
+// Connection states reported by Connection events.
+const (
+	StateConnected    = "connected"
+	StateResumed      = "resumed" // reconnected without missing anything
+	StateReconnecting = "reconnecting"
+	StateOffline      = "offline" // gave up; the session ends
+)
+
+// Event is one of Message, Receipt, Presence, KeyChange, Connection,
+// DeviceLink or Error.
+type Event interface {
+	isEvent()
+}
+
+// Message is a message to us, or one we sent from this or another of our
+// devices, in which case From is our own ID.
+type Message struct {
+	ID     string
+	From   string
+	Device string // sending device
+	To     string
+	Text   string
+	Time   time.Time
+	// Err is set on history entries that couldn't be decrypted.
+	Err error
+}
+
+// Receipt reports that a message we sent reached a new status.
+type Receipt struct {
+	MsgID  string
+	From   string // who acknowledged it; empty for the server
+	Device string
+	Status Status
+	Time   time.Time
+}
+
+// Presence reports that a device of User came online and sent its key.
+type Presence struct {
+	User   string
+	Device string
+	Time   time.Time
+}
+
+// KeyChange reports that a device we knew announced a different key.
+// Messages are encrypted to the new key from then on.
+type KeyChange struct {
+	User   string
+	Device string
+	Time   time.Time
+}
+
+// Connection reports a change of the session's connection; State is one
+// of the State constants.
+type Connection struct {
+	State string
+	Err   error // why the connection went down
+	Time  time.Time
+}
+
+// DeviceLink reports a new device asking to be linked to our ID. It has
+// to be approved from an already linked device.
+type DeviceLink struct {
+	Device string
+	Name   string
+	Time   time.Time
+}
+
+// Error reports something that went wrong without ending the session,
+// such as a message that couldn't be decrypted.
+type Error struct {
+	Err    error
+	From   string
+	Device string
+	MsgID  string
+	Time   time.Time
+}
+
+func (Message) isEvent()    {}
+func (Receipt) isEvent()    {}
+func (Presence) isEvent()   {}
+func (KeyChange) isEvent()  {}
+func (Connection) isEvent() {}
+func (DeviceLink) isEvent() {}
+func (Error) isEvent()      {}
+
+// convert turns an event of the underlying session into its typed form.
+func convert(e client.Event) Event {
+	var err error
+	if e.Error != "" {
+		err = errors.New(e.Error)
+	}
+	switch e.Type {
+	case client.EventMessage:
+		return messageOf(e)
+	case client.EventAck:
+		return Receipt{MsgID: e.MsgID, From: e.From, Device: e.Device, Status: Status(e.Status), Time: e.Time}
+	case client.EventPresence:
+		return Presence{User: e.From, Device: e.Device, Time: e.Time}
+	case client.EventKeyChange:
+		return KeyChange{User: e.From, Device: e.Device, Time: e.Time}
+	case client.EventConnection:
+		return Connection{State: e.Status, Err: err, Time: e.Time}
+	case client.EventDeviceLink:
+		return DeviceLink{Device: e.Device, Name: e.Text, Time: e.Time}
+	}
+	return Error{Err: err, From: e.From, Device: e.Device, MsgID: e.MsgID, Time: e.Time}
+}
+
+func messageOf(e client.Event) Message {
+	m := Message{ID: e.MsgID, From: e.From, Device: e.Device, To: e.To, Text: e.Text, Time: e.Time}
+	if e.Error != "" {
+		m.Err = errors.New(e.Error)
+	}
+	return m
+}
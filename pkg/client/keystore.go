@@ -0,0 +1,34 @@
+package client
+
+import "github.com/marcoantonios1/chat-app/internal/client"
+
+// KeyStore keeps the key material that identifies a client across runs:
+// its device ID and the secret proving it to the server, its KEM key pair,
+// and every session key derived with a peer, so stored messages stay
+// readable. Implementations must be safe for concurrent use.
+type KeyStore interface {
+	// DeviceID returns the device ID, creating one on first use.
+	DeviceID() (string, error)
+	// DeviceSecret returns the device's secret, creating one on first
+	// use. It must stay the same for the device ID.
+	DeviceSecret() (string, error)
+	// KeyPair returns the KEM key pair, or nil keys if there is none yet.
+	KeyPair() (pub, priv []byte, err error)
+	SaveKeyPair(pub, priv []byte) error
+	// SessionKeys returns the keys derived with peer, newest first.
+	SessionKeys(peer string) ([][]byte, error)
+	SaveSessionKey(peer string, key []byte) error
+}
+
+// FileKeyStore returns the KeyStore of the command line client, files in
+// its key directory. Sessions using it act as the same device as the
+// command line client.
+func FileKeyStore() KeyStore {
+	return client.FileKeyStore{}
+}
+
+// NewMemoryKeyStore returns a KeyStore that keeps everything in memory,
+// a new device every time it is created.
+func NewMemoryKeyStore() KeyStore {
+	return client.NewMemoryKeyStore()
+}